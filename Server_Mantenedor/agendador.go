@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/mux"
+)
+
+// Relatórios que o agendador sabe gerar
+const (
+	RelatorioFechamentoDiario = "fechamento_diario"
+	RelatorioFluxoMensal      = "fluxo_mensal"
+)
+
+// Formas de entrega de um relatório agendado
+const (
+	EntregaArquivo = "arquivo"
+	EntregaEmail   = "email"
+)
+
+// Situação de uma execução registrada no histórico
+const (
+	ExecucaoSucesso = "sucesso"
+	ExecucaoFalha   = "falha"
+)
+
+// Execução de um agendamento, guardada na coleção "execucoes_agendadas"
+type ExecucaoAgendada struct {
+	ID          string `firestore:"-"`
+	Agendamento string
+	Relatorio   string
+	Referencia  time.Time
+	Inicio      time.Time
+	Fim         time.Time
+	Status      string
+	Tentativas  int
+	Erro        string
+	RelatorioID string
+	Manual      bool
+}
+
+type LinhaAgendamento struct {
+	ConfigAgendamento
+	Proxima time.Time
+	Erro    string
+}
+
+type AgendamentosPageData struct {
+	PageTitle    string
+	Agendamentos []LinhaAgendamento
+	Execucoes    []ExecucaoAgendada
+}
+
+// Impede que o mesmo agendamento rode duas vezes ao mesmo tempo
+var emExecucao = struct {
+	sync.Mutex
+	nomes map[string]bool
+}{nomes: make(map[string]bool)}
+
+func (e ExecucaoAgendada) Duracao() time.Duration {
+	return e.Fim.Sub(e.Inicio).Round(time.Second)
+}
+
+func (a ConfigAgendamento) tentativas() int {
+	if a.Tentativas <= 0 {
+		return 1
+	}
+	return a.Tentativas
+}
+
+func (a ConfigAgendamento) intervaloTentativas() time.Duration {
+	if a.IntervaloTentativas <= 0 {
+		return time.Minute
+	}
+	return time.Duration(a.IntervaloTentativas) * time.Second
+}
+
+// Confere se o agendamento pode ser executado, antes de colocá-lo no agendador
+func (a ConfigAgendamento) validar() (ExpressaoCron, error) {
+	cron, err := parseCron(a.Expressao)
+	if err != nil {
+		return cron, err
+	}
+	if a.Relatorio != RelatorioFechamentoDiario && a.Relatorio != RelatorioFluxoMensal {
+		return cron, fmt.Errorf("unknown report %q", a.Relatorio)
+	}
+	if _, ok := renderizadores[a.Formato]; !ok || a.Formato == "html" {
+		return cron, fmt.Errorf("invalid report format %q", a.Formato)
+	}
+	switch a.Entrega {
+	case EntregaArquivo:
+	case EntregaEmail:
+		if len(a.Destinatarios) == 0 {
+			return cron, fmt.Errorf("email delivery without recipients")
+		}
+	default:
+		return cron, fmt.Errorf("unknown delivery %q", a.Entrega)
+	}
+	return cron, nil
+}
+
+// Período coberto pelo relatório: o dia ou o mês anterior ao disparo. O fechamento roda depois
+// da meia-noite para incluir as vendas até o último minuto do dia.
+func (a ConfigAgendamento) periodo(referencia time.Time) (Periodo, map[string]string, error) {
+	if a.Relatorio == RelatorioFluxoMensal {
+		mes := time.Date(referencia.Year(), referencia.Month(), 1, 0, 0, 0, 0, referencia.Location()).AddDate(0, -1, 0)
+		periodo, err := periodoMes(int(mes.Month()), mes.Year(), referencia.Location())
+		return periodo, map[string]string{"mes": fmt.Sprintf("%02d", int(mes.Month())), "ano": strconv.Itoa(mes.Year())}, err
+	}
+	dia := inicioDoDia(referencia).AddDate(0, 0, -1)
+	dataDia := dia.Format("2006-01-02")
+	return Periodo{Inicio: dia, Fim: dia.AddDate(0, 0, 1)}, map[string]string{"de": dataDia, "ate": dataDia}, nil
+}
+
+func agendamentoPorNome(nome string) (ConfigAgendamento, bool) {
+	for _, agendamento := range config.Agendamentos {
+		if agendamento.Nome == nome {
+			return agendamento, true
+		}
+	}
+	return ConfigAgendamento{}, false
+}
+
+// Laço do agendador: acorda a cada minuto e dispara os agendamentos cujo horário chegou
+func iniciarAgendador() {
+	crons := make(map[string]ExpressaoCron)
+	for _, agendamento := range config.Agendamentos {
+		cron, err := agendamento.validar()
+		if err != nil {
+			log.Printf("Ignoring scheduled report %s: %v", agendamento.Nome, err)
+			continue
+		}
+		crons[agendamento.Nome] = cron
+	}
+	if len(crons) == 0 {
+		return
+	}
+
+	ultima := time.Now().In(fusoLoja())
+	for {
+		agora := time.Now().In(fusoLoja())
+		time.Sleep(agora.Truncate(time.Minute).Add(time.Minute).Sub(agora))
+		agora = time.Now().In(fusoLoja())
+
+		// Considera todos os minutos desde a última verificação, caso o processo tenha atrasado
+		for _, agendamento := range config.Agendamentos {
+			cron, ok := crons[agendamento.Nome]
+			if !ok {
+				continue
+			}
+			if disparo := cron.Proxima(ultima); !disparo.IsZero() && !disparo.After(agora) {
+				go executarAgendamento(agendamento, disparo, false)
+			}
+		}
+		ultima = agora
+	}
+}
+
+// Gera e entrega o relatório, repetindo em caso de falha, e registra a execução no histórico
+func executarAgendamento(agendamento ConfigAgendamento, referencia time.Time, manual bool) ExecucaoAgendada {
+	execucao := ExecucaoAgendada{
+		Agendamento: agendamento.Nome,
+		Relatorio:   agendamento.Relatorio,
+		Referencia:  referencia,
+		Inicio:      time.Now(),
+		Manual:      manual,
+	}
+
+	emExecucao.Lock()
+	if emExecucao.nomes[agendamento.Nome] {
+		emExecucao.Unlock()
+		execucao.Status = ExecucaoFalha
+		execucao.Erro = "already running"
+		execucao.Fim = time.Now()
+		return execucao
+	}
+	emExecucao.nomes[agendamento.Nome] = true
+	emExecucao.Unlock()
+	defer func() {
+		emExecucao.Lock()
+		delete(emExecucao.nomes, agendamento.Nome)
+		emExecucao.Unlock()
+	}()
+
+	// Um relatório já arquivado não é gerado de novo; as novas tentativas só repetem o envio
+	var arquivado RelatorioArquivado
+	var mensagem MensagemEmail
+	var err error
+	execucao.Tentativas, err = repetirAgendamento(agendamento, time.Sleep, func() error {
+		var err error
+		if arquivado.ID == "" {
+			arquivado, mensagem, err = gerarRelatorioAgendado(agendamento, referencia)
+			execucao.RelatorioID = arquivado.ID
+		}
+		if err == nil && agendamento.Entrega == EntregaEmail {
+			err = enviarEmail(mensagem)
+		}
+		return err
+	})
+
+	execucao.Fim = time.Now()
+	execucao.Status = ExecucaoSucesso
+	if err != nil {
+		execucao.Status = ExecucaoFalha
+		execucao.Erro = err.Error()
+	}
+
+	if err := registrarExecucao(&execucao); err != nil {
+		log.Printf("Failed to record scheduled report run: %v", err)
+	}
+	return execucao
+}
+
+// Executa a tentativa até ela dar certo ou esgotar as tentativas do agendamento, esperando
+// um intervalo a mais a cada falha. Devolve o número de tentativas feitas e o último erro.
+func repetirAgendamento(agendamento ConfigAgendamento, esperar func(time.Duration), tentativa func() error) (int, error) {
+	var err error
+	tentativas := 0
+	for tentativas < agendamento.tentativas() {
+		if tentativas > 0 {
+			esperar(agendamento.intervaloTentativas() * time.Duration(tentativas))
+		}
+		tentativas++
+
+		if err = tentativa(); err == nil {
+			break
+		}
+		log.Printf("Scheduled report %s failed (attempt %d/%d): %v", agendamento.Nome, tentativas, agendamento.tentativas(), err)
+	}
+	return tentativas, err
+}
+
+// Monta e arquiva o relatório do período, devolvendo também o email com ele em anexo
+func gerarRelatorioAgendado(agendamento ConfigAgendamento, referencia time.Time) (RelatorioArquivado, MensagemEmail, error) {
+	periodo, parametros, err := agendamento.periodo(referencia)
+	if err != nil {
+		return RelatorioArquivado{}, MensagemEmail{}, err
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		return RelatorioArquivado{}, MensagemEmail{}, err
+	}
+	defer firestoreClient.Client.Close()
+
+	relatorio, err := montarRelatorioFluxo(firestoreClient, periodo)
+	if err != nil {
+		return RelatorioArquivado{}, MensagemEmail{}, err
+	}
+
+	titulo := fmt.Sprintf("Fluxo de Caixa - %s a %s", periodo.Inicio.Format("02/01/2006"), periodo.UltimoDia().Format("02/01/2006"))
+	if agendamento.Relatorio == RelatorioFechamentoDiario {
+		titulo = fmt.Sprintf("Fechamento do Dia - %s", periodo.Inicio.Format("02/01/2006"))
+	}
+	documento := DocumentoRelatorio{
+		Titulo:     titulo,
+		Relatorio:  relatorio,
+		Parametros: parametros,
+		GeradoEm:   time.Now().In(fusoLoja()),
+	}
+
+	renderizador := renderizadores[agendamento.Formato]
+	var conteudo bytes.Buffer
+	if err := renderizador.Renderizar(&conteudo, documento); err != nil {
+		return RelatorioArquivado{}, MensagemEmail{}, err
+	}
+
+	arquivado, err := arquivarRelatorio(firestoreClient, RelatorioArquivado{
+		Tipo:       agendamento.Relatorio,
+		Formato:    agendamento.Formato,
+		Parametros: parametros,
+		GeradoPor:  "agendador:" + agendamento.Nome,
+		GeradoEm:   documento.GeradoEm,
+	}, conteudo.Bytes())
+	if err != nil {
+		return RelatorioArquivado{}, MensagemEmail{}, err
+	}
+
+	total := relatorio.Total
+	mensagem := MensagemEmail{
+		Para:    agendamento.Destinatarios,
+		Assunto: titulo,
+		Corpo: fmt.Sprintf("%s\n\nItens vendidos: %d\nReceita: R$ %.2f\nCusto: R$ %.2f\nMargem bruta: R$ %.2f (%.1f%%)\n\nO relatório completo segue em anexo.\n",
+			titulo, total.Quantidade, total.Receita, total.Custo, total.MargemBruta, total.PercentualMargem),
+		Anexos: []AnexoEmail{{
+			Nome:         arquivado.NomeDownload(),
+			TipoConteudo: renderizador.TipoConteudo(),
+			Conteudo:     conteudo.Bytes(),
+		}},
+	}
+	return arquivado, mensagem, nil
+}
+
+func registrarExecucao(execucao *ExecucaoAgendada) error {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		return err
+	}
+	defer firestoreClient.Client.Close()
+
+	ref, _, err := firestoreClient.Client.Collection("execucoes_agendadas").Add(firestoreClient.Ctx, execucao)
+	if err != nil {
+		return err
+	}
+	execucao.ID = ref.ID
+	return nil
+}
+
+// Últimas execuções registradas, das mais recentes para as mais antigas
+func listarExecucoes(firestoreClient *FirestoreClient, limite int) ([]ExecucaoAgendada, error) {
+	docs, err := firestoreClient.Client.Collection("execucoes_agendadas").
+		OrderBy("Inicio", firestore.Desc).Limit(limite).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var execucoes []ExecucaoAgendada
+	for _, doc := range docs {
+		var execucao ExecucaoAgendada
+		if err := doc.DataTo(&execucao); err != nil {
+			return nil, err
+		}
+		execucao.ID = doc.Ref.ID
+		execucoes = append(execucoes, execucao)
+	}
+	return execucoes, nil
+}
+
+func AgendamentosHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	execucoes, err := listarExecucoes(firestoreClient, 50)
+	if err != nil {
+		log.Printf("Failed to list scheduled report runs: %v", err)
+		http.Error(w, "Failed to fetch job history", http.StatusInternalServerError)
+		return
+	}
+
+	agora := time.Now().In(fusoLoja())
+	var linhas []LinhaAgendamento
+	for _, agendamento := range config.Agendamentos {
+		linha := LinhaAgendamento{ConfigAgendamento: agendamento}
+		if cron, err := agendamento.validar(); err != nil {
+			linha.Erro = err.Error()
+		} else {
+			linha.Proxima = cron.Proxima(agora)
+		}
+		linhas = append(linhas, linha)
+	}
+	sort.SliceStable(linhas, func(i, j int) bool {
+		return strings.ToLower(linhas[i].Nome) < strings.ToLower(linhas[j].Nome)
+	})
+
+	tmpl := template.Must(template.ParseFiles("template/agendamentos.html"))
+	data := AgendamentosPageData{
+		PageTitle:    "Coffee Shop - Relatórios Agendados",
+		Agendamentos: linhas,
+		Execucoes:    execucoes,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+// Executa um agendamento imediatamente, por exemplo para repetir uma execução que falhou
+func ExecutarAgendamentoHandler(w http.ResponseWriter, r *http.Request) {
+	agendamento, ok := agendamentoPorNome(mux.Vars(r)["nome"])
+	if !ok {
+		http.Error(w, "Scheduled report not found", http.StatusNotFound)
+		return
+	}
+	if _, err := agendamento.validar(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	referencia := time.Now().In(fusoLoja())
+	if data := r.FormValue("referencia"); data != "" {
+		dia, err := time.ParseInLocation("2006-01-02", data, fusoLoja())
+		if err != nil {
+			http.Error(w, "Invalid reference date", http.StatusBadRequest)
+			return
+		}
+		referencia = dia
+	}
+
+	go executarAgendamento(agendamento, referencia, true)
+	http.Redirect(w, r, "/agendamentos", http.StatusSeeOther)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRepetirAgendamento(t *testing.T) {
+	agendamento := ConfigAgendamento{Nome: "teste", Tentativas: 4, IntervaloTentativas: 30}
+	falha := errors.New("falhou")
+
+	casos := []struct {
+		nome       string
+		falhas     int
+		tentativas int
+		esperas    []time.Duration
+		erro       error
+	}{
+		{"primeira tentativa", 0, 1, nil, nil},
+		{"sucesso na terceira", 2, 3, []time.Duration{30 * time.Second, 60 * time.Second}, nil},
+		{"esgota as tentativas", 10, 4, []time.Duration{30 * time.Second, 60 * time.Second, 90 * time.Second}, falha},
+	}
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			var esperas []time.Duration
+			chamadas := 0
+			tentativas, err := repetirAgendamento(agendamento, func(d time.Duration) { esperas = append(esperas, d) }, func() error {
+				chamadas++
+				if chamadas <= caso.falhas {
+					return falha
+				}
+				return nil
+			})
+			if tentativas != caso.tentativas || chamadas != caso.tentativas {
+				t.Errorf("tentativas = %d, chamadas = %d, esperava %d", tentativas, chamadas, caso.tentativas)
+			}
+			if err != caso.erro {
+				t.Errorf("erro = %v, esperava %v", err, caso.erro)
+			}
+			if !reflect.DeepEqual(esperas, caso.esperas) {
+				t.Errorf("esperas = %v, esperava %v", esperas, caso.esperas)
+			}
+		})
+	}
+}
+
+// Sem tentativas configuradas, roda uma vez e não espera
+func TestRepetirAgendamentoPadrao(t *testing.T) {
+	chamadas := 0
+	tentativas, err := repetirAgendamento(ConfigAgendamento{}, func(time.Duration) { t.Error("não deveria esperar") }, func() error {
+		chamadas++
+		return errors.New("falhou")
+	})
+	if tentativas != 1 || chamadas != 1 || err == nil {
+		t.Errorf("tentativas = %d, chamadas = %d, erro = %v", tentativas, chamadas, err)
+	}
+}
+
+func TestPeriodoAgendamento(t *testing.T) {
+	loc, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// O fechamento das 00:05 cobre o dia anterior inteiro, inclusive as vendas depois das 23:55
+	fechamento := ConfigAgendamento{Relatorio: RelatorioFechamentoDiario}
+	periodo, parametros, err := fechamento.periodo(time.Date(2026, 3, 1, 0, 5, 0, 0, loc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !periodo.Inicio.Equal(time.Date(2026, 2, 28, 0, 0, 0, 0, loc)) || !periodo.Fim.Equal(time.Date(2026, 3, 1, 0, 0, 0, 0, loc)) {
+		t.Errorf("período do fechamento = %v a %v", periodo.Inicio, periodo.Fim)
+	}
+	if !periodo.Contem(time.Date(2026, 2, 28, 23, 58, 0, 0, loc)) {
+		t.Error("venda das 23:58 ficou de fora do fechamento")
+	}
+	if parametros["de"] != "2026-02-28" || parametros["ate"] != "2026-02-28" {
+		t.Errorf("parâmetros do fechamento = %v", parametros)
+	}
+
+	mensal := ConfigAgendamento{Relatorio: RelatorioFluxoMensal}
+	periodo, parametros, err = mensal.periodo(time.Date(2026, 1, 1, 6, 0, 0, 0, loc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !periodo.Inicio.Equal(time.Date(2025, 12, 1, 0, 0, 0, 0, loc)) || !periodo.Fim.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, loc)) {
+		t.Errorf("período mensal = %v a %v", periodo.Inicio, periodo.Fim)
+	}
+	if parametros["mes"] != "12" || parametros["ano"] != "2025" {
+		t.Errorf("parâmetros mensais = %v", parametros)
+	}
+}
+
+// O padrão precisa disparar depois da meia-noite, senão o fechamento perde as últimas vendas do dia
+func TestAgendamentosPadraoValidos(t *testing.T) {
+	for _, agendamento := range agendamentosPadrao() {
+		cron, err := agendamento.validar()
+		if err != nil {
+			t.Errorf("%s: %v", agendamento.Nome, err)
+			continue
+		}
+		if agendamento.Relatorio == RelatorioFechamentoDiario {
+			disparo := cron.Proxima(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+			if disparo.Day() != 11 || disparo.Hour() != 0 {
+				t.Errorf("fechamento diário dispara em %v", disparo)
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Metadados de um relatório gerado, guardados na coleção "relatorios".
+// O conteúdo fica no diretório de relatórios configurado.
+type RelatorioArquivado struct {
+	ID         string `firestore:"-"`
+	Arquivo    string
+	Tipo       string
+	Formato    string
+	Parametros map[string]string
+	GeradoPor  string
+	GeradoEm   time.Time
+	Tamanho    int
+}
+
+// Usuário autenticado que fez a requisição
+func usuarioRequisicao(r *http.Request) string {
+	if username, _, ok := r.BasicAuth(); ok && username != "" {
+		return username
+	}
+	return "desconhecido"
+}
+
+// Grava o conteúdo no diretório de relatórios com um nome único e registra seus metadados
+func arquivarRelatorio(firestoreClient *FirestoreClient, relatorio RelatorioArquivado, conteudo []byte) (RelatorioArquivado, error) {
+	if err := os.MkdirAll(config.DiretorioRelatorios, 0o755); err != nil {
+		return relatorio, err
+	}
+
+	relatorio.Tamanho = len(conteudo)
+	relatorio.Arquivo = fmt.Sprintf("%s_%s.%s", relatorio.Tipo, relatorio.GeradoEm.Format("20060102_150405.000000000"), relatorio.Formato)
+	if err := os.WriteFile(filepath.Join(config.DiretorioRelatorios, relatorio.Arquivo), conteudo, 0o644); err != nil {
+		return relatorio, err
+	}
+
+	ref, _, err := firestoreClient.Client.Collection("relatorios").Add(firestoreClient.Ctx, relatorio)
+	if err != nil {
+		return relatorio, err
+	}
+	relatorio.ID = ref.ID
+	return relatorio, nil
+}
+
+// Envia o relatório ao navegador como download
+func enviarRelatorio(w http.ResponseWriter, nomeDownload, formato string, conteudo []byte) {
+	tipo := "application/octet-stream"
+	if renderizador, ok := renderizadores[formato]; ok {
+		tipo = renderizador.TipoConteudo()
+	}
+	w.Header().Set("Content-Type", tipo)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, nomeDownload))
+	w.Header().Set("Content-Length", strconv.Itoa(len(conteudo)))
+	w.Write(conteudo)
+}
+
+// Nome sugerido ao navegador, montado a partir do tipo e dos parâmetros do relatório
+func (r RelatorioArquivado) NomeDownload() string {
+	nome := r.Tipo
+	for _, chave := range r.chavesParametros() {
+		nome += "_" + r.Parametros[chave]
+	}
+	return nome + "." + r.Formato
+}
+
+// Parâmetros do relatório em ordem estável, para exibição
+func (r RelatorioArquivado) chavesParametros() []string {
+	var chaves []string
+	for chave := range r.Parametros {
+		chaves = append(chaves, chave)
+	}
+	sort.Strings(chaves)
+	return chaves
+}
+
+func (r RelatorioArquivado) DescricaoParametros() string {
+	var descricao string
+	for i, chave := range r.chavesParametros() {
+		if i > 0 {
+			descricao += ", "
+		}
+		descricao += chave + ": " + r.Parametros[chave]
+	}
+	return descricao
+}
+
+// Lista os relatórios arquivados, dos mais recentes para os mais antigos
+func listarRelatoriosArquivados(firestoreClient *FirestoreClient) ([]RelatorioArquivado, error) {
+	docs, err := firestoreClient.Client.Collection("relatorios").Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var relatorios []RelatorioArquivado
+	for _, doc := range docs {
+		var relatorio RelatorioArquivado
+		if err := doc.DataTo(&relatorio); err != nil {
+			return nil, err
+		}
+		relatorio.ID = doc.Ref.ID
+		relatorios = append(relatorios, relatorio)
+	}
+
+	sort.Slice(relatorios, func(i, j int) bool {
+		return relatorios[i].GeradoEm.After(relatorios[j].GeradoEm)
+	})
+	return relatorios, nil
+}
+
+func DownloadRelatorioHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+
+	snapshot, err := firestoreClient.Client.Collection("relatorios").Doc(mux.Vars(r)["id"]).Get(firestoreClient.Ctx)
+	if err != nil {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+
+	var relatorio RelatorioArquivado
+	if err := snapshot.DataTo(&relatorio); err != nil {
+		http.Error(w, "Failed to parse report data", http.StatusInternalServerError)
+		return
+	}
+
+	// Apenas o nome do arquivo é usado, para não sair do diretório de relatórios
+	conteudo, err := os.ReadFile(filepath.Join(config.DiretorioRelatorios, filepath.Base(relatorio.Arquivo)))
+	if err != nil {
+		http.Error(w, "Report file not found", http.StatusNotFound)
+		return
+	}
+
+	enviarRelatorio(w, relatorio.NomeDownload(), relatorio.Formato, conteudo)
+}
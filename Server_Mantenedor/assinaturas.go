@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Situações de uma assinatura
+const (
+	AssinaturaAtiva     = "ativa"
+	AssinaturaPausada   = "pausada"
+	AssinaturaCancelada = "cancelada"
+)
+
+// Cobranças recusadas seguidas antes de a assinatura ser pausada
+const maxFalhasAssinatura = 3
+
+var ErrAssinaturaAlterada = errors.New("subscription changed while generating its order")
+
+// Assinatura de um produto com entregas periódicas, na coleção "assinaturas".
+// Criada e alterada pelo cliente no Server_Usuario; os pedidos são gerados pelo agendador daqui.
+type Assinatura struct {
+	ID            string `firestore:"-"`
+	ClienteEmail  string
+	CodigoProd    int
+	NomeProd      string
+	Quantidade    int
+	IntervaloDias int
+	// Meia-noite, no fuso da loja, do dia da próxima entrega
+	ProximaEntrega  time.Time
+	Status          string
+	MetodoPagamento string
+	CriadaEm        time.Time
+	// Pedido gerado na última entrega
+	UltimoPedido int
+	// Cobranças recusadas seguidas e o motivo da última falha
+	Falhas     int
+	UltimoErro string
+}
+
+type AssinaturasPageData struct {
+	PageTitle string
+	Proximas  []Assinatura
+	Pausadas  []Assinatura
+	Gerados   string
+}
+
+// Primeira data de entrega depois de agora, seguindo o intervalo; entregas perdidas com o
+// servidor parado não geram vários pedidos de uma vez
+func (a Assinatura) proximaDepois(agora time.Time) time.Time {
+	proxima := a.ProximaEntrega
+	for !proxima.After(agora) {
+		proxima = proxima.AddDate(0, 0, a.IntervaloDias)
+	}
+	return proxima
+}
+
+func (a Assinatura) vencida(agora time.Time) bool {
+	return a.Status == AssinaturaAtiva && !a.ProximaEntrega.After(agora)
+}
+
+// Chave de idempotência da cobrança de uma entrega; repetir a entrega após uma falha não cobra de novo
+func (a Assinatura) chaveCobranca() string {
+	return a.ID + ":" + a.ProximaEntrega.Format("2006-01-02")
+}
+
+func buscarAssinaturas(firestoreClient *FirestoreClient, status string) ([]Assinatura, error) {
+	docs, err := firestoreClient.Client.Collection("assinaturas").Where("Status", "==", status).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var assinaturas []Assinatura
+	for _, doc := range docs {
+		var a Assinatura
+		if err := doc.DataTo(&a); err != nil {
+			return nil, err
+		}
+		a.ID = doc.Ref.ID
+		assinaturas = append(assinaturas, a)
+	}
+	sort.Slice(assinaturas, func(i, j int) bool { return assinaturas[i].ProximaEntrega.Before(assinaturas[j].ProximaEntrega) })
+	return assinaturas, nil
+}
+
+// Último código de pedido usado, no documento "contadores/pedidos". O Server_Usuario usa o mesmo
+// contador nos pedidos da loja, então os dois servidores nunca repetem um código.
+type ContadorPedidos struct {
+	Ultimo int
+}
+
+// Lê o contador na transação que grava o pedido e devolve o próximo código; a transação grava o
+// contador de volta com ele. Sem contador, a numeração continua depois do maior código já gravado.
+func proximoCodigoPedido(tx *firestore.Transaction, client *firestore.Client) (int, error) {
+	snapshot, err := tx.Get(client.Collection("contadores").Doc("pedidos"))
+	if err == nil {
+		var contador ContadorPedidos
+		if err := snapshot.DataTo(&contador); err != nil {
+			return 0, err
+		}
+		return contador.Ultimo + 1, nil
+	}
+	if status.Code(err) != codes.NotFound {
+		return 0, err
+	}
+	docs, err := tx.Documents(client.Collection("transacoes").OrderBy("CodigoTransacao", firestore.Desc).Limit(1)).GetAll()
+	if err != nil || len(docs) == 0 {
+		return 1, err
+	}
+	var ultima Transacao
+	if err := docs[0].DataTo(&ultima); err != nil {
+		return 0, err
+	}
+	return ultima.CodigoTransacao + 1, nil
+}
+
+// Gera os pedidos de todas as assinaturas ativas com entrega vencida e devolve quantos foram gerados.
+// Uma assinatura que falha não impede as demais.
+func processarAssinaturas(firestoreClient *FirestoreClient, provedor ProvedorPagamento, agora time.Time) (int, error) {
+	ativas, err := buscarAssinaturas(firestoreClient, AssinaturaAtiva)
+	if err != nil {
+		return 0, err
+	}
+	gerados := 0
+	for _, a := range ativas {
+		if !a.vencida(agora) {
+			continue
+		}
+		codigo, err := gerarPedidoAssinatura(firestoreClient, provedor, a, agora)
+		if err == ErrAssinaturaAlterada {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to generate order for subscription %s: %v", a.ID, err)
+			if err := registrarFalhaAssinatura(firestoreClient, a, err); err != nil {
+				log.Printf("Failed to record subscription %s failure: %v", a.ID, err)
+			}
+			continue
+		}
+		log.Printf("Generated order %d for subscription %s", codigo, a.ID)
+		gerados++
+	}
+	return gerados, nil
+}
+
+// Cobra a entrega e grava o pedido, baixa o estoque e agenda a próxima entrega numa única transação.
+// A cobrança vem antes, com chave de idempotência, para que uma falha na gravação seja repetida sem cobrar duas vezes.
+func gerarPedidoAssinatura(firestoreClient *FirestoreClient, provedor ProvedorPagamento, a Assinatura, agora time.Time) (int, error) {
+	produtoRef := firestoreClient.Client.Collection("produtos").Doc(strconv.Itoa(a.CodigoProd))
+	assinaturaRef := firestoreClient.Client.Collection("assinaturas").Doc(a.ID)
+
+	snapshot, err := produtoRef.Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return 0, errors.New("produto não está mais no catálogo")
+	}
+	if err != nil {
+		return 0, err
+	}
+	var produto Produto
+	if err := snapshot.DataTo(&produto); err != nil {
+		return 0, err
+	}
+	if produto.ControlaEstoque && produto.Estoque < a.Quantidade {
+		return 0, fmt.Errorf("estoque insuficiente de %s: restam %d", produto.NomeProduto, produto.Estoque)
+	}
+
+	valor, err := cobrarAssinatura(provedor, a, produto)
+	if err != nil {
+		return 0, err
+	}
+
+	var codigo int
+	err = firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(assinaturaRef)
+		if err != nil {
+			return err
+		}
+		var atual Assinatura
+		if err := snapshot.DataTo(&atual); err != nil {
+			return err
+		}
+		atual.ID = a.ID
+		// O cliente pode ter pausado ou pulado a entrega, ou outra execução já gerou o pedido
+		if !atual.vencida(agora) || !atual.ProximaEntrega.Equal(a.ProximaEntrega) {
+			return ErrAssinaturaAlterada
+		}
+		// O pedido usa o preço cobrado; aqui só o estoque é conferido de novo
+		snapshot, err = tx.Get(produtoRef)
+		if err != nil {
+			return err
+		}
+		var estoque Produto
+		if err := snapshot.DataTo(&estoque); err != nil {
+			return err
+		}
+		if estoque.ControlaEstoque && estoque.Estoque < atual.Quantidade {
+			return fmt.Errorf("estoque insuficiente de %s: restam %d", estoque.NomeProduto, estoque.Estoque)
+		}
+		codigo, err = proximoCodigoPedido(tx, firestoreClient.Client)
+		if err != nil {
+			return err
+		}
+		if err := tx.Set(firestoreClient.Client.Collection("contadores").Doc("pedidos"), ContadorPedidos{Ultimo: codigo}); err != nil {
+			return err
+		}
+
+		fiscais := produto.dadosFiscais()
+		err = tx.Create(firestoreClient.Client.Collection("transacoes").NewDoc(), Transacao{
+			CodigoTransacao: codigo,
+			CodigoProd:      atual.CodigoProd,
+			NomeProd:        produto.NomeProduto,
+			QuantidadeProd:  atual.Quantidade,
+			ValorUnitario:   produto.ValorVenda,
+			CustoUnitario:   produto.ValorCompra,
+			ValorTransacao:  valor,
+			MetodoPagamento: atual.MetodoPagamento,
+			DataTransacao:   agora,
+			Tipo:            "venda",
+			ClienteEmail:    atual.ClienteEmail,
+			EmailContato:    atual.ClienteEmail,
+			AssinaturaID:    atual.ID,
+			DadosFiscais:    &fiscais,
+		})
+		if err != nil {
+			return err
+		}
+		// A nota do pedido entra na fila de emissão
+		err = tx.Set(firestoreClient.Client.Collection("nfce").Doc(strconv.Itoa(codigo)), DocumentoFiscal{Codigo: codigo, Status: NFCePendente, SolicitadaEm: agora})
+		if err != nil {
+			return err
+		}
+		if estoque.ControlaEstoque {
+			if err := tx.Update(produtoRef, []firestore.Update{{Path: "Estoque", Value: firestore.Increment(-atual.Quantidade)}}); err != nil {
+				return err
+			}
+		}
+		if estoque.atingeEstoqueMinimo(atual.Quantidade) {
+			if err := tx.Create(firestoreClient.Client.Collection("emails").NewDoc(), emailEstoqueBaixo(estoque, estoque.Estoque-atual.Quantidade, agora)); err != nil {
+				return err
+			}
+		}
+		return tx.Update(assinaturaRef, []firestore.Update{
+			{Path: "ProximaEntrega", Value: atual.proximaDepois(agora)},
+			{Path: "UltimoPedido", Value: codigo},
+			{Path: "Falhas", Value: 0},
+			{Path: "UltimoErro", Value: ""},
+		})
+	})
+	return codigo, err
+}
+
+// Cobra a entrega da assinatura pelo preço atual do produto e devolve o valor cobrado
+func cobrarAssinatura(provedor ProvedorPagamento, a Assinatura, produto Produto) (float64, error) {
+	valor := arredondarCentavos(produto.ValorVenda * float64(a.Quantidade))
+	_, err := provedor.Cobrar(Cobranca{
+		Chave:        a.chaveCobranca(),
+		ClienteEmail: a.ClienteEmail,
+		Metodo:       a.MetodoPagamento,
+		Valor:        valor,
+		Descricao:    fmt.Sprintf("Assinatura %s: %dx %s", a.ID, a.Quantidade, produto.NomeProduto),
+	})
+	return valor, err
+}
+
+// Conta a falha na assinatura e a pausa depois de maxFalhasAssinatura falhas seguidas
+func (a Assinatura) atualizacoesFalha(falha error) []firestore.Update {
+	atualizacoes := []firestore.Update{
+		{Path: "Falhas", Value: a.Falhas + 1},
+		{Path: "UltimoErro", Value: falha.Error()},
+	}
+	if a.Falhas+1 >= maxFalhasAssinatura {
+		atualizacoes = append(atualizacoes, firestore.Update{Path: "Status", Value: AssinaturaPausada})
+	}
+	return atualizacoes
+}
+
+func registrarFalhaAssinatura(firestoreClient *FirestoreClient, a Assinatura, falha error) error {
+	_, err := firestoreClient.Client.Collection("assinaturas").Doc(a.ID).Update(firestoreClient.Ctx, a.atualizacoesFalha(falha))
+	return err
+}
+
+func iniciarAssinaturas() {
+	ticker := time.NewTicker(config.intervaloAssinaturas())
+	defer ticker.Stop()
+
+	for range ticker.C {
+		firestoreClient, err := InitializeFirestore()
+		if err != nil {
+			log.Printf("Failed to connect to Firestore: %v", err)
+			continue
+		}
+		if _, err := processarAssinaturas(firestoreClient, provedorPagamento(), time.Now().In(fusoLoja())); err != nil {
+			log.Printf("Failed to process subscriptions: %v", err)
+		}
+		firestoreClient.Client.Close()
+	}
+}
+
+// Próximas entregas das assinaturas ativas, da mais próxima para a mais distante, e as pausadas
+func AssinaturasHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	proximas, err := buscarAssinaturas(firestoreClient, AssinaturaAtiva)
+	if err != nil {
+		log.Printf("Failed to list subscriptions: %v", err)
+		http.Error(w, "Failed to fetch subscriptions", http.StatusInternalServerError)
+		return
+	}
+	pausadas, err := buscarAssinaturas(firestoreClient, AssinaturaPausada)
+	if err != nil {
+		log.Printf("Failed to list subscriptions: %v", err)
+		http.Error(w, "Failed to fetch subscriptions", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/assinaturas.html"))
+	data := AssinaturasPageData{
+		PageTitle: "Coffee Shop - Assinaturas",
+		Proximas:  proximas,
+		Pausadas:  pausadas,
+		Gerados:   r.URL.Query().Get("gerados"),
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+// Gera agora os pedidos vencidos, sem esperar a próxima verificação do agendador
+func ProcessarAssinaturasHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	gerados, err := processarAssinaturas(firestoreClient, provedorPagamento(), time.Now().In(fusoLoja()))
+	if err != nil {
+		log.Printf("Failed to process subscriptions: %v", err)
+		http.Error(w, "Failed to process subscriptions", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/assinaturas?gerados="+strconv.Itoa(gerados), http.StatusSeeOther)
+}
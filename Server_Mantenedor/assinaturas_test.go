@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Provedor que guarda as cobranças recebidas, por cima do fake
+type provedorRegistro struct {
+	provedorFake
+	cobrancas []Cobranca
+}
+
+func (p *provedorRegistro) Cobrar(cobranca Cobranca) (string, error) {
+	p.cobrancas = append(p.cobrancas, cobranca)
+	return p.provedorFake.Cobrar(cobranca)
+}
+
+func assinaturaTeste() Assinatura {
+	return Assinatura{
+		ID:              "assinatura-1",
+		ClienteEmail:    "ana@example.com",
+		CodigoProd:      1,
+		Quantidade:      2,
+		IntervaloDias:   7,
+		ProximaEntrega:  time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC),
+		Status:          AssinaturaAtiva,
+		MetodoPagamento: "card",
+	}
+}
+
+// Repetir a mesma entrega depois de uma falha na gravação não cobra de novo; a entrega seguinte cobra
+func TestCobrarAssinaturaIdempotente(t *testing.T) {
+	provedor := &provedorRegistro{}
+	a := assinaturaTeste()
+	produto := Produto{ID: 1, NomeProduto: "Café em grãos 250g", ValorVenda: 24.9}
+
+	for i := 0; i < 2; i++ {
+		valor, err := cobrarAssinatura(provedor, a, produto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valor != 49.8 {
+			t.Errorf("valor = %.2f, esperava 49.80", valor)
+		}
+	}
+	if len(provedor.cobradas) != 1 {
+		t.Errorf("a mesma entrega gerou %d cobranças", len(provedor.cobradas))
+	}
+
+	a.ProximaEntrega = a.proximaDepois(a.ProximaEntrega)
+	if _, err := cobrarAssinatura(provedor, a, produto); err != nil {
+		t.Fatal(err)
+	}
+	if len(provedor.cobradas) != 2 {
+		t.Errorf("a entrega seguinte não foi cobrada: %d cobranças", len(provedor.cobradas))
+	}
+	if provedor.cobrancas[2].Chave != "assinatura-1:2026-03-17" {
+		t.Errorf("chave da entrega seguinte = %q", provedor.cobrancas[2].Chave)
+	}
+}
+
+// Uma cobrança recusada conta como falha da assinatura, com o motivo guardado
+func TestCobrarAssinaturaRecusada(t *testing.T) {
+	a := assinaturaTeste()
+	_, err := cobrarAssinatura(&provedorFake{recusar: true}, a, Produto{ID: 1, ValorVenda: 24.9})
+	if !errors.Is(err, ErrPagamentoRecusado) {
+		t.Fatalf("erro = %v, esperava %v", err, ErrPagamentoRecusado)
+	}
+
+	atualizacoes := camposAtualizados(a.atualizacoesFalha(err))
+	if atualizacoes["Falhas"] != 1 || atualizacoes["UltimoErro"] != ErrPagamentoRecusado.Error() {
+		t.Errorf("atualizações = %v", atualizacoes)
+	}
+	if _, pausou := atualizacoes["Status"]; pausou {
+		t.Error("a primeira falha não deveria pausar a assinatura")
+	}
+}
+
+// A assinatura é pausada na falha de número maxFalhasAssinatura, e não antes
+func TestAtualizacoesFalhaPausa(t *testing.T) {
+	for falhas := 0; falhas < maxFalhasAssinatura; falhas++ {
+		a := assinaturaTeste()
+		a.Falhas = falhas
+		atualizacoes := camposAtualizados(a.atualizacoesFalha(ErrPagamentoRecusado))
+		if atualizacoes["Falhas"] != falhas+1 {
+			t.Errorf("com %d falhas: Falhas = %v", falhas, atualizacoes["Falhas"])
+		}
+		status, pausou := atualizacoes["Status"]
+		if deveria := falhas+1 >= maxFalhasAssinatura; pausou != deveria || (pausou && status != AssinaturaPausada) {
+			t.Errorf("com %d falhas: Status = %v, pausada = %v", falhas, status, pausou)
+		}
+	}
+}
+
+func camposAtualizados(atualizacoes []firestore.Update) map[string]interface{} {
+	campos := make(map[string]interface{})
+	for _, atualizacao := range atualizacoes {
+		campos[atualizacao.Path] = atualizacao.Value
+	}
+	return campos
+}
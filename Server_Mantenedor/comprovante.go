@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Colunas de uma impressora térmica de 80mm na fonte A
+const colunasComprovante = 48
+
+// Produto do pedido, somando as linhas vendidas dele
+type ItemComprovante struct {
+	NomeProd      string
+	Quantidade    int
+	ValorUnitario float64
+	Desconto      float64
+	Valor         float64
+}
+
+type DescontoComprovante struct {
+	Descricao string
+	Valor     float64
+}
+
+type PagamentoComprovante struct {
+	Metodo string
+	Valor  float64
+}
+
+// Comprovante de um pedido, montado das transações que compartilham o código, como o do Server_Usuario
+type Comprovante struct {
+	Codigo         int
+	Data           time.Time
+	Itens          []ItemComprovante
+	Subtotal       float64
+	Descontos      []DescontoComprovante
+	TotalDescontos float64
+	TaxaEntrega    float64
+	Total          float64
+	Pagamentos     []PagamentoComprovante
+	// Valor já devolvido nos estornos do pedido
+	Estornado  float64
+	RetiradaEm time.Time
+	Mesa       int
+}
+
+type ComprovantePageData struct {
+	PageTitle   string
+	Loja        string
+	Comprovante Comprovante
+}
+
+// Agrupa as vendas do pedido por produto, com os descontos pelo nome e os pagamentos pelo método
+func montarComprovante(codigo int, transacoes []Transacao) (Comprovante, error) {
+	comprovante := Comprovante{Codigo: codigo}
+	sort.SliceStable(transacoes, func(i, j int) bool {
+		return transacoes[i].DataTransacao.Before(transacoes[j].DataTransacao)
+	})
+
+	itens := make(map[int]*ItemComprovante)
+	var ordem []int
+	descontos := make(map[string]float64)
+	var ordemDescontos []string
+	pagamentos := make(map[string]float64)
+	var ordemPagamentos []string
+	pagar := func(metodo string, valor float64) {
+		if _, ok := pagamentos[metodo]; !ok {
+			ordemPagamentos = append(ordemPagamentos, metodo)
+		}
+		pagamentos[metodo] += valor
+	}
+
+	for _, t := range transacoes {
+		if t.Estorno() {
+			comprovante.Estornado -= t.ValorTransacao
+			continue
+		}
+		if comprovante.Data.IsZero() {
+			comprovante.Data = t.DataTransacao.In(fusoLoja())
+		}
+		if !t.RetiradaEm.IsZero() {
+			comprovante.RetiradaEm = t.RetiradaEm.In(fusoLoja())
+		}
+		if t.Mesa != 0 {
+			comprovante.Mesa = t.Mesa
+		}
+		comprovante.Total += t.ValorTransacao
+		if len(t.Pagamentos) > 0 {
+			for _, p := range t.Pagamentos {
+				pagar(p.Metodo, p.Valor)
+			}
+		} else {
+			pagar(t.MetodoPagamento, t.ValorTransacao)
+		}
+
+		if t.CodigoProd == CodigoTaxaEntrega {
+			comprovante.TaxaEntrega += t.ValorTransacao
+			continue
+		}
+		item, ok := itens[t.CodigoProd]
+		if !ok {
+			item = &ItemComprovante{NomeProd: t.NomeProd, ValorUnitario: t.ValorUnitario}
+			itens[t.CodigoProd] = item
+			ordem = append(ordem, t.CodigoProd)
+		}
+		item.Quantidade += t.QuantidadeProd
+		item.Desconto += t.Desconto
+		item.Valor += t.ValorTransacao
+		comprovante.Subtotal += float64(t.QuantidadeProd) * t.ValorUnitario
+		comprovante.TotalDescontos += t.Desconto
+
+		// Linhas antigas só têm o valor do desconto, sem a origem
+		restante := t.Desconto
+		for _, d := range t.Descontos {
+			if _, ok := descontos[d.Descricao]; !ok {
+				ordemDescontos = append(ordemDescontos, d.Descricao)
+			}
+			descontos[d.Descricao] += d.Valor
+			restante -= d.Valor
+		}
+		if restante > 0.005 {
+			if _, ok := descontos["Desconto"]; !ok {
+				ordemDescontos = append(ordemDescontos, "Desconto")
+			}
+			descontos["Desconto"] += restante
+		}
+	}
+	if comprovante.Data.IsZero() {
+		return comprovante, ErrPedidoNaoEncontrado
+	}
+
+	for _, codigoProd := range ordem {
+		item := itens[codigoProd]
+		item.Desconto = arredondarCentavos(item.Desconto)
+		item.Valor = arredondarCentavos(item.Valor)
+		comprovante.Itens = append(comprovante.Itens, *item)
+	}
+	for _, descricao := range ordemDescontos {
+		comprovante.Descontos = append(comprovante.Descontos, DescontoComprovante{Descricao: descricao, Valor: arredondarCentavos(descontos[descricao])})
+	}
+	for _, metodo := range ordemPagamentos {
+		if valor := arredondarCentavos(pagamentos[metodo]); valor > 0 {
+			comprovante.Pagamentos = append(comprovante.Pagamentos, PagamentoComprovante{Metodo: nomeMetodoPagamento(metodo), Valor: valor})
+		}
+	}
+	comprovante.Subtotal = arredondarCentavos(comprovante.Subtotal)
+	comprovante.TotalDescontos = arredondarCentavos(comprovante.TotalDescontos)
+	comprovante.TaxaEntrega = arredondarCentavos(comprovante.TaxaEntrega)
+	comprovante.Total = arredondarCentavos(comprovante.Total)
+	comprovante.Estornado = arredondarCentavos(comprovante.Estornado)
+	return comprovante, nil
+}
+
+func moedaComprovante(valor float64) string {
+	return strings.Replace(fmt.Sprintf("%.2f", valor), ".", ",", 1)
+}
+
+// Texto à esquerda e valor alinhado à direita na mesma linha, cortando o texto se não couber
+func linhaComprovante(texto, valor string) string {
+	espaco := colunasComprovante - utf8.RuneCountInString(valor) - 1
+	if utf8.RuneCountInString(texto) > espaco {
+		texto = string([]rune(texto)[:espaco])
+	}
+	return texto + strings.Repeat(" ", colunasComprovante-utf8.RuneCountInString(texto)-utf8.RuneCountInString(valor)) + valor + "\n"
+}
+
+// Comandos ESC/POS usados no comprovante
+const (
+	escInicializar   = "\x1b@"
+	escPaginaCP850   = "\x1bt\x02"
+	escCentralizar   = "\x1ba\x01"
+	escAlinharEsq    = "\x1ba\x00"
+	escNegritoLiga   = "\x1bE\x01"
+	escNegritoDesl   = "\x1bE\x00"
+	escAvancarLinhas = "\x1bd\x04"
+	escCortarPapel   = "\x1dV\x42\x00"
+)
+
+// Comprovante para impressoras térmicas ESC/POS, em 48 colunas e na página de código 850,
+// que cobre os acentos do português
+func (c Comprovante) escPos(loja string) ([]byte, error) {
+	var texto strings.Builder
+	separador := strings.Repeat("-", colunasComprovante) + "\n"
+
+	texto.WriteString(escInicializar + escPaginaCP850 + escCentralizar)
+	texto.WriteString(escNegritoLiga + loja + "\n" + escNegritoDesl)
+	fmt.Fprintf(&texto, "Pedido nº %d\n%s\n", c.Codigo, c.Data.Format("02/01/2006 15:04"))
+	if c.Mesa != 0 {
+		fmt.Fprintf(&texto, "Mesa %d\n", c.Mesa)
+	}
+	if !c.RetiradaEm.IsZero() {
+		fmt.Fprintf(&texto, "Retirada: %s\n", c.RetiradaEm.Format("02/01 15:04"))
+	}
+	texto.WriteString(escAlinharEsq + separador)
+
+	for _, item := range c.Itens {
+		texto.WriteString(linhaComprovante(item.NomeProd, moedaComprovante(item.Valor)))
+		detalhe := fmt.Sprintf("  %d x %s", item.Quantidade, moedaComprovante(item.ValorUnitario))
+		if item.Desconto > 0 {
+			detalhe += " (-" + moedaComprovante(item.Desconto) + ")"
+		}
+		texto.WriteString(detalhe + "\n")
+	}
+	texto.WriteString(separador)
+
+	texto.WriteString(linhaComprovante("Subtotal", moedaComprovante(c.Subtotal)))
+	for _, d := range c.Descontos {
+		texto.WriteString(linhaComprovante(d.Descricao, "-"+moedaComprovante(d.Valor)))
+	}
+	if c.TaxaEntrega > 0 {
+		texto.WriteString(linhaComprovante("Taxa de entrega", moedaComprovante(c.TaxaEntrega)))
+	}
+	texto.WriteString(escNegritoLiga + linhaComprovante("TOTAL R$", moedaComprovante(c.Total)) + escNegritoDesl)
+	for _, p := range c.Pagamentos {
+		texto.WriteString(linhaComprovante(p.Metodo, moedaComprovante(p.Valor)))
+	}
+	if c.Estornado > 0 {
+		texto.WriteString(linhaComprovante("Estornado", "-"+moedaComprovante(c.Estornado)))
+	}
+	texto.WriteString(separador)
+
+	texto.WriteString(escCentralizar + "Obrigado pela preferência!\n" + "Este comprovante não é documento fiscal.\n")
+	texto.WriteString(escAvancarLinhas + escCortarPapel)
+
+	var saida bytes.Buffer
+	escritor := encoding.ReplaceUnsupported(charmap.CodePage850.NewEncoder()).Writer(&saida)
+	if _, err := escritor.Write([]byte(texto.String())); err != nil {
+		return nil, err
+	}
+	return saida.Bytes(), nil
+}
+
+// Nome da loja no cabeçalho do comprovante
+func nomeLojaComprovante() string {
+	if config.NFCe.Emitente.NomeFantasia != "" {
+		return config.NFCe.Emitente.NomeFantasia
+	}
+	return config.NFCe.Emitente.RazaoSocial
+}
+
+// Comprovante do pedido para reimpressão no balcão: HTML no tamanho da bobina ou, com formato=escpos,
+// os bytes para a impressora térmica
+func ComprovantePedidoHandler(w http.ResponseWriter, r *http.Request) {
+	codigo, _ := strconv.Atoi(mux.Vars(r)["codigo"])
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	transacoes, _, err := buscarTransacoesPedido(firestoreClient, codigo)
+	if err != nil {
+		log.Printf("Failed to fetch order %d: %v", codigo, err)
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	comprovante, err := montarComprovante(codigo, transacoes)
+	if err == ErrPedidoNaoEncontrado {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to build receipt", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("formato") == "escpos" {
+		conteudo, err := comprovante.escPos(nomeLojaComprovante())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to encode receipt: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="comprovante-%d.bin"`, codigo))
+		w.Write(conteudo)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/comprovante.html"))
+	data := ComprovantePageData{
+		PageTitle:   fmt.Sprintf("Comprovante do pedido %d", codigo),
+		Loja:        nomeLojaComprovante(),
+		Comprovante: comprovante,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
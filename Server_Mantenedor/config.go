@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// Caminho padrão do arquivo de configuração do servidor de manutenção.
+// Pode ser sobrescrito pela variável de ambiente MANTENEDOR_CONFIG.
+const configPadrao = "config.json"
+
+// Metas de atendimento (SLA) de uma prioridade de ticket, em minutos
+type MetaSLA struct {
+	RespostaMin  int
+	ResolucaoMin int
+}
+
+// Servidor SMTP usado para enviar relatórios e notificações por email
+// Para testes locais, aponte para um SMTP de captura, como o MailHog em localhost:1025, sem usuário
+type ConfigSMTP struct {
+	Host      string
+	Porta     int
+	Usuario   string
+	Senha     string
+	Remetente string
+}
+
+// Emails transacionais enviados aos clientes e à equipe
+type ConfigEmail struct {
+	// "smtp" ou "arquivo", que grava as mensagens em DiretorioArquivos; vazio usa o SMTP quando há servidor
+	Mailer            string
+	DiretorioArquivos string
+	// Destinatários dos avisos internos, como o de estoque baixo
+	Equipe []string
+	// Endereços de cada papel, como o que recebe os escalonamentos de SLA; papel sem endereços usa a Equipe
+	Papeis map[string][]string
+	// Número máximo de tentativas e espera, em segundos, antes da segunda; a espera dobra a cada nova falha
+	Tentativas          int
+	IntervaloTentativas int
+	// Intervalo, em segundos, entre as verificações da fila
+	IntervaloFila int
+}
+
+// Relatório gerado automaticamente pelo agendador
+type ConfigAgendamento struct {
+	Nome string
+	// Expressão cron de cinco campos (ou @daily, @monthly...), avaliada no fuso da loja
+	Expressao string
+	// "fechamento_diario" (dia anterior ao disparo) ou "fluxo_mensal" (mês anterior ao disparo)
+	Relatorio string
+	Formato   string
+	// "arquivo" apenas arquiva o relatório; "email" também o envia aos destinatários
+	Entrega       string
+	Destinatarios []string
+	// Número máximo de tentativas e espera, em segundos, antes de repetir após uma falha
+	Tentativas          int
+	IntervaloTentativas int
+}
+
+// Dados do emitente impressos na NFC-e
+type EmitenteNFCe struct {
+	CNPJ         string
+	RazaoSocial  string
+	NomeFantasia string
+	IE           string
+	// Regime tributário: 1 = Simples Nacional, 3 = regime normal
+	CRT        int
+	Logradouro string
+	Numero     string
+	Bairro     string
+	// Código IBGE do município, com 7 dígitos
+	CodigoMunicipio string
+	Municipio       string
+	UF              string
+	CEP             string
+}
+
+// Emissão da NFC-e (nota fiscal de consumidor eletrônica) dos pedidos
+type ConfigNFCe struct {
+	// 1 = produção, 2 = homologação
+	Ambiente int
+	Serie    int
+	Emitente EmitenteNFCe
+	// Certificado A1 (.pfx) e sua senha; em homologação, sem certificado, é usado um certificado temporário
+	CaminhoCertificado string
+	SenhaCertificado   string
+	// Identificador e código de segurança do contribuinte (CSC), usados no QR code
+	IDToken string
+	CSC     string
+	// Web service de autorização da SEFAZ; vazio usa o simulador local de homologação
+	URLAutorizacao string
+	// Consultas públicas da SEFAZ da UF, pelo QR code e pela chave de acesso
+	URLQRCode   string
+	URLConsulta string
+	// Dados fiscais usados para os produtos que não têm os seus; o CSOSN vale no Simples Nacional, o CST no regime normal
+	NCMPadrao   string
+	CFOPPadrao  string
+	CSOSNPadrao string
+	CSTPadrao   string
+	// Intervalo, em segundos, entre as emissões das notas pendentes
+	IntervaloEmissao int
+}
+
+type Config struct {
+	// Banco usado para os tickets: "firestore" (padrão) ou "sqlite"
+	BancoTickets         string
+	CaminhoSQLiteTickets string
+	// Logotipo impresso no cabeçalho dos relatórios em PDF
+	CaminhoLogo string
+	// Fuso horário da loja, usado para delimitar os dias nos relatórios
+	FusoHorario string
+	// Diretório onde os relatórios gerados são arquivados
+	DiretorioRelatorios string
+	// Metas de SLA indexadas pela prioridade do ticket (baixa, media, alta, urgente)
+	SLA map[string]MetaSLA
+	// Intervalo, em segundos, entre as verificações de violação de SLA
+	IntervaloVerificacaoSLA int
+	// Papel que recebe as notificações de escalonamento
+	PapelEscalonamento string
+	SMTP               ConfigSMTP
+	Agendamentos       []ConfigAgendamento
+	// Provedor que cobra os pedidos das assinaturas: "fake" (padrão) ou "fake_recusa"
+	ProvedorPagamento string
+	// Intervalo, em segundos, entre as verificações de assinaturas com entrega vencida
+	IntervaloAssinaturas int
+	// Endereço público do Server_Usuario, gravado nos QR codes das mesas
+	URLLoja string
+	NFCe    ConfigNFCe
+	Email   ConfigEmail
+}
+
+var config = configPadraoMantenedor()
+
+func configPadraoMantenedor() Config {
+	return Config{
+		BancoTickets:         "firestore",
+		CaminhoSQLiteTickets: "tickets.db",
+		DiretorioRelatorios:  "./relatorios_fluxo",
+		FusoHorario:          "America/Sao_Paulo",
+		CaminhoLogo:          "template/img/logo.png",
+		SLA: map[string]MetaSLA{
+			PrioridadeBaixa:   {RespostaMin: 48 * 60, ResolucaoMin: 7 * 24 * 60},
+			PrioridadeMedia:   {RespostaMin: 24 * 60, ResolucaoMin: 3 * 24 * 60},
+			PrioridadeAlta:    {RespostaMin: 4 * 60, ResolucaoMin: 24 * 60},
+			PrioridadeUrgente: {RespostaMin: 60, ResolucaoMin: 4 * 60},
+		},
+		IntervaloVerificacaoSLA: 300,
+		PapelEscalonamento:      "proprietario",
+		ProvedorPagamento:       ProvedorFake,
+		IntervaloAssinaturas:    3600,
+		URLLoja:                 "http://localhost:8081",
+		NFCe: ConfigNFCe{
+			Ambiente: AmbienteHomologacao,
+			Serie:    1,
+			Emitente: EmitenteNFCe{
+				CNPJ: "11222333000181", RazaoSocial: "Coffee Shop Ltda", NomeFantasia: "Coffee Shop", IE: "111111111111", CRT: 1,
+				Logradouro: "Rua Chalingt Gates", Numero: "123", Bairro: "Centro", CodigoMunicipio: "3550308", Municipio: "São Paulo", UF: "SP", CEP: "01001000",
+			},
+			IDToken:          "000001",
+			CSC:              "CSC-HOMOLOGACAO",
+			URLQRCode:        "https://www.homologacao.nfce.fazenda.sp.gov.br/NFCeConsultaPublica/Paginas/ConsultaQRCode.aspx",
+			URLConsulta:      "https://www.homologacao.nfce.fazenda.sp.gov.br/NFCeConsultaPublica",
+			NCMPadrao:        "21069090",
+			CFOPPadrao:       "5102",
+			CSOSNPadrao:      "102",
+			CSTPadrao:        "00",
+			IntervaloEmissao: 60,
+		},
+		SMTP: ConfigSMTP{Porta: 587, Remetente: "relatorios@coffeeshop.local"},
+		Email: ConfigEmail{
+			DiretorioArquivos:   "emails",
+			Tentativas:          5,
+			IntervaloTentativas: 60,
+			IntervaloFila:       30,
+		},
+	}
+}
+
+// Agendamentos usados quando o arquivo de configuração não define nenhum.
+// Uma lista vazia no arquivo desativa o agendador.
+func agendamentosPadrao() []ConfigAgendamento {
+	return []ConfigAgendamento{
+		{Nome: "fechamento_diario", Expressao: "5 0 * * *", Relatorio: RelatorioFechamentoDiario, Formato: "pdf", Entrega: EntregaArquivo, Tentativas: 3, IntervaloTentativas: 60},
+		{Nome: "fluxo_mensal", Expressao: "0 6 1 * *", Relatorio: RelatorioFluxoMensal, Formato: "pdf", Entrega: EntregaArquivo, Tentativas: 3, IntervaloTentativas: 300},
+	}
+}
+
+// Carrega o arquivo de configuração, mantendo os valores padrão para os campos ausentes
+func carregarConfig() {
+	caminho := os.Getenv("MANTENEDOR_CONFIG")
+	if caminho == "" {
+		caminho = configPadrao
+	}
+
+	defer func() {
+		if config.Agendamentos == nil {
+			config.Agendamentos = agendamentosPadrao()
+		}
+	}()
+
+	conteudo, err := os.ReadFile(caminho)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read config file %s: %v", caminho, err)
+		}
+		return
+	}
+
+	if err := json.Unmarshal(conteudo, &config); err != nil {
+		log.Printf("Failed to parse config file %s: %v", caminho, err)
+		config = configPadraoMantenedor()
+	}
+}
+
+func (c Config) intervaloVerificacaoSLA() time.Duration {
+	if c.IntervaloVerificacaoSLA <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(c.IntervaloVerificacaoSLA) * time.Second
+}
+
+func (c Config) intervaloEmissaoNFCe() time.Duration {
+	if c.NFCe.IntervaloEmissao <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.NFCe.IntervaloEmissao) * time.Second
+}
+
+func (c Config) intervaloFilaEmails() time.Duration {
+	if c.Email.IntervaloFila <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.Email.IntervaloFila) * time.Second
+}
+
+func (c Config) intervaloAssinaturas() time.Duration {
+	if c.IntervaloAssinaturas <= 0 {
+		return time.Hour
+	}
+	return time.Duration(c.IntervaloAssinaturas) * time.Second
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expressão cron de cinco campos: minuto, hora, dia do mês, mês e dia da semana.
+// Cada campo aceita "*", valores, intervalos (1-5), listas (1,15) e passos (*/10).
+type ExpressaoCron struct {
+	minutos     [60]bool
+	horas       [24]bool
+	dias        [32]bool
+	meses       [13]bool
+	diasSemana  [7]bool
+	diaLivre    bool
+	semanaLivre bool
+}
+
+var atalhosCron = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+func parseCron(expressao string) (ExpressaoCron, error) {
+	var cron ExpressaoCron
+
+	if atalho, ok := atalhosCron[strings.TrimSpace(expressao)]; ok {
+		expressao = atalho
+	}
+	campos := strings.Fields(expressao)
+	if len(campos) != 5 {
+		return cron, fmt.Errorf("cron expression %q must have 5 fields", expressao)
+	}
+
+	if err := preencherCampoCron(campos[0], 0, 59, cron.minutos[:]); err != nil {
+		return cron, err
+	}
+	if err := preencherCampoCron(campos[1], 0, 23, cron.horas[:]); err != nil {
+		return cron, err
+	}
+	if err := preencherCampoCron(campos[2], 1, 31, cron.dias[:]); err != nil {
+		return cron, err
+	}
+	if err := preencherCampoCron(campos[3], 1, 12, cron.meses[:]); err != nil {
+		return cron, err
+	}
+	// O domingo pode ser escrito como 0 ou 7
+	var diasSemana [8]bool
+	if err := preencherCampoCron(campos[4], 0, 7, diasSemana[:]); err != nil {
+		return cron, err
+	}
+	copy(cron.diasSemana[:], diasSemana[:7])
+	cron.diasSemana[0] = cron.diasSemana[0] || diasSemana[7]
+
+	cron.diaLivre = campos[2] == "*"
+	cron.semanaLivre = campos[4] == "*"
+	return cron, nil
+}
+
+func preencherCampoCron(campo string, minimo, maximo int, valores []bool) error {
+	for _, parte := range strings.Split(campo, ",") {
+		intervalo, passo := parte, 1
+		if i := strings.Index(parte, "/"); i >= 0 {
+			var err error
+			intervalo = parte[:i]
+			passo, err = strconv.Atoi(parte[i+1:])
+			if err != nil || passo < 1 {
+				return fmt.Errorf("invalid step in cron field %q", campo)
+			}
+		}
+
+		inicio, fim := minimo, maximo
+		if intervalo != "*" {
+			limites := strings.SplitN(intervalo, "-", 2)
+			var err error
+			inicio, err = strconv.Atoi(limites[0])
+			if err != nil {
+				return fmt.Errorf("invalid value in cron field %q", campo)
+			}
+			fim = inicio
+			if len(limites) == 2 {
+				fim, err = strconv.Atoi(limites[1])
+				if err != nil {
+					return fmt.Errorf("invalid range in cron field %q", campo)
+				}
+			} else if passo > 1 {
+				fim = maximo
+			}
+		}
+		if inicio < minimo || fim > maximo || inicio > fim {
+			return fmt.Errorf("value out of range in cron field %q", campo)
+		}
+
+		for v := inicio; v <= fim; v += passo {
+			valores[v] = true
+		}
+	}
+	return nil
+}
+
+// Indica se a expressão dispara no minuto de t
+func (c ExpressaoCron) Corresponde(t time.Time) bool {
+	if !c.minutos[t.Minute()] || !c.horas[t.Hour()] || !c.meses[t.Month()] {
+		return false
+	}
+
+	dia := c.dias[t.Day()]
+	semana := c.diasSemana[t.Weekday()]
+	// Como no cron tradicional, se os dois campos de dia forem restritos basta um deles coincidir
+	switch {
+	case c.diaLivre && c.semanaLivre:
+		return true
+	case c.diaLivre:
+		return semana
+	case c.semanaLivre:
+		return dia
+	default:
+		return dia || semana
+	}
+}
+
+// Próximo minuto, depois de t, em que a expressão dispara. Procura no máximo um ano à frente.
+func (c ExpressaoCron) Proxima(t time.Time) time.Time {
+	proxima := t.Truncate(time.Minute).Add(time.Minute)
+	limite := proxima.AddDate(1, 0, 0)
+	for proxima.Before(limite) {
+		if c.Corresponde(proxima) {
+			return proxima
+		}
+		proxima = proxima.Add(time.Minute)
+	}
+	return time.Time{}
+}
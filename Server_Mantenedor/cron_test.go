@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalida(t *testing.T) {
+	for _, expressao := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"@never",
+	} {
+		if _, err := parseCron(expressao); err == nil {
+			t.Errorf("parseCron(%q) deveria falhar", expressao)
+		}
+	}
+}
+
+func TestParseCronCampos(t *testing.T) {
+	cron, err := parseCron("*/15 8-10 1,15 * 7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for minuto := 0; minuto < 60; minuto++ {
+		if cron.minutos[minuto] != (minuto%15 == 0) {
+			t.Errorf("minuto %d: %v", minuto, cron.minutos[minuto])
+		}
+	}
+	for hora := 0; hora < 24; hora++ {
+		if cron.horas[hora] != (hora >= 8 && hora <= 10) {
+			t.Errorf("hora %d: %v", hora, cron.horas[hora])
+		}
+	}
+	if !cron.dias[1] || !cron.dias[15] || cron.dias[2] {
+		t.Errorf("dias do mês incorretos: %v", cron.dias)
+	}
+	// 7 também é domingo
+	if !cron.diasSemana[0] || cron.diasSemana[1] {
+		t.Errorf("dias da semana incorretos: %v", cron.diasSemana)
+	}
+	if cron.diaLivre || cron.semanaLivre {
+		t.Error("campos de dia restritos marcados como livres")
+	}
+}
+
+func TestProxima(t *testing.T) {
+	loc, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := func(ano int, mes time.Month, dia, hora, minuto int) time.Time {
+		return time.Date(ano, mes, dia, hora, minuto, 0, 0, loc)
+	}
+
+	casos := []struct {
+		expressao string
+		depois    time.Time
+		esperado  time.Time
+	}{
+		// O próprio minuto não conta, mesmo no meio dele
+		{"5 0 * * *", data(2026, 3, 10, 0, 5).Add(30 * time.Second), data(2026, 3, 11, 0, 5)},
+		{"5 0 * * *", data(2026, 3, 10, 0, 4), data(2026, 3, 10, 0, 5)},
+		{"*/10 * * * *", data(2026, 3, 10, 9, 41), data(2026, 3, 10, 9, 50)},
+		{"@monthly", data(2026, 12, 15, 12, 0), data(2027, 1, 1, 0, 0)},
+		{"0 6 1 * *", data(2026, 3, 1, 6, 0), data(2026, 4, 1, 6, 0)},
+		// Segunda-feira, 09/03/2026
+		{"0 9 * * 1", data(2026, 3, 4, 0, 0), data(2026, 3, 9, 9, 0)},
+		// Com dia do mês e da semana restritos, basta um coincidir: dia 13 ou sexta-feira
+		{"0 0 13 * 5", data(2026, 3, 1, 0, 0), data(2026, 3, 6, 0, 0)},
+		// O próximo 29/02 fica a mais de um ano: a busca desiste
+		{"0 0 29 2 *", data(2026, 3, 1, 0, 0), time.Time{}},
+	}
+	for _, caso := range casos {
+		cron, err := parseCron(caso.expressao)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", caso.expressao, err)
+		}
+		if proxima := cron.Proxima(caso.depois); !proxima.Equal(caso.esperado) {
+			t.Errorf("%q depois de %v: esperava %v, veio %v", caso.expressao, caso.depois, caso.esperado, proxima)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Dias cobertos pela tendência de vendas do painel
+const diasTendencia = 30
+
+type PontoGrafico struct {
+	Rotulo string
+	Valor  float64
+}
+
+type DadosDashboard struct {
+	Data          time.Time
+	ReceitaHoje   float64
+	PedidosHoje   int
+	TicketMedio   float64
+	TopProdutos   []LinhaProdutoFluxo
+	VendasPorHora []PontoGrafico
+	Tendencia     []PontoGrafico
+}
+
+type DashboardPageData struct {
+	PageTitle          string
+	Dados              DadosDashboard
+	GraficoHoras       template.HTML
+	GraficoTendencia   template.HTML
+	GraficoTopProdutos template.HTML
+}
+
+// Calcula os indicadores do painel a partir das transações dos últimos dias
+func calcularDashboard(transacoes []Transacao, custos map[int]float64, agora time.Time) DadosDashboard {
+	hoje := inicioDoDia(agora)
+	inicioTendencia := hoje.AddDate(0, 0, -(diasTendencia - 1))
+
+	dados := DadosDashboard{Data: hoje}
+	pedidosHoje := make(map[int]bool)
+
+	vendasPorHora := make([]float64, 24)
+	vendasPorDia := make(map[string]float64)
+	var doPeriodo []Transacao
+
+	for _, t := range transacoes {
+		data := t.DataTransacao.In(agora.Location())
+		if data.Before(inicioTendencia) || !data.Before(hoje.AddDate(0, 0, 1)) {
+			continue
+		}
+		doPeriodo = append(doPeriodo, t)
+		vendasPorDia[data.Format("2006-01-02")] += t.ValorTransacao
+
+		if !data.Before(hoje) {
+			dados.ReceitaHoje += t.ValorTransacao
+			if !t.Estorno() {
+				pedidosHoje[t.CodigoTransacao] = true
+			}
+			vendasPorHora[data.Hour()] += t.ValorTransacao
+		}
+	}
+
+	dados.PedidosHoje = len(pedidosHoje)
+	if dados.PedidosHoje > 0 {
+		dados.TicketMedio = dados.ReceitaHoje / float64(dados.PedidosHoje)
+	}
+
+	for hora, valor := range vendasPorHora {
+		dados.VendasPorHora = append(dados.VendasPorHora, PontoGrafico{Rotulo: fmt.Sprintf("%02dh", hora), Valor: valor})
+	}
+	for dia := inicioTendencia; dia.Before(hoje.AddDate(0, 0, 1)); dia = dia.AddDate(0, 0, 1) {
+		dados.Tendencia = append(dados.Tendencia, PontoGrafico{Rotulo: dia.Format("02/01"), Valor: vendasPorDia[dia.Format("2006-01-02")]})
+	}
+
+	// Os produtos mais vendidos consideram o mesmo intervalo da tendência
+	relatorio := calcularFluxoCaixa(doPeriodo, custos, Periodo{Inicio: inicioTendencia, Fim: hoje.AddDate(0, 0, 1)})
+	dados.TopProdutos = relatorio.Produtos
+	if len(dados.TopProdutos) > 5 {
+		dados.TopProdutos = dados.TopProdutos[:5]
+	}
+	return dados
+}
+
+// Busca as transações da janela do painel e calcula seus indicadores
+func buscarDadosDashboard(agora time.Time) (DadosDashboard, error) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		return DadosDashboard{}, err
+	}
+	defer firestoreClient.Client.Close()
+
+	hoje := inicioDoDia(agora)
+	transacoes, err := buscarTransacoes(firestoreClient, hoje.AddDate(0, 0, -(diasTendencia-1)), hoje.AddDate(0, 0, 1))
+	if err != nil {
+		return DadosDashboard{}, err
+	}
+
+	custos, err := buscarCustosProdutos(firestoreClient)
+	if err != nil {
+		return DadosDashboard{}, err
+	}
+
+	return calcularDashboard(transacoes, custos, agora), nil
+}
+
+func DashboardHandler(w http.ResponseWriter, r *http.Request) {
+	dados, err := buscarDadosDashboard(time.Now().In(fusoLoja()))
+	if err != nil {
+		log.Printf("Failed to build dashboard: %v", err)
+		http.Error(w, "Failed to fetch transactions", http.StatusInternalServerError)
+		return
+	}
+
+	var topProdutos []PontoGrafico
+	for _, p := range dados.TopProdutos {
+		topProdutos = append(topProdutos, PontoGrafico{Rotulo: p.NomeProd, Valor: p.Receita})
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/dashboard.html"))
+	data := DashboardPageData{
+		PageTitle:          "Coffee Shop - Painel de Vendas",
+		Dados:              dados,
+		GraficoHoras:       graficoBarrasSVG("Vendas por hora (hoje)", dados.VendasPorHora, 720, 240),
+		GraficoTendencia:   graficoLinhaSVG("Receita diária - últimos 30 dias", dados.Tendencia, 720, 240),
+		GraficoTopProdutos: graficoBarrasSVG("Produtos mais vendidos - últimos 30 dias", topProdutos, 720, 240),
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+// Dados do painel em JSON, para integração com outras ferramentas
+func DashboardDadosHandler(w http.ResponseWriter, r *http.Request) {
+	dados, err := buscarDadosDashboard(time.Now().In(fusoLoja()))
+	if err != nil {
+		log.Printf("Failed to build dashboard: %v", err)
+		http.Error(w, "Failed to fetch transactions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dados); err != nil {
+		log.Printf("Failed to encode dashboard data: %v", err)
+	}
+}
+
+// Margens internas dos gráficos, em pixels
+const (
+	margemEsquerda = 60
+	margemDireita  = 10
+	margemTopo     = 30
+	margemBase     = 40
+)
+
+// Maior valor da série arredondado para cima, usado como topo do eixo vertical
+func escalaGrafico(pontos []PontoGrafico) float64 {
+	maximo := 0.0
+	for _, p := range pontos {
+		maximo = math.Max(maximo, p.Valor)
+	}
+	if maximo == 0 {
+		return 1
+	}
+	ordem := math.Pow(10, math.Floor(math.Log10(maximo)))
+	return math.Ceil(maximo/ordem) * ordem
+}
+
+// Cabeçalho, título e eixos comuns aos gráficos
+func inicioGraficoSVG(sb *strings.Builder, titulo string, largura, altura int, escala float64) {
+	fmt.Fprintf(sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="Arial, sans-serif" font-size="11">`, largura, altura, largura, altura)
+	fmt.Fprintf(sb, `<rect width="%d" height="%d" fill="#fff"/>`, largura, altura)
+	fmt.Fprintf(sb, `<text x="%d" y="18" font-size="14" fill="#333">%s</text>`, margemEsquerda, html.EscapeString(titulo))
+
+	base := altura - margemBase
+	areaAltura := float64(base - margemTopo)
+	for i := 0; i <= 4; i++ {
+		y := float64(base) - areaAltura*float64(i)/4
+		fmt.Fprintf(sb, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#eee"/>`, margemEsquerda, y, largura-margemDireita, y)
+		fmt.Fprintf(sb, `<text x="%d" y="%.1f" text-anchor="end" fill="#666">R$%.0f</text>`, margemEsquerda-5, y+4, escala*float64(i)/4)
+	}
+	fmt.Fprintf(sb, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#999"/>`, margemEsquerda, base, largura-margemDireita, base)
+}
+
+// Rótulos do eixo horizontal, pulando alguns quando não há espaço para todos
+func rotulosEixoSVG(sb *strings.Builder, pontos []PontoGrafico, altura int, x func(int) float64, espaco float64) {
+	passo := int(math.Ceil(60 / math.Max(espaco, 1)))
+	for i, p := range pontos {
+		if i%passo != 0 {
+			continue
+		}
+		fmt.Fprintf(sb, `<text x="%.1f" y="%d" text-anchor="middle" fill="#666">%s</text>`, x(i), altura-margemBase+15, html.EscapeString(p.Rotulo))
+	}
+}
+
+func graficoBarrasSVG(titulo string, pontos []PontoGrafico, largura, altura int) template.HTML {
+	var sb strings.Builder
+	escala := escalaGrafico(pontos)
+	inicioGraficoSVG(&sb, titulo, largura, altura, escala)
+
+	base := float64(altura - margemBase)
+	areaAltura := base - margemTopo
+	espaco := float64(largura-margemEsquerda-margemDireita) / math.Max(float64(len(pontos)), 1)
+	centro := func(i int) float64 { return float64(margemEsquerda) + espaco*(float64(i)+0.5) }
+
+	for i, p := range pontos {
+		h := math.Max(0, areaAltura*p.Valor/escala)
+		fmt.Fprintf(&sb, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#4caf50"><title>%s: R$ %.2f</title></rect>`,
+			centro(i)-espaco*0.4, base-h, espaco*0.8, h, html.EscapeString(p.Rotulo), p.Valor)
+	}
+	rotulosEixoSVG(&sb, pontos, altura, centro, espaco)
+
+	sb.WriteString(`</svg>`)
+	return template.HTML(sb.String())
+}
+
+func graficoLinhaSVG(titulo string, pontos []PontoGrafico, largura, altura int) template.HTML {
+	var sb strings.Builder
+	escala := escalaGrafico(pontos)
+	inicioGraficoSVG(&sb, titulo, largura, altura, escala)
+
+	base := float64(altura - margemBase)
+	areaAltura := base - margemTopo
+	espaco := float64(largura-margemEsquerda-margemDireita) / math.Max(float64(len(pontos)-1), 1)
+	x := func(i int) float64 { return float64(margemEsquerda) + espaco*float64(i) }
+
+	var coordenadas []string
+	for i, p := range pontos {
+		coordenadas = append(coordenadas, fmt.Sprintf("%.1f,%.1f", x(i), base-areaAltura*p.Valor/escala))
+	}
+	fmt.Fprintf(&sb, `<polyline points="%s" fill="none" stroke="#4caf50" stroke-width="2"/>`, strings.Join(coordenadas, " "))
+	for i, p := range pontos {
+		fmt.Fprintf(&sb, `<circle cx="%.1f" cy="%.1f" r="3" fill="#4caf50"><title>%s: R$ %.2f</title></circle>`,
+			x(i), base-areaAltura*p.Valor/escala, html.EscapeString(p.Rotulo), p.Valor)
+	}
+	rotulosEixoSVG(&sb, pontos, altura, x, espaco)
+
+	sb.WriteString(`</svg>`)
+	return template.HTML(sb.String())
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/mux"
+)
+
+// Tipos de cupom aceitos pelo carrinho do Server_Usuario
+const (
+	CupomPercentual = "percentual"
+	CupomValor      = "valor"
+	CupomItemGratis = "item_gratis"
+)
+
+// Tipos de promoção automática
+const (
+	PromocaoQuantidade = "quantidade"
+	PromocaoHappyHour  = "happy_hour"
+)
+
+var codigoCupomValido = regexp.MustCompile(`^[A-Z0-9_-]{3,20}$`)
+
+// Cupom guardado na coleção "cupons", com o código como ID do documento
+type Cupom struct {
+	Codigo string `firestore:"-"`
+	Tipo   string
+	// Percentual de desconto ou valor em reais, conforme o tipo
+	Valor float64
+	// Produto dado de graça nos cupons do tipo item_gratis
+	CodigoProdGratis int
+	ValidoDe         time.Time
+	ValidoAte        time.Time
+	// Zero significa uso ilimitado
+	LimiteUsos   int
+	Usos         int
+	PedidoMinimo float64
+	Ativo        bool
+}
+
+// Promoção aplicada automaticamente no carrinho, guardada na coleção "promocoes"
+type Promocao struct {
+	ID   string `firestore:"-"`
+	Nome string
+	Tipo string
+	// Produtos participantes; vazio vale para todo o catálogo
+	Produtos   []int
+	Percentual float64
+	// Quantidade mínima dos produtos participantes, nas promoções por quantidade
+	QuantidadeMinima int
+	// Janela do happy hour, no formato HH:MM, e dias da semana (0 = domingo; vazio = todos)
+	HoraInicio string
+	HoraFim    string
+	DiasSemana []int
+	Ativa      bool
+}
+
+// Desconto gravado em cada linha de venda pelo Server_Usuario
+type DescontoAplicado struct {
+	Origem    string
+	Codigo    string
+	Descricao string
+	Valor     float64
+}
+
+type PromocoesPageData struct {
+	PageTitle string
+	Cupons    []Cupom
+	Promocoes []Promocao
+	Produtos  []Produto
+}
+
+// Validade do cupom, para exibição
+func (c Cupom) Validade() string {
+	loc := fusoLoja()
+	switch {
+	case c.ValidoDe.IsZero() && c.ValidoAte.IsZero():
+		return "Sem prazo"
+	case c.ValidoAte.IsZero():
+		return "A partir de " + c.ValidoDe.In(loc).Format("02/01/2006")
+	case c.ValidoDe.IsZero():
+		return "Até " + c.ValidoAte.In(loc).AddDate(0, 0, -1).Format("02/01/2006")
+	}
+	return c.ValidoDe.In(loc).Format("02/01/2006") + " a " + c.ValidoAte.In(loc).AddDate(0, 0, -1).Format("02/01/2006")
+}
+
+// Lê o cupom do formulário. As datas são inclusivas; o fim é guardado como o início do dia seguinte.
+func lerCupom(r *http.Request) (Cupom, error) {
+	cupom := Cupom{
+		Codigo: strings.ToUpper(strings.TrimSpace(r.FormValue("codigo"))),
+		Tipo:   r.FormValue("tipo"),
+		Ativo:  true,
+	}
+	if !codigoCupomValido.MatchString(cupom.Codigo) {
+		return cupom, errors.New("Invalid coupon code")
+	}
+
+	var err error
+	switch cupom.Tipo {
+	case CupomPercentual, CupomValor:
+		if cupom.Valor, err = strconv.ParseFloat(r.FormValue("valor"), 64); err != nil || cupom.Valor <= 0 ||
+			(cupom.Tipo == CupomPercentual && cupom.Valor > 100) {
+			return cupom, errors.New("Invalid coupon value")
+		}
+	case CupomItemGratis:
+		if cupom.CodigoProdGratis, err = strconv.Atoi(r.FormValue("produto")); err != nil {
+			return cupom, errors.New("Invalid free product")
+		}
+	default:
+		return cupom, errors.New("Invalid coupon type")
+	}
+
+	loc := fusoLoja()
+	if de := r.FormValue("de"); de != "" {
+		if cupom.ValidoDe, err = time.ParseInLocation("2006-01-02", de, loc); err != nil {
+			return cupom, errors.New("Invalid start date")
+		}
+	}
+	if ate := r.FormValue("ate"); ate != "" {
+		fim, err := time.ParseInLocation("2006-01-02", ate, loc)
+		if err != nil || (!cupom.ValidoDe.IsZero() && fim.Before(cupom.ValidoDe)) {
+			return cupom, errors.New("Invalid end date")
+		}
+		cupom.ValidoAte = fim.AddDate(0, 0, 1)
+	}
+
+	if limite := r.FormValue("limite"); limite != "" {
+		if cupom.LimiteUsos, err = strconv.Atoi(limite); err != nil || cupom.LimiteUsos < 0 {
+			return cupom, errors.New("Invalid usage limit")
+		}
+	}
+	if minimo := r.FormValue("minimo"); minimo != "" {
+		if cupom.PedidoMinimo, err = strconv.ParseFloat(minimo, 64); err != nil || cupom.PedidoMinimo < 0 {
+			return cupom, errors.New("Invalid minimum order")
+		}
+	}
+	return cupom, nil
+}
+
+func lerPromocao(r *http.Request) (Promocao, error) {
+	promocao := Promocao{
+		Nome:  strings.TrimSpace(r.FormValue("nome")),
+		Tipo:  r.FormValue("tipo"),
+		Ativa: true,
+	}
+	if promocao.Nome == "" {
+		return promocao, errors.New("Promotion name is required")
+	}
+
+	var err error
+	if promocao.Percentual, err = strconv.ParseFloat(r.FormValue("percentual"), 64); err != nil || promocao.Percentual <= 0 || promocao.Percentual > 100 {
+		return promocao, errors.New("Invalid percentage")
+	}
+	if err := r.ParseForm(); err != nil {
+		return promocao, err
+	}
+	for _, valor := range r.Form["produtos"] {
+		codigo, err := strconv.Atoi(valor)
+		if err != nil {
+			return promocao, errors.New("Invalid product")
+		}
+		promocao.Produtos = append(promocao.Produtos, codigo)
+	}
+
+	switch promocao.Tipo {
+	case PromocaoQuantidade:
+		if promocao.QuantidadeMinima, err = strconv.Atoi(r.FormValue("quantidade")); err != nil || promocao.QuantidadeMinima < 1 {
+			return promocao, errors.New("Invalid minimum quantity")
+		}
+	case PromocaoHappyHour:
+		promocao.HoraInicio, promocao.HoraFim = r.FormValue("inicio"), r.FormValue("fim")
+		inicio, err1 := time.Parse("15:04", promocao.HoraInicio)
+		fim, err2 := time.Parse("15:04", promocao.HoraFim)
+		if err1 != nil || err2 != nil || !inicio.Before(fim) {
+			return promocao, errors.New("Invalid happy hour window")
+		}
+		for _, valor := range r.Form["dias"] {
+			dia, err := strconv.Atoi(valor)
+			if err != nil || dia < 0 || dia > 6 {
+				return promocao, errors.New("Invalid weekday")
+			}
+			promocao.DiasSemana = append(promocao.DiasSemana, dia)
+		}
+	default:
+		return promocao, errors.New("Invalid promotion type")
+	}
+	return promocao, nil
+}
+
+func PromocoesHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	data := PromocoesPageData{PageTitle: "Coffee Shop - Cupons e Promoções"}
+
+	docs, err := firestoreClient.Client.Collection("cupons").Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		log.Printf("Failed to list coupons: %v", err)
+		http.Error(w, "Failed to fetch coupons", http.StatusInternalServerError)
+		return
+	}
+	for _, doc := range docs {
+		var cupom Cupom
+		if err := doc.DataTo(&cupom); err != nil {
+			http.Error(w, "Failed to parse coupon data", http.StatusInternalServerError)
+			return
+		}
+		cupom.Codigo = doc.Ref.ID
+		data.Cupons = append(data.Cupons, cupom)
+	}
+
+	docs, err = firestoreClient.Client.Collection("promocoes").Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		log.Printf("Failed to list promotions: %v", err)
+		http.Error(w, "Failed to fetch promotions", http.StatusInternalServerError)
+		return
+	}
+	for _, doc := range docs {
+		var promocao Promocao
+		if err := doc.DataTo(&promocao); err != nil {
+			http.Error(w, "Failed to parse promotion data", http.StatusInternalServerError)
+			return
+		}
+		promocao.ID = doc.Ref.ID
+		data.Promocoes = append(data.Promocoes, promocao)
+	}
+
+	docs, err = firestoreClient.Client.Collection("produtos").Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+		return
+	}
+	for _, doc := range docs {
+		var produto Produto
+		if err := doc.DataTo(&produto); err != nil {
+			http.Error(w, "Failed to parse product data", http.StatusInternalServerError)
+			return
+		}
+		data.Produtos = append(data.Produtos, produto)
+	}
+
+	sort.Slice(data.Cupons, func(i, j int) bool { return data.Cupons[i].Codigo < data.Cupons[j].Codigo })
+	sort.Slice(data.Promocoes, func(i, j int) bool { return data.Promocoes[i].Nome < data.Promocoes[j].Nome })
+	sort.Slice(data.Produtos, func(i, j int) bool { return data.Produtos[i].ID < data.Produtos[j].ID })
+
+	tmpl := template.Must(template.ParseFiles("template/promocoes.html"))
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+func CriarCupomHandler(w http.ResponseWriter, r *http.Request) {
+	cupom, err := lerCupom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	// Create falha se o código já existir, preservando o contador de usos do cupom antigo
+	if _, err := firestoreClient.Client.Collection("cupons").Doc(cupom.Codigo).Create(firestoreClient.Ctx, cupom); err != nil {
+		log.Printf("Failed to create coupon %s: %v", cupom.Codigo, err)
+		http.Error(w, "Failed to create coupon (code already in use?)", http.StatusConflict)
+		return
+	}
+	http.Redirect(w, r, "/promocoes", http.StatusSeeOther)
+}
+
+func CriarPromocaoHandler(w http.ResponseWriter, r *http.Request) {
+	promocao, err := lerPromocao(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	if _, _, err := firestoreClient.Client.Collection("promocoes").Add(firestoreClient.Ctx, promocao); err != nil {
+		log.Printf("Failed to create promotion: %v", err)
+		http.Error(w, "Failed to create promotion", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/promocoes", http.StatusSeeOther)
+}
+
+// Ativa ou desativa um cupom ou uma promoção, conforme a coleção da rota
+func AlternarDescontoHandler(colecao, campo string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		firestoreClient, err := InitializeFirestore()
+		if err != nil {
+			http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+			return
+		}
+		defer firestoreClient.Client.Close()
+
+		_, err = firestoreClient.Client.Collection(colecao).Doc(mux.Vars(r)["id"]).Update(firestoreClient.Ctx, []firestore.Update{
+			{Path: campo, Value: r.FormValue("ativo") == "1"},
+		})
+		if err != nil {
+			log.Printf("Failed to update %s: %v", colecao, err)
+			http.Error(w, "Failed to update discount", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/promocoes", http.StatusSeeOther)
+	}
+}
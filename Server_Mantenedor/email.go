@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AnexoEmail struct {
+	Nome         string
+	TipoConteudo string
+	Conteudo     []byte
+}
+
+type MensagemEmail struct {
+	Para    []string
+	Assunto string
+	Corpo   string
+	Anexos  []AnexoEmail
+}
+
+// Monta a mensagem no formato MIME, com o corpo em texto e os anexos em base64
+func (m MensagemEmail) montar(remetente string, data time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", remetente)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.Para, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Assunto))
+	fmt.Fprintf(&buf, "Date: %s\r\n", data.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+
+	corpo, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"8bit"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	corpo.Write([]byte(m.Corpo))
+
+	for _, anexo := range m.Anexos {
+		parte, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {anexo.TipoConteudo},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": anexo.Nome})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		codificado := base64.StdEncoding.EncodeToString(anexo.Conteudo)
+		for len(codificado) > 76 {
+			fmt.Fprintf(parte, "%s\r\n", codificado[:76])
+			codificado = codificado[76:]
+		}
+		fmt.Fprintf(parte, "%s\r\n", codificado)
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Entrega as mensagens montadas; implementado pelo SMTP e, em desenvolvimento, por arquivos .eml
+type Mailer interface {
+	Enviar(mensagem MensagemEmail) error
+}
+
+// Mailers aceitos em ConfigEmail.Mailer
+const (
+	MailerSMTP    = "smtp"
+	MailerArquivo = "arquivo"
+)
+
+type mailerSMTP struct {
+	cfg ConfigSMTP
+}
+
+func (m mailerSMTP) Enviar(mensagem MensagemEmail) error {
+	if m.cfg.Host == "" {
+		return errors.New("SMTP server not configured")
+	}
+	if len(mensagem.Para) == 0 {
+		return errors.New("email without recipients")
+	}
+
+	conteudo, err := mensagem.montar(m.cfg.Remetente, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.cfg.Usuario != "" {
+		auth = smtp.PlainAuth("", m.cfg.Usuario, m.cfg.Senha, m.cfg.Host)
+	}
+	endereco := m.cfg.Host + ":" + strconv.Itoa(m.cfg.Porta)
+	return smtp.SendMail(endereco, auth, m.cfg.Remetente, mensagem.Para, conteudo)
+}
+
+// Grava cada mensagem como um arquivo .eml no diretório e registra no log, sem enviar nada
+type mailerArquivo struct {
+	diretorio string
+	remetente string
+	agora     func() time.Time
+}
+
+func (m mailerArquivo) Enviar(mensagem MensagemEmail) error {
+	if len(mensagem.Para) == 0 {
+		return errors.New("email without recipients")
+	}
+	agora := m.agora()
+	conteudo, err := mensagem.montar(m.remetente, agora)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.diretorio, 0o755); err != nil {
+		return err
+	}
+	arquivo, err := os.CreateTemp(m.diretorio, agora.Format("20060102-150405")+"-*.eml")
+	if err != nil {
+		return err
+	}
+	defer arquivo.Close()
+	if _, err := arquivo.Write(conteudo); err != nil {
+		return err
+	}
+	log.Printf("Email \"%s\" to %s written to %s", mensagem.Assunto, strings.Join(mensagem.Para, ", "), arquivo.Name())
+	return nil
+}
+
+// Mailer da configuração; sem escolha explícita, usa o SMTP quando há servidor e os arquivos quando não há
+func mailerConfigurado() Mailer {
+	tipo := config.Email.Mailer
+	if tipo == "" {
+		tipo = MailerArquivo
+		if config.SMTP.Host != "" {
+			tipo = MailerSMTP
+		}
+	}
+	if tipo == MailerArquivo {
+		return mailerArquivo{diretorio: config.Email.DiretorioArquivos, remetente: config.SMTP.Remetente, agora: time.Now}
+	}
+	return mailerSMTP{cfg: config.SMTP}
+}
+
+// Envia a mensagem pelo mailer configurado
+func enviarEmail(mensagem MensagemEmail) error {
+	return mailerConfigurado().Enviar(mensagem)
+}
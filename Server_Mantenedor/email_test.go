@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Mensagem recebida pelo servidor SMTP de captura
+type mensagemCapturada struct {
+	De    string
+	Para  []string
+	Dados string
+}
+
+// Servidor SMTP mínimo, sem TLS nem autenticação, que guarda a primeira mensagem recebida
+func smtpCaptura(t *testing.T) (string, int, <-chan mensagemCapturada) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	capturadas := make(chan mensagemCapturada, 1)
+	go func() {
+		conexao, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conexao.Close()
+		texto := textproto.NewConn(conexao)
+		var mensagem mensagemCapturada
+
+		texto.PrintfLine("220 captura ESMTP")
+		for {
+			linha, err := texto.ReadLine()
+			if err != nil {
+				return
+			}
+			comando := strings.ToUpper(linha)
+			switch {
+			case strings.HasPrefix(comando, "EHLO"), strings.HasPrefix(comando, "HELO"):
+				texto.PrintfLine("250 captura")
+			case strings.HasPrefix(comando, "MAIL FROM:"):
+				mensagem.De = strings.Trim(linha[len("MAIL FROM:"):], "<> ")
+				texto.PrintfLine("250 OK")
+			case strings.HasPrefix(comando, "RCPT TO:"):
+				mensagem.Para = append(mensagem.Para, strings.Trim(linha[len("RCPT TO:"):], "<> "))
+				texto.PrintfLine("250 OK")
+			case comando == "DATA":
+				texto.PrintfLine("354 fim com <CRLF>.<CRLF>")
+				dados, err := texto.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				mensagem.Dados = string(dados)
+				texto.PrintfLine("250 OK")
+			case comando == "QUIT":
+				texto.PrintfLine("221 tchau")
+				capturadas <- mensagem
+				return
+			default:
+				texto.PrintfLine("250 OK")
+			}
+		}
+	}()
+
+	host, porta, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	numero, _ := strconv.Atoi(porta)
+	return host, numero, capturadas
+}
+
+func TestMailerSMTPEnvia(t *testing.T) {
+	host, porta, capturadas := smtpCaptura(t)
+	mailer := mailerSMTP{cfg: ConfigSMTP{Host: host, Porta: porta, Remetente: "loja@coffeeshop.local"}}
+
+	mensagem := MensagemEmail{
+		Para:    []string{"ana@example.com", "bruno@example.com"},
+		Assunto: "Pedido 42 confirmado",
+		Corpo:   "Obrigado pela compra!\n",
+		Anexos:  []AnexoEmail{{Nome: "relatorio.csv", TipoConteudo: "text/csv", Conteudo: []byte("a;b\n1;2\n")}},
+	}
+	if err := mailer.Enviar(mensagem); err != nil {
+		t.Fatal(err)
+	}
+
+	recebida := <-capturadas
+	if recebida.De != "loja@coffeeshop.local" {
+		t.Errorf("remetente = %q", recebida.De)
+	}
+	if strings.Join(recebida.Para, ",") != "ana@example.com,bruno@example.com" {
+		t.Errorf("destinatários = %v", recebida.Para)
+	}
+	cabecalhos, err := textproto.NewReader(bufio.NewReader(strings.NewReader(recebida.Dados))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cabecalhos.Get("To") != "ana@example.com, bruno@example.com" {
+		t.Errorf("cabeçalho To = %q", cabecalhos.Get("To"))
+	}
+	if cabecalhos.Get("Subject") != "Pedido 42 confirmado" {
+		t.Errorf("cabeçalho Subject = %q", cabecalhos.Get("Subject"))
+	}
+	for _, trecho := range []string{"Obrigado pela compra!", `filename=relatorio.csv`, "YTtiCjE7Mgo="} {
+		if !strings.Contains(recebida.Dados, trecho) {
+			t.Errorf("mensagem sem %q:\n%s", trecho, recebida.Dados)
+		}
+	}
+}
+
+func TestMailerSMTPSemServidor(t *testing.T) {
+	mailer := mailerSMTP{cfg: ConfigSMTP{Porta: 587}}
+	if err := mailer.Enviar(MensagemEmail{Para: []string{"ana@example.com"}, Assunto: "Teste"}); err == nil {
+		t.Error("envio sem servidor SMTP configurado não falhou")
+	}
+}
+
+// O link de acompanhamento só funciona com a sessão da conta, então não vai para os pedidos de convidados
+func TestEmailPedidoPronto(t *testing.T) {
+	agora := time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC)
+	casos := []struct {
+		nome   string
+		pedido Pedido
+		link   bool
+	}{
+		{"pedido da conta", Pedido{Codigo: 7, ClienteEmail: "ana@example.com"}, true},
+		{"pedido de convidado", Pedido{Codigo: 7, EmailContato: "ana@example.com"}, false},
+	}
+	for _, caso := range casos {
+		mensagem, err := renderizarEmail(emailPedidoPronto(caso.pedido, Preparo{}, agora), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link := strings.Contains(mensagem.Corpo, "/pedido?codigo=7"); link != caso.link {
+			t.Errorf("%s: link de acompanhamento = %v, esperava %v\n%s", caso.nome, link, caso.link, mensagem.Corpo)
+		}
+		if !strings.Contains(mensagem.Corpo, "pronto para retirada") {
+			t.Errorf("%s: corpo sem o aviso:\n%s", caso.nome, mensagem.Corpo)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	textTemplate "text/template"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Situações de um email na fila
+const (
+	EmailPendente = "pendente"
+	EmailEnviado  = "enviado"
+	EmailFalhou   = "falhou"
+	// Campanha cujo destinatário cancelou a inscrição depois do enfileiramento
+	EmailDescartado = "descartado"
+)
+
+// Modelos em template/emails, cada um com os blocos "assunto" e "corpo"
+const (
+	ModeloPedidoConfirmado = "pedido_confirmado"
+	ModeloPedidoPronto     = "pedido_pronto"
+	ModeloRespostaTicket   = "resposta_ticket"
+	ModeloRedefinirSenha   = "redefinir_senha"
+	ModeloVerificarEmail   = "verificar_email"
+	ModeloEstoqueBaixo     = "estoque_baixo"
+	ModeloEscalonamentoSLA = "escalonamento_sla"
+)
+
+// Email na coleção "emails", enfileirado pelos dois servidores e enviado pelo Server_Mantenedor.
+// Os handlers só gravam o documento; a rotina da fila monta a mensagem e fala com o servidor de email.
+type EmailFila struct {
+	ID     string `firestore:"-"`
+	Modelo string
+	// Destinatários; vazio manda para a equipe de ConfigEmail.Equipe
+	Para   []string
+	Dados  map[string]interface{}
+	Status string
+	// Envios já tentados e quando tentar de novo após uma falha
+	Tentativas       int
+	ProximaTentativa time.Time
+	UltimoErro       string
+	CriadoEm         time.Time
+	EnviadoEm        time.Time
+}
+
+type EmailsPageData struct {
+	PageTitle string
+	Emails    []EmailFila
+}
+
+// Acorda a rotina da fila para enviar logo o que os handlers do Server_Mantenedor enfileiraram
+var acordarFila = make(chan struct{}, 1)
+
+func acordarFilaEmails() {
+	select {
+	case acordarFila <- struct{}{}:
+	default:
+	}
+}
+
+func novoEmail(modelo string, para []string, dados map[string]interface{}, agora time.Time) EmailFila {
+	return EmailFila{
+		Modelo:           modelo,
+		Para:             para,
+		Dados:            dados,
+		Status:           EmailPendente,
+		ProximaTentativa: agora,
+		CriadoEm:         agora,
+	}
+}
+
+func enfileirarEmail(firestoreClient *FirestoreClient, email EmailFila) error {
+	if _, _, err := firestoreClient.Client.Collection("emails").Add(firestoreClient.Ctx, email); err != nil {
+		return err
+	}
+	acordarFilaEmails()
+	return nil
+}
+
+// Monta a mensagem com o modelo do email; sem destinatários, o aviso vai para a equipe
+func renderizarEmail(email EmailFila, equipe []string) (MensagemEmail, error) {
+	para := email.Para
+	if len(para) == 0 {
+		para = equipe
+	}
+	if len(para) == 0 {
+		return MensagemEmail{}, errors.New("email without recipients")
+	}
+
+	// Os emails vão em texto puro, sem o escape de HTML
+	tmpl, err := textTemplate.ParseFiles(filepath.Join("template", "emails", email.Modelo+".txt"))
+	if err != nil {
+		return MensagemEmail{}, err
+	}
+	var assunto, corpo bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&assunto, "assunto", email.Dados); err != nil {
+		return MensagemEmail{}, err
+	}
+	if err := tmpl.ExecuteTemplate(&corpo, "corpo", email.Dados); err != nil {
+		return MensagemEmail{}, err
+	}
+	return MensagemEmail{
+		Para:    para,
+		Assunto: strings.TrimSpace(assunto.String()),
+		Corpo:   strings.TrimSpace(corpo.String()) + "\n",
+	}, nil
+}
+
+func (c ConfigEmail) tentativas() int {
+	if c.Tentativas <= 0 {
+		return 5
+	}
+	return c.Tentativas
+}
+
+// Espera antes da próxima tentativa, dobrando a cada falha
+func (c ConfigEmail) esperaTentativa(tentativas int) time.Duration {
+	intervalo := time.Duration(c.IntervaloTentativas) * time.Second
+	if intervalo <= 0 {
+		intervalo = time.Minute
+	}
+	for i := 1; i < tentativas; i++ {
+		intervalo *= 2
+	}
+	return intervalo
+}
+
+// Envia os emails pendentes cuja tentativa já venceu. A falha de um email não impede os demais;
+// esgotadas as tentativas, ele fica como "falhou" para reenvio manual.
+func processarFilaEmails(firestoreClient *FirestoreClient, mailer Mailer, cfg ConfigEmail, agora time.Time) (int, error) {
+	docs, err := firestoreClient.Client.Collection("emails").Where("Status", "==", EmailPendente).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+	enviados := 0
+	for _, doc := range docs {
+		var email EmailFila
+		if err := doc.DataTo(&email); err != nil {
+			log.Printf("Failed to parse queued email %s: %v", doc.Ref.ID, err)
+			continue
+		}
+		if email.ProximaTentativa.After(agora) {
+			continue
+		}
+
+		// A inscrição é conferida de novo no envio: quem cancelou depois da campanha não a recebe
+		if email.Modelo == ModeloNewsletterCampanha {
+			inscricao, err := buscarInscricao(firestoreClient, email.Para)
+			if err != nil {
+				log.Printf("Failed to fetch subscription for queued email %s: %v", doc.Ref.ID, err)
+				continue
+			}
+			if !campanhaLiberada(inscricao) {
+				if _, err := doc.Ref.Update(firestoreClient.Ctx, []firestore.Update{{Path: "Status", Value: EmailDescartado}}); err != nil {
+					log.Printf("Failed to update queued email %s: %v", doc.Ref.ID, err)
+				}
+				continue
+			}
+		}
+
+		mensagem, err := renderizarEmail(email, cfg.Equipe)
+		if err == nil {
+			err = mailer.Enviar(mensagem)
+		}
+		email.Tentativas++
+		atualizacao := []firestore.Update{{Path: "Tentativas", Value: email.Tentativas}}
+		switch {
+		case err == nil:
+			enviados++
+			atualizacao = append(atualizacao,
+				firestore.Update{Path: "Status", Value: EmailEnviado},
+				firestore.Update{Path: "EnviadoEm", Value: agora},
+				firestore.Update{Path: "UltimoErro", Value: ""})
+		case email.Tentativas >= cfg.tentativas():
+			log.Printf("Email %s (%s) failed for good after %d attempts: %v", doc.Ref.ID, email.Modelo, email.Tentativas, err)
+			atualizacao = append(atualizacao,
+				firestore.Update{Path: "Status", Value: EmailFalhou},
+				firestore.Update{Path: "UltimoErro", Value: err.Error()})
+		default:
+			log.Printf("Email %s (%s) failed (attempt %d/%d): %v", doc.Ref.ID, email.Modelo, email.Tentativas, cfg.tentativas(), err)
+			atualizacao = append(atualizacao,
+				firestore.Update{Path: "ProximaTentativa", Value: agora.Add(cfg.esperaTentativa(email.Tentativas))},
+				firestore.Update{Path: "UltimoErro", Value: err.Error()})
+		}
+		if _, err := doc.Ref.Update(firestoreClient.Ctx, atualizacao); err != nil {
+			log.Printf("Failed to update queued email %s: %v", doc.Ref.ID, err)
+		}
+	}
+	return enviados, nil
+}
+
+// Rotina em segundo plano que esvazia a fila periodicamente ou quando um handler enfileira um email
+func iniciarFilaEmails() {
+	ticker := time.NewTicker(config.intervaloFilaEmails())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-acordarFila:
+		}
+		firestoreClient, err := InitializeFirestore()
+		if err != nil {
+			log.Printf("Failed to connect to Firestore: %v", err)
+			continue
+		}
+		if _, err := processarFilaEmails(firestoreClient, mailerConfigurado(), config.Email, time.Now()); err != nil {
+			log.Printf("Failed to process email queue: %v", err)
+		}
+		firestoreClient.Client.Close()
+	}
+}
+
+// Destinatário dos avisos do pedido: o e-mail informado na compra ou o da conta
+func (p Pedido) emailAvisos() string {
+	if p.EmailContato != "" {
+		return p.EmailContato
+	}
+	return p.ClienteEmail
+}
+
+// Aviso ao cliente de que o pedido está pronto, gravado na transação que muda a situação do preparo
+func emailPedidoPronto(pedido Pedido, preparo Preparo, agora time.Time) EmailFila {
+	dados := map[string]interface{}{
+		"Codigo":  pedido.Codigo,
+		"Entrega": preparo.Entrega,
+		"Mesa":    preparo.Mesa,
+	}
+	// A página de acompanhamento pede a sessão da conta ou o token do pedido, que a loja não guarda;
+	// o link só vai para quem comprou com a conta
+	if pedido.ClienteEmail != "" {
+		dados["URLPedido"] = fmt.Sprintf("%s/pedido?codigo=%d", strings.TrimRight(config.URLLoja, "/"), pedido.Codigo)
+	}
+	return novoEmail(ModeloPedidoPronto, []string{pedido.emailAvisos()}, dados, agora)
+}
+
+// Resposta da equipe para quem abriu o ticket
+func emailRespostaTicket(ticket Ticket, agora time.Time) EmailFila {
+	return novoEmail(ModeloRespostaTicket, []string{ticket.EmailContato}, map[string]interface{}{
+		"Ticket":   ticket.ID,
+		"Titulo":   ticket.Titulo,
+		"Resposta": ticket.Resposta,
+	}, agora)
+}
+
+// Indica se a venda da quantidade leva o estoque ao mínimo; só a venda que cruza o limite avisa a equipe
+func (p Produto) atingeEstoqueMinimo(quantidade int) bool {
+	return p.ControlaEstoque && p.EstoqueMinimo > 0 && p.Estoque > p.EstoqueMinimo && p.Estoque-quantidade <= p.EstoqueMinimo
+}
+
+// Aviso de estoque baixo para a equipe configurada
+func emailEstoqueBaixo(produto Produto, restante int, agora time.Time) EmailFila {
+	return novoEmail(ModeloEstoqueBaixo, nil, map[string]interface{}{
+		"CodigoProd":    produto.ID,
+		"Produto":       produto.NomeProduto,
+		"Estoque":       restante,
+		"EstoqueMinimo": produto.EstoqueMinimo,
+	}, agora)
+}
+
+// Escalonamento de SLA para os endereços do papel notificado
+func emailEscalonamentoSLA(notificacao Notificacao) EmailFila {
+	return novoEmail(ModeloEscalonamentoSLA, config.Email.Papeis[notificacao.Papel], map[string]interface{}{
+		"Papel":    notificacao.Papel,
+		"Mensagem": notificacao.Mensagem,
+		"Ticket":   notificacao.TicketID,
+	}, notificacao.Data)
+}
+
+// Últimos emails da fila, com a situação de cada um
+func EmailsHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	docs, err := firestoreClient.Client.Collection("emails").OrderBy("CriadoEm", firestore.Desc).Limit(100).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		http.Error(w, "Failed to fetch emails", http.StatusInternalServerError)
+		return
+	}
+	var emails []EmailFila
+	for _, doc := range docs {
+		var email EmailFila
+		if err := doc.DataTo(&email); err != nil {
+			http.Error(w, "Failed to parse email data", http.StatusInternalServerError)
+			return
+		}
+		email.ID = doc.Ref.ID
+		email.CriadoEm = email.CriadoEm.In(fusoLoja())
+		email.EnviadoEm = email.EnviadoEm.In(fusoLoja())
+		emails = append(emails, email)
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/emails.html"))
+	if err := tmpl.Execute(w, EmailsPageData{PageTitle: "Coffee Shop - Emails", Emails: emails}); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+// Devolve à fila um email que esgotou as tentativas, com a contagem zerada
+func ReenviarEmailHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	ref := firestoreClient.Client.Collection("emails").Doc(mux.Vars(r)["id"])
+	_, err = ref.Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch email", http.StatusInternalServerError)
+		return
+	}
+	_, err = ref.Update(firestoreClient.Ctx, []firestore.Update{
+		{Path: "Status", Value: EmailPendente},
+		{Path: "Tentativas", Value: 0},
+		{Path: "ProximaTentativa", Value: time.Now()},
+	})
+	if err != nil {
+		http.Error(w, "Failed to requeue email", http.StatusInternalServerError)
+		return
+	}
+	acordarFilaEmails()
+	http.Redirect(w, r, "/emails", http.StatusSeeOther)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Documento em "configuracoes" com as zonas de entrega, lidas também pelo Server_Usuario
+const documentoRegrasEntrega = "entrega"
+
+// Código de produto da linha da taxa de entrega nas transações; não existe no catálogo
+const CodigoTaxaEntrega = -1
+
+// Situações de uma entrega
+const (
+	EntregaPendente   = "pendente"
+	EntregaDespachada = "despachada"
+	EntregaEntregue   = "entregue"
+	EntregaCancelada  = "cancelada"
+)
+
+// Situações que ainda aparecem na lista de entregas
+var statusEntregasAbertas = []string{EntregaPendente, EntregaDespachada}
+
+// Próxima situação de cada uma; o cancelamento só acontece pelo estorno do pedido
+var proximoStatusEntrega = map[string]string{
+	EntregaPendente:   EntregaDespachada,
+	EntregaDespachada: EntregaEntregue,
+}
+
+var ErrTransicaoEntrega = errors.New("invalid delivery status change")
+
+// Faixa de CEPs atendida. Os CEPs ficam só com os 8 dígitos, para que a busca do Server_Usuario
+// compare texto sem consultar nenhum serviço externo.
+type ZonaEntrega struct {
+	Nome         string
+	CEPInicial   string
+	CEPFinal     string
+	Taxa         float64
+	PedidoMinimo float64
+}
+
+type RegrasEntrega struct {
+	Ativo bool
+	Zonas []ZonaEntrega
+}
+
+// Endereço informado pelo cliente no carrinho
+type EnderecoEntrega struct {
+	Destinatario string
+	Telefone     string
+	CEP          string
+	Logradouro   string
+	Numero       string
+	Complemento  string
+	Bairro       string
+	Cidade       string
+}
+
+// Entrega de um pedido, na coleção "entregas" com o código do pedido como ID do documento.
+// Criada pelo Server_Usuario ao finalizar a compra; a taxa é uma linha do próprio pedido.
+type Entrega struct {
+	Codigo       int
+	ClienteEmail string
+	Endereco     EnderecoEntrega
+	Zona         string
+	Taxa         float64
+	Status       string
+	CriadaEm     time.Time
+	DespachadaEm time.Time
+	EntregueEm   time.Time
+	// Quem despachou ou confirmou a entrega por último
+	Usuario string
+}
+
+type EntregasPageData struct {
+	PageTitle string
+	Regras    RegrasEntrega
+	Entregas  []Entrega
+}
+
+func (e EnderecoEntrega) CEPFormatado() string {
+	if len(e.CEP) != 8 {
+		return e.CEP
+	}
+	return e.CEP[:5] + "-" + e.CEP[5:]
+}
+
+// Só os dígitos do CEP, que precisa ter 8
+func normalizarCEP(cep string) (string, error) {
+	digitos := strings.NewReplacer("-", "", ".", "", " ", "").Replace(cep)
+	if len(digitos) != 8 {
+		return "", fmt.Errorf("invalid CEP %q", cep)
+	}
+	for _, c := range digitos {
+		if c < '0' || c > '9' {
+			return "", fmt.Errorf("invalid CEP %q", cep)
+		}
+	}
+	return digitos, nil
+}
+
+func (z ZonaEntrega) CEPInicialFormatado() string {
+	return EnderecoEntrega{CEP: z.CEPInicial}.CEPFormatado()
+}
+
+func (z ZonaEntrega) CEPFinalFormatado() string {
+	return EnderecoEntrega{CEP: z.CEPFinal}.CEPFormatado()
+}
+
+func (z ZonaEntrega) sobrepoe(outra ZonaEntrega) bool {
+	return z.CEPInicial <= outra.CEPFinal && outra.CEPInicial <= z.CEPFinal
+}
+
+func buscarRegrasEntrega(firestoreClient *FirestoreClient) (RegrasEntrega, error) {
+	var regras RegrasEntrega
+	snapshot, err := firestoreClient.Client.Collection("configuracoes").Doc(documentoRegrasEntrega).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return regras, nil
+	}
+	if err != nil {
+		return regras, err
+	}
+	err = snapshot.DataTo(&regras)
+	return regras, err
+}
+
+// Lê, altera e grava as zonas numa transação, para que duas edições simultâneas não se percam
+func atualizarRegrasEntrega(firestoreClient *FirestoreClient, alterar func(*RegrasEntrega) error) error {
+	ref := firestoreClient.Client.Collection("configuracoes").Doc(documentoRegrasEntrega)
+	return firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var regras RegrasEntrega
+		snapshot, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if snapshot.Exists() {
+			if err := snapshot.DataTo(&regras); err != nil {
+				return err
+			}
+		}
+		if err := alterar(&regras); err != nil {
+			return err
+		}
+		return tx.Set(ref, regras)
+	})
+}
+
+// Entrega do pedido, ou nil se ele foi para retirada
+func buscarEntrega(firestoreClient *FirestoreClient, codigo int) (*Entrega, error) {
+	snapshot, err := firestoreClient.Client.Collection("entregas").Doc(strconv.Itoa(codigo)).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entrega Entrega
+	if err := snapshot.DataTo(&entrega); err != nil {
+		return nil, err
+	}
+	return &entrega, nil
+}
+
+// Avança a entrega para a situação informada, que precisa ser a seguinte à atual
+func avancarEntrega(firestoreClient *FirestoreClient, codigo int, status, usuario string) error {
+	ref := firestoreClient.Client.Collection("entregas").Doc(strconv.Itoa(codigo))
+	return firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var entrega Entrega
+		if err := snapshot.DataTo(&entrega); err != nil {
+			return err
+		}
+		if proximoStatusEntrega[entrega.Status] != status {
+			return ErrTransicaoEntrega
+		}
+		campoData := "DespachadaEm"
+		if status == EntregaEntregue {
+			campoData = "EntregueEm"
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "Status", Value: status},
+			{Path: campoData, Value: time.Now()},
+			{Path: "Usuario", Value: usuario},
+		})
+	})
+}
+
+// Zonas de entrega e os pedidos que ainda não foram entregues
+func EntregasHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	regras, err := buscarRegrasEntrega(firestoreClient)
+	if err != nil {
+		log.Printf("Failed to fetch delivery zones: %v", err)
+		http.Error(w, "Failed to fetch delivery zones", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(regras.Zonas, func(i, j int) bool { return regras.Zonas[i].CEPInicial < regras.Zonas[j].CEPInicial })
+
+	docs, err := firestoreClient.Client.Collection("entregas").Where("Status", "in", statusEntregasAbertas).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		log.Printf("Failed to list deliveries: %v", err)
+		http.Error(w, "Failed to fetch deliveries", http.StatusInternalServerError)
+		return
+	}
+	var entregas []Entrega
+	for _, doc := range docs {
+		var entrega Entrega
+		if err := doc.DataTo(&entrega); err != nil {
+			http.Error(w, "Failed to parse delivery data", http.StatusInternalServerError)
+			return
+		}
+		entrega.CriadaEm = entrega.CriadaEm.In(fusoLoja())
+		entrega.DespachadaEm = entrega.DespachadaEm.In(fusoLoja())
+		entregas = append(entregas, entrega)
+	}
+	sort.Slice(entregas, func(i, j int) bool { return entregas[i].CriadaEm.Before(entregas[j].CriadaEm) })
+
+	tmpl := template.Must(template.ParseFiles("template/entregas.html"))
+	data := EntregasPageData{
+		PageTitle: "Coffee Shop - Entregas",
+		Regras:    regras,
+		Entregas:  entregas,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+func SalvarRegrasEntregaHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	err = atualizarRegrasEntrega(firestoreClient, func(regras *RegrasEntrega) error {
+		regras.Ativo = r.FormValue("ativo") == "1"
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to save delivery rules: %v", err)
+		http.Error(w, "Failed to save delivery rules", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/entregas", http.StatusSeeOther)
+}
+
+// Cria ou substitui a zona com o nome informado; as faixas de CEP não podem se sobrepor
+func SalvarZonaEntregaHandler(w http.ResponseWriter, r *http.Request) {
+	zona := ZonaEntrega{Nome: strings.TrimSpace(r.FormValue("nome"))}
+	if zona.Nome == "" {
+		http.Error(w, "A zone name is required", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if zona.CEPInicial, err = normalizarCEP(r.FormValue("cepInicial")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if zona.CEPFinal, err = normalizarCEP(r.FormValue("cepFinal")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if zona.CEPFinal < zona.CEPInicial {
+		http.Error(w, "The CEP range ends before it starts", http.StatusBadRequest)
+		return
+	}
+	if zona.Taxa, err = strconv.ParseFloat(r.FormValue("taxa"), 64); err != nil || zona.Taxa < 0 {
+		http.Error(w, "Invalid delivery fee", http.StatusBadRequest)
+		return
+	}
+	if zona.PedidoMinimo, err = strconv.ParseFloat("0"+r.FormValue("pedidoMinimo"), 64); err != nil || zona.PedidoMinimo < 0 {
+		http.Error(w, "Invalid minimum order", http.StatusBadRequest)
+		return
+	}
+	zona.Taxa = arredondarCentavos(zona.Taxa)
+	zona.PedidoMinimo = arredondarCentavos(zona.PedidoMinimo)
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	var sobreposta string
+	err = atualizarRegrasEntrega(firestoreClient, func(regras *RegrasEntrega) error {
+		var zonas []ZonaEntrega
+		for _, existente := range regras.Zonas {
+			if existente.Nome == zona.Nome {
+				continue
+			}
+			if existente.sobrepoe(zona) {
+				sobreposta = existente.Nome
+				return errors.New("overlapping delivery zone")
+			}
+			zonas = append(zonas, existente)
+		}
+		regras.Zonas = append(zonas, zona)
+		return nil
+	})
+	if sobreposta != "" {
+		http.Error(w, fmt.Sprintf("The CEP range overlaps zone %s", sobreposta), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save delivery zone: %v", err)
+		http.Error(w, "Failed to save delivery zone", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/entregas", http.StatusSeeOther)
+}
+
+func ExcluirZonaEntregaHandler(w http.ResponseWriter, r *http.Request) {
+	nome := mux.Vars(r)["nome"]
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	err = atualizarRegrasEntrega(firestoreClient, func(regras *RegrasEntrega) error {
+		for i, zona := range regras.Zonas {
+			if zona.Nome == nome {
+				regras.Zonas = append(regras.Zonas[:i], regras.Zonas[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to delete delivery zone: %v", err)
+		http.Error(w, "Failed to delete delivery zone", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/entregas", http.StatusSeeOther)
+}
+
+// Marca a entrega como despachada ou entregue
+func AvancarEntregaHandler(w http.ResponseWriter, r *http.Request) {
+	codigo, _ := strconv.Atoi(mux.Vars(r)["codigo"])
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	err = avancarEntrega(firestoreClient, codigo, r.FormValue("status"), usuarioRequisicao(r))
+	if err == ErrTransicaoEntrega {
+		http.Error(w, "Delivery status has already changed", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to update delivery %d status: %v", codigo, err)
+		http.Error(w, "Failed to update delivery status", http.StatusInternalServerError)
+		return
+	}
+	destino := "/entregas"
+	if r.FormValue("voltar") == "pedido" {
+		destino = fmt.Sprintf("/pedidos/%d", codigo)
+	}
+	http.Redirect(w, r, destino, http.StatusSeeOther)
+}
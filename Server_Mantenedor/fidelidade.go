@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Tipos de lançamento no extrato de pontos
+const (
+	PontosGanho          = "ganho"
+	PontosResgate        = "resgate"
+	PontosEstornoGanho   = "estorno_ganho"
+	PontosEstornoResgate = "estorno_resgate"
+)
+
+// Documento em "configuracoes" com as regras do programa, lidas também pelo Server_Usuario
+const documentoRegrasFidelidade = "fidelidade"
+
+// Regras do programa de fidelidade
+type RegrasFidelidade struct {
+	Ativo bool
+	// Pontos ganhos por real pago nos pedidos da loja
+	PontosPorReal float64
+	// Desconto, em reais, de cada ponto resgatado no carrinho
+	ValorPonto float64
+	// Menor quantidade de pontos aceita num resgate como desconto
+	ResgateMinimo int
+	Recompensas   []RecompensaFidelidade
+}
+
+// Produto trocado por pontos no carrinho
+type RecompensaFidelidade struct {
+	CodigoProd int
+	NomeProd   string
+	Pontos     int
+}
+
+// Lançamento do extrato de pontos, na coleção "pontos". O saldo do cliente é a soma dos lançamentos;
+// o campo SaldoPontos do cliente é só uma cópia mantida na mesma transação de cada lançamento.
+type LancamentoPontos struct {
+	ClienteEmail    string
+	Tipo            string
+	Pontos          int
+	CodigoTransacao int
+	Descricao       string
+	Data            time.Time
+}
+
+// Saldo de um cliente no relatório de passivo
+type SaldoPontosCliente struct {
+	ClienteEmail string
+	Pontos       int
+	Valor        float64
+}
+
+// Pontos em circulação e seu valor em descontos ainda não resgatados
+type PassivoPontos struct {
+	Clientes []SaldoPontosCliente
+	Pontos   int
+	Valor    float64
+	// Totais lançados por tipo desde o início do programa
+	PorTipo map[string]int
+}
+
+type FidelidadePageData struct {
+	PageTitle string
+	Regras    RegrasFidelidade
+	Passivo   PassivoPontos
+	Produtos  []Produto
+}
+
+func regrasFidelidadePadrao() RegrasFidelidade {
+	return RegrasFidelidade{PontosPorReal: 1, ValorPonto: 0.05, ResgateMinimo: 100}
+}
+
+func buscarRegrasFidelidade(firestoreClient *FirestoreClient) (RegrasFidelidade, error) {
+	regras := regrasFidelidadePadrao()
+	snapshot, err := firestoreClient.Client.Collection("configuracoes").Doc(documentoRegrasFidelidade).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return regras, nil
+	}
+	if err != nil {
+		return regras, err
+	}
+	err = snapshot.DataTo(&regras)
+	return regras, err
+}
+
+// Valor cheio, antes dos descontos, dos produtos do pedido que dão pontos, e quanto dele já foi estornado
+// contando os estornos novos. A taxa de entrega e os vales-presente ficam de fora, como no ganho de pontos.
+func (p Pedido) valorPontuavel(estornos []Transacao, valesPresente map[int]bool) (vendido, estornado float64) {
+	pontua := func(codigoProd int) bool {
+		return codigoProd != CodigoTaxaEntrega && !valesPresente[codigoProd]
+	}
+	for _, item := range p.Itens {
+		if pontua(item.CodigoProd) {
+			vendido += item.ValorUnitario * float64(item.Vendido)
+			estornado += item.ValorUnitario * float64(item.Estornado)
+		}
+	}
+	for _, e := range estornos {
+		if pontua(e.CodigoProd) {
+			estornado -= e.ValorUnitario * float64(e.QuantidadeProd)
+		}
+	}
+	return vendido, estornado
+}
+
+// Lançamentos que desfazem, na proporção dos produtos já estornados do pedido, os pontos ganhos e resgatados nele.
+// A proporção usa o valor cheio dos produtos, para valer também nos pedidos pagos só com pontos, e o alvo é
+// recalculado a cada estorno, então estornos parciais sucessivos não acumulam arredondamentos e o cancelamento
+// desfaz exatamente o que foi lançado.
+func reverterPontos(pedido Pedido, estornos []Transacao, lancamentos []LancamentoPontos, valesPresente map[int]bool, agora time.Time) []LancamentoPontos {
+	if pedido.ClienteEmail == "" {
+		return nil
+	}
+
+	var ganho, resgatado, ganhoRevertido, resgateDevolvido int
+	for _, l := range lancamentos {
+		if l.ClienteEmail != pedido.ClienteEmail {
+			continue
+		}
+		switch l.Tipo {
+		case PontosGanho:
+			ganho += l.Pontos
+		case PontosResgate:
+			resgatado -= l.Pontos
+		case PontosEstornoGanho:
+			ganhoRevertido -= l.Pontos
+		case PontosEstornoResgate:
+			resgateDevolvido += l.Pontos
+		}
+	}
+
+	fracao := 0.0
+	if vendido, estornado := pedido.valorPontuavel(estornos, valesPresente); vendido > 0 {
+		fracao = math.Min(estornado/vendido, 1)
+	}
+	if pedido.canceladoCom(estornos) {
+		fracao = 1
+	}
+
+	var reversoes []LancamentoPontos
+	if delta := int(math.Round(float64(ganho)*fracao)) - ganhoRevertido; delta > 0 {
+		reversoes = append(reversoes, LancamentoPontos{
+			ClienteEmail:    pedido.ClienteEmail,
+			Tipo:            PontosEstornoGanho,
+			Pontos:          -delta,
+			CodigoTransacao: pedido.Codigo,
+			Descricao:       "Estorno do pedido " + strconv.Itoa(pedido.Codigo),
+			Data:            agora,
+		})
+	}
+	if delta := int(math.Round(float64(resgatado)*fracao)) - resgateDevolvido; delta > 0 {
+		reversoes = append(reversoes, LancamentoPontos{
+			ClienteEmail:    pedido.ClienteEmail,
+			Tipo:            PontosEstornoResgate,
+			Pontos:          delta,
+			CodigoTransacao: pedido.Codigo,
+			Descricao:       "Pontos devolvidos pelo estorno do pedido " + strconv.Itoa(pedido.Codigo),
+			Data:            agora,
+		})
+	}
+	return reversoes
+}
+
+func calcularPassivoPontos(lancamentos []LancamentoPontos, regras RegrasFidelidade) PassivoPontos {
+	passivo := PassivoPontos{PorTipo: make(map[string]int)}
+	saldos := make(map[string]int)
+	for _, l := range lancamentos {
+		saldos[l.ClienteEmail] += l.Pontos
+		passivo.PorTipo[l.Tipo] += l.Pontos
+	}
+	for email, pontos := range saldos {
+		if pontos == 0 {
+			continue
+		}
+		passivo.Clientes = append(passivo.Clientes, SaldoPontosCliente{
+			ClienteEmail: email,
+			Pontos:       pontos,
+			Valor:        arredondarCentavos(float64(pontos) * regras.ValorPonto),
+		})
+		passivo.Pontos += pontos
+	}
+	passivo.Valor = arredondarCentavos(float64(passivo.Pontos) * regras.ValorPonto)
+	sort.Slice(passivo.Clientes, func(i, j int) bool { return passivo.Clientes[i].Pontos > passivo.Clientes[j].Pontos })
+	return passivo
+}
+
+func FidelidadeHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	regras, err := buscarRegrasFidelidade(firestoreClient)
+	if err != nil {
+		log.Printf("Failed to fetch loyalty rules: %v", err)
+		http.Error(w, "Failed to fetch loyalty rules", http.StatusInternalServerError)
+		return
+	}
+
+	docs, err := firestoreClient.Client.Collection("pontos").Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		log.Printf("Failed to list points ledger: %v", err)
+		http.Error(w, "Failed to fetch points ledger", http.StatusInternalServerError)
+		return
+	}
+	var lancamentos []LancamentoPontos
+	for _, doc := range docs {
+		var l LancamentoPontos
+		if err := doc.DataTo(&l); err != nil {
+			http.Error(w, "Failed to parse points data", http.StatusInternalServerError)
+			return
+		}
+		lancamentos = append(lancamentos, l)
+	}
+
+	docs, err = firestoreClient.Client.Collection("produtos").Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+		return
+	}
+	var produtos []Produto
+	for _, doc := range docs {
+		var produto Produto
+		if err := doc.DataTo(&produto); err != nil {
+			http.Error(w, "Failed to parse product data", http.StatusInternalServerError)
+			return
+		}
+		produtos = append(produtos, produto)
+	}
+	sort.Slice(produtos, func(i, j int) bool { return produtos[i].ID < produtos[j].ID })
+
+	tmpl := template.Must(template.ParseFiles("template/fidelidade.html"))
+	data := FidelidadePageData{
+		PageTitle: "Coffee Shop - Programa de Fidelidade",
+		Regras:    regras,
+		Passivo:   calcularPassivoPontos(lancamentos, regras),
+		Produtos:  produtos,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+// Altera as regras guardadas numa transação, preservando os campos que o formulário não edita
+func atualizarRegrasFidelidade(firestoreClient *FirestoreClient, alterar func(*RegrasFidelidade) error) error {
+	ref := firestoreClient.Client.Collection("configuracoes").Doc(documentoRegrasFidelidade)
+	return firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		regras := regrasFidelidadePadrao()
+		snapshot, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if snapshot.Exists() {
+			if err := snapshot.DataTo(&regras); err != nil {
+				return err
+			}
+		}
+		if err := alterar(&regras); err != nil {
+			return err
+		}
+		return tx.Set(ref, regras)
+	})
+}
+
+func SalvarRegrasFidelidadeHandler(w http.ResponseWriter, r *http.Request) {
+	pontosPorReal, err := strconv.ParseFloat(r.FormValue("pontosPorReal"), 64)
+	if err != nil || pontosPorReal < 0 {
+		http.Error(w, "Invalid points per real", http.StatusBadRequest)
+		return
+	}
+	valorPonto, err := lerValorMonetario(r, "valorPonto")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resgateMinimo, err := strconv.Atoi(r.FormValue("resgateMinimo"))
+	if err != nil || resgateMinimo < 0 {
+		http.Error(w, "Invalid minimum redemption", http.StatusBadRequest)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	err = atualizarRegrasFidelidade(firestoreClient, func(regras *RegrasFidelidade) error {
+		regras.Ativo = r.FormValue("ativo") == "1"
+		regras.PontosPorReal = pontosPorReal
+		regras.ValorPonto = valorPonto
+		regras.ResgateMinimo = resgateMinimo
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to save loyalty rules: %v", err)
+		http.Error(w, "Failed to save loyalty rules", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/fidelidade", http.StatusSeeOther)
+}
+
+// Cadastra ou atualiza a recompensa de um produto
+func SalvarRecompensaHandler(w http.ResponseWriter, r *http.Request) {
+	codigoProd, err := strconv.Atoi(r.FormValue("produto"))
+	if err != nil {
+		http.Error(w, "Invalid product", http.StatusBadRequest)
+		return
+	}
+	pontos, err := strconv.Atoi(r.FormValue("pontos"))
+	if err != nil || pontos <= 0 {
+		http.Error(w, "Invalid points", http.StatusBadRequest)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	snapshot, err := firestoreClient.Client.Collection("produtos").Doc(strconv.Itoa(codigoProd)).Get(firestoreClient.Ctx)
+	if err != nil {
+		http.Error(w, "Product not found", http.StatusBadRequest)
+		return
+	}
+	var produto Produto
+	if err := snapshot.DataTo(&produto); err != nil {
+		http.Error(w, "Failed to parse product data", http.StatusInternalServerError)
+		return
+	}
+
+	err = atualizarRegrasFidelidade(firestoreClient, func(regras *RegrasFidelidade) error {
+		recompensa := RecompensaFidelidade{CodigoProd: codigoProd, NomeProd: produto.NomeProduto, Pontos: pontos}
+		for i := range regras.Recompensas {
+			if regras.Recompensas[i].CodigoProd == codigoProd {
+				regras.Recompensas[i] = recompensa
+				return nil
+			}
+		}
+		regras.Recompensas = append(regras.Recompensas, recompensa)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to save reward: %v", err)
+		http.Error(w, "Failed to save reward", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/fidelidade", http.StatusSeeOther)
+}
+
+func ExcluirRecompensaHandler(w http.ResponseWriter, r *http.Request) {
+	codigoProd, _ := strconv.Atoi(mux.Vars(r)["produto"])
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	err = atualizarRegrasFidelidade(firestoreClient, func(regras *RegrasFidelidade) error {
+		for i, recompensa := range regras.Recompensas {
+			if recompensa.CodigoProd == codigoProd {
+				regras.Recompensas = append(regras.Recompensas[:i], regras.Recompensas[i+1:]...)
+				return nil
+			}
+		}
+		return errors.New("reward not found")
+	})
+	if err != nil {
+		log.Printf("Failed to delete reward: %v", err)
+		http.Error(w, "Failed to delete reward", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/fidelidade", http.StatusSeeOther)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReverterPontos(t *testing.T) {
+	venda := time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC)
+	agora := venda.Add(time.Hour)
+	linha := func(codigoProd, quantidade int, unitario, pago float64) Transacao {
+		return Transacao{CodigoTransacao: 7, CodigoProd: codigoProd, NomeProd: "Produto", QuantidadeProd: quantidade, ValorUnitario: unitario,
+			ValorTransacao: pago, Desconto: unitario*float64(quantidade) - pago, MetodoPagamento: "card", DataTransacao: venda,
+			Tipo: TransacaoVenda, ClienteEmail: "ana@example.com"}
+	}
+	lancamento := func(tipo string, pontos int) LancamentoPontos {
+		return LancamentoPontos{ClienteEmail: "ana@example.com", Tipo: tipo, Pontos: pontos, CodigoTransacao: 7}
+	}
+
+	casos := []struct {
+		nome          string
+		transacoes    []Transacao
+		lancamentos   []LancamentoPontos
+		valesPresente map[int]bool
+		estornar      []ItemEstorno
+		ganho         int
+		resgate       int
+	}{
+		{
+			nome:        "pedido pago só com pontos cancelado",
+			transacoes:  []Transacao{linha(1, 3, 6, 0)},
+			lancamentos: []LancamentoPontos{lancamento(PontosResgate, -180)},
+			estornar:    []ItemEstorno{{CodigoProd: 1, Quantidade: 3}},
+			resgate:     180,
+		},
+		{
+			nome:        "pedido pago só com pontos com estorno parcial",
+			transacoes:  []Transacao{linha(1, 3, 6, 0)},
+			lancamentos: []LancamentoPontos{lancamento(PontosResgate, -180)},
+			estornar:    []ItemEstorno{{CodigoProd: 1, Quantidade: 1}},
+			resgate:     60,
+		},
+		{
+			nome:        "estorno parcial",
+			transacoes:  []Transacao{linha(1, 3, 6, 14), linha(2, 1, 5, 5)},
+			lancamentos: []LancamentoPontos{lancamento(PontosGanho, 19), lancamento(PontosResgate, -40)},
+			estornar:    []ItemEstorno{{CodigoProd: 2, Quantidade: 1}},
+			ganho:       4,
+			resgate:     9,
+		},
+		{
+			nome:        "estorno parcial depois de outro já revertido",
+			transacoes:  []Transacao{linha(1, 3, 6, 18), linha(1, -1, 6, -6)},
+			lancamentos: []LancamentoPontos{lancamento(PontosGanho, 18), lancamento(PontosEstornoGanho, -6)},
+			estornar:    []ItemEstorno{{CodigoProd: 1, Quantidade: 1}},
+			ganho:       6,
+		},
+		{
+			nome:        "taxa de entrega não conta na proporção",
+			transacoes:  []Transacao{linha(1, 2, 6, 12), linha(CodigoTaxaEntrega, 1, 8, 8)},
+			lancamentos: []LancamentoPontos{lancamento(PontosGanho, 12)},
+			estornar:    []ItemEstorno{{CodigoProd: 1, Quantidade: 2}},
+			ganho:       12,
+		},
+		{
+			nome:        "só a taxa de entrega estornada",
+			transacoes:  []Transacao{linha(1, 2, 6, 12), linha(CodigoTaxaEntrega, 1, 8, 8)},
+			lancamentos: []LancamentoPontos{lancamento(PontosGanho, 12)},
+			estornar:    []ItemEstorno{{CodigoProd: CodigoTaxaEntrega, Quantidade: 1}},
+		},
+		{
+			nome:          "vale-presente não conta na proporção",
+			transacoes:    []Transacao{linha(1, 2, 6, 12), linha(9, 1, 50, 50)},
+			lancamentos:   []LancamentoPontos{lancamento(PontosGanho, 12)},
+			valesPresente: map[int]bool{9: true},
+			estornar:      []ItemEstorno{{CodigoProd: 1, Quantidade: 2}},
+			ganho:         12,
+		},
+	}
+
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			for i := range caso.transacoes {
+				if caso.transacoes[i].QuantidadeProd < 0 {
+					caso.transacoes[i].Tipo = TransacaoEstorno
+				}
+			}
+			pedido, err := montarPedido(7, caso.transacoes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			estornos, err := pedido.estornar(caso.estornar, "", "card", "admin", agora)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ganho, resgate int
+			for _, l := range reverterPontos(pedido, estornos, caso.lancamentos, caso.valesPresente, agora) {
+				switch l.Tipo {
+				case PontosEstornoGanho:
+					ganho -= l.Pontos
+				case PontosEstornoResgate:
+					resgate += l.Pontos
+				default:
+					t.Errorf("lançamento inesperado: %+v", l)
+				}
+			}
+			if ganho != caso.ganho || resgate != caso.resgate {
+				t.Errorf("revertidos %d pontos ganhos e %d resgatados, esperava %d e %d", ganho, resgate, caso.ganho, caso.resgate)
+			}
+		})
+	}
+
+	// Pedido sem cliente identificado não tem pontos a reverter
+	pedido, _ := montarPedido(7, []Transacao{{CodigoTransacao: 7, CodigoProd: 1, QuantidadeProd: 1, ValorUnitario: 6, ValorTransacao: 6, DataTransacao: venda}})
+	estornos, _ := pedido.estornar([]ItemEstorno{{CodigoProd: 1, Quantidade: 1}}, "", "card", "admin", agora)
+	if reversoes := reverterPontos(pedido, estornos, nil, nil, agora); reversoes != nil {
+		t.Errorf("pedido sem cliente gerou %+v", reversoes)
+	}
+}
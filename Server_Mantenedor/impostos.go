@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Regime tributário do emitente (CRT)
+const (
+	CRTSimplesNacional = 1
+	CRTRegimeNormal    = 3
+)
+
+// CSOSN e CST do ICMS que a NFC-e da loja sabe declarar
+var (
+	csosnSuportados = map[string]bool{"102": true, "103": true, "300": true, "400": true, "500": true}
+	cstSuportados   = map[string]bool{"00": true, "40": true, "41": true, "60": true}
+)
+
+var (
+	padraoNCM  = regexp.MustCompile(`^[0-9]{8}$`)
+	padraoCFOP = regexp.MustCompile(`^5[0-9]{3}$`)
+)
+
+// Classificação e alíquotas de um produto, copiadas para a transação no momento da venda
+type DadosFiscais struct {
+	NCM            string
+	CFOP           string
+	CSOSN          string
+	CST            string
+	AliquotaICMS   float64
+	AliquotaPIS    float64
+	AliquotaCOFINS float64
+}
+
+// Tributos de uma linha vendida ou estornada; nos estornos os valores são negativos
+type ImpostosLinha struct {
+	NCM  string
+	CFOP string
+	// CSOSN no Simples Nacional, CST do ICMS no regime normal
+	CST            string
+	BaseCalculo    float64
+	AliquotaICMS   float64
+	ICMS           float64
+	AliquotaPIS    float64
+	PIS            float64
+	AliquotaCOFINS float64
+	COFINS         float64
+}
+
+func (i ImpostosLinha) Total() float64 {
+	return arredondarCentavos(i.ICMS + i.PIS + i.COFINS)
+}
+
+func (p Produto) dadosFiscais() DadosFiscais {
+	return DadosFiscais{
+		NCM: p.NCM, CFOP: p.CFOP, CSOSN: p.CSOSN, CST: p.CST,
+		AliquotaICMS: p.AliquotaICMS, AliquotaPIS: p.AliquotaPIS, AliquotaCOFINS: p.AliquotaCOFINS,
+	}
+}
+
+// Completa os códigos vazios com os padrões da configuração
+func (d DadosFiscais) comPadroes(cfg ConfigNFCe) DadosFiscais {
+	if d.NCM == "" {
+		d.NCM = cfg.NCMPadrao
+	}
+	if d.CFOP == "" {
+		d.CFOP = cfg.CFOPPadrao
+	}
+	if d.CSOSN == "" {
+		d.CSOSN = cfg.CSOSNPadrao
+	}
+	if d.CST == "" {
+		d.CST = cfg.CSTPadrao
+	}
+	return d
+}
+
+// Dados fiscais da linha: os gravados na venda ou, nas transações antigas e nos estornos, os atuais do produto
+func dadosFiscaisTransacao(t Transacao, produtos map[int]Produto, cfg ConfigNFCe) DadosFiscais {
+	if t.DadosFiscais != nil {
+		return t.DadosFiscais.comPadroes(cfg)
+	}
+	return produtos[t.CodigoProd].dadosFiscais().comPadroes(cfg)
+}
+
+// Tributos sobre o valor pago na linha, já com os descontos. No Simples Nacional o ICMS é recolhido
+// no DAS e não é destacado; no regime normal só o CST 00 tem ICMS destacado.
+func calcularImpostos(dados DadosFiscais, crt int, valor float64) ImpostosLinha {
+	linha := ImpostosLinha{
+		NCM:            dados.NCM,
+		CFOP:           dados.CFOP,
+		CST:            dados.CSOSN,
+		BaseCalculo:    arredondarCentavos(valor),
+		AliquotaPIS:    dados.AliquotaPIS,
+		PIS:            arredondarCentavos(valor * dados.AliquotaPIS / 100),
+		AliquotaCOFINS: dados.AliquotaCOFINS,
+		COFINS:         arredondarCentavos(valor * dados.AliquotaCOFINS / 100),
+	}
+	if crt != CRTSimplesNacional {
+		linha.CST = dados.CST
+		if dados.CST == "00" {
+			linha.AliquotaICMS = dados.AliquotaICMS
+			linha.ICMS = arredondarCentavos(valor * dados.AliquotaICMS / 100)
+		}
+	}
+	return linha
+}
+
+// Lê os dados fiscais do formulário de produto. O NCM aceita os pontos da forma impressa (0901.21.00);
+// códigos vazios ficam com os padrões da configuração.
+func lerDadosFiscais(r *http.Request) (DadosFiscais, error) {
+	dados := DadosFiscais{
+		NCM:   strings.ReplaceAll(strings.TrimSpace(r.FormValue("ncm")), ".", ""),
+		CFOP:  strings.TrimSpace(r.FormValue("cfop")),
+		CSOSN: strings.TrimSpace(r.FormValue("csosn")),
+		CST:   strings.TrimSpace(r.FormValue("cst")),
+	}
+	if dados.NCM != "" && !padraoNCM.MatchString(dados.NCM) {
+		return dados, errors.New("Invalid NCM: it must have 8 digits")
+	}
+	if dados.CFOP != "" && !padraoCFOP.MatchString(dados.CFOP) {
+		return dados, errors.New("Invalid CFOP: in-state consumer sales use a 5xxx code")
+	}
+	if dados.CSOSN != "" && !csosnSuportados[dados.CSOSN] {
+		return dados, errors.New("Unsupported CSOSN")
+	}
+	if dados.CST != "" && !cstSuportados[dados.CST] {
+		return dados, errors.New("Unsupported ICMS CST")
+	}
+
+	aliquotas := []struct {
+		campo   string
+		destino *float64
+	}{
+		{"aliquotaICMS", &dados.AliquotaICMS},
+		{"aliquotaPIS", &dados.AliquotaPIS},
+		{"aliquotaCOFINS", &dados.AliquotaCOFINS},
+	}
+	for _, a := range aliquotas {
+		texto := strings.TrimSpace(strings.Replace(r.FormValue(a.campo), ",", ".", 1))
+		if texto == "" {
+			continue
+		}
+		aliquota, err := strconv.ParseFloat(texto, 64)
+		if err != nil || aliquota < 0 || aliquota > 100 {
+			return dados, errors.New("Invalid tax rate for " + a.campo)
+		}
+		*a.destino = aliquota
+	}
+	return dados, nil
+}
+
+// Tributos do período agrupados por NCM, CFOP e CST
+type LinhaImpostoFluxo struct {
+	ImpostosLinha
+	Itens int
+}
+
+// Soma os tributos das linhas do período, vendas e estornos. A taxa de entrega e os vales-presente
+// vendidos ficam de fora, como na NFC-e.
+func resumirImpostos(transacoes []Transacao, produtos map[int]Produto, cfg ConfigNFCe) ([]LinhaImpostoFluxo, ImpostosLinha) {
+	grupos := make(map[string]*LinhaImpostoFluxo)
+	var total ImpostosLinha
+	for _, t := range transacoes {
+		if t.CodigoProd == CodigoTaxaEntrega || produtos[t.CodigoProd].ValePresente {
+			continue
+		}
+		impostos := calcularImpostos(dadosFiscaisTransacao(t, produtos, cfg), cfg.Emitente.CRT, t.ValorTransacao)
+		chave := impostos.NCM + "|" + impostos.CFOP + "|" + impostos.CST
+		grupo, ok := grupos[chave]
+		if !ok {
+			grupo = &LinhaImpostoFluxo{ImpostosLinha: ImpostosLinha{NCM: impostos.NCM, CFOP: impostos.CFOP, CST: impostos.CST}}
+			grupos[chave] = grupo
+		}
+		grupo.Itens += t.QuantidadeProd
+		grupo.somar(impostos)
+		total.somar(impostos)
+	}
+
+	var linhas []LinhaImpostoFluxo
+	for _, grupo := range grupos {
+		linhas = append(linhas, *grupo)
+	}
+	sort.Slice(linhas, func(i, j int) bool {
+		if linhas[i].BaseCalculo != linhas[j].BaseCalculo {
+			return linhas[i].BaseCalculo > linhas[j].BaseCalculo
+		}
+		return linhas[i].NCM+linhas[i].CFOP+linhas[i].CST < linhas[j].NCM+linhas[j].CFOP+linhas[j].CST
+	})
+	return linhas, total
+}
+
+func (i *ImpostosLinha) somar(outro ImpostosLinha) {
+	i.BaseCalculo = arredondarCentavos(i.BaseCalculo + outro.BaseCalculo)
+	i.ICMS = arredondarCentavos(i.ICMS + outro.ICMS)
+	i.PIS = arredondarCentavos(i.PIS + outro.PIS)
+	i.COFINS = arredondarCentavos(i.COFINS + outro.COFINS)
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Tipos e situações das solicitações do titular dos dados (LGPD)
+const (
+	SolicitacaoExportacao = "exportacao"
+	SolicitacaoExclusao   = "exclusao"
+
+	SolicitacaoPendente  = "pendente"
+	SolicitacaoConcluida = "concluida"
+	SolicitacaoRecusada  = "recusada"
+)
+
+var ErrSolicitacaoNaoEncontrada = errors.New("data request not found")
+
+// Solicitação na coleção "solicitacoes_lgpd", feita pelo cliente no Server_Usuario ou registrada aqui
+// pela equipe quando chega por outro canal
+type SolicitacaoLGPD struct {
+	ID     string `firestore:"-"`
+	Email  string
+	Tipo   string
+	Status string
+	// "site" quando feita pelo cliente, "equipe" quando registrada no Server_Mantenedor
+	Origem      string
+	Observacao  string
+	CriadaEm    time.Time
+	ConcluidaEm time.Time
+	// O que foi apagado ou anonimizado, por coleção
+	Resumo string
+}
+
+type LGPDPageData struct {
+	PageTitle    string
+	Solicitacoes []SolicitacaoLGPD
+	Status       string
+	Mensagem     string
+	Erro         string
+}
+
+// Coleção com dados do titular e o campo que guarda o e-mail dele. A lista, os campos ocultos e o percurso
+// dos documentos são iguais no Server_Usuario e no Server_Mantenedor; TestLGPDIgualNosServidores confere.
+type colecaoTitular struct {
+	Colecao string
+	Campo   string
+}
+
+// Coleções que usam o próprio e-mail do titular como ID do documento
+var documentosPorEmail = []string{"clientes", "newsletter"}
+
+// As transações vêm antes das entregas, que dependem delas para saber quais pedidos são da conta
+var colecoesTitular = []colecaoTitular{
+	{"transacoes", "ClienteEmail"},
+	{"transacoes", "EmailContato"},
+	{"entregas", "ClienteEmail"},
+	{"assinaturas", "ClienteEmail"},
+	{"pontos", "ClienteEmail"},
+	{"carrinhos", "ClienteEmail"},
+	{"consentimentos", "Email"},
+	{"tickets", "EmailContato"},
+	{"solicitacoes_lgpd", "Email"},
+}
+
+// Campos que são credenciais, e não dados do titular, deixados de fora da exportação
+var camposOcultosTitular = map[string][]string{
+	"clientes":   {"SenhaHash"},
+	"newsletter": {"Token"},
+}
+
+// Percorre os documentos do titular no Firestore, sem os campos ocultos. O mesmo documento pode aparecer por
+// mais de um campo, como o pedido com ClienteEmail e EmailContato, e é visitado uma vez só.
+func documentosTitular(firestoreClient *FirestoreClient, email string, visitar func(colecao string, dados map[string]interface{})) error {
+	dadosDocumento := func(colecao string, snapshot *firestore.DocumentSnapshot) map[string]interface{} {
+		dados := snapshot.Data()
+		for _, campo := range camposOcultosTitular[colecao] {
+			delete(dados, campo)
+		}
+		return dados
+	}
+
+	for _, colecao := range documentosPorEmail {
+		snapshot, err := firestoreClient.Client.Collection(colecao).Doc(email).Get(firestoreClient.Ctx)
+		if status.Code(err) == codes.NotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		visitar(colecao, dadosDocumento(colecao, snapshot))
+	}
+
+	vistos := make(map[string]bool)
+	for _, c := range colecoesTitular {
+		docs, err := firestoreClient.Client.Collection(c.Colecao).Where(c.Campo, "==", email).Documents(firestoreClient.Ctx).GetAll()
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if !vistos[doc.Ref.Path] {
+				vistos[doc.Ref.Path] = true
+				visitar(c.Colecao, dadosDocumento(c.Colecao, doc))
+			}
+		}
+	}
+	return nil
+}
+
+// Reúne todos os documentos do titular, agrupados por coleção. Com os tickets no SQLite, eles vêm do repositório.
+func exportarDadosTitular(firestoreClient *FirestoreClient, repositorio TicketRepository, email string) (map[string]interface{}, error) {
+	dados := make(map[string][]map[string]interface{})
+	err := documentosTitular(firestoreClient, email, func(colecao string, documento map[string]interface{}) {
+		dados[colecao] = append(dados[colecao], documento)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exportacao := map[string]interface{}{
+		"Email":    email,
+		"GeradoEm": time.Now(),
+		"Dados":    dados,
+	}
+	if config.BancoTickets == "sqlite" {
+		tickets, err := ticketsTitular(repositorio, email)
+		if err != nil {
+			return nil, err
+		}
+		exportacao["Tickets"] = tickets
+	}
+	return exportacao, nil
+}
+
+func ticketsTitular(repositorio TicketRepository, email string) ([]Ticket, error) {
+	todos, err := repositorio.Todos()
+	if err != nil {
+		return nil, err
+	}
+	var tickets []Ticket
+	for _, t := range todos {
+		if strings.EqualFold(t.EmailContato, email) {
+			tickets = append(tickets, t)
+		}
+	}
+	return tickets, nil
+}
+
+// Escrita da anonimização: apaga o documento ou troca os campos pessoais
+type escritaAnonimizacao struct {
+	ref    *firestore.DocumentRef
+	apagar bool
+	campos []firestore.Update
+}
+
+// Coleções que guardam só credenciais da conta, apagadas junto com ela mas fora da exportação
+var colecoesCredenciais = []colecaoTitular{
+	{"sessoes", "Email"},
+	{"redefinicoes_senha", "Email"},
+	{"verificacoes_email", "Email"},
+}
+
+// O que a anonimização faz com os documentos da coleção: apagar, trocar campos ou, com a escrita vazia, manter.
+// Devolve falso para uma coleção sem regra; o teste confere que toda coleção de colecoesTitular tem uma.
+func anonimizacaoColecao(colecao, pseudonimo string) (escritaAnonimizacao, bool) {
+	switch colecao {
+	// O carrinho guarda o endereço de entrega informado
+	case "clientes", "newsletter", "sessoes", "redefinicoes_senha", "verificacoes_email", "pontos", "emails", "carrinhos":
+		return escritaAnonimizacao{apagar: true}, true
+	case "transacoes":
+		return escritaAnonimizacao{campos: []firestore.Update{
+			{Path: "ClienteEmail", Value: ""},
+			{Path: "EmailContato", Value: ""},
+		}}, true
+	case "entregas":
+		// Ficam a zona, a taxa, o bairro e a cidade, usados nos relatórios de entrega
+		return escritaAnonimizacao{campos: []firestore.Update{
+			{Path: "ClienteEmail", Value: ""},
+			{Path: "Endereco.Destinatario", Value: ""},
+			{Path: "Endereco.Telefone", Value: ""},
+			{Path: "Endereco.CEP", Value: ""},
+			{Path: "Endereco.Logradouro", Value: ""},
+			{Path: "Endereco.Numero", Value: ""},
+			{Path: "Endereco.Complemento", Value: ""},
+		}}, true
+	case "assinaturas":
+		return escritaAnonimizacao{campos: []firestore.Update{
+			{Path: "ClienteEmail", Value: ""},
+			{Path: "Status", Value: AssinaturaCancelada},
+		}}, true
+	case "consentimentos":
+		return escritaAnonimizacao{campos: []firestore.Update{
+			{Path: "Email", Value: pseudonimo},
+			{Path: "IP", Value: ""},
+			{Path: "UserAgent", Value: ""},
+		}}, true
+	case "tickets", "solicitacoes_lgpd":
+		// Os tickets passam pelo repositório, que pode ser o SQLite, e a solicitação fica como registro do atendimento
+		return escritaAnonimizacao{}, true
+	}
+	return escritaAnonimizacao{}, false
+}
+
+// Apaga a conta e tudo o que só existe por causa dela, e tira os dados pessoais do que precisa ficar:
+// os pedidos e as entregas são guardados por exigência fiscal, e os consentimentos como prova do
+// tratamento, identificados só pela solicitação. Devolve quantos documentos mudaram em cada coleção.
+func anonimizarTitular(firestoreClient *FirestoreClient, repositorio TicketRepository, email, pseudonimo string) (map[string]int, error) {
+	var escritas []escritaAnonimizacao
+	contagem := make(map[string]int)
+	vistos := make(map[string]bool)
+	adicionar := func(colecao string, docs []*firestore.DocumentSnapshot) error {
+		escrita, ok := anonimizacaoColecao(colecao, pseudonimo)
+		if !ok {
+			return fmt.Errorf("no anonymization rule for collection %s", colecao)
+		}
+		if !escrita.apagar && len(escrita.campos) == 0 {
+			return nil
+		}
+		for _, doc := range docs {
+			if vistos[doc.Ref.Path] {
+				continue
+			}
+			vistos[doc.Ref.Path] = true
+			escrita.ref = doc.Ref
+			escritas = append(escritas, escrita)
+			contagem[colecao]++
+		}
+		return nil
+	}
+
+	for _, colecao := range documentosPorEmail {
+		snapshot, err := firestoreClient.Client.Collection(colecao).Doc(email).Get(firestoreClient.Ctx)
+		if status.Code(err) == codes.NotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := adicionar(colecao, []*firestore.DocumentSnapshot{snapshot}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Os emails da fila guardam os destinatários numa lista
+	docs, err := firestoreClient.Client.Collection("emails").Where("Para", "array-contains", email).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	if err := adicionar("emails", docs); err != nil {
+		return nil, err
+	}
+	for _, c := range append(colecoesCredenciais, colecoesTitular...) {
+		docs, err := firestoreClient.Client.Collection(c.Colecao).Where(c.Campo, "==", email).Documents(firestoreClient.Ctx).GetAll()
+		if err != nil {
+			return nil, err
+		}
+		if err := adicionar(c.Colecao, docs); err != nil {
+			return nil, err
+		}
+	}
+
+	// Grava em lotes, respeitando o limite de escritas por batch
+	for inicio := 0; inicio < len(escritas); inicio += tamanhoLoteFirestore {
+		fim := inicio + tamanhoLoteFirestore
+		if fim > len(escritas) {
+			fim = len(escritas)
+		}
+		batch := firestoreClient.Client.Batch()
+		for _, escrita := range escritas[inicio:fim] {
+			if escrita.apagar {
+				batch.Delete(escrita.ref)
+			} else {
+				batch.Update(escrita.ref, escrita.campos)
+			}
+		}
+		if _, err := batch.Commit(firestoreClient.Ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	tickets, err := ticketsTitular(repositorio, email)
+	if err != nil {
+		return nil, err
+	}
+	// O texto do ticket foi escrito pelo titular e pode trazer nome, telefone ou endereço; ficam as datas,
+	// a prioridade e os prazos, usados nos relatórios de SLA
+	for _, t := range tickets {
+		t.EmailContato = ""
+		t.Titulo = "Ticket anonimizado"
+		t.Descricao = ""
+		if err := repositorio.Salvar(t); err != nil {
+			return nil, err
+		}
+		contagem["tickets"]++
+	}
+	return contagem, nil
+}
+
+// Resumo da anonimização gravado na solicitação, como "clientes: 1, transacoes: 4"
+func resumoAnonimizacao(contagem map[string]int) string {
+	if len(contagem) == 0 {
+		return "nenhum dado encontrado"
+	}
+	colecoes := make([]string, 0, len(contagem))
+	for colecao := range contagem {
+		colecoes = append(colecoes, colecao)
+	}
+	sort.Strings(colecoes)
+	partes := make([]string, len(colecoes))
+	for i, colecao := range colecoes {
+		partes[i] = fmt.Sprintf("%s: %d", colecao, contagem[colecao])
+	}
+	return strings.Join(partes, ", ")
+}
+
+func obterSolicitacaoLGPD(firestoreClient *FirestoreClient, id string) (SolicitacaoLGPD, error) {
+	snapshot, err := firestoreClient.Client.Collection("solicitacoes_lgpd").Doc(id).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return SolicitacaoLGPD{}, ErrSolicitacaoNaoEncontrada
+	}
+	if err != nil {
+		return SolicitacaoLGPD{}, err
+	}
+	var solicitacao SolicitacaoLGPD
+	if err := snapshot.DataTo(&solicitacao); err != nil {
+		return SolicitacaoLGPD{}, err
+	}
+	solicitacao.ID = snapshot.Ref.ID
+	return solicitacao, nil
+}
+
+func concluirSolicitacaoLGPD(firestoreClient *FirestoreClient, id, status string, campos ...firestore.Update) error {
+	_, err := firestoreClient.Client.Collection("solicitacoes_lgpd").Doc(id).Update(firestoreClient.Ctx, append([]firestore.Update{
+		{Path: "Status", Value: status},
+		{Path: "ConcluidaEm", Value: time.Now()},
+	}, campos...))
+	return err
+}
+
+func redirecionarLGPD(w http.ResponseWriter, r *http.Request, chave, mensagem string) {
+	http.Redirect(w, r, "/lgpd?"+chave+"="+url.QueryEscape(mensagem), http.StatusSeeOther)
+}
+
+// Solicitações dos titulares, das mais recentes para as mais antigas, com filtro opcional por situação
+func LGPDHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	// Com filtro, a ordenação é feita aqui, sem exigir um índice composto no Firestore
+	status := r.URL.Query().Get("status")
+	query := firestoreClient.Client.Collection("solicitacoes_lgpd").OrderBy("CriadaEm", firestore.Desc).Limit(200)
+	if status != "" {
+		query = firestoreClient.Client.Collection("solicitacoes_lgpd").Where("Status", "==", status)
+	}
+	docs, err := query.Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		http.Error(w, "Failed to fetch data requests", http.StatusInternalServerError)
+		return
+	}
+
+	data := LGPDPageData{
+		PageTitle: "Coffee Shop - Solicitações LGPD",
+		Status:    status,
+		Mensagem:  r.URL.Query().Get("mensagem"),
+		Erro:      r.URL.Query().Get("erro"),
+	}
+	for _, doc := range docs {
+		var solicitacao SolicitacaoLGPD
+		if err := doc.DataTo(&solicitacao); err != nil {
+			http.Error(w, "Failed to parse data request", http.StatusInternalServerError)
+			return
+		}
+		solicitacao.ID = doc.Ref.ID
+		solicitacao.CriadaEm = solicitacao.CriadaEm.In(fusoLoja())
+		solicitacao.ConcluidaEm = solicitacao.ConcluidaEm.In(fusoLoja())
+		data.Solicitacoes = append(data.Solicitacoes, solicitacao)
+	}
+	sort.SliceStable(data.Solicitacoes, func(i, j int) bool {
+		return data.Solicitacoes[i].CriadaEm.After(data.Solicitacoes[j].CriadaEm)
+	})
+
+	tmpl := template.Must(template.ParseFiles("template/lgpd.html"))
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+// Registra uma solicitação recebida por outro canal, como email ou telefone
+func RegistrarSolicitacaoLGPDHandler(w http.ResponseWriter, r *http.Request) {
+	endereco, err := mail.ParseAddress(strings.TrimSpace(r.FormValue("email")))
+	if err != nil {
+		http.Error(w, "Invalid email", http.StatusBadRequest)
+		return
+	}
+	tipo := r.FormValue("tipo")
+	if tipo != SolicitacaoExportacao && tipo != SolicitacaoExclusao {
+		http.Error(w, "Invalid request type", http.StatusBadRequest)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	_, _, err = firestoreClient.Client.Collection("solicitacoes_lgpd").Add(firestoreClient.Ctx, SolicitacaoLGPD{
+		Email:      strings.ToLower(endereco.Address),
+		Tipo:       tipo,
+		Status:     SolicitacaoPendente,
+		Origem:     "equipe",
+		Observacao: strings.TrimSpace(r.FormValue("observacao")),
+		CriadaEm:   time.Now(),
+	})
+	if err != nil {
+		http.Error(w, "Failed to save data request", http.StatusInternalServerError)
+		return
+	}
+	redirecionarLGPD(w, r, "mensagem", "Solicitação registrada")
+}
+
+// Baixa os dados do titular em JSON; numa solicitação de exportação pendente, marca como concluída
+func ExportarSolicitacaoLGPDHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	solicitacao, err := obterSolicitacaoLGPD(firestoreClient, mux.Vars(r)["id"])
+	if err == ErrSolicitacaoNaoEncontrada {
+		http.Error(w, "Data request not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch data request", http.StatusInternalServerError)
+		return
+	}
+
+	repositorio, err := novoRepositorioTickets()
+	if err != nil {
+		http.Error(w, "Failed to open tickets repository", http.StatusInternalServerError)
+		return
+	}
+	defer repositorio.Fechar()
+
+	dados, err := exportarDadosTitular(firestoreClient, repositorio, solicitacao.Email)
+	if err != nil {
+		http.Error(w, "Failed to fetch personal data", http.StatusInternalServerError)
+		return
+	}
+	conteudo, err := json.MarshalIndent(dados, "", "  ")
+	if err != nil {
+		http.Error(w, "Failed to encode personal data", http.StatusInternalServerError)
+		return
+	}
+
+	if solicitacao.Tipo == SolicitacaoExportacao && solicitacao.Status == SolicitacaoPendente {
+		if err := concluirSolicitacaoLGPD(firestoreClient, solicitacao.ID, SolicitacaoConcluida); err != nil {
+			http.Error(w, "Failed to update data request", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="dados_%s.json"`, solicitacao.ID))
+	w.Write(conteudo)
+}
+
+// Atende uma solicitação de exclusão pendente, anonimizando os dados do titular
+func AnonimizarSolicitacaoLGPDHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	solicitacao, err := obterSolicitacaoLGPD(firestoreClient, mux.Vars(r)["id"])
+	if err == ErrSolicitacaoNaoEncontrada {
+		http.Error(w, "Data request not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch data request", http.StatusInternalServerError)
+		return
+	}
+	if solicitacao.Tipo != SolicitacaoExclusao || solicitacao.Status != SolicitacaoPendente {
+		redirecionarLGPD(w, r, "erro", "Só solicitações de exclusão pendentes podem ser anonimizadas")
+		return
+	}
+
+	repositorio, err := novoRepositorioTickets()
+	if err != nil {
+		http.Error(w, "Failed to open tickets repository", http.StatusInternalServerError)
+		return
+	}
+	defer repositorio.Fechar()
+
+	contagem, err := anonimizarTitular(firestoreClient, repositorio, solicitacao.Email, "anonimizado-"+solicitacao.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to anonymize personal data: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	resumo := resumoAnonimizacao(contagem)
+	if err := concluirSolicitacaoLGPD(firestoreClient, solicitacao.ID, SolicitacaoConcluida, firestore.Update{Path: "Resumo", Value: resumo}); err != nil {
+		http.Error(w, "Failed to update data request", http.StatusInternalServerError)
+		return
+	}
+	redirecionarLGPD(w, r, "mensagem", fmt.Sprintf("Dados de %s anonimizados (%s)", solicitacao.Email, resumo))
+}
+
+// Encerra uma solicitação pendente sem atendê-la, com o motivo, como a identidade não confirmada
+func RecusarSolicitacaoLGPDHandler(w http.ResponseWriter, r *http.Request) {
+	motivo := strings.TrimSpace(r.FormValue("observacao"))
+	if motivo == "" {
+		redirecionarLGPD(w, r, "erro", "Informe o motivo da recusa")
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	solicitacao, err := obterSolicitacaoLGPD(firestoreClient, mux.Vars(r)["id"])
+	if err == ErrSolicitacaoNaoEncontrada {
+		http.Error(w, "Data request not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch data request", http.StatusInternalServerError)
+		return
+	}
+	if solicitacao.Status != SolicitacaoPendente {
+		redirecionarLGPD(w, r, "erro", "A solicitação já foi encerrada")
+		return
+	}
+	if err := concluirSolicitacaoLGPD(firestoreClient, solicitacao.ID, SolicitacaoRecusada, firestore.Update{Path: "Observacao", Value: motivo}); err != nil {
+		http.Error(w, "Failed to update data request", http.StatusInternalServerError)
+		return
+	}
+	redirecionarLGPD(w, r, "mensagem", "Solicitação recusada")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"testing"
+)
+
+// Declarações do lgpd.go, pelo nome, como texto
+func declaracoesLGPD(t *testing.T, arquivo string) map[string]string {
+	t.Helper()
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, arquivo, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	declaracoes := make(map[string]string)
+	imprimir := func(nome string, no ast.Node) {
+		var texto bytes.Buffer
+		if err := printer.Fprint(&texto, fset, no); err != nil {
+			t.Fatal(err)
+		}
+		declaracoes[nome] = texto.String()
+	}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			imprimir(d.Name.Name, d)
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					imprimir(s.Name.Name, s)
+				case *ast.ValueSpec:
+					imprimir(s.Names[0].Name, s)
+				}
+			}
+		}
+	}
+	return declaracoes
+}
+
+// Os dois servidores são módulos separados; a lista de coleções do titular e o percurso delas são copiados
+// e precisam continuar iguais
+func TestLGPDIgualNosServidores(t *testing.T) {
+	mantenedor := declaracoesLGPD(t, "lgpd.go")
+	usuario := declaracoesLGPD(t, "../Server_Usuario/lgpd.go")
+	for _, nome := range []string{"colecaoTitular", "documentosPorEmail", "colecoesTitular", "camposOcultosTitular", "documentosTitular"} {
+		if mantenedor[nome] == "" {
+			t.Errorf("%s não existe no Server_Mantenedor", nome)
+			continue
+		}
+		if mantenedor[nome] != usuario[nome] {
+			t.Errorf("%s diferente nos dois servidores:\n%s\n---\n%s", nome, mantenedor[nome], usuario[nome])
+		}
+	}
+}
+
+func TestAnonimizacaoColecoes(t *testing.T) {
+	colecoes := append([]string{"emails"}, documentosPorEmail...)
+	for _, c := range append(colecoesCredenciais, colecoesTitular...) {
+		colecoes = append(colecoes, c.Colecao)
+	}
+	for _, colecao := range colecoes {
+		if _, ok := anonimizacaoColecao(colecao, "anonimizado-1"); !ok {
+			t.Errorf("coleção %s sem regra de anonimização", colecao)
+		}
+	}
+	if _, ok := anonimizacaoColecao("desconhecida", "anonimizado-1"); ok {
+		t.Error("coleção desconhecida com regra de anonimização")
+	}
+
+	// O carrinho guarda o endereço de entrega e sai inteiro
+	if escrita, _ := anonimizacaoColecao("carrinhos", "anonimizado-1"); !escrita.apagar {
+		t.Error("carrinho não é apagado")
+	}
+	escrita, _ := anonimizacaoColecao("consentimentos", "anonimizado-1")
+	if escrita.apagar || len(escrita.campos) == 0 || escrita.campos[0].Path != "Email" || escrita.campos[0].Value != "anonimizado-1" {
+		t.Errorf("consentimento anonimizado com %+v", escrita)
+	}
+}
+
+func TestResumoAnonimizacao(t *testing.T) {
+	if resumo := resumoAnonimizacao(map[string]int{"transacoes": 4, "carrinhos": 1, "clientes": 1}); resumo != "carrinhos: 1, clientes: 1, transacoes: 4" {
+		t.Errorf("resumo = %q", resumo)
+	}
+	if resumo := resumoAnonimizacao(nil); resumo != "nenhum dado encontrado" {
+		t.Errorf("resumo vazio = %q", resumo)
+	}
+}
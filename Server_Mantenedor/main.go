@@ -1,13 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/csv"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
-	"os"
+	"net/mail"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -28,12 +30,45 @@ type Produto struct {
 	NomeProduto string
 	ValorCompra float64
 	ValorVenda  float64
+	// Produtos de revenda têm estoque controlado; bebidas preparadas na hora, não
+	ControlaEstoque bool
+	Estoque         int
+	// Abaixo ou igual a este estoque a equipe recebe um aviso por email; zero desativa o aviso
+	EstoqueMinimo int
+	// Vendido na loja como vale-presente: cada unidade emite um vale com o valor de venda
+	ValePresente bool
+	// Oferecido aos clientes como assinatura com entregas periódicas
+	Assinavel bool
+	// Dados fiscais da NFC-e; códigos vazios usam os padrões da configuração
+	NCM   string
+	CFOP  string
+	CSOSN string
+	// CST do ICMS, usado quando a loja está no regime normal
+	CST string
+	// Alíquotas, em percentual sobre o valor pago na linha
+	AliquotaICMS   float64
+	AliquotaPIS    float64
+	AliquotaCOFINS float64
 }
 
 type Ticket struct {
-	Titulo       string
-	Descricao    string
-	DataAbertura time.Time
+	ID               string `firestore:"-"`
+	Titulo           string
+	Descricao        string
+	DataAbertura     time.Time
+	Prioridade       string
+	Status           string
+	Responsavel      string
+	PrazoResposta    time.Time
+	PrazoResolucao   time.Time
+	DataResposta     time.Time
+	DataResolucao    time.Time
+	RespostaViolada  bool
+	ResolucaoViolada bool
+	Escalado         bool
+	// Quem abriu o ticket recebe a resposta da equipe por email
+	EmailContato string
+	Resposta     string
 }
 
 type Transacao struct {
@@ -41,21 +76,67 @@ type Transacao struct {
 	CodigoProd      int
 	NomeProd        string
 	QuantidadeProd  int
+	ValorUnitario   float64
+	CustoUnitario   float64
 	ValorTransacao  float64
+	MetodoPagamento string
 	DataTransacao   time.Time
+	// Turno de caixa aberto no momento da venda, se houver
+	TurnoID string
+	// "venda" ou "estorno"; transações antigas, sem tipo, são vendas
+	Tipo string
+	// Motivo e responsável, apenas nos estornos
+	Motivo   string
+	Operador string
+	// Descontos da linha; ValorTransacao já vem com eles abatidos
+	Desconto  float64
+	Descontos []DescontoAplicado
+	// Conta do cliente na loja e e-mail informado na compra; vazios nas vendas de balcão
+	ClienteEmail string
+	EmailContato string
+	// Divisão do valor da linha entre métodos, quando parte foi paga com vale-presente
+	Pagamentos []PagamentoParcial
+	// Assinatura que gerou o pedido, nos pedidos criados pelo agendador
+	AssinaturaID string
+	// Início do horário de retirada escolhido na loja, se houver
+	RetiradaEm time.Time
+	// Mesa do salão de onde o cliente pediu pelo QR code
+	Mesa int
+	// Dados fiscais do produto no momento da venda, repetidos nos estornos; nil só nas transações antigas
+	DadosFiscais *DadosFiscais
+	// Unidades do estorno que voltaram ao estoque; só elas devolvem o custo. nil nos estornos antigos,
+	// que devolviam o custo de toda a quantidade
+	Restituido *int
 }
 
 type RelatorioPageData struct {
-	Meses []string
-	Anos  []string
+	Meses      []string
+	Anos       []string
+	Presets    []PresetPeriodo
+	Relatorios []RelatorioArquivado
 }
 
 type ProdutoPageData struct {
+	PageTitle   string
+	Produtos    []Produto
+	Tickets     []Ticket
+	Transacoes  []Transacao
+	Produto     Produto
+	Prioridades []string
+}
+
+type TicketsPageData struct {
+	PageTitle   string
+	Pagina      PaginaTickets
+	Prioridades []string
+	Status      []string
+	Filtro      url.Values
+}
+
+type RelatorioFluxoPageData struct {
 	PageTitle  string
-	Produtos   []Produto
-	Tickets    []Ticket
-	Transacoes []Transacao
-	Produto    Produto
+	Relatorio  RelatorioFluxo
+	Parametros map[string]string
 }
 
 type TransacaoPageData struct {
@@ -63,21 +144,101 @@ type TransacaoPageData struct {
 }
 
 func main() {
+	carregarConfig()
+
+	// Verificação periódica dos prazos de atendimento dos tickets
+	go monitorarSLA()
+
+	// Geração automática dos relatórios configurados
+	go iniciarAgendador()
 
+	// Pedidos das assinaturas com entrega vencida
+	go iniciarAssinaturas()
+
+	// Emissão das NFC-e dos pedidos
+	go iniciarNFCe()
+
+	// Envio dos emails enfileirados pelos dois servidores
+	go iniciarFilaEmails()
+
+	http.Handle("/", novoRouter())
+	http.ListenAndServe(":8080", nil)
+}
+
+// Rotas do back office, todas atrás do login do administrador
+func novoRouter() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(exigirAutenticacao)
 	r.HandleFunc("/", LoginHandler).Methods("GET")
 	r.HandleFunc("/index", ListProdutosHandler).Methods("GET")
+	r.HandleFunc("/dashboard", DashboardHandler).Methods("GET")
+	r.HandleFunc("/dashboard/dados", DashboardDadosHandler).Methods("GET")
 	r.HandleFunc("/produto/novo", CreateProdutoHandler).Methods("GET", "POST")
 	r.HandleFunc("/produto/editar/{id:[0-9]+}", EditProdutoHandler).Methods("GET", "POST")
 	r.HandleFunc("/produto/excluir/{id:[0-9]+}", DeleteProdutoHandler).Methods("POST")
 	r.HandleFunc("/abrir-ticket", AbrirTicketHandler).Methods("GET", "POST")
 	r.HandleFunc("/tickets", ListTicketsHandler).Methods("GET")
+	r.HandleFunc("/tickets/{id}/responder", ResponderTicketHandler).Methods("POST")
+	r.HandleFunc("/tickets/{id}/resolver", ResolverTicketHandler).Methods("POST")
+	r.HandleFunc("/tickets/{id}/atribuir", AtribuirTicketHandler).Methods("POST")
+	r.HandleFunc("/relatorio-sla", RelatorioSLAHandler).Methods("GET")
 	r.HandleFunc("/relatorio-fluxo", RelatorioFluxoHandler).Methods("GET")
 	r.HandleFunc("/visualizar-transacoes", VisualizarTransacoesHandler).Methods("GET")
 	r.HandleFunc("/gerar-relatorio", GerarRelatorioHandler).Methods("POST") // Adicionando a rota para lidar com a submissão do formulário
-
-	http.Handle("/", r)
-	http.ListenAndServe(":8080", nil)
+	r.HandleFunc("/relatorios/{id}/download", DownloadRelatorioHandler).Methods("GET")
+	r.HandleFunc("/pedidos/{codigo:[0-9]+}", PedidoHandler).Methods("GET")
+	r.HandleFunc("/pedidos/{codigo:[0-9]+}/estornar", EstornarPedidoHandler).Methods("POST")
+	r.HandleFunc("/pedidos/{codigo:[0-9]+}/nfce", EmitirNFCeHandler).Methods("POST")
+	r.HandleFunc("/pedidos/{codigo:[0-9]+}/danfe", DanfeHandler).Methods("GET")
+	r.HandleFunc("/pedidos/{codigo:[0-9]+}/nfce.xml", XMLNFCeHandler).Methods("GET")
+	r.HandleFunc("/pedidos/{codigo:[0-9]+}/comprovante", ComprovantePedidoHandler).Methods("GET")
+	r.HandleFunc("/promocoes", PromocoesHandler).Methods("GET")
+	r.HandleFunc("/promocoes/cupons", CriarCupomHandler).Methods("POST")
+	r.HandleFunc("/promocoes/cupons/{id}/ativo", AlternarDescontoHandler("cupons", "Ativo")).Methods("POST")
+	r.HandleFunc("/promocoes/automaticas", CriarPromocaoHandler).Methods("POST")
+	r.HandleFunc("/promocoes/automaticas/{id}/ativo", AlternarDescontoHandler("promocoes", "Ativa")).Methods("POST")
+	r.HandleFunc("/fidelidade", FidelidadeHandler).Methods("GET")
+	r.HandleFunc("/fidelidade/regras", SalvarRegrasFidelidadeHandler).Methods("POST")
+	r.HandleFunc("/fidelidade/recompensas", SalvarRecompensaHandler).Methods("POST")
+	r.HandleFunc("/fidelidade/recompensas/{produto:[0-9]+}/excluir", ExcluirRecompensaHandler).Methods("POST")
+	r.HandleFunc("/vales", ValesHandler).Methods("GET")
+	r.HandleFunc("/vales", GerarValesHandler).Methods("POST")
+	r.HandleFunc("/vales/{codigo}", ValeHandler).Methods("GET")
+	r.HandleFunc("/vales/{codigo}/ativo", BloquearValeHandler).Methods("POST")
+	r.HandleFunc("/assinaturas", AssinaturasHandler).Methods("GET")
+	r.HandleFunc("/assinaturas/processar", ProcessarAssinaturasHandler).Methods("POST")
+	r.HandleFunc("/retirada", RetiradaHandler).Methods("GET")
+	r.HandleFunc("/retirada/regras", SalvarRegrasRetiradaHandler).Methods("POST")
+	r.HandleFunc("/entregas", EntregasHandler).Methods("GET")
+	r.HandleFunc("/entregas/regras", SalvarRegrasEntregaHandler).Methods("POST")
+	r.HandleFunc("/entregas/zonas", SalvarZonaEntregaHandler).Methods("POST")
+	r.HandleFunc("/entregas/zonas/{nome}/excluir", ExcluirZonaEntregaHandler).Methods("POST")
+	r.HandleFunc("/entregas/{codigo:[0-9]+}/status", AvancarEntregaHandler).Methods("POST")
+	r.HandleFunc("/mesas", MesasHandler).Methods("GET")
+	r.HandleFunc("/mesas", SalvarMesasHandler).Methods("POST")
+	r.HandleFunc("/mesas/qrcodes.pdf", FolhaMesasHandler).Methods("GET")
+	r.HandleFunc("/mesas/{numero:[0-9]+}/qrcode.png", QRCodeMesaHandler).Methods("GET")
+	r.HandleFunc("/preparo", PreparoHandler).Methods("GET")
+	r.HandleFunc("/preparo/eventos", PreparoEventosHandler).Methods("GET")
+	r.HandleFunc("/preparo/{codigo:[0-9]+}/status", AvancarPreparoHandler).Methods("POST")
+	r.HandleFunc("/turnos", TurnosHandler).Methods("GET")
+	r.HandleFunc("/turnos/abrir", AbrirTurnoHandler).Methods("POST")
+	r.HandleFunc("/turnos/{id}", TurnoHandler).Methods("GET")
+	r.HandleFunc("/turnos/{id}/movimento", MovimentoTurnoHandler).Methods("POST")
+	r.HandleFunc("/turnos/{id}/fechar", FecharTurnoHandler).Methods("POST")
+	r.HandleFunc("/agendamentos", AgendamentosHandler).Methods("GET")
+	r.HandleFunc("/agendamentos/{nome}/executar", ExecutarAgendamentoHandler).Methods("POST")
+	r.HandleFunc("/emails", EmailsHandler).Methods("GET")
+	r.HandleFunc("/emails/{id}/reenviar", ReenviarEmailHandler).Methods("POST")
+	r.HandleFunc("/newsletter", NewsletterHandler).Methods("GET")
+	r.HandleFunc("/newsletter/inscritos.csv", ExportarInscritosHandler).Methods("GET")
+	r.HandleFunc("/newsletter/campanhas", EnviarCampanhaHandler).Methods("POST")
+	r.HandleFunc("/lgpd", LGPDHandler).Methods("GET")
+	r.HandleFunc("/lgpd/solicitacoes", RegistrarSolicitacaoLGPDHandler).Methods("POST")
+	r.HandleFunc("/lgpd/solicitacoes/{id}/exportar", ExportarSolicitacaoLGPDHandler).Methods("POST")
+	r.HandleFunc("/lgpd/solicitacoes/{id}/anonimizar", AnonimizarSolicitacaoLGPDHandler).Methods("POST")
+	r.HandleFunc("/lgpd/solicitacoes/{id}/recusar", RecusarSolicitacaoLGPDHandler).Methods("POST")
+	return r
 }
 
 func InitializeFirestore() (*FirestoreClient, error) {
@@ -160,12 +321,36 @@ func CreateProdutoHandler(w http.ResponseWriter, r *http.Request) {
 		// Encontrar o próximo ID disponível para o novo produto
 		newID := findAvailableID(existingIDs)
 
+		controlaEstoque, estoque, estoqueMinimo, err := lerEstoque(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fiscais, err := lerDadosFiscais(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		// Criar o novo produto com o ID gerado automaticamente
 		produto := Produto{
-			ID:          int(newID),
-			NomeProduto: nomeProduto,
-			ValorCompra: valorCompraFloat,
-			ValorVenda:  valorVendaFloat,
+			ID:              int(newID),
+			NomeProduto:     nomeProduto,
+			ValorCompra:     valorCompraFloat,
+			ValorVenda:      valorVendaFloat,
+			ControlaEstoque: controlaEstoque,
+			Estoque:         estoque,
+			EstoqueMinimo:   estoqueMinimo,
+			ValePresente:    r.FormValue("valePresente") != "",
+			Assinavel:       r.FormValue("assinavel") != "",
+			NCM:             fiscais.NCM,
+			CFOP:            fiscais.CFOP,
+			CSOSN:           fiscais.CSOSN,
+			CST:             fiscais.CST,
+			AliquotaICMS:    fiscais.AliquotaICMS,
+			AliquotaPIS:     fiscais.AliquotaPIS,
+			AliquotaCOFINS:  fiscais.AliquotaCOFINS,
 		}
 
 		_, err = produtosRef.Doc(strconv.Itoa(newID)).Set(firestoreClient.Ctx, produto)
@@ -188,6 +373,25 @@ func CreateProdutoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Lê o controle de estoque do formulário de produto; produtos sem controle ficam com estoque e mínimo zero
+func lerEstoque(r *http.Request) (bool, int, int, error) {
+	if r.FormValue("controlaEstoque") == "" {
+		return false, 0, 0, nil
+	}
+	estoque, err := strconv.Atoi(r.FormValue("estoque"))
+	if err != nil || estoque < 0 {
+		return false, 0, 0, errors.New("Invalid estoque")
+	}
+	minimo := 0
+	if v := r.FormValue("estoqueMinimo"); v != "" {
+		minimo, err = strconv.Atoi(v)
+		if err != nil || minimo < 0 {
+			return false, 0, 0, errors.New("Invalid estoqueMinimo")
+		}
+	}
+	return true, estoque, minimo, nil
+}
+
 // Função auxiliar para encontrar o próximo ID disponível
 func findAvailableID(existingIDs []int) int {
 	// Lógica para encontrar o próximo ID disponível, por exemplo:
@@ -226,13 +430,37 @@ func EditProdutoHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		controlaEstoque, estoque, estoqueMinimo, err := lerEstoque(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fiscais, err := lerDadosFiscais(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		produtoRef := firestoreClient.Client.Collection("produtos").Doc(id)
 
 		// Atualiza os campos do documento no Firestore
 		_, err = produtoRef.Set(firestoreClient.Ctx, map[string]interface{}{
-			"NomeProduto": nomeProduto,
-			"ValorCompra": valorCompraFloat,
-			"ValorVenda":  valorVendaFloat,
+			"NomeProduto":     nomeProduto,
+			"ValorCompra":     valorCompraFloat,
+			"ValorVenda":      valorVendaFloat,
+			"ControlaEstoque": controlaEstoque,
+			"Estoque":         estoque,
+			"EstoqueMinimo":   estoqueMinimo,
+			"ValePresente":    r.FormValue("valePresente") != "",
+			"Assinavel":       r.FormValue("assinavel") != "",
+			"NCM":             fiscais.NCM,
+			"CFOP":            fiscais.CFOP,
+			"CSOSN":           fiscais.CSOSN,
+			"CST":             fiscais.CST,
+			"AliquotaICMS":    fiscais.AliquotaICMS,
+			"AliquotaPIS":     fiscais.AliquotaPIS,
+			"AliquotaCOFINS":  fiscais.AliquotaCOFINS,
 		}, firestore.MergeAll)
 		if err != nil {
 			http.Error(w, "Failed to update product in Firestore", http.StatusInternalServerError)
@@ -316,55 +544,72 @@ func authenticate(w http.ResponseWriter, r *http.Request) bool {
 	return true
 }
 
-func AbrirTicketHandler(w http.ResponseWriter, r *http.Request) {
+// Middleware que recusa com 401 as requisições sem o login, antes de chegar a qualquer handler
+func exigirAutenticacao(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authenticate(w, r) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-	firestoreClient, err := InitializeFirestore()
-	if err != nil {
-		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
-		return
-	}
+func AbrirTicketHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "POST" {
+		repositorio, err := novoRepositorioTickets()
+		if err != nil {
+			http.Error(w, "Failed to open tickets repository", http.StatusInternalServerError)
+			return
+		}
+		defer repositorio.Fechar()
+
 		// Processar o formulário de abertura de ticket aqui
 		titulo := r.FormValue("titulo")
 		descricao := r.FormValue("descricao")
+		prioridade := r.FormValue("prioridade")
+		if prioridade == "" {
+			prioridade = PrioridadeMedia
+		}
+		if !prioridadeValida(prioridade) {
+			http.Error(w, "Invalid prioridade", http.StatusBadRequest)
+			return
+		}
+
+		emailContato := strings.TrimSpace(r.FormValue("email"))
+		if emailContato != "" {
+			endereco, err := mail.ParseAddress(emailContato)
+			if err != nil {
+				http.Error(w, "Invalid email", http.StatusBadRequest)
+				return
+			}
+			emailContato = endereco.Address
+		}
 
 		novoTicket := Ticket{
 			Titulo:       titulo,
 			Descricao:    descricao,
 			DataAbertura: time.Now(),
+			Prioridade:   prioridade,
+			Status:       StatusAberto,
+			Responsavel:  r.FormValue("responsavel"),
+			EmailContato: emailContato,
 		}
+		novoTicket.calcularPrazos()
 
-		// Adicionar um novo documento à coleção "tickets" no Firestore
-		_, _, err := firestoreClient.Client.Collection("tickets").Add(firestoreClient.Ctx, novoTicket)
-		if err != nil {
-			http.Error(w, "Failed to create ticket in Firestore", http.StatusInternalServerError)
+		if _, err := repositorio.Criar(novoTicket); err != nil {
+			http.Error(w, "Failed to create ticket", http.StatusInternalServerError)
 			return
 		}
-	}
 
-	// Recuperar a lista de tickets
-	var tickets []Ticket
-
-	ticketsRef, err := firestoreClient.Client.Collection("tickets").Documents(firestoreClient.Ctx).GetAll()
-	if err != nil {
-		http.Error(w, "Failed to fetch tickets from Firestore", http.StatusInternalServerError)
+		http.Redirect(w, r, "/tickets", http.StatusSeeOther)
 		return
 	}
 
-	for _, doc := range ticketsRef {
-		var ticket Ticket
-		if err := doc.DataTo(&ticket); err != nil {
-			http.Error(w, "Failed to parse ticket data", http.StatusInternalServerError)
-			return
-		}
-		tickets = append(tickets, ticket)
-	}
-
 	tmpl := template.Must(template.ParseFiles("template/abrir_ticket.html"))
 	data := ProdutoPageData{
-		PageTitle: "Coffee Shop - Abertura de Ticket",
-		Tickets:   tickets,
+		PageTitle:   "Coffee Shop - Abertura de Ticket",
+		Prioridades: prioridades,
 	}
 
 	if err := tmpl.Execute(w, data); err != nil {
@@ -374,34 +619,33 @@ func AbrirTicketHandler(w http.ResponseWriter, r *http.Request) {
 
 func ListTicketsHandler(w http.ResponseWriter, r *http.Request) {
 
-	firestoreClient, err := InitializeFirestore()
+	repositorio, err := novoRepositorioTickets()
 	if err != nil {
-		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		http.Error(w, "Failed to open tickets repository", http.StatusInternalServerError)
 		return
 	}
+	defer repositorio.Fechar()
 
-	// Recuperar a lista de tickets
-	var tickets []Ticket
-
-	ticketsRef, err := firestoreClient.Client.Collection("tickets").Documents(firestoreClient.Ctx).GetAll()
+	filtro, err := lerFiltroTickets(r)
 	if err != nil {
-		http.Error(w, "Failed to fetch tickets from Firestore", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	for _, doc := range ticketsRef {
-		var ticket Ticket
-		if err := doc.DataTo(&ticket); err != nil {
-			http.Error(w, "Failed to parse ticket data", http.StatusInternalServerError)
-			return
-		}
-		tickets = append(tickets, ticket)
+	// Recuperar a página de tickets, dos mais urgentes para os menos urgentes
+	pagina, err := repositorio.Listar(filtro)
+	if err != nil {
+		http.Error(w, "Failed to fetch tickets", http.StatusInternalServerError)
+		return
 	}
 
 	tmpl := template.Must(template.ParseFiles("template/tickets.html"))
-	data := ProdutoPageData{
-		PageTitle: "Coffee Shop - Lista de Tickets",
-		Tickets:   tickets,
+	data := TicketsPageData{
+		PageTitle:   "Coffee Shop - Lista de Tickets",
+		Pagina:      pagina,
+		Prioridades: prioridades,
+		Status:      []string{StatusAberto, StatusRespondido, StatusResolvido},
+		Filtro:      r.URL.Query(),
 	}
 
 	if err := tmpl.Execute(w, data); err != nil {
@@ -529,9 +773,17 @@ func RelatorioFluxoHandler(w http.ResponseWriter, r *http.Request) {
 		meses = append(meses, splitDate[1])
 	}
 
+	relatorios, err := listarRelatoriosArquivados(firestoreClient)
+	if err != nil {
+		http.Error(w, "Failed to fetch generated reports", http.StatusInternalServerError)
+		return
+	}
+
 	data := RelatorioPageData{
-		Meses: meses,
-		Anos:  anos,
+		Meses:      meses,
+		Anos:       anos,
+		Presets:    presetsPeriodo,
+		Relatorios: relatorios,
 	}
 
 	tmpl := template.Must(template.ParseFiles("template/relatorio_fluxo.html"))
@@ -550,117 +802,66 @@ func GerarRelatorioHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		mesStr := r.FormValue("mes")
-		anoStr := r.FormValue("ano")
-
-		mes, err := strconv.Atoi(mesStr)
+		// Período pedido: preset, intervalo de datas ou mês/ano, sempre como [inicio, fim)
+		periodo, parametros, err := lerPeriodo(r, time.Now())
 		if err != nil {
-			http.Error(w, "Failed to convert month to integer", http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		ano, err := strconv.Atoi(anoStr)
+		relatorio, err := montarRelatorioFluxo(firestoreClient, periodo)
 		if err != nil {
-			http.Error(w, "Failed to convert year to integer", http.StatusBadRequest)
+			log.Printf("Failed to build cash-flow report: %v", err)
+			http.Error(w, "Failed to fetch transactions", http.StatusInternalServerError)
 			return
 		}
 
-		// Calcular o primeiro e último dia do mês no ano especificado
-		firstDay := time.Date(ano, time.Month(mes), 1, 0, 0, 0, 0, time.UTC)
-		lastDay := firstDay.AddDate(0, 1, -1).Add(24 * time.Hour)
-
-		// Consultar as transações dentro do intervalo de datas
-		docs, err := firestoreClient.Client.Collection("transacoes").Where("DataTransacao", ">=", firstDay).Where("DataTransacao", "<=", lastDay).Documents(firestoreClient.Ctx).GetAll()
-		if err != nil {
-			http.Error(w, "Failed to fetch transactions", http.StatusInternalServerError)
+		formato := r.FormValue("formato")
+		if formato == "" {
+			formato = "html"
+		}
+		renderizador, ok := renderizadores[formato]
+		if !ok {
+			http.Error(w, "Invalid report format", http.StatusBadRequest)
 			return
 		}
 
-		if len(docs) == 0 {
-			http.Error(w, "No transactions found for the specified date range", http.StatusNotFound)
-			return
+		documento := DocumentoRelatorio{
+			Titulo:     fmt.Sprintf("Fluxo de Caixa - %s a %s", periodo.Inicio.Format("02/01/2006"), periodo.UltimoDia().Format("02/01/2006")),
+			Relatorio:  relatorio,
+			Parametros: parametros,
+			GeradoEm:   time.Now().In(fusoLoja()),
 		}
 
-		// Criar um arquivo CSV
-		fileName := fmt.Sprintf("./relatorios_fluxo/relatorio_%02d_%d.csv", mes, ano)
-		file, err := os.Create(fileName)
-		if err != nil {
-			http.Error(w, "Failed to create CSV file", http.StatusInternalServerError)
+		// A versão HTML é apenas exibida; os demais formatos são arquivados e baixados
+		if formato == "html" {
+			if err := renderizador.Renderizar(w, documento); err != nil {
+				http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+				log.Printf("Failed to execute template: %v", err)
+			}
 			return
 		}
-		defer file.Close()
-
-		// Escrever no arquivo CSV
-		writer := csv.NewWriter(file)
-		defer writer.Flush()
 
-		// Escrever cabeçalhos
-		headers := []string{"ID", "CodigoTransacao", "CodigoProd", "NomeProd", "QuantidadeProd", "ValorTransacao", "DataTransacao"}
-		if err := writer.Write(headers); err != nil {
-			http.Error(w, "Failed to write CSV headers", http.StatusInternalServerError)
+		var conteudo bytes.Buffer
+		if err := renderizador.Renderizar(&conteudo, documento); err != nil {
+			log.Printf("Failed to render %s report: %v", formato, err)
+			http.Error(w, "Failed to render report", http.StatusInternalServerError)
 			return
 		}
 
-		// Escrever os dados das transações no arquivo CSV
-		for _, doc := range docs {
-			data := doc.Data()
-			record := []string{
-				doc.Ref.ID,
-			}
-
-			if val, ok := data["CodigoTransacao"].(int64); ok {
-				record = append(record, strconv.Itoa(int(val)))
-			} else {
-				record = append(record, "null") // Tratamento para valor nulo ou não int64
-			}
-
-			if val, ok := data["CodigoProd"].(int64); ok {
-				record = append(record, strconv.Itoa(int(val)))
-			} else {
-				record = append(record, "null") // Tratamento para valor nulo ou não int64
-			}
-
-			// Verificação e conversão para outros campos conforme necessário
-			if val, ok := data["NomeProd"].(string); ok {
-				record = append(record, val)
-			} else {
-				record = append(record, "null") // Tratamento para valor nulo ou não string
-			}
-
-			if val, ok := data["QuantidadeProd"].(int64); ok {
-				record = append(record, strconv.Itoa(int(val)))
-			} else {
-				record = append(record, "null") // Tratamento para valor nulo ou não int64
-			}
-
-			if val, ok := data["ValorTransacao"].(float64); ok {
-				record = append(record, fmt.Sprintf("%.2f", val))
-			} else if val, ok := data["ValorTransacao"].(int64); ok {
-				record = append(record, strconv.Itoa(int(val)))
-			} else {
-				record = append(record, "null") // Tratamento para valor nulo ou não int64
-			}
-
-			if val, ok := data["DataTransacao"].(time.Time); ok {
-				record = append(record, val.Format("02/01/2006"))
-			} else {
-				record = append(record, "null") // Tratamento para valor nulo ou não time.Time
-			}
-
-			if err := writer.Write(record); err != nil {
-				http.Error(w, "Failed to write CSV record", http.StatusInternalServerError)
-				return
-			}
+		arquivado, err := arquivarRelatorio(firestoreClient, RelatorioArquivado{
+			Tipo:       "fluxo_caixa",
+			Formato:    formato,
+			Parametros: parametros,
+			GeradoPor:  usuarioRequisicao(r),
+			GeradoEm:   documento.GeradoEm,
+		}, conteudo.Bytes())
+		if err != nil {
+			log.Printf("Failed to archive report: %v", err)
+			http.Error(w, "Failed to archive report", http.StatusInternalServerError)
+			return
 		}
 
-		// Redirecionar para a página de sucesso ou download do arquivo CSV
-		fmt.Fprintf(w, `<html><body>Relatório gerado em: %s</body></html>`, fileName)
-		fmt.Fprintf(w, `
-			<script>
-				setTimeout(function() {
-					window.location.href = '/relatorio-fluxo';
-				}, 5000); // Redirecionar após 5 segundos (5000 milissegundos)
-			</script>
-		`)
+		enviarRelatorio(w, arquivado.NomeDownload(), arquivado.Formato, conteudo.Bytes())
 	}
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Sem o login, nenhuma rota chega ao handler, então o teste não precisa do Firestore
+func TestRotasExigemAutenticacao(t *testing.T) {
+	router := novoRouter()
+	rotas := []struct {
+		metodo string
+		url    string
+	}{
+		{http.MethodGet, "/"},
+		{http.MethodGet, "/index"},
+		{http.MethodPost, "/lgpd/solicitacoes/abc/exportar"},
+		{http.MethodPost, "/lgpd/solicitacoes/abc/anonimizar"},
+		{http.MethodGet, "/newsletter/inscritos.csv"},
+		{http.MethodPost, "/pedidos/7/estornar"},
+		{http.MethodPost, "/vales"},
+		{http.MethodGet, "/turnos"},
+		{http.MethodPost, "/turnos/abrir"},
+		{http.MethodPost, "/turnos/abc/fechar"},
+	}
+	for _, rota := range rotas {
+		for _, senha := range []string{"", "errada"} {
+			req := httptest.NewRequest(rota.metodo, rota.url, nil)
+			if senha != "" {
+				req.SetBasicAuth("admin", senha)
+			}
+			resposta := httptest.NewRecorder()
+			router.ServeHTTP(resposta, req)
+			if resposta.Code != http.StatusUnauthorized {
+				t.Errorf("%s %s com senha %q: status %d, esperava 401", rota.metodo, rota.url, senha, resposta.Code)
+			}
+			if resposta.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s %s: resposta sem WWW-Authenticate", rota.metodo, rota.url)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/gorilla/mux"
+	"github.com/skip2/go-qrcode"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Documento em "configuracoes" com as mesas do salão, lido também pelo Server_Usuario
+const documentoMesas = "mesas"
+
+// Mesas por folha A4 no PDF de QR codes, em duas colunas
+const (
+	colunasFolhaMesas = 2
+	linhasFolhaMesas  = 3
+)
+
+// Mesas numeradas de 1 até a quantidade
+type ConfigMesas struct {
+	Quantidade int
+}
+
+type MesasPageData struct {
+	PageTitle string
+	Mesas     ConfigMesas
+	Numeros   []int
+	URLLoja   string
+}
+
+func (c ConfigMesas) numeros() []int {
+	numeros := make([]int, c.Quantidade)
+	for i := range numeros {
+		numeros[i] = i + 1
+	}
+	return numeros
+}
+
+func buscarConfigMesas(firestoreClient *FirestoreClient) (ConfigMesas, error) {
+	var mesas ConfigMesas
+	snapshot, err := firestoreClient.Client.Collection("configuracoes").Doc(documentoMesas).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return mesas, nil
+	}
+	if err != nil {
+		return mesas, err
+	}
+	err = snapshot.DataTo(&mesas)
+	return mesas, err
+}
+
+// Endereço do catálogo da loja com a mesa, gravado no QR code
+func urlMesa(numero int) string {
+	return fmt.Sprintf("%s/catalogo?mesa=%d", strings.TrimRight(config.URLLoja, "/"), numero)
+}
+
+func qrCodeMesa(numero, tamanho int) ([]byte, error) {
+	return qrcode.Encode(urlMesa(numero), qrcode.Medium, tamanho)
+}
+
+// Gera o PDF com um cartão por mesa, pronto para imprimir e recortar
+func gerarFolhaMesas(w io.Writer, numeros []int) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle("QR codes das mesas", true)
+	pdf.SetAuthor("Coffee Shop", true)
+	pdf.SetAutoPageBreak(false, 0)
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	const largura, altura, lado = 95.0, 92.0, 62.0
+	for i, numero := range numeros {
+		posicao := i % (colunasFolhaMesas * linhasFolhaMesas)
+		if posicao == 0 {
+			pdf.AddPage()
+		}
+		x := 10 + float64(posicao%colunasFolhaMesas)*largura
+		y := 10 + float64(posicao/colunasFolhaMesas)*altura
+
+		png, err := qrCodeMesa(numero, 512)
+		if err != nil {
+			return err
+		}
+		nome := fmt.Sprintf("mesa%d", numero)
+		pdf.RegisterImageOptionsReader(nome, fpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(png))
+
+		pdf.SetDrawColor(200, 200, 200)
+		pdf.Rect(x, y, largura-5, altura-5, "D")
+		pdf.SetXY(x, y+4)
+		pdf.SetFont("Arial", "B", 18)
+		pdf.CellFormat(largura-5, 8, tr(fmt.Sprintf("Mesa %d", numero)), "", 0, "C", false, 0, "")
+		pdf.ImageOptions(nome, x+(largura-5-lado)/2, y+13, lado, lado, false, fpdf.ImageOptions{ImageType: "PNG"}, 0, "")
+		pdf.SetXY(x, y+77)
+		pdf.SetFont("Arial", "", 10)
+		pdf.CellFormat(largura-5, 6, tr("Aponte a câmera do celular para fazer seu pedido"), "", 0, "C", false, 0, "")
+	}
+	if err := pdf.Error(); err != nil {
+		return err
+	}
+	return pdf.Output(w)
+}
+
+// Mesas do salão, com a prévia dos QR codes e o PDF para impressão
+func MesasHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	mesas, err := buscarConfigMesas(firestoreClient)
+	if err != nil {
+		log.Printf("Failed to fetch tables: %v", err)
+		http.Error(w, "Failed to fetch tables", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/mesas.html"))
+	data := MesasPageData{
+		PageTitle: "Coffee Shop - Mesas",
+		Mesas:     mesas,
+		Numeros:   mesas.numeros(),
+		URLLoja:   config.URLLoja,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+func SalvarMesasHandler(w http.ResponseWriter, r *http.Request) {
+	quantidade, err := strconv.Atoi(r.FormValue("quantidade"))
+	if err != nil || quantidade < 0 || quantidade > 500 {
+		http.Error(w, "Invalid number of tables", http.StatusBadRequest)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	if _, err := firestoreClient.Client.Collection("configuracoes").Doc(documentoMesas).Set(firestoreClient.Ctx, ConfigMesas{Quantidade: quantidade}); err != nil {
+		log.Printf("Failed to save tables: %v", err)
+		http.Error(w, "Failed to save tables", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/mesas", http.StatusSeeOther)
+}
+
+func QRCodeMesaHandler(w http.ResponseWriter, r *http.Request) {
+	numero, _ := strconv.Atoi(mux.Vars(r)["numero"])
+	if numero < 1 {
+		http.Error(w, "Invalid table", http.StatusBadRequest)
+		return
+	}
+	png, err := qrCodeMesa(numero, 256)
+	if err != nil {
+		log.Printf("Failed to generate QR code for table %d: %v", numero, err)
+		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
+
+func FolhaMesasHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	mesas, err := buscarConfigMesas(firestoreClient)
+	if err != nil {
+		log.Printf("Failed to fetch tables: %v", err)
+		http.Error(w, "Failed to fetch tables", http.StatusInternalServerError)
+		return
+	}
+	if mesas.Quantidade == 0 {
+		http.Error(w, "No tables configured", http.StatusNotFound)
+		return
+	}
+
+	var conteudo bytes.Buffer
+	if err := gerarFolhaMesas(&conteudo, mesas.numeros()); err != nil {
+		log.Printf("Failed to generate table QR sheet: %v", err)
+		http.Error(w, "Failed to generate QR sheet", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="mesas.pdf"`)
+	w.Write(conteudo.Bytes())
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Situações de uma inscrição na newsletter, gravada pelo Server_Usuario
+const (
+	InscricaoPendente   = "pendente"
+	InscricaoConfirmada = "confirmada"
+	InscricaoCancelada  = "cancelada"
+)
+
+const (
+	ModeloNewsletterConfirmacao = "newsletter_confirmacao"
+	ModeloNewsletterCampanha    = "newsletter_campanha"
+)
+
+// Limite de escritas de um batch do Firestore
+const tamanhoLoteFirestore = 500
+
+// Inscrição na coleção "newsletter", com o e-mail como ID do documento. Só as confirmadas pelo link
+// do email (double opt-in) recebem campanhas; o histórico de consentimentos fica em "consentimentos".
+type InscricaoNewsletter struct {
+	Email        string
+	Status       string
+	Token        string
+	CriadaEm     time.Time
+	ConfirmadaEm time.Time
+	CanceladaEm  time.Time
+}
+
+// Campanha enviada aos inscritos, guardada na coleção "campanhas"
+type Campanha struct {
+	ID            string `firestore:"-"`
+	Assunto       string
+	Corpo         string
+	Destinatarios int
+	CriadaEm      time.Time
+}
+
+type NewsletterPageData struct {
+	PageTitle   string
+	Inscricoes  []InscricaoNewsletter
+	Confirmadas int
+	Campanhas   []Campanha
+	Mensagem    string
+	Erro        string
+}
+
+func buscarInscricoes(firestoreClient *FirestoreClient, query firestore.Query) ([]InscricaoNewsletter, error) {
+	docs, err := query.Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	inscricoes := make([]InscricaoNewsletter, 0, len(docs))
+	for _, doc := range docs {
+		var inscricao InscricaoNewsletter
+		if err := doc.DataTo(&inscricao); err != nil {
+			return nil, err
+		}
+		inscricoes = append(inscricoes, inscricao)
+	}
+	return inscricoes, nil
+}
+
+// Inscrição do destinatário de uma campanha, ou nil se ela não existe mais
+func buscarInscricao(firestoreClient *FirestoreClient, para []string) (*InscricaoNewsletter, error) {
+	if len(para) != 1 {
+		return nil, nil
+	}
+	snapshot, err := firestoreClient.Client.Collection("newsletter").Doc(para[0]).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var inscricao InscricaoNewsletter
+	if err := snapshot.DataTo(&inscricao); err != nil {
+		return nil, err
+	}
+	return &inscricao, nil
+}
+
+// Só inscrições ainda confirmadas recebem a campanha
+func campanhaLiberada(inscricao *InscricaoNewsletter) bool {
+	return inscricao != nil && inscricao.Status == InscricaoConfirmada
+}
+
+// Link de cancelamento incluído em cada email da newsletter
+func urlCancelarNewsletter(inscricao InscricaoNewsletter) string {
+	return fmt.Sprintf("%s/newsletter/cancelar?token=%s", strings.TrimRight(config.URLLoja, "/"), url.QueryEscape(inscricao.Token))
+}
+
+func emailCampanha(campanha Campanha, inscricao InscricaoNewsletter, agora time.Time) EmailFila {
+	return novoEmail(ModeloNewsletterCampanha, []string{inscricao.Email}, map[string]interface{}{
+		"Assunto":     campanha.Assunto,
+		"Corpo":       campanha.Corpo,
+		"URLCancelar": urlCancelarNewsletter(inscricao),
+	}, agora)
+}
+
+// Emails da campanha, um por inscrito, divididos em lotes que cabem num batch do Firestore
+func lotesCampanha(campanha Campanha, inscricoes []InscricaoNewsletter) [][]EmailFila {
+	var lotes [][]EmailFila
+	for inicio := 0; inicio < len(inscricoes); inicio += tamanhoLoteFirestore {
+		fim := inicio + tamanhoLoteFirestore
+		if fim > len(inscricoes) {
+			fim = len(inscricoes)
+		}
+		lote := make([]EmailFila, 0, fim-inicio)
+		for _, inscricao := range inscricoes[inicio:fim] {
+			lote = append(lote, emailCampanha(campanha, inscricao, campanha.CriadaEm))
+		}
+		lotes = append(lotes, lote)
+	}
+	return lotes
+}
+
+// Inscritos, campanhas enviadas e o formulário de nova campanha
+func NewsletterHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	inscricoes, err := buscarInscricoes(firestoreClient, firestoreClient.Client.Collection("newsletter").OrderBy("CriadaEm", firestore.Desc))
+	if err != nil {
+		http.Error(w, "Failed to fetch subscribers", http.StatusInternalServerError)
+		return
+	}
+	data := NewsletterPageData{
+		PageTitle:  "Coffee Shop - Newsletter",
+		Inscricoes: inscricoes,
+		Mensagem:   r.URL.Query().Get("mensagem"),
+		Erro:       r.URL.Query().Get("erro"),
+	}
+	for i := range data.Inscricoes {
+		data.Inscricoes[i].CriadaEm = data.Inscricoes[i].CriadaEm.In(fusoLoja())
+		data.Inscricoes[i].ConfirmadaEm = data.Inscricoes[i].ConfirmadaEm.In(fusoLoja())
+		data.Inscricoes[i].CanceladaEm = data.Inscricoes[i].CanceladaEm.In(fusoLoja())
+		if data.Inscricoes[i].Status == InscricaoConfirmada {
+			data.Confirmadas++
+		}
+	}
+
+	docs, err := firestoreClient.Client.Collection("campanhas").OrderBy("CriadaEm", firestore.Desc).Limit(20).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		http.Error(w, "Failed to fetch campaigns", http.StatusInternalServerError)
+		return
+	}
+	for _, doc := range docs {
+		var campanha Campanha
+		if err := doc.DataTo(&campanha); err != nil {
+			http.Error(w, "Failed to parse campaign data", http.StatusInternalServerError)
+			return
+		}
+		campanha.ID = doc.Ref.ID
+		campanha.CriadaEm = campanha.CriadaEm.In(fusoLoja())
+		data.Campanhas = append(data.Campanhas, campanha)
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/newsletter.html"))
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+// Lista de inscritos em CSV, com as datas de inscrição, confirmação e cancelamento
+func ExportarInscritosHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	inscricoes, err := buscarInscricoes(firestoreClient, firestoreClient.Client.Collection("newsletter").OrderBy("CriadaEm", firestore.Asc))
+	if err != nil {
+		http.Error(w, "Failed to fetch subscribers", http.StatusInternalServerError)
+		return
+	}
+
+	data := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.In(fusoLoja()).Format("2006-01-02 15:04:05")
+	}
+	linhas := [][]string{{"Email", "Situacao", "InscritoEm", "ConfirmadoEm", "CanceladoEm"}}
+	for _, inscricao := range inscricoes {
+		linhas = append(linhas, []string{inscricao.Email, inscricao.Status, data(inscricao.CriadaEm), data(inscricao.ConfirmadaEm), data(inscricao.CanceladaEm)})
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="newsletter_%s.csv"`, time.Now().In(fusoLoja()).Format("20060102")))
+	if err := csv.NewWriter(w).WriteAll(linhas); err != nil {
+		http.Error(w, "Failed to write CSV", http.StatusInternalServerError)
+	}
+}
+
+// Envia a campanha a todos os inscritos confirmados, pela fila de emails. Com "teste", a mensagem vai
+// na hora só para o endereço informado, pelo mailer configurado, para conferir o texto e o servidor SMTP.
+func EnviarCampanhaHandler(w http.ResponseWriter, r *http.Request) {
+	campanha := Campanha{
+		Assunto:  strings.TrimSpace(r.FormValue("assunto")),
+		Corpo:    strings.TrimSpace(r.FormValue("corpo")),
+		CriadaEm: time.Now(),
+	}
+	if campanha.Assunto == "" || campanha.Corpo == "" {
+		http.Redirect(w, r, "/newsletter?erro="+url.QueryEscape("Informe o assunto e o texto da campanha"), http.StatusSeeOther)
+		return
+	}
+
+	if teste := strings.TrimSpace(r.FormValue("teste")); teste != "" {
+		mensagem, err := renderizarEmail(emailCampanha(campanha, InscricaoNewsletter{Email: teste}, campanha.CriadaEm), nil)
+		if err == nil {
+			err = mailerConfigurado().Enviar(mensagem)
+		}
+		if err != nil {
+			http.Redirect(w, r, "/newsletter?erro="+url.QueryEscape("Falha no envio de teste: "+err.Error()), http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/newsletter?mensagem="+url.QueryEscape("Teste enviado para "+teste), http.StatusSeeOther)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	inscricoes, err := buscarInscricoes(firestoreClient, firestoreClient.Client.Collection("newsletter").Where("Status", "==", InscricaoConfirmada))
+	if err != nil {
+		http.Error(w, "Failed to fetch subscribers", http.StatusInternalServerError)
+		return
+	}
+	if len(inscricoes) == 0 {
+		http.Redirect(w, r, "/newsletter?erro="+url.QueryEscape("Nenhum inscrito confirmado"), http.StatusSeeOther)
+		return
+	}
+
+	campanha.Destinatarios = len(inscricoes)
+	if _, _, err := firestoreClient.Client.Collection("campanhas").Add(firestoreClient.Ctx, campanha); err != nil {
+		http.Error(w, "Failed to save campaign", http.StatusInternalServerError)
+		return
+	}
+
+	// Enfileira em lotes, respeitando o limite de escritas por batch
+	emails := firestoreClient.Client.Collection("emails")
+	for _, lote := range lotesCampanha(campanha, inscricoes) {
+		batch := firestoreClient.Client.Batch()
+		for _, email := range lote {
+			batch.Create(emails.NewDoc(), email)
+		}
+		if _, err := batch.Commit(firestoreClient.Ctx); err != nil {
+			http.Error(w, "Failed to queue campaign emails", http.StatusInternalServerError)
+			return
+		}
+	}
+	acordarFilaEmails()
+
+	http.Redirect(w, r, "/newsletter?mensagem="+url.QueryEscape(fmt.Sprintf("Campanha enfileirada para %d inscritos", campanha.Destinatarios)), http.StatusSeeOther)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func inscritosTeste(quantidade int) []InscricaoNewsletter {
+	inscricoes := make([]InscricaoNewsletter, quantidade)
+	for i := range inscricoes {
+		inscricoes[i] = InscricaoNewsletter{Email: fmt.Sprintf("cliente%d@example.com", i), Status: InscricaoConfirmada, Token: fmt.Sprintf("token-%d", i)}
+	}
+	return inscricoes
+}
+
+func TestLotesCampanha(t *testing.T) {
+	campanha := Campanha{Assunto: "Novidades", Corpo: "Café novo no cardápio", CriadaEm: time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC)}
+	inscricoes := inscritosTeste(2*tamanhoLoteFirestore + 1)
+
+	lotes := lotesCampanha(campanha, inscricoes)
+	if len(lotes) != 3 {
+		t.Fatalf("lotes = %d, esperava 3", len(lotes))
+	}
+	for i, esperado := range []int{tamanhoLoteFirestore, tamanhoLoteFirestore, 1} {
+		if len(lotes[i]) != esperado {
+			t.Errorf("lote %d com %d emails, esperava %d", i, len(lotes[i]), esperado)
+		}
+	}
+
+	// Cada inscrito recebe um email pendente só para ele, com o próprio link de cancelamento
+	ultimo := lotes[2][0]
+	if ultimo.Modelo != ModeloNewsletterCampanha || ultimo.Status != EmailPendente {
+		t.Errorf("email enfileirado como %s/%s", ultimo.Modelo, ultimo.Status)
+	}
+	if len(ultimo.Para) != 1 || ultimo.Para[0] != inscricoes[len(inscricoes)-1].Email {
+		t.Errorf("destinatários = %v", ultimo.Para)
+	}
+	if !ultimo.ProximaTentativa.Equal(campanha.CriadaEm) {
+		t.Errorf("próxima tentativa = %v, esperava %v", ultimo.ProximaTentativa, campanha.CriadaEm)
+	}
+	url, _ := ultimo.Dados["URLCancelar"].(string)
+	if !strings.HasSuffix(url, "/newsletter/cancelar?token=token-1000") {
+		t.Errorf("link de cancelamento = %q", url)
+	}
+
+	if lotes := lotesCampanha(campanha, nil); len(lotes) != 0 {
+		t.Errorf("sem inscritos gerou %d lotes", len(lotes))
+	}
+}
+
+func TestEmailCampanhaRenderizado(t *testing.T) {
+	campanha := Campanha{Assunto: "Novidades", Corpo: "Café novo no cardápio"}
+	email := emailCampanha(campanha, InscricaoNewsletter{Email: "ana@example.com", Token: "abc"}, time.Now())
+
+	mensagem, err := renderizarEmail(email, []string{"equipe@coffeeshop.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mensagem.Assunto != "Novidades" || len(mensagem.Para) != 1 || mensagem.Para[0] != "ana@example.com" {
+		t.Errorf("mensagem = %q para %v", mensagem.Assunto, mensagem.Para)
+	}
+	if !strings.Contains(mensagem.Corpo, "Café novo no cardápio") || !strings.Contains(mensagem.Corpo, "/newsletter/cancelar?token=abc") {
+		t.Errorf("corpo sem o texto ou o link de cancelamento:\n%s", mensagem.Corpo)
+	}
+}
+
+func TestCampanhaLiberada(t *testing.T) {
+	casos := []struct {
+		nome      string
+		inscricao *InscricaoNewsletter
+		esperado  bool
+	}{
+		{"confirmada", &InscricaoNewsletter{Status: InscricaoConfirmada}, true},
+		{"cancelada depois de enfileirada", &InscricaoNewsletter{Status: InscricaoCancelada}, false},
+		{"pendente", &InscricaoNewsletter{Status: InscricaoPendente}, false},
+		{"apagada", nil, false},
+	}
+	for _, caso := range casos {
+		if liberada := campanhaLiberada(caso.inscricao); liberada != caso.esperado {
+			t.Errorf("%s: liberada = %v, esperava %v", caso.nome, liberada, caso.esperado)
+		}
+	}
+}
@@ -0,0 +1,930 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/mux"
+	"github.com/skip2/go-qrcode"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Ambiente de emissão (tpAmb)
+const (
+	AmbienteProducao    = 1
+	AmbienteHomologacao = 2
+)
+
+const (
+	nsNFe      = "http://www.portalfiscal.inf.br/nfe"
+	versaoNFe  = "4.00"
+	modeloNFCe = "65"
+)
+
+// Situações da nota de um pedido, na coleção "nfce" com o código do pedido como ID do documento
+const (
+	NFCePendente   = "pendente"
+	NFCeAutorizada = "autorizada"
+	NFCeRejeitada  = "rejeitada"
+	// Pedido sem nada a declarar, como só vales-presente, ou cancelado antes da emissão
+	NFCeDispensada = "dispensada"
+)
+
+// Em homologação a SEFAZ exige este texto na descrição do primeiro item
+const descricaoHomologacao = "NOTA FISCAL EMITIDA EM AMBIENTE DE HOMOLOGACAO - SEM VALOR FISCAL"
+
+var ErrNFCeNaoEncontrada = errors.New("NFC-e not found")
+
+// Códigos IBGE das UFs, que abrem a chave de acesso
+var codigosUF = map[string]string{
+	"RO": "11", "AC": "12", "AM": "13", "RR": "14", "PA": "15", "AP": "16", "TO": "17",
+	"MA": "21", "PI": "22", "CE": "23", "RN": "24", "PB": "25", "PE": "26", "AL": "27", "SE": "28", "BA": "29",
+	"MG": "31", "ES": "32", "RJ": "33", "SP": "35",
+	"PR": "41", "SC": "42", "RS": "43",
+	"MS": "50", "MT": "51", "GO": "52", "DF": "53",
+}
+
+// Meios de pagamento (tPag) dos métodos da loja; o vale-presente é crédito da própria loja
+var meiosPagamentoNFCe = map[string]string{
+	"cash": "01",
+	"card": "03",
+	"vale": "05",
+	"pix":  "17",
+}
+
+// Nota fiscal de um pedido. A numeração é reservada na primeira tentativa e mantida nas seguintes,
+// e o XML assinado fica guardado para ser reenviado igual se a SEFAZ não responder.
+type DocumentoFiscal struct {
+	Codigo   int
+	Status   string
+	Ambiente int
+	Serie    int
+	Numero   int
+	// Código numérico aleatório (cNF) que compõe a chave
+	CodigoNumerico int
+	Chave          string
+	// NFe assinada enquanto pendente; depois de autorizada, o nfeProc com o protocolo
+	XML          string
+	URLQRCode    string
+	CodigoStatus int
+	Motivo       string
+	Protocolo    string
+	SolicitadaEm time.Time
+	EmitidaEm    time.Time
+	AutorizadaEm time.Time
+	Tentativas   int
+}
+
+func (d DocumentoFiscal) ChaveFormatada() string {
+	var partes []string
+	for i := 0; i < len(d.Chave); i += 4 {
+		fim := i + 4
+		if fim > len(d.Chave) {
+			fim = len(d.Chave)
+		}
+		partes = append(partes, d.Chave[i:fim])
+	}
+	return strings.Join(partes, " ")
+}
+
+// Elementos do leiaute 4.00 usados na NFC-e, na ordem do schema. Os valores vão já formatados.
+type infNFe struct {
+	XMLName xml.Name `xml:"infNFe"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	ID      string   `xml:"Id,attr"`
+	Versao  string   `xml:"versao,attr"`
+	Ide     ideNFe   `xml:"ide"`
+	Emit    emitNFe  `xml:"emit"`
+	Det     []detNFe `xml:"det"`
+	Total   totalNFe `xml:"total>ICMSTot"`
+	Frete   string   `xml:"transp>modFrete"`
+	Pag     []detPag `xml:"pag>detPag"`
+}
+
+type ideNFe struct {
+	CUF         string `xml:"cUF"`
+	CNF         string `xml:"cNF"`
+	NatOp       string `xml:"natOp"`
+	Mod         string `xml:"mod"`
+	Serie       string `xml:"serie"`
+	NNF         string `xml:"nNF"`
+	DhEmi       string `xml:"dhEmi"`
+	TpNF        string `xml:"tpNF"`
+	IDDest      string `xml:"idDest"`
+	CMunFG      string `xml:"cMunFG"`
+	TpImp       string `xml:"tpImp"`
+	TpEmis      string `xml:"tpEmis"`
+	CDV         string `xml:"cDV"`
+	TpAmb       string `xml:"tpAmb"`
+	FinNFe      string `xml:"finNFe"`
+	IndFinal    string `xml:"indFinal"`
+	IndPres     string `xml:"indPres"`
+	IndIntermed string `xml:"indIntermed,omitempty"`
+	ProcEmi     string `xml:"procEmi"`
+	VerProc     string `xml:"verProc"`
+}
+
+type emitNFe struct {
+	CNPJ     string `xml:"CNPJ"`
+	XNome    string `xml:"xNome"`
+	XFant    string `xml:"xFant,omitempty"`
+	Endereco struct {
+		XLgr    string `xml:"xLgr"`
+		Nro     string `xml:"nro"`
+		XBairro string `xml:"xBairro"`
+		CMun    string `xml:"cMun"`
+		XMun    string `xml:"xMun"`
+		UF      string `xml:"UF"`
+		CEP     string `xml:"CEP"`
+		CPais   string `xml:"cPais"`
+		XPais   string `xml:"xPais"`
+	} `xml:"enderEmit"`
+	IE  string `xml:"IE"`
+	CRT string `xml:"CRT"`
+}
+
+type detNFe struct {
+	NItem   string     `xml:"nItem,attr"`
+	Prod    prodNFe    `xml:"prod"`
+	Imposto impostoNFe `xml:"imposto"`
+}
+
+type prodNFe struct {
+	CProd    string `xml:"cProd"`
+	CEAN     string `xml:"cEAN"`
+	XProd    string `xml:"xProd"`
+	NCM      string `xml:"NCM"`
+	CFOP     string `xml:"CFOP"`
+	UCom     string `xml:"uCom"`
+	QCom     string `xml:"qCom"`
+	VUnCom   string `xml:"vUnCom"`
+	VProd    string `xml:"vProd"`
+	CEANTrib string `xml:"cEANTrib"`
+	UTrib    string `xml:"uTrib"`
+	QTrib    string `xml:"qTrib"`
+	VUnTrib  string `xml:"vUnTrib"`
+	VDesc    string `xml:"vDesc,omitempty"`
+	VOutro   string `xml:"vOutro,omitempty"`
+	IndTot   string `xml:"indTot"`
+}
+
+// Tributos do item; o nome de cada grupo depende do CST, por isso vem do XMLName
+type impostoNFe struct {
+	ICMS struct {
+		Grupo icmsNFe
+	} `xml:"ICMS"`
+	PIS struct {
+		Grupo pisNFe
+	} `xml:"PIS"`
+	COFINS struct {
+		Grupo cofinsNFe
+	} `xml:"COFINS"`
+}
+
+// ICMSSN102 e ICMSSN500 no Simples Nacional; ICMS00, ICMS40 e ICMS60 no regime normal
+type icmsNFe struct {
+	XMLName xml.Name
+	Orig    string `xml:"orig"`
+	CSOSN   string `xml:"CSOSN,omitempty"`
+	CST     string `xml:"CST,omitempty"`
+	ModBC   string `xml:"modBC,omitempty"`
+	VBC     string `xml:"vBC,omitempty"`
+	PICMS   string `xml:"pICMS,omitempty"`
+	VICMS   string `xml:"vICMS,omitempty"`
+}
+
+// PISAliq com alíquota informada, PISOutr sem ela
+type pisNFe struct {
+	XMLName xml.Name
+	CST     string `xml:"CST"`
+	VBC     string `xml:"vBC"`
+	PPIS    string `xml:"pPIS"`
+	VPIS    string `xml:"vPIS"`
+}
+
+type cofinsNFe struct {
+	XMLName xml.Name
+	CST     string `xml:"CST"`
+	VBC     string `xml:"vBC"`
+	PCOFINS string `xml:"pCOFINS"`
+	VCOFINS string `xml:"vCOFINS"`
+}
+
+type totalNFe struct {
+	VBC        string `xml:"vBC"`
+	VICMS      string `xml:"vICMS"`
+	VICMSDeson string `xml:"vICMSDeson"`
+	VFCP       string `xml:"vFCP"`
+	VBCST      string `xml:"vBCST"`
+	VST        string `xml:"vST"`
+	VFCPST     string `xml:"vFCPST"`
+	VFCPSTRet  string `xml:"vFCPSTRet"`
+	VProd      string `xml:"vProd"`
+	VFrete     string `xml:"vFrete"`
+	VSeg       string `xml:"vSeg"`
+	VDesc      string `xml:"vDesc"`
+	VII        string `xml:"vII"`
+	VIPI       string `xml:"vIPI"`
+	VIPIDevol  string `xml:"vIPIDevol"`
+	VPIS       string `xml:"vPIS"`
+	VCOFINS    string `xml:"vCOFINS"`
+	VOutro     string `xml:"vOutro"`
+	VNF        string `xml:"vNF"`
+}
+
+type detPag struct {
+	TPag string `xml:"tPag"`
+	VPag string `xml:"vPag"`
+	// Cartão sem integração com a automação (tpIntegra 2)
+	TpIntegra string `xml:"card>tpIntegra,omitempty"`
+}
+
+type infNFeSupl struct {
+	XMLName  xml.Name `xml:"infNFeSupl"`
+	QRCode   string   `xml:"qrCode"`
+	URLChave string   `xml:"urlChave"`
+}
+
+func moedaNFe(valor float64) string {
+	return strconv.FormatFloat(arredondarCentavos(valor), 'f', 2, 64)
+}
+
+func valorNFe(texto string) float64 {
+	valor, _ := strconv.ParseFloat(texto, 64)
+	return valor
+}
+
+// Dígito verificador da chave de acesso, pelo módulo 11 com pesos de 2 a 9 da direita para a esquerda
+func digitoChave(chave string) string {
+	soma, peso := 0, 2
+	for i := len(chave) - 1; i >= 0; i-- {
+		soma += int(chave[i]-'0') * peso
+		if peso++; peso > 9 {
+			peso = 2
+		}
+	}
+	resto := soma % 11
+	if resto < 2 {
+		return "0"
+	}
+	return strconv.Itoa(11 - resto)
+}
+
+func chaveAcesso(uf string, emissao time.Time, cnpj string, serie, numero, codigoNumerico int) string {
+	chave := fmt.Sprintf("%s%s%s%s%03d%09d1%08d", codigosUF[uf], emissao.Format("0601"), cnpj, modeloNFCe, serie, numero, codigoNumerico)
+	return chave + digitoChave(chave)
+}
+
+// QR code da NFC-e na versão 2, emissão on-line: o hash leva o CSC, que não vai no endereço
+func urlQRCodeNFCe(cfg ConfigNFCe, chave string, ambiente int) string {
+	token := strings.TrimLeft(cfg.IDToken, "0")
+	parametros := fmt.Sprintf("%s|2|%d|%s", chave, ambiente, token)
+	hash := sha1.Sum([]byte(parametros + cfg.CSC))
+	return fmt.Sprintf("%s?p=%s|%s", cfg.URLQRCode, parametros, strings.ToUpper(fmt.Sprintf("%x", hash)))
+}
+
+func aliquotaNFe(aliquota float64) string {
+	return strconv.FormatFloat(aliquota, 'f', 4, 64)
+}
+
+// Grupos de tributos do item a partir dos valores calculados para a linha
+func impostoItemNFe(impostos ImpostosLinha, crt int) impostoNFe {
+	var imposto impostoNFe
+	icms := icmsNFe{Orig: "0"}
+	if crt == CRTSimplesNacional {
+		icms.CSOSN = impostos.CST
+		icms.XMLName.Local = "ICMSSN102"
+		if impostos.CST == "500" {
+			icms.XMLName.Local = "ICMSSN500"
+		}
+	} else {
+		icms.CST = impostos.CST
+		switch impostos.CST {
+		case "00":
+			icms.XMLName.Local = "ICMS00"
+			icms.ModBC, icms.VBC = "3", moedaNFe(impostos.BaseCalculo)
+			icms.PICMS, icms.VICMS = aliquotaNFe(impostos.AliquotaICMS), moedaNFe(impostos.ICMS)
+		case "60":
+			icms.XMLName.Local = "ICMS60"
+		default:
+			icms.XMLName.Local = "ICMS40"
+		}
+	}
+	imposto.ICMS.Grupo = icms
+
+	imposto.PIS.Grupo = pisNFe{XMLName: xml.Name{Local: "PISOutr"}, CST: "99", VBC: moedaNFe(0), PPIS: aliquotaNFe(0), VPIS: moedaNFe(0)}
+	if impostos.AliquotaPIS > 0 {
+		imposto.PIS.Grupo = pisNFe{XMLName: xml.Name{Local: "PISAliq"}, CST: "01", VBC: moedaNFe(impostos.BaseCalculo),
+			PPIS: aliquotaNFe(impostos.AliquotaPIS), VPIS: moedaNFe(impostos.PIS)}
+	}
+	imposto.COFINS.Grupo = cofinsNFe{XMLName: xml.Name{Local: "COFINSOutr"}, CST: "99", VBC: moedaNFe(0), PCOFINS: aliquotaNFe(0), VCOFINS: moedaNFe(0)}
+	if impostos.AliquotaCOFINS > 0 {
+		imposto.COFINS.Grupo = cofinsNFe{XMLName: xml.Name{Local: "COFINSAliq"}, CST: "01", VBC: moedaNFe(impostos.BaseCalculo),
+			PCOFINS: aliquotaNFe(impostos.AliquotaCOFINS), VCOFINS: moedaNFe(impostos.COFINS)}
+	}
+	return imposto
+}
+
+// Monta a nota do pedido. Vales-presente vendidos não entram, pois são tributados quando usados,
+// e a taxa de entrega vai como outras despesas do último item, já que a NFC-e não tem frete.
+// Devolve nil quando não sobra nada a declarar.
+func montarNFCe(cfg ConfigNFCe, doc DocumentoFiscal, transacoes []Transacao, produtos map[int]Produto, entrega bool) (*infNFe, error) {
+	pedido, err := montarPedido(doc.Codigo, transacoes)
+	if err != nil {
+		return nil, err
+	}
+	emitente := cfg.Emitente
+	if _, ok := codigosUF[emitente.UF]; !ok {
+		return nil, fmt.Errorf("invalid issuer state %q", emitente.UF)
+	}
+	emissao := doc.EmitidaEm.In(fusoLoja())
+
+	// Dados fiscais gravados na venda de cada produto
+	fiscais := make(map[int]DadosFiscais)
+	for _, t := range transacoes {
+		if _, ok := fiscais[t.CodigoProd]; !ok && !t.Estorno() {
+			fiscais[t.CodigoProd] = dadosFiscaisTransacao(t, produtos, cfg)
+		}
+	}
+
+	nfe := &infNFe{Xmlns: nsNFe, Versao: versaoNFe, Frete: "9"}
+	var totalProdutos, totalDescontos, taxaEntrega float64
+	var tributos ImpostosLinha
+	// Só as linhas com ICMS destacado entram na base de cálculo do total
+	var baseICMS float64
+	for _, item := range pedido.Itens {
+		if item.CodigoProd == CodigoTaxaEntrega {
+			taxaEntrega += item.ValorPago
+			continue
+		}
+		produto := produtos[item.CodigoProd]
+		if produto.ValePresente || item.Vendido <= 0 {
+			continue
+		}
+		impostos := calcularImpostos(fiscais[item.CodigoProd], emitente.CRT, item.ValorPago)
+		if !padraoNCM.MatchString(impostos.NCM) {
+			return nil, fmt.Errorf("invalid NCM %q for product %d", impostos.NCM, item.CodigoProd)
+		}
+
+		valorProduto := arredondarCentavos(item.ValorUnitario * float64(item.Vendido))
+		desconto := arredondarCentavos(valorProduto - item.ValorPago)
+		det := detNFe{NItem: strconv.Itoa(len(nfe.Det) + 1), Prod: prodNFe{
+			CProd: strconv.Itoa(item.CodigoProd), CEAN: "SEM GTIN", XProd: item.NomeProd, NCM: impostos.NCM, CFOP: impostos.CFOP,
+			UCom: "UN", QCom: fmt.Sprintf("%d.0000", item.Vendido), VUnCom: moedaNFe(item.ValorUnitario), VProd: moedaNFe(valorProduto),
+			CEANTrib: "SEM GTIN", UTrib: "UN", QTrib: fmt.Sprintf("%d.0000", item.Vendido), VUnTrib: moedaNFe(item.ValorUnitario),
+			IndTot: "1",
+		}}
+		if desconto > 0 {
+			det.Prod.VDesc = moedaNFe(desconto)
+			totalDescontos += desconto
+		}
+		if cfg.Ambiente == AmbienteHomologacao && len(nfe.Det) == 0 {
+			det.Prod.XProd = descricaoHomologacao
+		}
+		det.Imposto = impostoItemNFe(impostos, emitente.CRT)
+		tributos.somar(impostos)
+		if impostos.AliquotaICMS > 0 {
+			baseICMS += impostos.BaseCalculo
+		}
+		totalProdutos += valorProduto
+		nfe.Det = append(nfe.Det, det)
+	}
+	if len(nfe.Det) == 0 {
+		return nil, nil
+	}
+	if taxaEntrega > 0 {
+		nfe.Det[len(nfe.Det)-1].Prod.VOutro = moedaNFe(taxaEntrega)
+	}
+	total := arredondarCentavos(totalProdutos - totalDescontos + taxaEntrega)
+
+	// Pagamentos somados por meio, só das linhas que entraram na nota
+	valores := make(map[string]float64)
+	var meios []string
+	for _, t := range transacoes {
+		if t.Estorno() || produtos[t.CodigoProd].ValePresente {
+			continue
+		}
+		pagamentos := t.Pagamentos
+		if len(pagamentos) == 0 {
+			pagamentos = []PagamentoParcial{{Metodo: t.MetodoPagamento, Valor: t.ValorTransacao}}
+		}
+		for _, p := range pagamentos {
+			meio, ok := meiosPagamentoNFCe[p.Metodo]
+			if !ok {
+				meio = "99"
+			}
+			if _, ok := valores[meio]; !ok {
+				meios = append(meios, meio)
+			}
+			valores[meio] += p.Valor
+		}
+	}
+	pago := 0.0
+	for i, meio := range meios {
+		valor := arredondarCentavos(valores[meio])
+		// Sobras de arredondamento do rateio ficam no último meio
+		if i == len(meios)-1 {
+			valor = arredondarCentavos(total - pago)
+		}
+		pago += valor
+		pagamento := detPag{TPag: meio, VPag: moedaNFe(valor)}
+		if meio == meiosPagamentoNFCe["card"] {
+			pagamento.TpIntegra = "2"
+		}
+		nfe.Pag = append(nfe.Pag, pagamento)
+	}
+	if len(nfe.Pag) == 0 {
+		nfe.Pag = []detPag{{TPag: "90", VPag: "0.00"}}
+	}
+
+	chave := chaveAcesso(emitente.UF, emissao, emitente.CNPJ, doc.Serie, doc.Numero, doc.CodigoNumerico)
+	nfe.ID = "NFe" + chave
+	nfe.Ide = ideNFe{
+		CUF: codigosUF[emitente.UF], CNF: fmt.Sprintf("%08d", doc.CodigoNumerico), NatOp: "VENDA", Mod: modeloNFCe,
+		Serie: strconv.Itoa(doc.Serie), NNF: strconv.Itoa(doc.Numero), DhEmi: emissao.Format(time.RFC3339),
+		TpNF: "1", IDDest: "1", CMunFG: emitente.CodigoMunicipio, TpImp: "4", TpEmis: "1", CDV: chave[43:],
+		TpAmb: strconv.Itoa(cfg.Ambiente), FinNFe: "1", IndFinal: "1", IndPres: "1", ProcEmi: "0", VerProc: "CoffeeShop 1.0",
+	}
+	// Entrega em domicílio tem indicador de presença próprio, que pede também o de intermediador
+	if entrega {
+		nfe.Ide.IndPres, nfe.Ide.IndIntermed = "4", "0"
+	}
+	nfe.Emit = emitNFe{CNPJ: emitente.CNPJ, XNome: emitente.RazaoSocial, XFant: emitente.NomeFantasia, IE: emitente.IE, CRT: strconv.Itoa(emitente.CRT)}
+	nfe.Emit.Endereco.XLgr, nfe.Emit.Endereco.Nro, nfe.Emit.Endereco.XBairro = emitente.Logradouro, emitente.Numero, emitente.Bairro
+	nfe.Emit.Endereco.CMun, nfe.Emit.Endereco.XMun, nfe.Emit.Endereco.UF = emitente.CodigoMunicipio, emitente.Municipio, emitente.UF
+	nfe.Emit.Endereco.CEP, nfe.Emit.Endereco.CPais, nfe.Emit.Endereco.XPais = emitente.CEP, "1058", "BRASIL"
+
+	zero := moedaNFe(0)
+	nfe.Total = totalNFe{
+		VBC: moedaNFe(baseICMS), VICMS: moedaNFe(tributos.ICMS), VICMSDeson: zero, VFCP: zero, VBCST: zero, VST: zero, VFCPST: zero, VFCPSTRet: zero,
+		VProd: moedaNFe(totalProdutos), VFrete: zero, VSeg: zero, VDesc: moedaNFe(totalDescontos), VII: zero, VIPI: zero,
+		VIPIDevol: zero, VPIS: moedaNFe(tributos.PIS), VCOFINS: moedaNFe(tributos.COFINS), VOutro: moedaNFe(taxaEntrega), VNF: moedaNFe(total),
+	}
+	return nfe, nil
+}
+
+// NFe assinada: o infNFe canônico, os dados do QR code e a assinatura
+func documentoNFCe(cfg ConfigNFCe, nfe *infNFe, certificado *CertificadoA1) ([]byte, string, error) {
+	conteudo, err := xml.Marshal(nfe)
+	if err != nil {
+		return nil, "", err
+	}
+	canonico, err := canonicalizar(conteudo, "infNFe")
+	if err != nil {
+		return nil, "", err
+	}
+	assinatura, err := assinarXML(canonico, nfe.ID, certificado)
+	if err != nil {
+		return nil, "", err
+	}
+	chave := strings.TrimPrefix(nfe.ID, "NFe")
+	qrCode := urlQRCodeNFCe(cfg, chave, valorAmbiente(nfe.Ide.TpAmb))
+	suplemento, err := xml.Marshal(infNFeSupl{QRCode: qrCode, URLChave: cfg.URLConsulta})
+	if err != nil {
+		return nil, "", err
+	}
+	documento := `<NFe xmlns="` + nsNFe + `">` + string(canonico) + string(suplemento) + assinatura + `</NFe>`
+	return []byte(documento), qrCode, nil
+}
+
+func valorAmbiente(texto string) int {
+	ambiente, _ := strconv.Atoi(texto)
+	return ambiente
+}
+
+// Nota autorizada com o protocolo, como deve ser guardada e entregue ao consumidor
+func processoNFCe(nfe []byte, chave string, ambiente int, retorno RetornoSefaz) string {
+	return fmt.Sprintf(`<nfeProc xmlns="%s" versao="%s">%s<protNFe versao="%s"><infProt><tpAmb>%d</tpAmb><chNFe>%s</chNFe>`+
+		`<dhRecbto>%s</dhRecbto><nProt>%s</nProt><cStat>%d</cStat><xMotivo>%s</xMotivo></infProt></protNFe></nfeProc>`,
+		nsNFe, versaoNFe, nfe, versaoNFe, ambiente, chave, retorno.RecebidoEm.In(fusoLoja()).Format(time.RFC3339),
+		retorno.Protocolo, retorno.Status, escaparTextoC14N(retorno.Motivo))
+}
+
+var padraoProtocoloDuplicidade = regexp.MustCompile(`nProt:([0-9]+)`)
+
+func buscarDocumentoFiscal(firestoreClient *FirestoreClient, codigo int) (*DocumentoFiscal, error) {
+	snapshot, err := firestoreClient.Client.Collection("nfce").Doc(strconv.Itoa(codigo)).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc DocumentoFiscal
+	if err := snapshot.DataTo(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// Coloca o pedido na fila de emissão; uma nota rejeitada volta para a fila, com o mesmo número
+func solicitarNFCe(firestoreClient *FirestoreClient, codigo int, agora time.Time) error {
+	ref := firestoreClient.Client.Collection("nfce").Doc(strconv.Itoa(codigo))
+	return firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if !snapshot.Exists() {
+			return tx.Set(ref, DocumentoFiscal{Codigo: codigo, Status: NFCePendente, SolicitadaEm: agora})
+		}
+		var doc DocumentoFiscal
+		if err := snapshot.DataTo(&doc); err != nil {
+			return err
+		}
+		if doc.Status != NFCeRejeitada {
+			return nil
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "Status", Value: NFCePendente},
+			{Path: "XML", Value: ""},
+		})
+	})
+}
+
+// Reserva o próximo número da série para a nota, uma única vez, e fixa a data de emissão que entra na chave
+func numerarNFCe(firestoreClient *FirestoreClient, codigo int, cfg ConfigNFCe, agora time.Time) (DocumentoFiscal, error) {
+	ref := firestoreClient.Client.Collection("nfce").Doc(strconv.Itoa(codigo))
+	serieRef := firestoreClient.Client.Collection("numeracao_nfce").Doc(strconv.Itoa(cfg.Serie))
+
+	var doc DocumentoFiscal
+	err := firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return ErrNFCeNaoEncontrada
+		}
+		if err != nil {
+			return err
+		}
+		doc = DocumentoFiscal{}
+		if err := snapshot.DataTo(&doc); err != nil {
+			return err
+		}
+		if doc.Numero != 0 {
+			return nil
+		}
+
+		var numeracao struct{ Ultimo int }
+		snapshot, err = tx.Get(serieRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if snapshot.Exists() {
+			if err := snapshot.DataTo(&numeracao); err != nil {
+				return err
+			}
+		}
+		doc.Numero = numeracao.Ultimo + 1
+		doc.Serie = cfg.Serie
+		doc.Ambiente = cfg.Ambiente
+		doc.EmitidaEm = agora
+		// O código numérico não pode repetir o número da nota
+		for doc.CodigoNumerico == 0 || doc.CodigoNumerico == doc.Numero {
+			n, err := rand.Int(rand.Reader, big.NewInt(100000000))
+			if err != nil {
+				return err
+			}
+			doc.CodigoNumerico = int(n.Int64())
+		}
+
+		if err := tx.Set(serieRef, map[string]interface{}{"Ultimo": doc.Numero}); err != nil {
+			return err
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "Numero", Value: doc.Numero},
+			{Path: "Serie", Value: doc.Serie},
+			{Path: "Ambiente", Value: doc.Ambiente},
+			{Path: "EmitidaEm", Value: doc.EmitidaEm},
+			{Path: "CodigoNumerico", Value: doc.CodigoNumerico},
+		})
+	})
+	return doc, err
+}
+
+func buscarTransacoesPedido(firestoreClient *FirestoreClient, codigo int) ([]Transacao, map[int]Produto, error) {
+	docs, err := firestoreClient.Client.Collection("transacoes").Where("CodigoTransacao", "==", codigo).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	var transacoes []Transacao
+	produtos := make(map[int]Produto)
+	for _, doc := range docs {
+		var t Transacao
+		if err := doc.DataTo(&t); err != nil {
+			return nil, nil, err
+		}
+		transacoes = append(transacoes, t)
+		if _, ok := produtos[t.CodigoProd]; ok || t.CodigoProd == CodigoTaxaEntrega {
+			continue
+		}
+		// Um produto que saiu do catálogo fica com os dados fiscais padrão
+		snapshot, err := firestoreClient.Client.Collection("produtos").Doc(strconv.Itoa(t.CodigoProd)).Get(firestoreClient.Ctx)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return nil, nil, err
+		}
+		var produto Produto
+		if snapshot.Exists() {
+			if err := snapshot.DataTo(&produto); err != nil {
+				return nil, nil, err
+			}
+		}
+		produtos[t.CodigoProd] = produto
+	}
+	return transacoes, produtos, nil
+}
+
+func atualizarDocumentoFiscal(firestoreClient *FirestoreClient, doc DocumentoFiscal) error {
+	_, err := firestoreClient.Client.Collection("nfce").Doc(strconv.Itoa(doc.Codigo)).Set(firestoreClient.Ctx, doc)
+	return err
+}
+
+// Emite a nota pendente do pedido e grava o resultado. Uma falha de comunicação deixa a nota pendente,
+// com o mesmo XML, para a próxima tentativa; uma rejeição fica registrada com o motivo da SEFAZ.
+func emitirNFCe(firestoreClient *FirestoreClient, codigo int, sefaz Sefaz, certificado *CertificadoA1, agora time.Time) (DocumentoFiscal, error) {
+	cfg := config.NFCe
+	atual, err := buscarDocumentoFiscal(firestoreClient, codigo)
+	if err != nil {
+		return DocumentoFiscal{}, err
+	}
+	if atual == nil {
+		return DocumentoFiscal{}, ErrNFCeNaoEncontrada
+	}
+	doc := *atual
+	if doc.Status != NFCePendente {
+		return doc, nil
+	}
+
+	if doc.XML == "" {
+		transacoes, produtos, err := buscarTransacoesPedido(firestoreClient, codigo)
+		if err != nil {
+			return doc, err
+		}
+		pedido, err := montarPedido(codigo, transacoes)
+		if err != nil {
+			return doc, err
+		}
+		if pedido.Cancelado() {
+			doc.Status, doc.Motivo = NFCeDispensada, "Pedido cancelado antes da emissão"
+			return doc, atualizarDocumentoFiscal(firestoreClient, doc)
+		}
+		entrega, err := buscarEntrega(firestoreClient, codigo)
+		if err != nil {
+			return doc, err
+		}
+
+		if doc, err = numerarNFCe(firestoreClient, codigo, cfg, agora); err != nil {
+			return doc, err
+		}
+		nfe, err := montarNFCe(cfg, doc, transacoes, produtos, entrega != nil)
+		if err != nil {
+			return doc, err
+		}
+		if nfe == nil {
+			doc.Status, doc.Motivo = NFCeDispensada, "Pedido sem produtos a declarar"
+			return doc, atualizarDocumentoFiscal(firestoreClient, doc)
+		}
+		documento, qrCode, err := documentoNFCe(cfg, nfe, certificado)
+		if err != nil {
+			return doc, err
+		}
+		doc.Chave, doc.XML, doc.URLQRCode = strings.TrimPrefix(nfe.ID, "NFe"), string(documento), qrCode
+		// Gravada antes do envio, para que uma resposta perdida seja repetida com a mesma nota
+		if err := atualizarDocumentoFiscal(firestoreClient, doc); err != nil {
+			return doc, err
+		}
+	}
+
+	doc.Tentativas++
+	retorno, err := sefaz.Autorizar([]byte(doc.XML), doc.Numero)
+	if err != nil {
+		if errAtualizar := atualizarDocumentoFiscal(firestoreClient, doc); errAtualizar != nil {
+			log.Printf("Failed to record NFC-e attempt for order %d: %v", codigo, errAtualizar)
+		}
+		return doc, err
+	}
+
+	doc.CodigoStatus, doc.Motivo = retorno.Status, retorno.Motivo
+	// Duplicidade da mesma chave: a tentativa anterior foi autorizada, mas a resposta se perdeu
+	if retorno.Status == SefazDuplicidade {
+		if protocolo := padraoProtocoloDuplicidade.FindStringSubmatch(retorno.Motivo); protocolo != nil {
+			retorno = RetornoSefaz{Status: SefazAutorizada, Motivo: "Autorizado o uso da NF-e", Protocolo: protocolo[1], RecebidoEm: retorno.RecebidoEm}
+		}
+	}
+	if retorno.Autorizada() {
+		if retorno.RecebidoEm.IsZero() {
+			retorno.RecebidoEm = agora
+		}
+		doc.Status, doc.Protocolo, doc.AutorizadaEm = NFCeAutorizada, retorno.Protocolo, retorno.RecebidoEm
+		doc.XML = processoNFCe([]byte(doc.XML), doc.Chave, doc.Ambiente, retorno)
+	} else {
+		doc.Status = NFCeRejeitada
+	}
+	return doc, atualizarDocumentoFiscal(firestoreClient, doc)
+}
+
+// Emite as notas pendentes, uma a uma; a falha de uma não impede as demais
+func processarNFCePendentes(firestoreClient *FirestoreClient, agora time.Time) (int, error) {
+	sefaz, err := sefazEmissor()
+	if err != nil {
+		return 0, err
+	}
+	certificado, err := certificadoEmissor()
+	if err != nil {
+		return 0, err
+	}
+	docs, err := firestoreClient.Client.Collection("nfce").Where("Status", "==", NFCePendente).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+	autorizadas := 0
+	for _, snapshot := range docs {
+		codigo, _ := strconv.Atoi(snapshot.Ref.ID)
+		doc, err := emitirNFCe(firestoreClient, codigo, sefaz, certificado, agora)
+		if err != nil {
+			log.Printf("Failed to issue NFC-e for order %d: %v", codigo, err)
+			continue
+		}
+		if doc.Status == NFCeRejeitada {
+			log.Printf("NFC-e for order %d rejected: %d %s", codigo, doc.CodigoStatus, doc.Motivo)
+		}
+		if doc.Status == NFCeAutorizada {
+			autorizadas++
+		}
+	}
+	return autorizadas, nil
+}
+
+func iniciarNFCe() {
+	ticker := time.NewTicker(config.intervaloEmissaoNFCe())
+	defer ticker.Stop()
+
+	for range ticker.C {
+		firestoreClient, err := InitializeFirestore()
+		if err != nil {
+			log.Printf("Failed to connect to Firestore: %v", err)
+			continue
+		}
+		if _, err := processarNFCePendentes(firestoreClient, time.Now()); err != nil {
+			log.Printf("Failed to issue pending NFC-e: %v", err)
+		}
+		firestoreClient.Client.Close()
+	}
+}
+
+// Emite a nota do pedido na hora, ou a reenvia depois de uma rejeição
+func EmitirNFCeHandler(w http.ResponseWriter, r *http.Request) {
+	codigo, _ := strconv.Atoi(mux.Vars(r)["codigo"])
+	destino := fmt.Sprintf("/pedidos/%d", codigo)
+
+	sefaz, err := sefazEmissor()
+	if err != nil {
+		log.Printf("SEFAZ client unavailable: %v", err)
+		http.Error(w, "NFC-e issuing is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	certificado, err := certificadoEmissor()
+	if err != nil {
+		log.Printf("A1 certificate unavailable: %v", err)
+		http.Error(w, "NFC-e issuing is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	if _, err := buscarPedido(firestoreClient, codigo); err == ErrPedidoNaoEncontrado {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err := solicitarNFCe(firestoreClient, codigo, time.Now()); err != nil {
+		log.Printf("Failed to queue NFC-e for order %d: %v", codigo, err)
+		http.Error(w, "Failed to queue NFC-e", http.StatusInternalServerError)
+		return
+	}
+	doc, err := emitirNFCe(firestoreClient, codigo, sefaz, certificado, time.Now())
+	if err != nil {
+		log.Printf("Failed to issue NFC-e for order %d: %v", codigo, err)
+		http.Redirect(w, r, destino+"?erro="+url.QueryEscape("Não foi possível emitir a NFC-e agora; a emissão será repetida automaticamente"), http.StatusSeeOther)
+		return
+	}
+	if doc.Status == NFCeRejeitada {
+		http.Redirect(w, r, destino+"?erro="+url.QueryEscape(fmt.Sprintf("NFC-e rejeitada: %d %s", doc.CodigoStatus, doc.Motivo)), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, destino, http.StatusSeeOther)
+}
+
+// Nota autorizada do pedido, lida do XML guardado
+type notaAutorizada struct {
+	Inf        infNFe     `xml:"NFe>infNFe"`
+	Suplemento infNFeSupl `xml:"NFe>infNFeSupl"`
+}
+
+type DanfePageData struct {
+	PageTitle      string
+	Documento      DocumentoFiscal
+	Nota           infNFe
+	URLConsulta    string
+	QRCode         template.URL
+	Homologacao    bool
+	MeiosPagamento map[string]string
+}
+
+// Nomes dos meios de pagamento impressos no DANFE
+var nomesMeioPagamentoNFCe = map[string]string{
+	"01": "Dinheiro",
+	"03": "Cartão de Crédito",
+	"05": "Crédito Loja",
+	"17": "PIX",
+	"90": "Sem pagamento",
+	"99": "Outros",
+}
+
+func documentoAutorizado(w http.ResponseWriter, codigo int) (*DocumentoFiscal, bool) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return nil, false
+	}
+	defer firestoreClient.Client.Close()
+
+	doc, err := buscarDocumentoFiscal(firestoreClient, codigo)
+	if err != nil {
+		log.Printf("Failed to fetch NFC-e of order %d: %v", codigo, err)
+		http.Error(w, "Failed to fetch NFC-e", http.StatusInternalServerError)
+		return nil, false
+	}
+	if doc == nil || doc.Status != NFCeAutorizada {
+		http.Error(w, "Order has no authorized NFC-e", http.StatusNotFound)
+		return nil, false
+	}
+	return doc, true
+}
+
+// Reimpressão do DANFE NFC-e, no formato das impressoras térmicas de 80 mm
+func DanfeHandler(w http.ResponseWriter, r *http.Request) {
+	codigo, _ := strconv.Atoi(mux.Vars(r)["codigo"])
+	doc, ok := documentoAutorizado(w, codigo)
+	if !ok {
+		return
+	}
+
+	var nota notaAutorizada
+	if err := decodificarElemento([]byte(doc.XML), "nfeProc", &nota); err != nil {
+		log.Printf("Failed to parse NFC-e of order %d: %v", codigo, err)
+		http.Error(w, "Failed to read NFC-e", http.StatusInternalServerError)
+		return
+	}
+	png, err := qrcode.Encode(nota.Suplemento.QRCode, qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
+		return
+	}
+	doc.AutorizadaEm = doc.AutorizadaEm.In(fusoLoja())
+	doc.EmitidaEm = doc.EmitidaEm.In(fusoLoja())
+
+	tmpl := template.Must(template.New("danfe.html").Funcs(template.FuncMap{"valor": valorNFe}).ParseFiles("template/danfe.html"))
+	data := DanfePageData{
+		PageTitle:      fmt.Sprintf("DANFE NFC-e %d", doc.Numero),
+		Documento:      *doc,
+		Nota:           nota.Inf,
+		URLConsulta:    nota.Suplemento.URLChave,
+		QRCode:         template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+		Homologacao:    doc.Ambiente == AmbienteHomologacao,
+		MeiosPagamento: nomesMeioPagamentoNFCe,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+func XMLNFCeHandler(w http.ResponseWriter, r *http.Request) {
+	codigo, _ := strconv.Atoi(mux.Vars(r)["codigo"])
+	doc, ok := documentoAutorizado(w, codigo)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-procNFe.xml"`, doc.Chave))
+	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>` + doc.XML))
+}
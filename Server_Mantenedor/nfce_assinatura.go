@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Algoritmos da assinatura XMLDSig exigidos pela SEFAZ no leiaute 4.00
+const (
+	nsAssinatura        = "http://www.w3.org/2000/09/xmldsig#"
+	algoritmoC14N       = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"
+	algoritmoRSASHA1    = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	algoritmoEnveloped  = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	algoritmoDigestSHA1 = "http://www.w3.org/2000/09/xmldsig#sha1"
+)
+
+var ErrAssinaturaInvalida = errors.New("invalid XML signature")
+
+// Certificado digital A1 do emitente: a chave privada e o certificado correspondente
+type CertificadoA1 struct {
+	Chave       *rsa.PrivateKey
+	Certificado *x509.Certificate
+}
+
+var (
+	certificadoNFCe     *CertificadoA1
+	erroCertificadoNFCe error
+	carregarCertificado sync.Once
+)
+
+// Lê o arquivo .pfx do certificado A1. O arquivo pode trazer a cadeia da certificadora junto;
+// o certificado do emitente é o que corresponde à chave privada.
+func carregarCertificadoA1(caminho, senha string) (*CertificadoA1, error) {
+	conteudo, err := os.ReadFile(caminho)
+	if err != nil {
+		return nil, err
+	}
+	privada, primeiro, cadeia, err := pkcs12.DecodeChain(conteudo, senha)
+	if err != nil {
+		return nil, err
+	}
+	chave, ok := privada.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("certificate file has no RSA private key")
+	}
+	// Nem todo arquivo traz o certificado do emitente em primeiro lugar
+	certificados := append([]*x509.Certificate{primeiro}, cadeia...)
+	for _, certificado := range certificados {
+		if publica, ok := certificado.PublicKey.(*rsa.PublicKey); ok && publica.Equal(&chave.PublicKey) {
+			return &CertificadoA1{Chave: chave, Certificado: certificado}, nil
+		}
+	}
+	return nil, errors.New("certificate file has no certificate for its private key")
+}
+
+// Certificado autoassinado para testar a emissão em homologação sem um A1 de verdade
+func certificadoTemporario(cnpj string) (*CertificadoA1, error) {
+	chave, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	modelo := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "COFFEE SHOP HOMOLOGACAO:" + cnpj},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, modelo, modelo, &chave.PublicKey, chave)
+	if err != nil {
+		return nil, err
+	}
+	certificado, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CertificadoA1{Chave: chave, Certificado: certificado}, nil
+}
+
+// Certificado usado nas emissões, carregado uma única vez
+func certificadoEmissor() (*CertificadoA1, error) {
+	carregarCertificado.Do(func() {
+		cfg := config.NFCe
+		if cfg.CaminhoCertificado != "" {
+			certificadoNFCe, erroCertificadoNFCe = carregarCertificadoA1(cfg.CaminhoCertificado, cfg.SenhaCertificado)
+			return
+		}
+		if cfg.Ambiente != AmbienteHomologacao {
+			erroCertificadoNFCe = errors.New("an A1 certificate is required to issue NFC-e in production")
+			return
+		}
+		log.Printf("No A1 certificate configured; signing NFC-e with a temporary homologation certificate")
+		certificadoNFCe, erroCertificadoNFCe = certificadoTemporario(cfg.Emitente.CNPJ)
+	})
+	return certificadoNFCe, erroCertificadoNFCe
+}
+
+// Forma canônica (C14N 1.0, sem comentários) do primeiro elemento com o nome informado, como é
+// calculada na assinatura. Cobre o XML que a NFC-e usa: só namespaces padrão, sem prefixos,
+// comentários ou instruções de processamento.
+func canonicalizar(documento []byte, elemento string) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(documento))
+	var saida bytes.Buffer
+	var namespaces []string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if len(namespaces) == 0 && t.Name.Local != elemento {
+				continue
+			}
+			herdado := ""
+			if len(namespaces) > 0 {
+				herdado = namespaces[len(namespaces)-1]
+			}
+			saida.WriteString("<" + t.Name.Local)
+			if t.Name.Space != herdado {
+				saida.WriteString(` xmlns="` + escaparAtributoC14N(t.Name.Space) + `"`)
+			}
+			namespaces = append(namespaces, t.Name.Space)
+
+			var atributos []xml.Attr
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+					continue
+				}
+				atributos = append(atributos, a)
+			}
+			sort.Slice(atributos, func(i, j int) bool { return atributos[i].Name.Local < atributos[j].Name.Local })
+			for _, a := range atributos {
+				saida.WriteString(" " + a.Name.Local + `="` + escaparAtributoC14N(a.Value) + `"`)
+			}
+			saida.WriteString(">")
+		case xml.EndElement:
+			if len(namespaces) == 0 {
+				continue
+			}
+			saida.WriteString("</" + t.Name.Local + ">")
+			namespaces = namespaces[:len(namespaces)-1]
+			if len(namespaces) == 0 {
+				return saida.Bytes(), nil
+			}
+		case xml.CharData:
+			if len(namespaces) > 0 {
+				saida.WriteString(escaparTextoC14N(string(t)))
+			}
+		}
+	}
+	return nil, fmt.Errorf("element %s not found", elemento)
+}
+
+var (
+	escapeTextoC14N    = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	escapeAtributoC14N = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+func escaparTextoC14N(texto string) string {
+	return escapeTextoC14N.Replace(texto)
+}
+
+func escaparAtributoC14N(texto string) string {
+	return escapeAtributoC14N.Replace(texto)
+}
+
+// SignedInfo já na forma canônica, referenciando o elemento pelo Id
+func signedInfo(id, digest string) string {
+	return `<SignedInfo xmlns="` + nsAssinatura + `">` +
+		`<CanonicalizationMethod Algorithm="` + algoritmoC14N + `"></CanonicalizationMethod>` +
+		`<SignatureMethod Algorithm="` + algoritmoRSASHA1 + `"></SignatureMethod>` +
+		`<Reference URI="#` + escaparAtributoC14N(id) + `"><Transforms>` +
+		`<Transform Algorithm="` + algoritmoEnveloped + `"></Transform>` +
+		`<Transform Algorithm="` + algoritmoC14N + `"></Transform>` +
+		`</Transforms><DigestMethod Algorithm="` + algoritmoDigestSHA1 + `"></DigestMethod>` +
+		`<DigestValue>` + digest + `</DigestValue></Reference></SignedInfo>`
+}
+
+// Assina o elemento canônico com o Id informado e devolve o elemento Signature, que vai logo depois dele
+func assinarXML(canonico []byte, id string, certificado *CertificadoA1) (string, error) {
+	resumo := sha1.Sum(canonico)
+	info := signedInfo(id, base64.StdEncoding.EncodeToString(resumo[:]))
+	resumoInfo := sha1.Sum([]byte(info))
+	valor, err := rsa.SignPKCS1v15(rand.Reader, certificado.Chave, crypto.SHA1, resumoInfo[:])
+	if err != nil {
+		return "", err
+	}
+	return `<Signature xmlns="` + nsAssinatura + `">` + info +
+		`<SignatureValue>` + base64.StdEncoding.EncodeToString(valor) + `</SignatureValue>` +
+		`<KeyInfo><X509Data><X509Certificate>` + base64.StdEncoding.EncodeToString(certificado.Certificado.Raw) +
+		`</X509Certificate></X509Data></KeyInfo></Signature>`, nil
+}
+
+// Campos da assinatura lidos na verificação
+type assinaturaLida struct {
+	Referencia struct {
+		URI    string `xml:"URI,attr"`
+		Digest string `xml:"DigestValue"`
+	} `xml:"SignedInfo>Reference"`
+	Valor       string `xml:"SignatureValue"`
+	Certificado string `xml:"KeyInfo>X509Data>X509Certificate"`
+}
+
+// Confere a assinatura do elemento com o certificado que vai nela. Devolve o certificado,
+// para que quem recebe o documento confira também o emitente.
+func verificarAssinaturaXML(documento []byte, elemento, id string) (*x509.Certificate, error) {
+	var assinatura assinaturaLida
+	if err := decodificarElemento(documento, "Signature", &assinatura); err != nil {
+		return nil, err
+	}
+	if assinatura.Referencia.URI != "#"+id {
+		return nil, ErrAssinaturaInvalida
+	}
+	canonico, err := canonicalizar(documento, elemento)
+	if err != nil {
+		return nil, err
+	}
+	resumo := sha1.Sum(canonico)
+	if base64.StdEncoding.EncodeToString(resumo[:]) != strings.TrimSpace(assinatura.Referencia.Digest) {
+		return nil, ErrAssinaturaInvalida
+	}
+
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(assinatura.Certificado))
+	if err != nil {
+		return nil, ErrAssinaturaInvalida
+	}
+	certificado, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, ErrAssinaturaInvalida
+	}
+	publica, ok := certificado.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, ErrAssinaturaInvalida
+	}
+	valor, err := base64.StdEncoding.DecodeString(strings.TrimSpace(assinatura.Valor))
+	if err != nil {
+		return nil, ErrAssinaturaInvalida
+	}
+	info, err := canonicalizar(documento, "SignedInfo")
+	if err != nil {
+		return nil, err
+	}
+	resumoInfo := sha1.Sum(info)
+	if err := rsa.VerifyPKCS1v15(publica, crypto.SHA1, resumoInfo[:], valor); err != nil {
+		return nil, ErrAssinaturaInvalida
+	}
+	return certificado, nil
+}
+
+// Decodifica o primeiro elemento com o nome informado, em qualquer nível do documento
+func decodificarElemento(documento []byte, elemento string, destino interface{}) error {
+	decoder := xml.NewDecoder(bytes.NewReader(documento))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return fmt.Errorf("element %s not found", elemento)
+		}
+		if err != nil {
+			return err
+		}
+		if inicio, ok := token.(xml.StartElement); ok && inicio.Name.Local == elemento {
+			return decoder.DecodeElement(destino, &inicio)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// NFC-e assinada de um pedido com um café, no ambiente e com o número informados
+func notaAssinadaTeste(t *testing.T, certificado *CertificadoA1, ambiente, numero int) []byte {
+	t.Helper()
+	cfg := configPadraoMantenedor().NFCe
+	cfg.Ambiente = ambiente
+	emissao := time.Date(2026, 3, 10, 9, 30, 0, 0, fusoLoja())
+	doc := DocumentoFiscal{Codigo: numero, Ambiente: ambiente, Serie: cfg.Serie, Numero: numero, CodigoNumerico: 12345678, EmitidaEm: emissao}
+	transacoes := []Transacao{{
+		CodigoTransacao: numero, CodigoProd: 1, NomeProd: "Café expresso", QuantidadeProd: 2, ValorUnitario: 6,
+		ValorTransacao: 12, MetodoPagamento: "card", DataTransacao: emissao, Tipo: "venda",
+	}}
+	produtos := map[int]Produto{1: {ID: 1, NomeProduto: "Café expresso", NCM: "09012100", CFOP: "5102", CSOSN: "102"}}
+
+	nfe, err := montarNFCe(cfg, doc, transacoes, produtos, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	documento, _, err := documentoNFCe(cfg, nfe, certificado)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return documento
+}
+
+func certificadoTeste(t *testing.T) *CertificadoA1 {
+	t.Helper()
+	certificado, err := certificadoTemporario(configPadraoMantenedor().NFCe.Emitente.CNPJ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificado
+}
+
+// Cliente SOAP falando com o simulador por HTTP, como falaria com o web service da SEFAZ
+func sefazTeste(t *testing.T) (*sefazWebService, *sefazFake) {
+	t.Helper()
+	fake := novaSefazFake()
+	fake.agora = func() time.Time { return time.Date(2026, 3, 10, 9, 31, 0, 0, fusoLoja()) }
+	servidor := httptest.NewServer(servidorSefazFake(fake))
+	t.Cleanup(servidor.Close)
+	return novaSefazWebService(servidor.URL, nil), fake
+}
+
+func TestSefazWebServiceAutoriza(t *testing.T) {
+	sefaz, _ := sefazTeste(t)
+	retorno, err := sefaz.Autorizar(notaAssinadaTeste(t, certificadoTeste(t), AmbienteHomologacao, 1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !retorno.Autorizada() || retorno.Status != SefazAutorizada {
+		t.Fatalf("retorno = %+v, esperava autorização", retorno)
+	}
+	if retorno.Protocolo == "" {
+		t.Error("autorização sem protocolo")
+	}
+	if !retorno.RecebidoEm.Equal(time.Date(2026, 3, 10, 9, 31, 0, 0, fusoLoja())) {
+		t.Errorf("recebido em %v", retorno.RecebidoEm)
+	}
+}
+
+// A mesma chave enviada de novo volta como duplicidade, com o protocolo da primeira autorização
+func TestSefazWebServiceDuplicidade(t *testing.T) {
+	sefaz, _ := sefazTeste(t)
+	nota := notaAssinadaTeste(t, certificadoTeste(t), AmbienteHomologacao, 2)
+
+	primeiro, err := sefaz.Autorizar(nota, 2)
+	if err != nil || !primeiro.Autorizada() {
+		t.Fatalf("primeiro envio: %+v, %v", primeiro, err)
+	}
+	segundo, err := sefaz.Autorizar(nota, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segundo.Status != SefazDuplicidade {
+		t.Fatalf("segundo envio: status %d, esperava %d", segundo.Status, SefazDuplicidade)
+	}
+	protocolo := padraoProtocoloDuplicidade.FindStringSubmatch(segundo.Motivo)
+	if protocolo == nil || protocolo[1] != primeiro.Protocolo {
+		t.Errorf("motivo da duplicidade %q não traz o protocolo %s", segundo.Motivo, primeiro.Protocolo)
+	}
+}
+
+func TestSefazWebServiceRejeicoes(t *testing.T) {
+	certificado := certificadoTeste(t)
+	valida := notaAssinadaTeste(t, certificado, AmbienteHomologacao, 3)
+
+	// Alterar o conteúdo depois de assinado invalida o digest
+	adulterada := bytes.Replace(valida, []byte("<vUnCom>6.00</vUnCom>"), []byte("<vUnCom>1.00</vUnCom>"), 1)
+	if bytes.Equal(adulterada, valida) {
+		t.Fatal("valor unitário não encontrado na nota")
+	}
+	// Assinatura de outra nota, com outro Id
+	outra := notaAssinadaTeste(t, certificado, AmbienteHomologacao, 4)
+	inicio := bytes.Index(outra, []byte("<Signature "))
+	trocada := append(append([]byte{}, valida[:bytes.Index(valida, []byte("<Signature "))]...), outra[inicio:]...)
+	// Dígito verificador da chave alterado no Id
+	chave := bytes.Index(valida, []byte(`Id="NFe`)) + len(`Id="NFe`) + 43
+	digito := append([]byte{}, valida...)
+	digito[chave] = '0' + (digito[chave]-'0'+1)%10
+
+	casos := []struct {
+		nome   string
+		nota   []byte
+		status int
+	}{
+		{"conteúdo adulterado", adulterada, SefazAssinaturaInvalida},
+		{"assinatura de outra nota", trocada, SefazAssinaturaInvalida},
+		{"chave inválida", digito, SefazChaveInvalida},
+		{"ambiente de produção", notaAssinadaTeste(t, certificado, AmbienteProducao, 5), SefazAmbienteDivergente},
+	}
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			sefaz, _ := sefazTeste(t)
+			retorno, err := sefaz.Autorizar(caso.nota, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if retorno.Status != caso.status || retorno.Autorizada() {
+				t.Errorf("status %d (%s), esperava %d", retorno.Status, retorno.Motivo, caso.status)
+			}
+		})
+	}
+}
+
+// rejeitarCom força a rejeição com o código informado, mesmo com a nota válida
+func TestSefazWebServiceRejeitarCom(t *testing.T) {
+	sefaz, fake := sefazTeste(t)
+	fake.rejeitarCom = SefazFalhaSchema
+	retorno, err := sefaz.Autorizar(notaAssinadaTeste(t, certificadoTeste(t), AmbienteHomologacao, 6), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retorno.Status != SefazFalhaSchema || !strings.HasPrefix(retorno.Motivo, "Rejeição") {
+		t.Errorf("retorno = %+v", retorno)
+	}
+
+	// Sem a rejeição forçada, a mesma nota é autorizada
+	fake.rejeitarCom = 0
+	retorno, err = sefaz.Autorizar(notaAssinadaTeste(t, certificadoTeste(t), AmbienteHomologacao, 6), 6)
+	if err != nil || !retorno.Autorizada() {
+		t.Errorf("retorno = %+v, %v", retorno, err)
+	}
+}
+
+// Falhas de comunicação voltam como erro, para a nota continuar pendente
+func TestSefazWebServiceErroHTTP(t *testing.T) {
+	servidor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "indisponível", http.StatusServiceUnavailable)
+	}))
+	defer servidor.Close()
+	if _, err := novaSefazWebService(servidor.URL, nil).Autorizar([]byte("<NFe/>"), 1); err == nil {
+		t.Error("HTTP 503 deveria voltar como erro")
+	}
+}
+
+func TestCarregarCertificadoA1(t *testing.T) {
+	emitente := certificadoTeste(t)
+	certificadora := certificadoTeste(t)
+	pfx, err := pkcs12.Modern.Encode(emitente.Chave, emitente.Certificado, []*x509.Certificate{certificadora.Certificado}, "senha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caminho := filepath.Join(t.TempDir(), "certificado.pfx")
+	if err := os.WriteFile(caminho, pfx, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	certificado, err := carregarCertificadoA1(caminho, "senha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certificado.Certificado.Equal(emitente.Certificado) || !certificado.Chave.Equal(emitente.Chave) {
+		t.Error("certificado carregado não é o do emitente")
+	}
+	if _, err := carregarCertificadoA1(caminho, "errada"); err == nil {
+		t.Error("senha errada deveria falhar")
+	}
+}
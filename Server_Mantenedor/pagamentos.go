@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Provedores de pagamento aceitos em config.ProvedorPagamento
+const (
+	ProvedorFake       = "fake"
+	ProvedorFakeRecusa = "fake_recusa"
+)
+
+var ErrPagamentoRecusado = errors.New("payment declined")
+
+// Cobrança de um pedido feito fora do caixa, como os das assinaturas
+type Cobranca struct {
+	// Chave de idempotência: repetir a cobrança com a mesma chave não cobra duas vezes
+	Chave        string
+	ClienteEmail string
+	// "card" ou "pix", os métodos da loja que não exigem o cliente no caixa
+	Metodo    string
+	Valor     float64
+	Descricao string
+}
+
+// Cobra o cliente e devolve o identificador da cobrança no provedor
+type ProvedorPagamento interface {
+	Cobrar(cobranca Cobranca) (string, error)
+}
+
+// Provedor em memória usado em desenvolvimento e testes; aprova tudo, ou recusa tudo se recusar for true
+type provedorFake struct {
+	recusar bool
+
+	mu       sync.Mutex
+	cobradas map[string]string
+}
+
+func (p *provedorFake) Cobrar(cobranca Cobranca) (string, error) {
+	if p.recusar {
+		return "", ErrPagamentoRecusado
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id, ok := p.cobradas[cobranca.Chave]; ok {
+		return id, nil
+	}
+	if p.cobradas == nil {
+		p.cobradas = make(map[string]string)
+	}
+	id := fmt.Sprintf("fake-%d", len(p.cobradas)+1)
+	p.cobradas[cobranca.Chave] = id
+	log.Printf("Fake payment %s: R$ %.2f via %s for %s (%s)", id, cobranca.Valor, cobranca.Metodo, cobranca.ClienteEmail, cobranca.Descricao)
+	return id, nil
+}
+
+var (
+	provedorPagamentoOnce  sync.Once
+	provedorPagamentoAtual ProvedorPagamento
+)
+
+// Provedor configurado; nenhum provedor real está integrado ainda, então um valor desconhecido usa o fake
+func provedorPagamento() ProvedorPagamento {
+	provedorPagamentoOnce.Do(func() {
+		switch config.ProvedorPagamento {
+		case ProvedorFake, "":
+			provedorPagamentoAtual = &provedorFake{}
+		case ProvedorFakeRecusa:
+			provedorPagamentoAtual = &provedorFake{recusar: true}
+		default:
+			log.Printf("Unknown payment provider %q, using %s", config.ProvedorPagamento, ProvedorFake)
+			provedorPagamentoAtual = &provedorFake{}
+		}
+	})
+	return provedorPagamentoAtual
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestProvedorFakeIdempotente(t *testing.T) {
+	provedor := &provedorFake{}
+	cobranca := Cobranca{Chave: "assinatura-1:2026-03-10", ClienteEmail: "ana@example.com", Metodo: "card", Valor: 30}
+
+	primeiro, err := provedor.Cobrar(cobranca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A mesma chave devolve a cobrança já feita, mesmo com outro valor
+	cobranca.Valor = 45
+	repetido, err := provedor.Cobrar(cobranca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repetido != primeiro {
+		t.Errorf("repetição com a mesma chave gerou %q, esperava %q", repetido, primeiro)
+	}
+
+	cobranca.Chave = "assinatura-1:2026-03-17"
+	outro, err := provedor.Cobrar(cobranca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outro == primeiro {
+		t.Error("chaves diferentes geraram a mesma cobrança")
+	}
+	if len(provedor.cobradas) != 2 {
+		t.Errorf("cobranças registradas = %d, esperava 2", len(provedor.cobradas))
+	}
+}
+
+func TestProvedorFakeRecusa(t *testing.T) {
+	provedor := &provedorFake{recusar: true}
+	id, err := provedor.Cobrar(Cobranca{Chave: "assinatura-1:2026-03-10", Metodo: "pix", Valor: 30})
+	if !errors.Is(err, ErrPagamentoRecusado) {
+		t.Errorf("erro = %v, esperava %v", err, ErrPagamentoRecusado)
+	}
+	if id != "" || len(provedor.cobradas) != 0 {
+		t.Errorf("cobrança recusada foi registrada: id %q, %d cobranças", id, len(provedor.cobradas))
+	}
+}
@@ -0,0 +1,796 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Tipos de transação gravados na coleção "transacoes"
+const (
+	TransacaoVenda   = "venda"
+	TransacaoEstorno = "estorno"
+)
+
+var (
+	ErrPedidoNaoEncontrado = errors.New("order not found")
+	ErrNadaAEstornar       = errors.New("nothing to refund")
+)
+
+// Linha de um pedido, somando as vendas e os estornos do mesmo produto
+type ItemPedido struct {
+	CodigoProd    int
+	NomeProd      string
+	ValorUnitario float64
+	CustoUnitario float64
+	Vendido       int
+	ValorPago     float64
+	// Desconto de cupons e promoções, já abatido do valor pago
+	Desconto       float64
+	Estornado      int
+	ValorEstornado float64
+	// Classificação e alíquotas gravadas na venda, repetidas nos estornos
+	DadosFiscais *DadosFiscais
+	// Valor pago com cada vale-presente, descontado o que já voltou a ele em estornos
+	PagoPorVale map[string]float64
+}
+
+// Pedido do Server_Usuario: as transações que compartilham o mesmo código
+type Pedido struct {
+	Codigo          int
+	Data            time.Time
+	MetodoPagamento string
+	Itens           []ItemPedido
+	Estornos        []Transacao
+	Total           float64
+	TotalEstornado  float64
+	ClienteEmail    string
+	EmailContato    string
+	// Vales-presente usados no pagamento
+	ValesPresente []string
+	// Horário de retirada escolhido na loja
+	RetiradaEm time.Time
+	// Mesa do salão, nos pedidos feitos pelo QR code
+	Mesa int
+	// Cupom usado no pedido; o uso volta ao limite do cupom quando o pedido é cancelado
+	Cupom string
+}
+
+// Quantidade de um produto a estornar
+type ItemEstorno struct {
+	CodigoProd int
+	Quantidade int
+	// Devolve a quantidade ao estoque, para produtos com estoque controlado
+	Restituir bool
+}
+
+type PedidoPageData struct {
+	PageTitle string
+	Pedido    Pedido
+	Metodos   map[string]string
+	Erro      string
+	// Vales vendidos neste pedido
+	ValesEmitidos []ValePresente
+	// Entrega do pedido, ou nil se foi para retirada
+	Entrega *Entrega
+	// Nota fiscal do pedido, ou nil se ainda não foi solicitada
+	NFCe *DocumentoFiscal
+}
+
+func (t Transacao) Estorno() bool {
+	return t.Tipo == TransacaoEstorno
+}
+
+func (i ItemPedido) Restante() int {
+	return i.Vendido - i.Estornado
+}
+
+// Valor efetivamente pago por unidade, já considerando eventuais descontos da venda
+func (i ItemPedido) ValorPagoUnitario() float64 {
+	if i.Vendido == 0 {
+		return 0
+	}
+	return i.ValorPago / float64(i.Vendido)
+}
+
+func (p Pedido) Cancelado() bool {
+	for _, item := range p.Itens {
+		if item.Restante() > 0 {
+			return false
+		}
+	}
+	return len(p.Estornos) > 0
+}
+
+// Indica se os estornos, somados aos anteriores, zeram todos os itens do pedido
+func (p Pedido) canceladoCom(estornos []Transacao) bool {
+	for _, item := range p.Itens {
+		quantidade := 0
+		for _, e := range estornos {
+			if e.CodigoProd == item.CodigoProd {
+				quantidade -= e.QuantidadeProd
+			}
+		}
+		if item.Restante() != quantidade {
+			return false
+		}
+	}
+	return true
+}
+
+func (p Pedido) item(codigoProd int) (ItemPedido, bool) {
+	for _, item := range p.Itens {
+		if item.CodigoProd == codigoProd {
+			return item, true
+		}
+	}
+	return ItemPedido{}, false
+}
+
+// Agrupa as transações do pedido por produto
+func montarPedido(codigo int, transacoes []Transacao) (Pedido, error) {
+	pedido := Pedido{Codigo: codigo}
+	itens := make(map[int]*ItemPedido)
+	var ordem []int
+
+	for _, t := range transacoes {
+		item, ok := itens[t.CodigoProd]
+		if !ok {
+			item = &ItemPedido{CodigoProd: t.CodigoProd, NomeProd: t.NomeProd, ValorUnitario: t.ValorUnitario, CustoUnitario: t.CustoUnitario}
+			itens[t.CodigoProd] = item
+			ordem = append(ordem, t.CodigoProd)
+		}
+
+		for _, p := range t.Pagamentos {
+			if p.Metodo == "vale" && p.Referencia != "" {
+				if item.PagoPorVale == nil {
+					item.PagoPorVale = make(map[string]float64)
+				}
+				item.PagoPorVale[p.Referencia] += p.Valor
+			}
+		}
+
+		if t.Estorno() {
+			item.Estornado -= t.QuantidadeProd
+			item.ValorEstornado -= t.ValorTransacao
+			pedido.TotalEstornado -= t.ValorTransacao
+			pedido.Estornos = append(pedido.Estornos, t)
+			continue
+		}
+
+		item.Vendido += t.QuantidadeProd
+		item.ValorPago += t.ValorTransacao
+		if item.DadosFiscais == nil {
+			item.DadosFiscais = t.DadosFiscais
+		}
+		item.Desconto += t.Desconto
+		pedido.Total += t.ValorTransacao
+		if pedido.Data.IsZero() || t.DataTransacao.Before(pedido.Data) {
+			pedido.Data = t.DataTransacao
+			pedido.MetodoPagamento = t.MetodoPagamento
+		}
+		// Um pedido de convidado reivindicado depois ganha a conta em todas as linhas
+		if t.ClienteEmail != "" {
+			pedido.ClienteEmail = t.ClienteEmail
+		}
+		if t.EmailContato != "" {
+			pedido.EmailContato = t.EmailContato
+		}
+		if !t.RetiradaEm.IsZero() {
+			pedido.RetiradaEm = t.RetiradaEm.In(fusoLoja())
+		}
+		if t.Mesa != 0 {
+			pedido.Mesa = t.Mesa
+		}
+		for _, d := range t.Descontos {
+			if d.Origem == "cupom" {
+				pedido.Cupom = d.Codigo
+			}
+		}
+		for _, p := range t.Pagamentos {
+			novo := p.Referencia != ""
+			for _, codigo := range pedido.ValesPresente {
+				novo = novo && codigo != p.Referencia
+			}
+			if novo {
+				pedido.ValesPresente = append(pedido.ValesPresente, p.Referencia)
+			}
+		}
+	}
+	if pedido.Data.IsZero() {
+		return pedido, ErrPedidoNaoEncontrado
+	}
+
+	// Estornos antigos para vale não registravam o vale creditado; saem dos vales na ordem de uso
+	for _, e := range pedido.Estornos {
+		if e.MetodoPagamento != "vale" || len(e.Pagamentos) > 0 {
+			continue
+		}
+		item := itens[e.CodigoProd]
+		partes, _ := pedido.ratearVales(*item, -e.ValorTransacao)
+		for _, parte := range partes {
+			item.PagoPorVale[parte.Referencia] += parte.Valor
+		}
+	}
+
+	for _, codigoProd := range ordem {
+		pedido.Itens = append(pedido.Itens, *itens[codigoProd])
+	}
+	sort.Slice(pedido.Estornos, func(i, j int) bool {
+		return pedido.Estornos[i].DataTransacao.Before(pedido.Estornos[j].DataTransacao)
+	})
+	return pedido, nil
+}
+
+// Monta as transações de estorno, com quantidade e valor negativos, conferindo o que ainda pode ser estornado
+func (p Pedido) estornar(itens []ItemEstorno, motivo, metodo, operador string, agora time.Time) ([]Transacao, error) {
+	var estornos []Transacao
+	for _, solicitado := range itens {
+		if solicitado.Quantidade == 0 {
+			continue
+		}
+		item, ok := p.item(solicitado.CodigoProd)
+		if !ok {
+			return nil, fmt.Errorf("product %d is not part of order %d", solicitado.CodigoProd, p.Codigo)
+		}
+		if solicitado.Quantidade < 0 || solicitado.Quantidade > item.Restante() {
+			return nil, fmt.Errorf("invalid refund quantity for %s: %d of %d remaining", item.NomeProd, solicitado.Quantidade, item.Restante())
+		}
+
+		// O último estorno do item devolve exatamente o saldo, sem sobras de arredondamento
+		valor := arredondarCentavos(item.ValorPagoUnitario() * float64(solicitado.Quantidade))
+		if solicitado.Quantidade == item.Restante() {
+			valor = arredondarCentavos(item.ValorPago - item.ValorEstornado)
+		}
+
+		// O valor devolvido em vale volta aos vales que pagaram o item
+		var pagamentos []PagamentoParcial
+		if metodo == "vale" {
+			var err error
+			if pagamentos, err = p.ratearVales(item, valor); err != nil {
+				return nil, err
+			}
+		}
+
+		estornos = append(estornos, Transacao{
+			CodigoTransacao: p.Codigo,
+			CodigoProd:      item.CodigoProd,
+			NomeProd:        item.NomeProd,
+			QuantidadeProd:  -solicitado.Quantidade,
+			ValorUnitario:   item.ValorUnitario,
+			CustoUnitario:   item.CustoUnitario,
+			ValorTransacao:  -valor,
+			MetodoPagamento: metodo,
+			Pagamentos:      pagamentos,
+			DataTransacao:   agora,
+			Tipo:            TransacaoEstorno,
+			Motivo:          motivo,
+			Operador:        operador,
+			ClienteEmail:    p.ClienteEmail,
+			EmailContato:    p.EmailContato,
+			// Os tributos do estorno seguem os da venda, mesmo que o produto tenha mudado depois
+			DadosFiscais: item.DadosFiscais,
+		})
+	}
+	if len(estornos) == 0 {
+		return nil, ErrNadaAEstornar
+	}
+	return estornos, nil
+}
+
+// Divide o valor de um estorno para vale entre os vales que pagaram o item, na ordem em que foram usados no pedido,
+// com os valores negativos como nas demais linhas de estorno
+func (p Pedido) ratearVales(item ItemPedido, valor float64) ([]PagamentoParcial, error) {
+	var partes []PagamentoParcial
+	restante := arredondarCentavos(valor)
+	for _, codigo := range p.ValesPresente {
+		parte := arredondarCentavos(math.Min(restante, item.PagoPorVale[codigo]))
+		if parte <= 0 {
+			continue
+		}
+		partes = append(partes, PagamentoParcial{Metodo: "vale", Valor: -parte, Referencia: codigo})
+		restante = arredondarCentavos(restante - parte)
+	}
+	if restante > 0 {
+		return nil, fmt.Errorf("only R$ %.2f of %s was paid with gift cards", arredondarCentavos(valor-restante), item.NomeProd)
+	}
+	return partes, nil
+}
+
+// Escolhe, entre os vales vendidos no pedido, os que os estornos das linhas de vale-presente cancelam. Só um vale
+// ainda intacto pode ser cancelado; se o cliente já gastou parte dele, o estorno é recusado
+func valesACancelar(estornos []Transacao, valesPresente map[int]bool, emitidos []ValePresente) ([]ValePresente, error) {
+	usado := make([]bool, len(emitidos))
+	var cancelar []ValePresente
+	for _, e := range estornos {
+		if !valesPresente[e.CodigoProd] {
+			continue
+		}
+		for n := 0; n < -e.QuantidadeProd; n++ {
+			encontrado := false
+			for i, vale := range emitidos {
+				if usado[i] || vale.ValorInicial != e.ValorUnitario || vale.Saldo <= 0 || vale.Saldo < vale.ValorInicial {
+					continue
+				}
+				usado[i] = true
+				cancelar = append(cancelar, vale)
+				encontrado = true
+				break
+			}
+			if !encontrado {
+				return nil, fmt.Errorf("the gift cards sold as %s have already been spent and cannot be refunded", e.NomeProd)
+			}
+		}
+	}
+	return cancelar, nil
+}
+
+func buscarPedido(firestoreClient *FirestoreClient, codigo int) (Pedido, error) {
+	docs, err := firestoreClient.Client.Collection("transacoes").Where("CodigoTransacao", "==", codigo).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return Pedido{}, err
+	}
+	return montarPedidoDocumentos(codigo, docs)
+}
+
+func montarPedidoDocumentos(codigo int, docs []*firestore.DocumentSnapshot) (Pedido, error) {
+	var transacoes []Transacao
+	for _, doc := range docs {
+		var transacao Transacao
+		if err := doc.DataTo(&transacao); err != nil {
+			return Pedido{}, err
+		}
+		transacoes = append(transacoes, transacao)
+	}
+	return montarPedido(codigo, transacoes)
+}
+
+// Grava os estornos, devolve as quantidades ao estoque, desfaz os pontos de fidelidade do pedido, tira da fila de
+// preparo, cancela a entrega ainda não despachada, libera o horário de retirada e devolve o uso do cupom dos
+// pedidos cancelados, cancela os vales-presente vendidos no pedido e, nos estornos para vale-presente, credita os
+// vales que pagaram os itens, tudo numa única transação do Firestore, para que dois estornos simultâneos não devolvam
+// o mesmo item duas vezes
+func registrarEstorno(firestoreClient *FirestoreClient, codigo int, itens []ItemEstorno, motivo, metodo, operador, turnoID string) ([]Transacao, error) {
+	transacoesRef := firestoreClient.Client.Collection("transacoes")
+	produtosRef := firestoreClient.Client.Collection("produtos")
+	pontosRef := firestoreClient.Client.Collection("pontos")
+	valesRef := firestoreClient.Client.Collection("vales_presente")
+
+	var estornos []Transacao
+	err := firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docs, err := tx.Documents(transacoesRef.Where("CodigoTransacao", "==", codigo)).GetAll()
+		if err != nil {
+			return err
+		}
+		pedido, err := montarPedidoDocumentos(codigo, docs)
+		if err != nil {
+			return err
+		}
+
+		agora := time.Now()
+		estornos, err = pedido.estornar(itens, motivo, metodo, operador, agora)
+		if err != nil {
+			return err
+		}
+
+		// Todas as leituras precisam acontecer antes das escritas
+		produtos := make(map[int]Produto)
+		for _, item := range pedido.Itens {
+			if item.CodigoProd == CodigoTaxaEntrega {
+				continue
+			}
+			snapshot, err := tx.Get(produtosRef.Doc(strconv.Itoa(item.CodigoProd)))
+			if status.Code(err) == codes.NotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			var produto Produto
+			if err := snapshot.DataTo(&produto); err != nil {
+				return err
+			}
+			produtos[item.CodigoProd] = produto
+		}
+		restituir := make(map[int]int)
+		for _, item := range itens {
+			if item.Restituir && item.Quantidade > 0 && produtos[item.CodigoProd].ControlaEstoque {
+				restituir[item.CodigoProd] += item.Quantidade
+			}
+		}
+		valesPresente := make(map[int]bool)
+		for codigoProd, produto := range produtos {
+			valesPresente[codigoProd] = produto.ValePresente
+		}
+
+		var reversoes []LancamentoPontos
+		if pedido.ClienteEmail != "" {
+			docs, err := tx.Documents(pontosRef.Where("CodigoTransacao", "==", codigo)).GetAll()
+			if err != nil {
+				return err
+			}
+			var lancamentos []LancamentoPontos
+			for _, doc := range docs {
+				var l LancamentoPontos
+				if err := doc.DataTo(&l); err != nil {
+					return err
+				}
+				lancamentos = append(lancamentos, l)
+			}
+			reversoes = reverterPontos(pedido, estornos, lancamentos, valesPresente, agora)
+		}
+
+		// Vales que recebem o valor estornado, na ordem em que foram usados no pedido
+		creditos := make(map[string]float64)
+		for _, e := range estornos {
+			for _, p := range e.Pagamentos {
+				creditos[p.Referencia] -= p.Valor
+			}
+		}
+		var creditar []ValePresente
+		for _, codigo := range pedido.ValesPresente {
+			if creditos[codigo] <= 0 {
+				continue
+			}
+			snapshot, err := tx.Get(valesRef.Doc(codigo))
+			if err != nil {
+				return err
+			}
+			vale := ValePresente{Codigo: snapshot.Ref.ID}
+			if err := snapshot.DataTo(&vale); err != nil {
+				return err
+			}
+			creditar = append(creditar, vale)
+		}
+
+		// Estornar a venda de um vale-presente cancela o vale, se ele ainda não foi usado
+		vendeVale := false
+		for _, e := range estornos {
+			vendeVale = vendeVale || valesPresente[e.CodigoProd]
+		}
+		var cancelarVales []ValePresente
+		if vendeVale {
+			docs, err := tx.Documents(valesRef.Where("CodigoTransacao", "==", codigo)).GetAll()
+			if err != nil {
+				return err
+			}
+			var emitidos []ValePresente
+			for _, doc := range docs {
+				vale := ValePresente{Codigo: doc.Ref.ID}
+				if err := doc.DataTo(&vale); err != nil {
+					return err
+				}
+				emitidos = append(emitidos, vale)
+			}
+			if cancelarVales, err = valesACancelar(estornos, valesPresente, emitidos); err != nil {
+				return err
+			}
+		}
+
+		cancelado := pedido.canceladoCom(estornos)
+
+		// O cupom de um pedido cancelado volta a ter o uso disponível, se ainda existir
+		var cupomRef *firestore.DocumentRef
+		if cancelado && pedido.Cupom != "" {
+			snapshot, err := tx.Get(firestoreClient.Client.Collection("cupons").Doc(pedido.Cupom))
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+			if snapshot.Exists() {
+				cupomRef = snapshot.Ref
+			}
+		}
+
+		// Pedido cancelado sai da fila de preparo, se ainda não foi retirado
+		var preparoRef *firestore.DocumentRef
+		if cancelado {
+			snapshot, err := tx.Get(firestoreClient.Client.Collection("preparos").Doc(strconv.Itoa(codigo)))
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+			if snapshot.Exists() {
+				var preparo Preparo
+				if err := snapshot.DataTo(&preparo); err != nil {
+					return err
+				}
+				if preparo.Status != PreparoRetirado && preparo.Status != PreparoCancelado {
+					preparoRef = snapshot.Ref
+				}
+			}
+		}
+		// A entrega é cancelada junto, se ainda não saiu da loja
+		var entregaRef *firestore.DocumentRef
+		if cancelado {
+			snapshot, err := tx.Get(firestoreClient.Client.Collection("entregas").Doc(strconv.Itoa(codigo)))
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+			if snapshot.Exists() {
+				var entrega Entrega
+				if err := snapshot.DataTo(&entrega); err != nil {
+					return err
+				}
+				if entrega.Status == EntregaPendente {
+					entregaRef = snapshot.Ref
+				}
+			}
+		}
+
+		// Cada estorno registra quantas unidades voltaram ao estoque, as únicas que devolvem o custo
+		disponivel := make(map[int]int)
+		for codigoProd, quantidade := range restituir {
+			disponivel[codigoProd] = quantidade
+		}
+		for i := range estornos {
+			restituido := -estornos[i].QuantidadeProd
+			if disponivel[estornos[i].CodigoProd] < restituido {
+				restituido = disponivel[estornos[i].CodigoProd]
+			}
+			disponivel[estornos[i].CodigoProd] -= restituido
+			estornos[i].Restituido = &restituido
+		}
+
+		for i := range estornos {
+			estornos[i].TurnoID = turnoID
+			if err := tx.Create(transacoesRef.NewDoc(), estornos[i]); err != nil {
+				return err
+			}
+		}
+		for codigoProd, quantidade := range restituir {
+			err := tx.Update(produtosRef.Doc(strconv.Itoa(codigoProd)), []firestore.Update{
+				{Path: "Estoque", Value: firestore.Increment(quantidade)},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, vale := range creditar {
+			saldo := arredondarCentavos(vale.Saldo + creditos[vale.Codigo])
+			if err := tx.Update(valesRef.Doc(vale.Codigo), []firestore.Update{{Path: "Saldo", Value: saldo}}); err != nil {
+				return err
+			}
+			err := tx.Create(firestoreClient.Client.Collection("movimentos_vale").NewDoc(), MovimentoVale{
+				Codigo: vale.Codigo, Tipo: ValeEstorno, Valor: arredondarCentavos(creditos[vale.Codigo]), SaldoApos: saldo,
+				CodigoTransacao: codigo, Usuario: operador, Data: agora,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, vale := range cancelarVales {
+			err := tx.Update(valesRef.Doc(vale.Codigo), []firestore.Update{
+				{Path: "Saldo", Value: 0},
+				{Path: "Ativo", Value: false},
+			})
+			if err != nil {
+				return err
+			}
+			err = tx.Create(firestoreClient.Client.Collection("movimentos_vale").NewDoc(), MovimentoVale{
+				Codigo: vale.Codigo, Tipo: ValeCancelamento, Valor: -vale.Saldo, SaldoApos: 0,
+				CodigoTransacao: codigo, Usuario: operador, Data: agora,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if cupomRef != nil {
+			if err := tx.Update(cupomRef, []firestore.Update{{Path: "Usos", Value: firestore.Increment(-1)}}); err != nil {
+				return err
+			}
+		}
+		if preparoRef != nil {
+			err := tx.Update(preparoRef, []firestore.Update{
+				{Path: "Status", Value: PreparoCancelado},
+				{Path: "AtualizadoEm", Value: agora},
+				{Path: "Historico", Value: firestore.ArrayUnion(MudancaPreparo{Status: PreparoCancelado, Data: agora, Usuario: operador})},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if entregaRef != nil {
+			err := tx.Update(entregaRef, []firestore.Update{
+				{Path: "Status", Value: EntregaCancelada},
+				{Path: "Usuario", Value: operador},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		// O cancelamento antes da retirada libera a vaga no horário
+		if !pedido.RetiradaEm.IsZero() && pedido.RetiradaEm.After(agora) && cancelado {
+			horarioRef := firestoreClient.Client.Collection("horarios_retirada").Doc(pedido.RetiradaEm.Format(formatoHorarioRetirada))
+			err := tx.Update(horarioRef, []firestore.Update{
+				{Path: "Pedidos", Value: firestore.Increment(-1)},
+				{Path: "Codigos", Value: firestore.ArrayRemove(codigo)},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, l := range reversoes {
+			if err := tx.Create(pontosRef.NewDoc(), l); err != nil {
+				return err
+			}
+			err := tx.Update(firestoreClient.Client.Collection("clientes").Doc(l.ClienteEmail), []firestore.Update{
+				{Path: "SaldoPontos", Value: firestore.Increment(l.Pontos)},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return estornos, err
+}
+
+func PedidoHandler(w http.ResponseWriter, r *http.Request) {
+	codigo, _ := strconv.Atoi(mux.Vars(r)["codigo"])
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	pedido, err := buscarPedido(firestoreClient, codigo)
+	if err == ErrPedidoNaoEncontrado {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fetch order %d: %v", codigo, err)
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+
+	docs, err := firestoreClient.Client.Collection("vales_presente").Where("CodigoTransacao", "==", codigo).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		log.Printf("Failed to fetch gift cards of order %d: %v", codigo, err)
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	var vales []ValePresente
+	for _, doc := range docs {
+		var vale ValePresente
+		if err := doc.DataTo(&vale); err != nil {
+			http.Error(w, "Failed to parse gift card data", http.StatusInternalServerError)
+			return
+		}
+		vale.Codigo = doc.Ref.ID
+		vales = append(vales, vale)
+	}
+
+	entrega, err := buscarEntrega(firestoreClient, codigo)
+	if err != nil {
+		log.Printf("Failed to fetch delivery of order %d: %v", codigo, err)
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	if entrega != nil {
+		entrega.DespachadaEm = entrega.DespachadaEm.In(fusoLoja())
+		entrega.EntregueEm = entrega.EntregueEm.In(fusoLoja())
+	}
+
+	nfce, err := buscarDocumentoFiscal(firestoreClient, codigo)
+	if err != nil {
+		log.Printf("Failed to fetch NFC-e of order %d: %v", codigo, err)
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	if nfce != nil {
+		nfce.AutorizadaEm = nfce.AutorizadaEm.In(fusoLoja())
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/pedido.html"))
+	data := PedidoPageData{
+		PageTitle:     fmt.Sprintf("Coffee Shop - Pedido %d", codigo),
+		Pedido:        pedido,
+		Metodos:       nomesMetodoPagamento,
+		Erro:          r.URL.Query().Get("erro"),
+		ValesEmitidos: vales,
+		Entrega:       entrega,
+		NFCe:          nfce,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+// Estorna as quantidades informadas ou, com cancelar=1, todo o saldo do pedido
+func EstornarPedidoHandler(w http.ResponseWriter, r *http.Request) {
+	codigo, _ := strconv.Atoi(mux.Vars(r)["codigo"])
+	destino := fmt.Sprintf("/pedidos/%d", codigo)
+
+	motivo := r.FormValue("motivo")
+	if motivo == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	pedido, err := buscarPedido(firestoreClient, codigo)
+	if err == ErrPedidoNaoEncontrado {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+
+	metodo := r.FormValue("metodo")
+	if metodo == "" {
+		metodo = pedido.MetodoPagamento
+	}
+	if _, ok := nomesMetodoPagamento[metodo]; !ok {
+		http.Error(w, "Invalid refund method", http.StatusBadRequest)
+		return
+	}
+	if metodo == "vale" && len(pedido.ValesPresente) == 0 {
+		http.Redirect(w, r, destino+"?erro="+url.QueryEscape("O pedido não foi pago com vale-presente"), http.StatusSeeOther)
+		return
+	}
+
+	cancelar := r.FormValue("cancelar") == "1"
+	var itens []ItemEstorno
+	for _, item := range pedido.Itens {
+		chave := strconv.Itoa(item.CodigoProd)
+		quantidade := item.Restante()
+		if !cancelar {
+			quantidade, err = strconv.Atoi("0" + r.FormValue("quantidade_"+chave))
+			if err != nil {
+				http.Error(w, "Invalid refund quantity", http.StatusBadRequest)
+				return
+			}
+		}
+		itens = append(itens, ItemEstorno{
+			CodigoProd: item.CodigoProd,
+			Quantidade: quantidade,
+			Restituir:  r.FormValue("restituir_"+chave) != "",
+		})
+	}
+
+	// Estornos em dinheiro saem da gaveta do turno aberto
+	var turnoID string
+	if metodo == "cash" {
+		turno, err := buscarTurnoAberto(firestoreClient)
+		if err != nil {
+			http.Error(w, "Failed to fetch open shift", http.StatusInternalServerError)
+			return
+		}
+		if turno == nil {
+			http.Redirect(w, r, destino+"?erro="+url.QueryEscape("Abra um turno de caixa para estornar em dinheiro"), http.StatusSeeOther)
+			return
+		}
+		turnoID = turno.ID
+	}
+
+	_, err = registrarEstorno(firestoreClient, codigo, itens, motivo, metodo, usuarioRequisicao(r), turnoID)
+	if err != nil {
+		log.Printf("Failed to refund order %d: %v", codigo, err)
+		http.Redirect(w, r, destino+"?erro="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, destino, http.StatusSeeOther)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Pedido 7: três cafés com cupom de R$ 1,00 e um pão de queijo
+func pedidoTeste(t *testing.T, extras ...Transacao) Pedido {
+	t.Helper()
+	venda := time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC)
+	transacoes := append([]Transacao{
+		{CodigoTransacao: 7, CodigoProd: 1, NomeProd: "Café expresso", QuantidadeProd: 3, ValorUnitario: 6, CustoUnitario: 1.5,
+			ValorTransacao: 17, MetodoPagamento: "card", DataTransacao: venda, Tipo: TransacaoVenda, ClienteEmail: "ana@example.com",
+			Desconto: 1, Descontos: []DescontoAplicado{{Origem: "cupom", Codigo: "BEMVINDO", Valor: 1}},
+			DadosFiscais: &DadosFiscais{NCM: "09012100", CFOP: "5102"}},
+		{CodigoTransacao: 7, CodigoProd: 2, NomeProd: "Pão de queijo", QuantidadeProd: 1, ValorUnitario: 5,
+			ValorTransacao: 5, MetodoPagamento: "card", DataTransacao: venda, Tipo: TransacaoVenda, ClienteEmail: "ana@example.com"},
+	}, extras...)
+	pedido, err := montarPedido(7, transacoes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pedido
+}
+
+func TestMontarPedido(t *testing.T) {
+	pedido := pedidoTeste(t)
+	if pedido.Total != 22 || len(pedido.Itens) != 2 {
+		t.Fatalf("pedido = total %.2f com %d itens", pedido.Total, len(pedido.Itens))
+	}
+	if pedido.Cupom != "BEMVINDO" {
+		t.Errorf("cupom = %q, esperava BEMVINDO", pedido.Cupom)
+	}
+	if pedido.Itens[0].DadosFiscais == nil || pedido.Itens[0].DadosFiscais.NCM != "09012100" {
+		t.Errorf("dados fiscais da venda não ficaram no item: %+v", pedido.Itens[0].DadosFiscais)
+	}
+	if _, err := montarPedido(8, nil); !errors.Is(err, ErrPedidoNaoEncontrado) {
+		t.Errorf("pedido sem transações: erro %v", err)
+	}
+}
+
+func TestEstornarParcial(t *testing.T) {
+	pedido := pedidoTeste(t)
+	agora := time.Date(2026, 3, 10, 10, 0, 0, 0, time.UTC)
+
+	// Um dos três cafés: um terço do valor pago, já com o desconto
+	estornos, err := pedido.estornar([]ItemEstorno{{CodigoProd: 1, Quantidade: 1}}, "Errado", "card", "admin", agora)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(estornos) != 1 {
+		t.Fatalf("estornos = %d, esperava 1", len(estornos))
+	}
+	e := estornos[0]
+	if e.QuantidadeProd != -1 || math.Abs(e.ValorTransacao+5.67) > 0.001 || e.Tipo != TransacaoEstorno {
+		t.Errorf("estorno = %d unidades, R$ %.2f, tipo %s", e.QuantidadeProd, e.ValorTransacao, e.Tipo)
+	}
+	if e.DadosFiscais == nil || e.DadosFiscais.NCM != "09012100" {
+		t.Errorf("estorno sem os dados fiscais da venda: %+v", e.DadosFiscais)
+	}
+	if pedido.canceladoCom(estornos) {
+		t.Error("estorno parcial cancelou o pedido")
+	}
+
+	// Os dois cafés restantes devolvem exatamente o saldo, sem sobra de arredondamento
+	pedido = pedidoTeste(t, e)
+	estornos, err = pedido.estornar([]ItemEstorno{{CodigoProd: 1, Quantidade: 2}, {CodigoProd: 2, Quantidade: 1}}, "Errado", "card", "admin", agora)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(estornos[0].ValorTransacao+11.33) > 0.001 {
+		t.Errorf("último estorno do café = R$ %.2f, esperava -11.33", estornos[0].ValorTransacao)
+	}
+	if !pedido.canceladoCom(estornos) {
+		t.Error("estorno do restante não cancelou o pedido")
+	}
+}
+
+func TestEstornarInvalido(t *testing.T) {
+	pedido := pedidoTeste(t)
+	agora := time.Now()
+	casos := []struct {
+		nome  string
+		itens []ItemEstorno
+	}{
+		{"mais do que foi vendido", []ItemEstorno{{CodigoProd: 1, Quantidade: 4}}},
+		{"quantidade negativa", []ItemEstorno{{CodigoProd: 1, Quantidade: -1}}},
+		{"produto fora do pedido", []ItemEstorno{{CodigoProd: 99, Quantidade: 1}}},
+		{"nada a estornar", []ItemEstorno{{CodigoProd: 1, Quantidade: 0}}},
+	}
+	for _, caso := range casos {
+		if _, err := pedido.estornar(caso.itens, "", "card", "admin", agora); err == nil {
+			t.Errorf("%s: estorno aceito", caso.nome)
+		}
+	}
+}
+
+// Pedido 8: um café em grãos de R$ 30 pago com dois vales e um pão de queijo pago no cartão
+func pedidoValesTeste(t *testing.T, extras ...Transacao) Pedido {
+	t.Helper()
+	venda := time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC)
+	transacoes := append([]Transacao{
+		{CodigoTransacao: 8, CodigoProd: 1, NomeProd: "Café em grãos", QuantidadeProd: 1, ValorUnitario: 30, ValorTransacao: 30,
+			MetodoPagamento: "card", DataTransacao: venda, Tipo: TransacaoVenda,
+			Pagamentos: []PagamentoParcial{{Metodo: "vale", Valor: 20, Referencia: "VALE-A"}, {Metodo: "vale", Valor: 10, Referencia: "VALE-B"}}},
+		{CodigoTransacao: 8, CodigoProd: 2, NomeProd: "Pão de queijo", QuantidadeProd: 1, ValorUnitario: 5, ValorTransacao: 5,
+			MetodoPagamento: "card", DataTransacao: venda, Tipo: TransacaoVenda},
+	}, extras...)
+	pedido, err := montarPedido(8, transacoes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pedido
+}
+
+func TestEstornarParaVales(t *testing.T) {
+	pedido := pedidoValesTeste(t)
+	agora := time.Date(2026, 3, 10, 10, 0, 0, 0, time.UTC)
+
+	estornos, err := pedido.estornar([]ItemEstorno{{CodigoProd: 1, Quantidade: 1}}, "", "vale", "admin", agora)
+	if err != nil {
+		t.Fatal(err)
+	}
+	esperado := []PagamentoParcial{{Metodo: "vale", Valor: -20, Referencia: "VALE-A"}, {Metodo: "vale", Valor: -10, Referencia: "VALE-B"}}
+	if len(estornos[0].Pagamentos) != len(esperado) {
+		t.Fatalf("pagamentos do estorno = %+v", estornos[0].Pagamentos)
+	}
+	for i, p := range estornos[0].Pagamentos {
+		if p != esperado[i] {
+			t.Errorf("pagamento %d = %+v, esperava %+v", i, p, esperado[i])
+		}
+	}
+
+	// Depois do estorno, os vales já não têm nada a receber por esse item
+	pedido = pedidoValesTeste(t, estornos...)
+	if item, _ := pedido.item(1); item.PagoPorVale["VALE-A"] != 0 || item.PagoPorVale["VALE-B"] != 0 {
+		t.Errorf("saldo pago por vale depois do estorno = %v", item.PagoPorVale)
+	}
+
+	// Estornos antigos para vale, sem o vale registrado, saem dos vales na ordem de uso
+	antigo := Transacao{CodigoTransacao: 8, CodigoProd: 1, NomeProd: "Café em grãos", QuantidadeProd: -1, ValorUnitario: 30, ValorTransacao: -25,
+		MetodoPagamento: "vale", DataTransacao: agora, Tipo: TransacaoEstorno}
+	pedido = pedidoValesTeste(t, antigo)
+	if item, _ := pedido.item(1); item.PagoPorVale["VALE-A"] != 0 || item.PagoPorVale["VALE-B"] != 5 {
+		t.Errorf("saldo pago por vale depois do estorno antigo = %v", item.PagoPorVale)
+	}
+
+	// O pão foi pago no cartão, então não pode voltar para um vale
+	if _, err := pedidoValesTeste(t).estornar([]ItemEstorno{{CodigoProd: 2, Quantidade: 1}}, "", "vale", "admin", agora); err == nil {
+		t.Error("estorno para vale de item pago no cartão aceito")
+	}
+}
+
+func TestValesACancelar(t *testing.T) {
+	agora := time.Now()
+	venda := time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC)
+	pedido, err := montarPedido(9, []Transacao{
+		{CodigoTransacao: 9, CodigoProd: 9, NomeProd: "Vale-presente R$ 50", QuantidadeProd: 2, ValorUnitario: 50, ValorTransacao: 100,
+			MetodoPagamento: "card", DataTransacao: venda, Tipo: TransacaoVenda},
+		{CodigoTransacao: 9, CodigoProd: 1, NomeProd: "Café expresso", QuantidadeProd: 1, ValorUnitario: 6, ValorTransacao: 6,
+			MetodoPagamento: "card", DataTransacao: venda, Tipo: TransacaoVenda},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valesPresente := map[int]bool{9: true}
+	intacto := func(codigo string) ValePresente {
+		return ValePresente{Codigo: codigo, ValorInicial: 50, Saldo: 50, Ativo: true, CodigoTransacao: 9}
+	}
+	gasto := ValePresente{Codigo: "GASTO", ValorInicial: 50, Saldo: 20, Ativo: true, CodigoTransacao: 9}
+	cancelado := ValePresente{Codigo: "CANCELADO", ValorInicial: 50, CodigoTransacao: 9}
+
+	casos := []struct {
+		nome     string
+		estornar []ItemEstorno
+		emitidos []ValePresente
+		cancelar []string
+		recusado bool
+	}{
+		{nome: "um dos vales intactos", estornar: []ItemEstorno{{CodigoProd: 9, Quantidade: 1}},
+			emitidos: []ValePresente{intacto("A"), intacto("B")}, cancelar: []string{"A"}},
+		{nome: "os dois vales", estornar: []ItemEstorno{{CodigoProd: 9, Quantidade: 2}},
+			emitidos: []ValePresente{intacto("A"), intacto("B")}, cancelar: []string{"A", "B"}},
+		{nome: "pula o vale já gasto", estornar: []ItemEstorno{{CodigoProd: 9, Quantidade: 1}},
+			emitidos: []ValePresente{gasto, intacto("B")}, cancelar: []string{"B"}},
+		{nome: "vale gasto em parte", estornar: []ItemEstorno{{CodigoProd: 9, Quantidade: 2}},
+			emitidos: []ValePresente{gasto, intacto("B")}, recusado: true},
+		{nome: "vale já cancelado", estornar: []ItemEstorno{{CodigoProd: 9, Quantidade: 1}},
+			emitidos: []ValePresente{cancelado}, recusado: true},
+		{nome: "estorno sem vale", estornar: []ItemEstorno{{CodigoProd: 1, Quantidade: 1}},
+			emitidos: []ValePresente{intacto("A")}},
+	}
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			estornos, err := pedido.estornar(caso.estornar, "", "card", "admin", agora)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vales, err := valesACancelar(estornos, valesPresente, caso.emitidos)
+			if caso.recusado {
+				if err == nil {
+					t.Fatalf("estorno aceito cancelando %+v", vales)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var codigos []string
+			for _, vale := range vales {
+				codigos = append(codigos, vale.Codigo)
+			}
+			if strings.Join(codigos, ",") != strings.Join(caso.cancelar, ",") {
+				t.Errorf("vales cancelados = %v, esperava %v", codigos, caso.cancelar)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	_ "time/tzdata"
+)
+
+type PresetPeriodo struct {
+	Valor string
+	Nome  string
+}
+
+// Períodos pré-definidos oferecidos no formulário de relatórios
+var presetsPeriodo = []PresetPeriodo{
+	{"hoje", "Hoje"},
+	{"semana", "Esta semana"},
+	{"ultimos30", "Últimos 30 dias"},
+	{"mes", "Este mês"},
+	{"trimestre", "Este trimestre"},
+	{"ano", "Este ano"},
+}
+
+// Intervalo semiaberto [Inicio, Fim) no fuso horário da loja
+type Periodo struct {
+	Inicio time.Time
+	Fim    time.Time
+	// Quantidade de meses quando o período é alinhado ao calendário (mês, trimestre, ano)
+	meses int
+}
+
+// Fuso horário usado para delimitar os dias dos relatórios
+func fusoLoja() *time.Location {
+	loc, err := time.LoadLocation(config.FusoHorario)
+	if err != nil {
+		log.Printf("Invalid time zone %q, using local time: %v", config.FusoHorario, err)
+		return time.Local
+	}
+	return loc
+}
+
+func inicioDoDia(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// Último dia incluído no período, para exibição
+func (p Periodo) UltimoDia() time.Time {
+	return p.Fim.AddDate(0, 0, -1)
+}
+
+func (p Periodo) Contem(t time.Time) bool {
+	return !t.Before(p.Inicio) && t.Before(p.Fim)
+}
+
+// Período de mesma duração imediatamente anterior; períodos de calendário recuam o mesmo número de meses
+func (p Periodo) Anterior() Periodo {
+	if p.meses > 0 {
+		return Periodo{Inicio: p.Inicio.AddDate(0, -p.meses, 0), Fim: p.Inicio, meses: p.meses}
+	}
+	dias := int(p.Fim.Sub(p.Inicio).Hours()/24 + 0.5)
+	return Periodo{Inicio: p.Inicio.AddDate(0, 0, -dias), Fim: p.Inicio}
+}
+
+func periodoMes(mes, ano int, loc *time.Location) (Periodo, error) {
+	if mes < 1 || mes > 12 {
+		return Periodo{}, errors.New("Invalid month")
+	}
+	inicio := time.Date(ano, time.Month(mes), 1, 0, 0, 0, 0, loc)
+	return Periodo{Inicio: inicio, Fim: inicio.AddDate(0, 1, 0), meses: 1}, nil
+}
+
+// Período a partir de datas inclusivas no formato AAAA-MM-DD
+func periodoIntervalo(de, ate string, loc *time.Location) (Periodo, error) {
+	inicio, err := time.ParseInLocation("2006-01-02", de, loc)
+	if err != nil {
+		return Periodo{}, errors.New("Invalid start date")
+	}
+	fim, err := time.ParseInLocation("2006-01-02", ate, loc)
+	if err != nil {
+		return Periodo{}, errors.New("Invalid end date")
+	}
+	if fim.Before(inicio) {
+		return Periodo{}, errors.New("End date before start date")
+	}
+	return Periodo{Inicio: inicio, Fim: fim.AddDate(0, 0, 1)}, nil
+}
+
+func periodoPreset(preset string, agora time.Time) (Periodo, error) {
+	hoje := inicioDoDia(agora)
+	switch preset {
+	case "hoje":
+		return Periodo{Inicio: hoje, Fim: hoje.AddDate(0, 0, 1)}, nil
+	case "semana":
+		// A semana começa na segunda-feira
+		deslocamento := (int(hoje.Weekday()) + 6) % 7
+		inicio := hoje.AddDate(0, 0, -deslocamento)
+		return Periodo{Inicio: inicio, Fim: inicio.AddDate(0, 0, 7)}, nil
+	case "ultimos30":
+		return Periodo{Inicio: hoje.AddDate(0, 0, -29), Fim: hoje.AddDate(0, 0, 1)}, nil
+	case "mes":
+		return periodoMes(int(hoje.Month()), hoje.Year(), hoje.Location())
+	case "trimestre":
+		mes := (int(hoje.Month())-1)/3*3 + 1
+		inicio := time.Date(hoje.Year(), time.Month(mes), 1, 0, 0, 0, 0, hoje.Location())
+		return Periodo{Inicio: inicio, Fim: inicio.AddDate(0, 3, 0), meses: 3}, nil
+	case "ano":
+		inicio := time.Date(hoje.Year(), 1, 1, 0, 0, 0, 0, hoje.Location())
+		return Periodo{Inicio: inicio, Fim: inicio.AddDate(1, 0, 0), meses: 12}, nil
+	}
+	return Periodo{}, fmt.Errorf("Unknown period preset %q", preset)
+}
+
+// Lê o período do formulário: um preset, um intervalo de datas ou um mês/ano
+func lerPeriodo(r *http.Request, agora time.Time) (Periodo, map[string]string, error) {
+	loc := fusoLoja()
+
+	if preset := r.FormValue("preset"); preset != "" {
+		periodo, err := periodoPreset(preset, agora.In(loc))
+		parametros := map[string]string{
+			"preset": preset,
+			"de":     periodo.Inicio.Format("2006-01-02"),
+			"ate":    periodo.UltimoDia().Format("2006-01-02"),
+		}
+		return periodo, parametros, err
+	}
+
+	if de, ate := r.FormValue("de"), r.FormValue("ate"); de != "" || ate != "" {
+		periodo, err := periodoIntervalo(de, ate, loc)
+		return periodo, map[string]string{"de": de, "ate": ate}, err
+	}
+
+	mes, err := strconv.Atoi(r.FormValue("mes"))
+	if err != nil {
+		return Periodo{}, nil, errors.New("Failed to convert month to integer")
+	}
+	ano, err := strconv.Atoi(r.FormValue("ano"))
+	if err != nil {
+		return Periodo{}, nil, errors.New("Failed to convert year to integer")
+	}
+	periodo, err := periodoMes(mes, ano, loc)
+	return periodo, map[string]string{"mes": fmt.Sprintf("%02d", mes), "ano": strconv.Itoa(ano)}, err
+}
+
+// Variação percentual entre o período atual e o anterior
+func variacao(atual, anterior float64) float64 {
+	if anterior == 0 {
+		return 0
+	}
+	return 100 * (atual - anterior) / anterior
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/mux"
+)
+
+// Situações de um pedido na fila de preparo
+const (
+	PreparoRecebido   = "recebido"
+	PreparoPreparando = "preparando"
+	PreparoPronto     = "pronto"
+	PreparoRetirado   = "retirado"
+	PreparoCancelado  = "cancelado"
+)
+
+// Situações que ainda aparecem na tela do balcão
+var statusFilaPreparo = []string{PreparoRecebido, PreparoPreparando, PreparoPronto}
+
+// Próxima situação de cada uma; o balcão só avança o pedido um passo por vez
+var proximoStatusPreparo = map[string]string{
+	PreparoRecebido:   PreparoPreparando,
+	PreparoPreparando: PreparoPronto,
+	PreparoPronto:     PreparoRetirado,
+}
+
+var ErrTransicaoPreparo = errors.New("invalid order status change")
+
+// Pedido da loja na fila de preparo, na coleção "preparos" com o código do pedido como ID do documento.
+// Criado pelo Server_Usuario ao finalizar a compra, só com os itens que o balcão prepara.
+type Preparo struct {
+	Codigo     int
+	Status     string
+	Itens      []ItemPreparo
+	RetiradaEm time.Time
+	// Pedido que sai para entrega; o passo "retirado" é a saída com o entregador
+	Entrega bool
+	// Mesa do salão para onde o pedido é levado, nos pedidos feitos pelo QR code
+	Mesa         int
+	CriadoEm     time.Time
+	AtualizadoEm time.Time
+	Historico    []MudancaPreparo
+}
+
+type ItemPreparo struct {
+	NomeProd   string
+	Quantidade int
+}
+
+type MudancaPreparo struct {
+	Status  string
+	Data    time.Time
+	Usuario string
+}
+
+type PreparoPageData struct {
+	PageTitle string
+}
+
+// Fila na ordem de atendimento: pelo horário de retirada, quando houver, e depois pela chegada
+func ordenarPreparos(preparos []Preparo) {
+	chave := func(p Preparo) time.Time {
+		if !p.RetiradaEm.IsZero() {
+			return p.RetiradaEm
+		}
+		return p.CriadoEm
+	}
+	sort.Slice(preparos, func(i, j int) bool { return chave(preparos[i]).Before(chave(preparos[j])) })
+}
+
+// Avança o pedido para a situação informada, que precisa ser a seguinte à atual. Quando o pedido
+// fica pronto, o aviso ao cliente entra na fila de emails na mesma transação.
+func avancarPreparo(firestoreClient *FirestoreClient, codigo int, status, usuario string) error {
+	ref := firestoreClient.Client.Collection("preparos").Doc(strconv.Itoa(codigo))
+	transacoesRef := firestoreClient.Client.Collection("transacoes")
+	emailsRef := firestoreClient.Client.Collection("emails")
+	enfileirado := false
+	err := firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		enfileirado = false
+		snapshot, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var preparo Preparo
+		if err := snapshot.DataTo(&preparo); err != nil {
+			return err
+		}
+		if proximoStatusPreparo[preparo.Status] != status {
+			return ErrTransicaoPreparo
+		}
+
+		// Todas as leituras precisam acontecer antes das escritas
+		var pedido Pedido
+		if status == PreparoPronto {
+			docs, err := tx.Documents(transacoesRef.Where("CodigoTransacao", "==", codigo)).GetAll()
+			if err != nil {
+				return err
+			}
+			pedido, err = montarPedidoDocumentos(codigo, docs)
+			if err != nil && err != ErrPedidoNaoEncontrado {
+				return err
+			}
+		}
+
+		agora := time.Now()
+		err = tx.Update(ref, []firestore.Update{
+			{Path: "Status", Value: status},
+			{Path: "AtualizadoEm", Value: agora},
+			{Path: "Historico", Value: firestore.ArrayUnion(MudancaPreparo{Status: status, Data: agora, Usuario: usuario})},
+		})
+		if err != nil || pedido.emailAvisos() == "" {
+			return err
+		}
+		enfileirado = true
+		return tx.Create(emailsRef.NewDoc(), emailPedidoPronto(pedido, preparo, agora))
+	})
+	if err == nil && enfileirado {
+		acordarFilaEmails()
+	}
+	return err
+}
+
+// Envia um evento do Server-Sent Events com os dados em JSON
+func enviarEventoSSE(w http.ResponseWriter, flusher http.Flusher, evento string, dados interface{}) error {
+	conteudo, err := json.Marshal(dados)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evento, conteudo); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// Tela do balcão; os pedidos chegam por /preparo/eventos
+func PreparoHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("template/preparo.html"))
+	if err := tmpl.Execute(w, PreparoPageData{PageTitle: "Coffee Shop - Fila de preparo"}); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+// Envia a fila inteira a cada mudança na coleção, acompanhando o Firestore em tempo real
+// até o navegador desconectar
+func PreparoEventosHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	snapshots := firestoreClient.Client.Collection("preparos").Where("Status", "in", statusFilaPreparo).Snapshots(r.Context())
+	defer snapshots.Stop()
+	for {
+		snapshot, err := snapshots.Next()
+		if err != nil {
+			if r.Context().Err() == nil {
+				log.Printf("Failed to watch order queue: %v", err)
+			}
+			return
+		}
+		docs, err := snapshot.Documents.GetAll()
+		if err != nil {
+			log.Printf("Failed to read order queue: %v", err)
+			return
+		}
+		preparos := []Preparo{}
+		for _, doc := range docs {
+			var preparo Preparo
+			if err := doc.DataTo(&preparo); err != nil {
+				log.Printf("Failed to parse order queue entry %s: %v", doc.Ref.ID, err)
+				continue
+			}
+			preparos = append(preparos, preparo)
+		}
+		ordenarPreparos(preparos)
+		if err := enviarEventoSSE(w, flusher, "fila", preparos); err != nil {
+			return
+		}
+	}
+}
+
+func AvancarPreparoHandler(w http.ResponseWriter, r *http.Request) {
+	codigo, _ := strconv.Atoi(mux.Vars(r)["codigo"])
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	err = avancarPreparo(firestoreClient, codigo, r.FormValue("status"), usuarioRequisicao(r))
+	if err == ErrTransicaoPreparo {
+		http.Error(w, "Order status has already changed", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to update order %d status: %v", codigo, err)
+		http.Error(w, "Failed to update order status", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
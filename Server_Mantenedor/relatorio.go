@@ -0,0 +1,394 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/iterator"
+)
+
+// Métodos de pagamento aceitos no carrinho do Server_Usuario
+var nomesMetodoPagamento = map[string]string{
+	"card": "Cartão",
+	"cash": "Dinheiro",
+	"pix":  "PIX",
+	"vale": "Vale-presente",
+}
+
+// Totais financeiros de um conjunto de transações
+type ResumoFinanceiro struct {
+	Quantidade       int
+	Receita          float64
+	Custo            float64
+	MargemBruta      float64
+	PercentualMargem float64
+}
+
+type LinhaProdutoFluxo struct {
+	CodigoProd int
+	NomeProd   string
+	ResumoFinanceiro
+}
+
+type LinhaDiaFluxo struct {
+	Dia time.Time
+	ResumoFinanceiro
+}
+
+// Total de um cupom ou promoção no período
+type LinhaDescontoFluxo struct {
+	Origem    string
+	Codigo    string
+	Descricao string
+	Itens     int
+	Valor     float64
+}
+
+type LinhaPagamentoFluxo struct {
+	Metodo     string
+	Transacoes int
+	Receita    float64
+	Percentual float64
+}
+
+// Totais do período anterior e a variação do período atual em relação a ele
+type ComparacaoFluxo struct {
+	Periodo             Periodo
+	Total               ResumoFinanceiro
+	VariacaoQuantidade  float64
+	VariacaoReceita     float64
+	VariacaoCusto       float64
+	VariacaoMargemBruta float64
+}
+
+type RelatorioFluxo struct {
+	Periodo    Periodo
+	Anterior   ComparacaoFluxo
+	Produtos   []LinhaProdutoFluxo
+	Dias       []LinhaDiaFluxo
+	Pagamentos []LinhaPagamentoFluxo
+	Total      ResumoFinanceiro
+	// Estornos do período, já descontados dos totais acima com valores negativos
+	Estornos       []Transacao
+	TotalEstornado float64
+	// Descontos concedidos no período; a receita já vem líquida deles
+	Descontos      []LinhaDescontoFluxo
+	TotalDescontos float64
+	// Valor pago com vales-presente. Fica fora da receita e dos métodos de pagamento: o dinheiro entrou
+	// na venda do vale, que já é receita
+	ResgatesVale float64
+	// Tributos das vendas líquidas de estornos, por NCM, CFOP e CST
+	Impostos      []LinhaImpostoFluxo
+	TotalImpostos ImpostosLinha
+}
+
+func (r *ResumoFinanceiro) adicionar(quantidade int, receita, custo float64) {
+	r.Quantidade += quantidade
+	r.Receita += receita
+	r.Custo += custo
+	r.MargemBruta = r.Receita - r.Custo
+	r.PercentualMargem = 0
+	if r.Receita != 0 {
+		r.PercentualMargem = 100 * r.MargemBruta / r.Receita
+	}
+}
+
+func nomeMetodoPagamento(metodo string) string {
+	if nome, ok := nomesMetodoPagamento[metodo]; ok {
+		return nome
+	}
+	if metodo == "" {
+		return "Não informado"
+	}
+	return metodo
+}
+
+// Custo unitário da transação: o registrado no momento da venda ou, para transações antigas,
+// o valor de compra atual do produto
+func custoUnitario(t Transacao, custos map[int]float64) float64 {
+	if t.CustoUnitario > 0 {
+		return t.CustoUnitario
+	}
+	return custos[t.CodigoProd]
+}
+
+// Custo da linha. Um estorno só devolve o custo das unidades que voltaram ao estoque; o que foi
+// descartado continua custando.
+func custoTransacao(t Transacao, custos map[int]float64) float64 {
+	quantidade := t.QuantidadeProd
+	if t.Estorno() && t.Restituido != nil {
+		quantidade = -*t.Restituido
+	}
+	return custoUnitario(t, custos) * float64(quantidade)
+}
+
+// Consolida receita, custo e margem por produto, por dia e no total, além da divisão por método de pagamento
+func calcularFluxoCaixa(transacoes []Transacao, custos map[int]float64, periodo Periodo) RelatorioFluxo {
+	relatorio := RelatorioFluxo{Periodo: periodo}
+
+	porProduto := make(map[int]*LinhaProdutoFluxo)
+	porDia := make(map[string]*LinhaDiaFluxo)
+	porMetodo := make(map[string]*LinhaPagamentoFluxo)
+	porDesconto := make(map[string]*LinhaDescontoFluxo)
+
+	for _, t := range transacoes {
+		custo := custoTransacao(t, custos)
+		metodos := t.valorPorMetodo()
+		receita := t.ValorTransacao - metodos["vale"]
+		relatorio.ResgatesVale += metodos["vale"]
+
+		produto, ok := porProduto[t.CodigoProd]
+		if !ok {
+			produto = &LinhaProdutoFluxo{CodigoProd: t.CodigoProd, NomeProd: t.NomeProd}
+			porProduto[t.CodigoProd] = produto
+		}
+		produto.adicionar(t.QuantidadeProd, receita, custo)
+
+		data := t.DataTransacao.In(periodo.Inicio.Location())
+		chaveDia := data.Format("2006-01-02")
+		dia, ok := porDia[chaveDia]
+		if !ok {
+			dia = &LinhaDiaFluxo{Dia: inicioDoDia(data)}
+			porDia[chaveDia] = dia
+		}
+		dia.adicionar(t.QuantidadeProd, receita, custo)
+
+		for codigo, valor := range metodos {
+			if codigo == "vale" {
+				continue
+			}
+			metodo := nomeMetodoPagamento(codigo)
+			pagamento, ok := porMetodo[metodo]
+			if !ok {
+				pagamento = &LinhaPagamentoFluxo{Metodo: metodo}
+				porMetodo[metodo] = pagamento
+			}
+			pagamento.Transacoes++
+			pagamento.Receita += valor
+		}
+
+		relatorio.Total.adicionar(t.QuantidadeProd, receita, custo)
+
+		if t.Estorno() {
+			relatorio.Estornos = append(relatorio.Estornos, t)
+			relatorio.TotalEstornado += t.ValorTransacao
+		}
+
+		for _, d := range t.Descontos {
+			chave := d.Origem + ":" + d.Codigo
+			desconto, ok := porDesconto[chave]
+			if !ok {
+				desconto = &LinhaDescontoFluxo{Origem: d.Origem, Codigo: d.Codigo, Descricao: d.Descricao}
+				porDesconto[chave] = desconto
+			}
+			desconto.Itens += t.QuantidadeProd
+			desconto.Valor += d.Valor
+			relatorio.TotalDescontos += d.Valor
+		}
+	}
+
+	for _, produto := range porProduto {
+		relatorio.Produtos = append(relatorio.Produtos, *produto)
+	}
+	sort.Slice(relatorio.Produtos, func(i, j int) bool {
+		if relatorio.Produtos[i].Receita != relatorio.Produtos[j].Receita {
+			return relatorio.Produtos[i].Receita > relatorio.Produtos[j].Receita
+		}
+		return relatorio.Produtos[i].CodigoProd < relatorio.Produtos[j].CodigoProd
+	})
+
+	for _, dia := range porDia {
+		relatorio.Dias = append(relatorio.Dias, *dia)
+	}
+	sort.Slice(relatorio.Dias, func(i, j int) bool {
+		return relatorio.Dias[i].Dia.Before(relatorio.Dias[j].Dia)
+	})
+
+	for _, pagamento := range porMetodo {
+		if relatorio.Total.Receita != 0 {
+			pagamento.Percentual = 100 * pagamento.Receita / relatorio.Total.Receita
+		}
+		relatorio.Pagamentos = append(relatorio.Pagamentos, *pagamento)
+	}
+	sort.Slice(relatorio.Pagamentos, func(i, j int) bool {
+		return relatorio.Pagamentos[i].Receita > relatorio.Pagamentos[j].Receita
+	})
+
+	for _, desconto := range porDesconto {
+		relatorio.Descontos = append(relatorio.Descontos, *desconto)
+	}
+	sort.Slice(relatorio.Descontos, func(i, j int) bool {
+		return relatorio.Descontos[i].Valor > relatorio.Descontos[j].Valor
+	})
+
+	return relatorio
+}
+
+// Linhas do relatório de fluxo de caixa no formato CSV, uma seção por agrupamento
+func (r RelatorioFluxo) linhasCSV() [][]string {
+	valor := func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) }
+
+	linhas := [][]string{
+		{"Relatório de fluxo de caixa", r.Periodo.Inicio.Format("02/01/2006"), r.Periodo.UltimoDia().Format("02/01/2006")},
+		{},
+		{"Produto", "CodigoProd", "Quantidade", "Receita", "Custo", "MargemBruta", "Margem%"},
+	}
+	for _, p := range r.Produtos {
+		linhas = append(linhas, []string{p.NomeProd, strconv.Itoa(p.CodigoProd), strconv.Itoa(p.Quantidade),
+			valor(p.Receita), valor(p.Custo), valor(p.MargemBruta), valor(p.PercentualMargem)})
+	}
+
+	linhas = append(linhas, []string{}, []string{"Dia", "Quantidade", "Receita", "Custo", "MargemBruta", "Margem%"})
+	for _, d := range r.Dias {
+		linhas = append(linhas, []string{d.Dia.Format("02/01/2006"), strconv.Itoa(d.Quantidade),
+			valor(d.Receita), valor(d.Custo), valor(d.MargemBruta), valor(d.PercentualMargem)})
+	}
+
+	linhas = append(linhas, []string{}, []string{"MetodoPagamento", "Transacoes", "Receita", "Percentual"})
+	for _, p := range r.Pagamentos {
+		linhas = append(linhas, []string{p.Metodo, strconv.Itoa(p.Transacoes), valor(p.Receita), valor(p.Percentual)})
+	}
+	if r.ResgatesVale != 0 {
+		linhas = append(linhas, []string{"PagoComVales", "", valor(r.ResgatesVale), ""})
+	}
+
+	if len(r.Descontos) > 0 {
+		linhas = append(linhas, []string{}, []string{"Desconto", "Origem", "Codigo", "Itens", "Valor"})
+		for _, d := range r.Descontos {
+			linhas = append(linhas, []string{d.Descricao, d.Origem, d.Codigo, strconv.Itoa(d.Itens), valor(d.Valor)})
+		}
+		linhas = append(linhas, []string{"TotalDescontos", "", "", "", valor(r.TotalDescontos)})
+	}
+
+	if len(r.Impostos) > 0 {
+		linhas = append(linhas, []string{}, []string{"NCM", "CFOP", "CST", "Itens", "BaseCalculo", "ICMS", "PIS", "COFINS", "TotalTributos"})
+		for _, i := range r.Impostos {
+			linhas = append(linhas, []string{i.NCM, i.CFOP, i.CST, strconv.Itoa(i.Itens), valor(i.BaseCalculo),
+				valor(i.ICMS), valor(i.PIS), valor(i.COFINS), valor(i.Total())})
+		}
+		t := r.TotalImpostos
+		linhas = append(linhas, []string{"TotalTributos", "", "", "", valor(t.BaseCalculo), valor(t.ICMS), valor(t.PIS), valor(t.COFINS), valor(t.Total())})
+	}
+
+	if len(r.Estornos) > 0 {
+		linhas = append(linhas, []string{}, []string{"Estorno", "Pedido", "Produto", "Quantidade", "Valor", "MetodoPagamento", "Motivo"})
+		for _, e := range r.Estornos {
+			linhas = append(linhas, []string{e.DataTransacao.In(r.Periodo.Inicio.Location()).Format("02/01/2006 15:04"), strconv.Itoa(e.CodigoTransacao),
+				e.NomeProd, strconv.Itoa(e.QuantidadeProd), valor(e.ValorTransacao), nomeMetodoPagamento(e.MetodoPagamento), e.Motivo})
+		}
+		linhas = append(linhas, []string{"TotalEstornado", "", "", "", valor(r.TotalEstornado)})
+	}
+
+	linhas = append(linhas, []string{}, []string{"Total", "Quantidade", "Receita", "Custo", "MargemBruta", "Margem%"},
+		[]string{"", strconv.Itoa(r.Total.Quantidade), valor(r.Total.Receita), valor(r.Total.Custo),
+			valor(r.Total.MargemBruta), valor(r.Total.PercentualMargem)})
+
+	a := r.Anterior
+	linhas = append(linhas, []string{},
+		[]string{"PeriodoAnterior", "Quantidade", "Receita", "Custo", "MargemBruta", "Margem%"},
+		[]string{a.Periodo.Inicio.Format("02/01/2006") + " - " + a.Periodo.UltimoDia().Format("02/01/2006"),
+			strconv.Itoa(a.Total.Quantidade), valor(a.Total.Receita), valor(a.Total.Custo),
+			valor(a.Total.MargemBruta), valor(a.Total.PercentualMargem)},
+		[]string{"Variacao%", valor(a.VariacaoQuantidade), valor(a.VariacaoReceita), valor(a.VariacaoCusto),
+			valor(a.VariacaoMargemBruta), ""})
+	return linhas
+}
+
+// Busca as transações do período e do período anterior e monta o relatório com a comparação entre eles
+func montarRelatorioFluxo(firestoreClient *FirestoreClient, periodo Periodo) (RelatorioFluxo, error) {
+	anterior := periodo.Anterior()
+
+	transacoes, err := buscarTransacoes(firestoreClient, anterior.Inicio, periodo.Fim)
+	if err != nil {
+		return RelatorioFluxo{}, err
+	}
+
+	produtos, err := buscarProdutosPorID(firestoreClient)
+	if err != nil {
+		return RelatorioFluxo{}, err
+	}
+	custos := custosProdutos(produtos)
+
+	var atuais, anteriores []Transacao
+	for _, t := range transacoes {
+		if periodo.Contem(t.DataTransacao) {
+			atuais = append(atuais, t)
+		} else if anterior.Contem(t.DataTransacao) {
+			anteriores = append(anteriores, t)
+		}
+	}
+
+	relatorio := calcularFluxoCaixa(atuais, custos, periodo)
+	relatorio.Impostos, relatorio.TotalImpostos = resumirImpostos(atuais, produtos, config.NFCe)
+	relatorio.Anterior = compararFluxo(relatorio.Total, calcularFluxoCaixa(anteriores, custos, anterior))
+	return relatorio, nil
+}
+
+func compararFluxo(atual ResumoFinanceiro, anterior RelatorioFluxo) ComparacaoFluxo {
+	return ComparacaoFluxo{
+		Periodo:             anterior.Periodo,
+		Total:               anterior.Total,
+		VariacaoQuantidade:  variacao(float64(atual.Quantidade), float64(anterior.Total.Quantidade)),
+		VariacaoReceita:     variacao(atual.Receita, anterior.Total.Receita),
+		VariacaoCusto:       variacao(atual.Custo, anterior.Total.Custo),
+		VariacaoMargemBruta: variacao(atual.MargemBruta, anterior.Total.MargemBruta),
+	}
+}
+
+// Busca as transações com data no intervalo semiaberto [inicio, fim)
+func buscarTransacoes(firestoreClient *FirestoreClient, inicio, fim time.Time) ([]Transacao, error) {
+	docs, err := firestoreClient.Client.Collection("transacoes").Where("DataTransacao", ">=", inicio).Where("DataTransacao", "<", fim).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var transacoes []Transacao
+	for _, doc := range docs {
+		var transacao Transacao
+		if err := doc.DataTo(&transacao); err != nil {
+			return nil, err
+		}
+		transacoes = append(transacoes, transacao)
+	}
+	return transacoes, nil
+}
+
+// Produtos do catálogo, indexados pelo ID
+func buscarProdutosPorID(firestoreClient *FirestoreClient) (map[int]Produto, error) {
+	produtos := make(map[int]Produto)
+
+	iter := firestoreClient.Client.Collection("produtos").Documents(firestoreClient.Ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var produto Produto
+		if err := doc.DataTo(&produto); err != nil {
+			return nil, err
+		}
+		produtos[produto.ID] = produto
+	}
+	return produtos, nil
+}
+
+// Valor de compra atual de cada produto, indexado pelo ID
+func custosProdutos(produtos map[int]Produto) map[int]float64 {
+	custos := make(map[int]float64)
+	for id, produto := range produtos {
+		custos[id] = produto.ValorCompra
+	}
+	return custos
+}
+
+func buscarCustosProdutos(firestoreClient *FirestoreClient) (map[int]float64, error) {
+	produtos, err := buscarProdutosPorID(firestoreClient)
+	if err != nil {
+		return nil, err
+	}
+	return custosProdutos(produtos), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFluxoCaixaValePresente(t *testing.T) {
+	periodo := Periodo{Inicio: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), Fim: time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)}
+	dia := func(d int) time.Time { return time.Date(2026, 3, d, 10, 0, 0, 0, time.UTC) }
+	transacoes := []Transacao{
+		// Venda de um vale de R$ 50 em dinheiro
+		{CodigoTransacao: 1, CodigoProd: 9, NomeProd: "Vale-presente R$ 50", QuantidadeProd: 1, ValorUnitario: 50,
+			ValorTransacao: 50, MetodoPagamento: "cash", DataTransacao: dia(2)},
+		// Resgate: um café de R$ 30, com R$ 20 do vale e o restante no cartão
+		{CodigoTransacao: 2, CodigoProd: 1, NomeProd: "Café em grãos", QuantidadeProd: 1, ValorUnitario: 30, CustoUnitario: 12,
+			ValorTransacao: 30, MetodoPagamento: "card", DataTransacao: dia(5),
+			Pagamentos: []PagamentoParcial{{Metodo: "vale", Valor: 20, Referencia: "VALE-1"}, {Metodo: "card", Valor: 10}}},
+		// Resgate do saldo restante do vale, pago inteiro com ele
+		{CodigoTransacao: 3, CodigoProd: 1, NomeProd: "Café em grãos", QuantidadeProd: 1, ValorUnitario: 30, CustoUnitario: 12,
+			ValorTransacao: 30, MetodoPagamento: "vale", DataTransacao: dia(6)},
+	}
+
+	relatorio := calcularFluxoCaixa(transacoes, nil, periodo)
+
+	// Entraram R$ 50 do vale e R$ 10 do cartão; os R$ 50 gastos com o vale não são receita de novo
+	if math.Abs(relatorio.Total.Receita-60) > 0.001 {
+		t.Errorf("receita = %.2f, esperava 60.00", relatorio.Total.Receita)
+	}
+	if math.Abs(relatorio.ResgatesVale-50) > 0.001 {
+		t.Errorf("resgates de vale = %.2f, esperava 50.00", relatorio.ResgatesVale)
+	}
+	recebido := 0.0
+	for _, p := range relatorio.Pagamentos {
+		if p.Metodo == nomeMetodoPagamento("vale") {
+			t.Errorf("vale-presente aparece como método de pagamento: %+v", p)
+		}
+		recebido += p.Receita
+	}
+	if math.Abs(recebido-relatorio.Total.Receita) > 0.001 {
+		t.Errorf("métodos de pagamento somam %.2f, a receita é %.2f", recebido, relatorio.Total.Receita)
+	}
+	for _, d := range relatorio.Dias {
+		if d.Dia.Day() == 6 && d.Receita != 0 {
+			t.Errorf("dia pago só com vale tem receita %.2f", d.Receita)
+		}
+	}
+
+	// O estorno de uma compra paga com vale devolve o saldo ao vale, sem mexer na receita
+	estorno := Transacao{CodigoTransacao: 3, CodigoProd: 1, NomeProd: "Café em grãos", QuantidadeProd: -1, ValorUnitario: 30, CustoUnitario: 12,
+		ValorTransacao: -30, MetodoPagamento: "vale", DataTransacao: dia(7), Tipo: TransacaoEstorno}
+	relatorio = calcularFluxoCaixa(append(transacoes, estorno), nil, periodo)
+	if math.Abs(relatorio.Total.Receita-60) > 0.001 {
+		t.Errorf("receita depois do estorno para o vale = %.2f, esperava 60.00", relatorio.Total.Receita)
+	}
+}
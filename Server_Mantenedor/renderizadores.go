@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// Relatório de fluxo de caixa pronto para ser renderizado em algum formato
+type DocumentoRelatorio struct {
+	Titulo     string
+	Relatorio  RelatorioFluxo
+	Parametros map[string]string
+	GeradoEm   time.Time
+}
+
+// Converte um relatório de fluxo de caixa para um formato de saída
+type RenderizadorRelatorio interface {
+	Formato() string
+	TipoConteudo() string
+	Renderizar(w io.Writer, documento DocumentoRelatorio) error
+}
+
+var renderizadores = map[string]RenderizadorRelatorio{
+	"csv":  renderizadorCSV{},
+	"html": renderizadorHTML{},
+	"pdf":  renderizadorPDF{},
+}
+
+type renderizadorCSV struct{}
+
+func (renderizadorCSV) Formato() string      { return "csv" }
+func (renderizadorCSV) TipoConteudo() string { return "text/csv; charset=utf-8" }
+
+func (renderizadorCSV) Renderizar(w io.Writer, documento DocumentoRelatorio) error {
+	return csv.NewWriter(w).WriteAll(documento.Relatorio.linhasCSV())
+}
+
+type renderizadorHTML struct{}
+
+func (renderizadorHTML) Formato() string      { return "html" }
+func (renderizadorHTML) TipoConteudo() string { return "text/html; charset=utf-8" }
+
+func (renderizadorHTML) Renderizar(w io.Writer, documento DocumentoRelatorio) error {
+	tmpl, err := template.ParseFiles("template/relatorio_fluxo_resultado.html")
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, RelatorioFluxoPageData{
+		PageTitle:  documento.Titulo,
+		Relatorio:  documento.Relatorio,
+		Parametros: documento.Parametros,
+	})
+}
+
+type renderizadorPDF struct{}
+
+func (renderizadorPDF) Formato() string      { return "pdf" }
+func (renderizadorPDF) TipoConteudo() string { return "application/pdf" }
+
+// Gera o PDF com logo, período, totais e tabelas. A data de criação vem do documento,
+// de modo que o mesmo relatório produz sempre os mesmos bytes.
+func (renderizadorPDF) Renderizar(w io.Writer, documento DocumentoRelatorio) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetCreationDate(documento.GeradoEm)
+	pdf.SetModificationDate(documento.GeradoEm)
+	pdf.SetCatalogSort(true)
+	pdf.SetTitle(documento.Titulo, true)
+	pdf.SetAuthor("Coffee Shop", true)
+	pdf.SetAutoPageBreak(true, 15)
+	pdf.AliasNbPages("")
+
+	// As fontes padrão do PDF usam cp1252, então os textos em UTF-8 precisam ser convertidos
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-12)
+		pdf.SetFont("Arial", "I", 8)
+		pdf.SetTextColor(120, 120, 120)
+		pdf.CellFormat(0, 6, tr(fmt.Sprintf("Gerado em %s - Página %d/{nb}", documento.GeradoEm.Format("02/01/2006 15:04"), pdf.PageNo())), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	if _, err := os.Stat(config.CaminhoLogo); err == nil {
+		pdf.ImageOptions(config.CaminhoLogo, 10, 10, 40, 0, false, fpdf.ImageOptions{}, 0, "")
+	}
+	pdf.SetXY(55, 12)
+	pdf.SetFont("Arial", "B", 16)
+	pdf.SetTextColor(51, 51, 51)
+	pdf.CellFormat(0, 8, tr(documento.Titulo), "", 1, "L", false, 0, "")
+	pdf.SetX(55)
+	pdf.SetFont("Arial", "", 10)
+	periodo := documento.Relatorio.Periodo
+	pdf.CellFormat(0, 6, tr(fmt.Sprintf("Período: %s a %s", periodo.Inicio.Format("02/01/2006"), periodo.UltimoDia().Format("02/01/2006"))), "", 1, "L", false, 0, "")
+	pdf.SetY(35)
+
+	moeda := func(v float64) string { return fmt.Sprintf("R$ %.2f", v) }
+	percentual := func(v float64) string { return fmt.Sprintf("%.1f%%", v) }
+
+	tabela := func(titulo string, larguras []float64, cabecalho []string, linhas [][]string) {
+		pdf.Ln(4)
+		pdf.SetFont("Arial", "B", 12)
+		pdf.CellFormat(0, 8, tr(titulo), "", 1, "L", false, 0, "")
+
+		pdf.SetFont("Arial", "B", 9)
+		pdf.SetFillColor(242, 242, 242)
+		for i, coluna := range cabecalho {
+			pdf.CellFormat(larguras[i], 7, tr(coluna), "1", 0, "L", true, 0, "")
+		}
+		pdf.Ln(-1)
+
+		pdf.SetFont("Arial", "", 9)
+		for _, linha := range linhas {
+			for i, valor := range linha {
+				alinhamento := "R"
+				if i == 0 {
+					alinhamento = "L"
+				}
+				pdf.CellFormat(larguras[i], 6, tr(valor), "1", 0, alinhamento, false, 0, "")
+			}
+			pdf.Ln(-1)
+		}
+	}
+
+	relatorio := documento.Relatorio
+	total := relatorio.Total
+	tabela("Totais do período", []float64{38, 38, 38, 38, 38},
+		[]string{"Itens vendidos", "Receita", "Custo", "Margem bruta", "Margem %"},
+		[][]string{{fmt.Sprint(total.Quantidade), moeda(total.Receita), moeda(total.Custo), moeda(total.MargemBruta), percentual(total.PercentualMargem)}})
+
+	anterior := relatorio.Anterior
+	tabela(fmt.Sprintf("Comparação com %s a %s", anterior.Periodo.Inicio.Format("02/01/2006"), anterior.Periodo.UltimoDia().Format("02/01/2006")),
+		[]float64{38, 38, 38, 38, 38},
+		[]string{"", "Itens vendidos", "Receita", "Custo", "Margem bruta"},
+		[][]string{
+			{"Período anterior", fmt.Sprint(anterior.Total.Quantidade), moeda(anterior.Total.Receita), moeda(anterior.Total.Custo), moeda(anterior.Total.MargemBruta)},
+			{"Variação", percentual(anterior.VariacaoQuantidade), percentual(anterior.VariacaoReceita), percentual(anterior.VariacaoCusto), percentual(anterior.VariacaoMargemBruta)},
+		})
+
+	var linhasProdutos [][]string
+	for _, p := range relatorio.Produtos {
+		linhasProdutos = append(linhasProdutos, []string{p.NomeProd, fmt.Sprint(p.Quantidade), moeda(p.Receita), moeda(p.Custo), moeda(p.MargemBruta), percentual(p.PercentualMargem)})
+	}
+	tabela("Por produto", []float64{55, 20, 30, 30, 35, 20},
+		[]string{"Produto", "Qtd.", "Receita", "Custo", "Margem bruta", "Margem %"}, linhasProdutos)
+
+	var linhasDias [][]string
+	for _, d := range relatorio.Dias {
+		linhasDias = append(linhasDias, []string{d.Dia.Format("02/01/2006"), fmt.Sprint(d.Quantidade), moeda(d.Receita), moeda(d.Custo), moeda(d.MargemBruta), percentual(d.PercentualMargem)})
+	}
+	tabela("Por dia", []float64{55, 20, 30, 30, 35, 20},
+		[]string{"Dia", "Qtd.", "Receita", "Custo", "Margem bruta", "Margem %"}, linhasDias)
+
+	var linhasPagamentos [][]string
+	for _, p := range relatorio.Pagamentos {
+		linhasPagamentos = append(linhasPagamentos, []string{p.Metodo, fmt.Sprint(p.Transacoes), moeda(p.Receita), percentual(p.Percentual)})
+	}
+	if relatorio.ResgatesVale != 0 {
+		linhasPagamentos = append(linhasPagamentos, []string{"Pago com vales (fora da receita)", "", moeda(relatorio.ResgatesVale), ""})
+	}
+	tabela("Por método de pagamento", []float64{55, 30, 35, 30},
+		[]string{"Método", "Transações", "Receita", "Participação"}, linhasPagamentos)
+
+	if len(relatorio.Descontos) > 0 {
+		var linhasDescontos [][]string
+		for _, d := range relatorio.Descontos {
+			linhasDescontos = append(linhasDescontos, []string{d.Descricao, fmt.Sprint(d.Itens), moeda(d.Valor)})
+		}
+		linhasDescontos = append(linhasDescontos, []string{"Total de descontos", "", moeda(relatorio.TotalDescontos)})
+		tabela("Descontos concedidos", []float64{100, 30, 40},
+			[]string{"Cupom ou promoção", "Itens", "Valor"}, linhasDescontos)
+	}
+
+	if len(relatorio.Impostos) > 0 {
+		var linhasImpostos [][]string
+		for _, i := range relatorio.Impostos {
+			linhasImpostos = append(linhasImpostos, []string{i.NCM, i.CFOP, i.CST, fmt.Sprint(i.Itens), moeda(i.BaseCalculo),
+				moeda(i.ICMS), moeda(i.PIS), moeda(i.COFINS), moeda(i.Total())})
+		}
+		t := relatorio.TotalImpostos
+		linhasImpostos = append(linhasImpostos, []string{"Total", "", "", "", moeda(t.BaseCalculo), moeda(t.ICMS), moeda(t.PIS), moeda(t.COFINS), moeda(t.Total())})
+		tabela("Tributos", []float64{20, 14, 14, 12, 28, 24, 24, 24, 30},
+			[]string{"NCM", "CFOP", "CST", "Itens", "Base", "ICMS", "PIS", "COFINS", "Total"}, linhasImpostos)
+	}
+
+	if len(relatorio.Estornos) > 0 {
+		var linhasEstornos [][]string
+		for _, e := range relatorio.Estornos {
+			linhasEstornos = append(linhasEstornos, []string{e.DataTransacao.In(periodo.Inicio.Location()).Format("02/01/2006 15:04"), fmt.Sprint(e.CodigoTransacao),
+				e.NomeProd, fmt.Sprint(e.QuantidadeProd), moeda(e.ValorTransacao), nomeMetodoPagamento(e.MetodoPagamento), e.Motivo})
+		}
+		linhasEstornos = append(linhasEstornos, []string{"Total estornado", "", "", "", moeda(relatorio.TotalEstornado), "", ""})
+		tabela("Estornos", []float64{30, 15, 40, 12, 25, 22, 46},
+			[]string{"Data", "Pedido", "Produto", "Qtd.", "Valor", "Método", "Motivo"}, linhasEstornos)
+	}
+
+	return pdf.Output(w)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// go test -run TestRenderizadores -update regrava os arquivos de testdata
+var atualizarGolden = flag.Bool("update", false, "regrava os arquivos .golden")
+
+// Relatório de março de 2026 com vendas, desconto, vale-presente, estorno e tributos
+func documentoRelatorioTeste(t *testing.T) DocumentoRelatorio {
+	t.Helper()
+	loc, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	periodo, err := periodoMes(3, 2026, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dia := func(d, h int) time.Time { return time.Date(2026, 3, d, h, 0, 0, 0, loc) }
+	produtos := map[int]Produto{
+		1: {ID: 1, NomeProduto: "Café expresso", ValorCompra: 1.5, NCM: "09012100", CFOP: "5102", CSOSN: "102"},
+		2: {ID: 2, NomeProduto: "Pão de queijo", ValorCompra: 2},
+	}
+	transacoes := []Transacao{
+		{CodigoTransacao: 10, CodigoProd: 1, NomeProd: "Café expresso", QuantidadeProd: 2, ValorUnitario: 6, CustoUnitario: 1.5,
+			ValorTransacao: 12, MetodoPagamento: "card", DataTransacao: dia(2, 9)},
+		{CodigoTransacao: 10, CodigoProd: 2, NomeProd: "Pão de queijo", QuantidadeProd: 3, ValorUnitario: 5,
+			ValorTransacao: 13.5, MetodoPagamento: "pix", DataTransacao: dia(2, 9),
+			Desconto: 1.5, Descontos: []DescontoAplicado{{Origem: "cupom", Codigo: "BEMVINDO", Descricao: "Cupom BEMVINDO", Valor: 1.5}}},
+		{CodigoTransacao: 11, CodigoProd: 1, NomeProd: "Café expresso", QuantidadeProd: 1, ValorUnitario: 6, CustoUnitario: 1.5,
+			ValorTransacao: 6, MetodoPagamento: "card", DataTransacao: dia(15, 16),
+			Pagamentos: []PagamentoParcial{{Metodo: "vale", Valor: 4, Referencia: "VALE-TESTE"}, {Metodo: "card", Valor: 2}}},
+		{CodigoTransacao: 10, CodigoProd: 1, NomeProd: "Café expresso", QuantidadeProd: -1, ValorUnitario: 6, CustoUnitario: 1.5,
+			ValorTransacao: -6, MetodoPagamento: "card", DataTransacao: dia(3, 10),
+			Tipo: TransacaoEstorno, Motivo: "Pedido errado", Operador: "admin"},
+	}
+	anteriores := []Transacao{
+		{CodigoTransacao: 5, CodigoProd: 1, NomeProd: "Café expresso", QuantidadeProd: 4, ValorUnitario: 6, CustoUnitario: 1.5,
+			ValorTransacao: 24, MetodoPagamento: "cash", DataTransacao: time.Date(2026, 2, 20, 8, 0, 0, 0, loc)},
+	}
+
+	custos := custosProdutos(produtos)
+	relatorio := calcularFluxoCaixa(transacoes, custos, periodo)
+	relatorio.Impostos, relatorio.TotalImpostos = resumirImpostos(transacoes, produtos, configPadraoMantenedor().NFCe)
+	relatorio.Anterior = compararFluxo(relatorio.Total, calcularFluxoCaixa(anteriores, custos, periodo.Anterior()))
+
+	return DocumentoRelatorio{
+		Titulo:     "Fluxo de caixa - 03/2026",
+		Relatorio:  relatorio,
+		Parametros: map[string]string{"mes": "3", "ano": "2026"},
+		GeradoEm:   time.Date(2026, 4, 1, 8, 30, 0, 0, loc),
+	}
+}
+
+func TestRenderizadores(t *testing.T) {
+	// O logo não entra no teste, para o PDF não depender da imagem
+	logo := config.CaminhoLogo
+	config.CaminhoLogo = ""
+	defer func() { config.CaminhoLogo = logo }()
+
+	documento := documentoRelatorioTeste(t)
+	for formato, renderizador := range renderizadores {
+		t.Run(formato, func(t *testing.T) {
+			var saida bytes.Buffer
+			if err := renderizador.Renderizar(&saida, documento); err != nil {
+				t.Fatalf("Renderizar: %v", err)
+			}
+
+			golden := filepath.Join("testdata", "relatorio_fluxo."+formato+".golden")
+			if *atualizarGolden {
+				if err := os.WriteFile(golden, saida.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			esperado, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (rode com -update para gerar o arquivo)", err)
+			}
+			if !bytes.Equal(saida.Bytes(), esperado) {
+				t.Errorf("saída em %s difere de %s; confira a mudança e rode com -update", formato, golden)
+			}
+		})
+	}
+}
+
+// O mesmo documento precisa gerar sempre os mesmos bytes, para os relatórios arquivados serem reproduzíveis
+func TestRenderizadorPDFDeterministico(t *testing.T) {
+	documento := documentoRelatorioTeste(t)
+	var primeiro, segundo bytes.Buffer
+	if err := (renderizadorPDF{}).Renderizar(&primeiro, documento); err != nil {
+		t.Fatal(err)
+	}
+	if err := (renderizadorPDF{}).Renderizar(&segundo, documento); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(primeiro.Bytes(), segundo.Bytes()) {
+		t.Error("duas renderizações do mesmo documento geraram PDFs diferentes")
+	}
+}
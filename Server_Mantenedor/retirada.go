@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Documento em "configuracoes" com as regras de retirada, lidas também pelo Server_Usuario
+const documentoRegrasRetirada = "retirada"
+
+// Formato do ID dos documentos de "horarios_retirada": o início do horário no fuso da loja
+const formatoHorarioRetirada = "2006-01-02T15:04"
+
+var diasSemana = []string{"Domingo", "Segunda", "Terça", "Quarta", "Quinta", "Sexta", "Sábado"}
+
+// Horário de funcionamento de um dia, como "07:00" e "19:00"; Abre vazio indica loja fechada
+type HorarioFuncionamento struct {
+	Abre  string
+	Fecha string
+}
+
+// Regras da retirada agendada dos pedidos da loja
+type RegrasRetirada struct {
+	Ativo bool
+	// Duração de cada horário de retirada, em minutos
+	DuracaoMin int
+	// Pedidos aceitos em cada horário
+	Capacidade int
+	// Tempo mínimo de preparo, em minutos, entre o pedido e a retirada
+	AntecedenciaMin int
+	// Dias, a partir de hoje, em que o cliente pode agendar
+	DiasAgendamento int
+	// Funcionamento por dia da semana, de domingo a sábado
+	Horarios []HorarioFuncionamento
+}
+
+// Ocupação de um horário de retirada, na coleção "horarios_retirada", atualizada a cada pedido
+type ReservaHorario struct {
+	Inicio  time.Time
+	Pedidos int
+	Codigos []int
+}
+
+type RetiradaPageData struct {
+	PageTitle  string
+	Regras     RegrasRetirada
+	DiasSemana []string
+	Reservas   []ReservaHorario
+}
+
+func regrasRetiradaPadrao() RegrasRetirada {
+	regras := RegrasRetirada{DuracaoMin: 15, Capacidade: 5, AntecedenciaMin: 15, DiasAgendamento: 2}
+	for range diasSemana {
+		regras.Horarios = append(regras.Horarios, HorarioFuncionamento{Abre: "07:00", Fecha: "19:00"})
+	}
+	return regras
+}
+
+func buscarRegrasRetirada(firestoreClient *FirestoreClient) (RegrasRetirada, error) {
+	regras := regrasRetiradaPadrao()
+	snapshot, err := firestoreClient.Client.Collection("configuracoes").Doc(documentoRegrasRetirada).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return regras, nil
+	}
+	if err != nil {
+		return regras, err
+	}
+	err = snapshot.DataTo(&regras)
+	for len(regras.Horarios) < len(diasSemana) {
+		regras.Horarios = append(regras.Horarios, HorarioFuncionamento{})
+	}
+	return regras, err
+}
+
+// Lê os horários de funcionamento do formulário, um par abre_N/fecha_N por dia da semana
+func lerHorariosFuncionamento(r *http.Request) ([]HorarioFuncionamento, error) {
+	var horarios []HorarioFuncionamento
+	for dia, nome := range diasSemana {
+		horario := HorarioFuncionamento{Abre: r.FormValue(fmt.Sprintf("abre_%d", dia)), Fecha: r.FormValue(fmt.Sprintf("fecha_%d", dia))}
+		if horario.Abre == "" || horario.Fecha == "" {
+			horarios = append(horarios, HorarioFuncionamento{})
+			continue
+		}
+		abre, err := time.Parse("15:04", horario.Abre)
+		if err != nil {
+			return nil, fmt.Errorf("invalid opening time for %s", nome)
+		}
+		fecha, err := time.Parse("15:04", horario.Fecha)
+		if err != nil || !fecha.After(abre) {
+			return nil, fmt.Errorf("invalid closing time for %s", nome)
+		}
+		horarios = append(horarios, horario)
+	}
+	return horarios, nil
+}
+
+// Regras de retirada e a ocupação dos horários de hoje em diante
+func RetiradaHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	regras, err := buscarRegrasRetirada(firestoreClient)
+	if err != nil {
+		log.Printf("Failed to fetch pickup rules: %v", err)
+		http.Error(w, "Failed to fetch pickup rules", http.StatusInternalServerError)
+		return
+	}
+
+	hoje := inicioDoDia(time.Now().In(fusoLoja()))
+	docs, err := firestoreClient.Client.Collection("horarios_retirada").Where("Inicio", ">=", hoje).OrderBy("Inicio", firestore.Asc).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		log.Printf("Failed to list pickup slots: %v", err)
+		http.Error(w, "Failed to fetch pickup slots", http.StatusInternalServerError)
+		return
+	}
+	var reservas []ReservaHorario
+	for _, doc := range docs {
+		var reserva ReservaHorario
+		if err := doc.DataTo(&reserva); err != nil {
+			http.Error(w, "Failed to parse pickup slot data", http.StatusInternalServerError)
+			return
+		}
+		reserva.Inicio = reserva.Inicio.In(fusoLoja())
+		if reserva.Pedidos > 0 {
+			reservas = append(reservas, reserva)
+		}
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/retirada.html"))
+	data := RetiradaPageData{
+		PageTitle:  "Coffee Shop - Retirada agendada",
+		Regras:     regras,
+		DiasSemana: diasSemana,
+		Reservas:   reservas,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+func SalvarRegrasRetiradaHandler(w http.ResponseWriter, r *http.Request) {
+	var regras RegrasRetirada
+	campos := []struct {
+		nome  string
+		valor *int
+		min   int
+	}{
+		{"duracao", &regras.DuracaoMin, 5},
+		{"capacidade", &regras.Capacidade, 1},
+		{"antecedencia", &regras.AntecedenciaMin, 0},
+		{"dias", &regras.DiasAgendamento, 1},
+	}
+	for _, campo := range campos {
+		valor, err := strconv.Atoi(r.FormValue(campo.nome))
+		if err != nil || valor < campo.min {
+			http.Error(w, "Invalid "+campo.nome, http.StatusBadRequest)
+			return
+		}
+		*campo.valor = valor
+	}
+	horarios, err := lerHorariosFuncionamento(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	regras.Horarios = horarios
+	regras.Ativo = r.FormValue("ativo") == "1"
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	if _, err := firestoreClient.Client.Collection("configuracoes").Doc(documentoRegrasRetirada).Set(firestoreClient.Ctx, regras); err != nil {
+		log.Printf("Failed to save pickup rules: %v", err)
+		http.Error(w, "Failed to save pickup rules", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/retirada", http.StatusSeeOther)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Códigos de situação (cStat) devolvidos pela SEFAZ que a loja trata
+const (
+	SefazLoteProcessado      = 104
+	SefazAutorizada          = 100
+	SefazAutorizadaForaPrazo = 150
+	SefazDuplicidade         = 204
+	SefazFalhaSchema         = 225
+	SefazAmbienteDivergente  = 252
+	SefazAssinaturaInvalida  = 297
+	SefazChaveInvalida       = 502
+)
+
+const nsAutorizacao = "http://www.portalfiscal.inf.br/nfe/wsdl/NFeAutorizacao4"
+
+// Resposta da SEFAZ ao pedido de autorização de uma nota
+type RetornoSefaz struct {
+	Status     int
+	Motivo     string
+	Protocolo  string
+	RecebidoEm time.Time
+}
+
+func (r RetornoSefaz) Autorizada() bool {
+	return r.Status == SefazAutorizada || r.Status == SefazAutorizadaForaPrazo
+}
+
+// Web service de autorização da SEFAZ. A nota vai assinada e a resposta traz o protocolo
+// ou o motivo da rejeição; erros de comunicação voltam como error, para nova tentativa.
+type Sefaz interface {
+	Autorizar(nfe []byte, lote int) (RetornoSefaz, error)
+}
+
+var (
+	sefazNFCe     Sefaz
+	iniciarSefaz  sync.Once
+	erroSefazNFCe error
+)
+
+// SEFAZ usada nas emissões: o web service configurado ou, sem endereço, o simulador local de homologação
+func sefazEmissor() (Sefaz, error) {
+	iniciarSefaz.Do(func() {
+		if config.NFCe.URLAutorizacao == "" {
+			sefazNFCe = novaSefazFake()
+			return
+		}
+		certificado, err := certificadoEmissor()
+		if err != nil {
+			erroSefazNFCe = err
+			return
+		}
+		sefazNFCe = novaSefazWebService(config.NFCe.URLAutorizacao, certificado)
+	})
+	return sefazNFCe, erroSefazNFCe
+}
+
+// Cliente SOAP do NFeAutorizacao4, com o certificado A1 na conexão TLS
+type sefazWebService struct {
+	url     string
+	cliente *http.Client
+}
+
+func novaSefazWebService(url string, certificado *CertificadoA1) *sefazWebService {
+	transporte := http.DefaultTransport.(*http.Transport).Clone()
+	if certificado != nil {
+		transporte.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{{
+			Certificate: [][]byte{certificado.Certificado.Raw},
+			PrivateKey:  certificado.Chave,
+		}}}
+	}
+	return &sefazWebService{url: url, cliente: &http.Client{Transport: transporte, Timeout: 30 * time.Second}}
+}
+
+// Envelope SOAP 1.2 com o lote de uma nota em processamento síncrono
+func envelopeAutorizacao(nfe []byte, lote int) []byte {
+	var envelope bytes.Buffer
+	envelope.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	envelope.WriteString(`<soap12:Envelope xmlns:soap12="http://www.w3.org/2003/05/soap-envelope"><soap12:Body>`)
+	envelope.WriteString(`<nfeDadosMsg xmlns="` + nsAutorizacao + `">`)
+	fmt.Fprintf(&envelope, `<enviNFe xmlns="%s" versao="%s"><idLote>%d</idLote><indSinc>1</indSinc>`, nsNFe, versaoNFe, lote)
+	envelope.Write(nfe)
+	envelope.WriteString(`</enviNFe></nfeDadosMsg></soap12:Body></soap12:Envelope>`)
+	return envelope.Bytes()
+}
+
+type retornoEnvioLido struct {
+	Status  int    `xml:"cStat"`
+	Motivo  string `xml:"xMotivo"`
+	Recibo  string `xml:"dhRecbto"`
+	Retorno *struct {
+		Status    int    `xml:"cStat"`
+		Motivo    string `xml:"xMotivo"`
+		Protocolo string `xml:"nProt"`
+		Recibo    string `xml:"dhRecbto"`
+	} `xml:"protNFe>infProt"`
+}
+
+// Situação da nota na resposta; sem protNFe a rejeição foi do lote inteiro
+func lerRetornoAutorizacao(resposta []byte) (RetornoSefaz, error) {
+	var lido retornoEnvioLido
+	if err := decodificarElemento(resposta, "retEnviNFe", &lido); err != nil {
+		return RetornoSefaz{}, err
+	}
+	retorno := RetornoSefaz{Status: lido.Status, Motivo: lido.Motivo}
+	recibo := lido.Recibo
+	if lido.Retorno != nil {
+		retorno = RetornoSefaz{Status: lido.Retorno.Status, Motivo: lido.Retorno.Motivo, Protocolo: lido.Retorno.Protocolo}
+		recibo = lido.Retorno.Recibo
+	}
+	if data, err := time.Parse(time.RFC3339, recibo); err == nil {
+		retorno.RecebidoEm = data
+	}
+	return retorno, nil
+}
+
+func (s *sefazWebService) Autorizar(nfe []byte, lote int) (RetornoSefaz, error) {
+	requisicao, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(envelopeAutorizacao(nfe, lote)))
+	if err != nil {
+		return RetornoSefaz{}, err
+	}
+	requisicao.Header.Set("Content-Type", `application/soap+xml; charset=utf-8; action="`+nsAutorizacao+`/nfeAutorizacaoLote"`)
+	resposta, err := s.cliente.Do(requisicao)
+	if err != nil {
+		return RetornoSefaz{}, err
+	}
+	defer resposta.Body.Close()
+	corpo, err := io.ReadAll(resposta.Body)
+	if err != nil {
+		return RetornoSefaz{}, err
+	}
+	if resposta.StatusCode != http.StatusOK {
+		return RetornoSefaz{}, fmt.Errorf("SEFAZ returned HTTP %d", resposta.StatusCode)
+	}
+	return lerRetornoAutorizacao(corpo)
+}
+
+// Simulador da autorização em homologação. Confere a chave de acesso e a assinatura como a SEFAZ
+// e rejeita a mesma chave enviada duas vezes. Pode ser usado direto ou, por servidorSefazFake,
+// atrás de um servidor HTTP local no lugar do web service.
+type sefazFake struct {
+	mu          sync.Mutex
+	protocolos  map[string]string
+	sequencia   int
+	agora       func() time.Time
+	rejeitarCom int
+}
+
+func novaSefazFake() *sefazFake {
+	return &sefazFake{protocolos: make(map[string]string), agora: time.Now}
+}
+
+type notaRecebida struct {
+	Inf struct {
+		ID  string `xml:"Id,attr"`
+		Ide struct {
+			Ambiente string `xml:"tpAmb"`
+		} `xml:"ide"`
+	} `xml:"infNFe"`
+}
+
+func (s *sefazFake) Autorizar(nfe []byte, lote int) (RetornoSefaz, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agora := s.agora()
+	rejeicao := func(status int, motivo string) (RetornoSefaz, error) {
+		return RetornoSefaz{Status: status, Motivo: "Rejeição: " + motivo, RecebidoEm: agora}, nil
+	}
+	if s.rejeitarCom != 0 {
+		return rejeicao(s.rejeitarCom, "rejeição simulada")
+	}
+
+	var nota notaRecebida
+	if err := decodificarElemento(nfe, "NFe", &nota); err != nil {
+		return rejeicao(SefazFalhaSchema, "Falha no Schema XML")
+	}
+	if nota.Inf.Ide.Ambiente != strconv.Itoa(AmbienteHomologacao) {
+		return rejeicao(SefazAmbienteDivergente, "Ambiente informado diverge do Ambiente de recebimento")
+	}
+	chave := strings.TrimPrefix(nota.Inf.ID, "NFe")
+	if len(chave) != 44 || digitoChave(chave[:43]) != chave[43:] {
+		return rejeicao(SefazChaveInvalida, "Erro na Chave de Acesso - Campo Id não corresponde à concatenação dos campos correspondentes")
+	}
+	if _, err := verificarAssinaturaXML(nfe, "infNFe", nota.Inf.ID); err != nil {
+		return rejeicao(SefazAssinaturaInvalida, "Assinatura difere do calculado")
+	}
+	if protocolo, ok := s.protocolos[chave]; ok {
+		return rejeicao(SefazDuplicidade, "Duplicidade de NF-e [nProt:"+protocolo+"]")
+	}
+
+	s.sequencia++
+	protocolo := fmt.Sprintf("1%s%s%010d", chave[:2], agora.Format("06"), s.sequencia)
+	s.protocolos[chave] = protocolo
+	return RetornoSefaz{Status: SefazAutorizada, Motivo: "Autorizado o uso da NF-e", Protocolo: protocolo, RecebidoEm: agora}, nil
+}
+
+type envioLido struct {
+	Lote int `xml:"idLote"`
+	NFe  struct {
+		Conteudo []byte `xml:",innerxml"`
+	} `xml:"NFe"`
+}
+
+// Responde ao envelope SOAP do NFeAutorizacao4 com o simulador, para testar o cliente HTTP de ponta a ponta
+func servidorSefazFake(s *sefazFake) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		corpo, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request", http.StatusBadRequest)
+			return
+		}
+		var envio envioLido
+		if err := decodificarElemento(corpo, "enviNFe", &envio); err != nil {
+			http.Error(w, "Invalid SOAP request", http.StatusBadRequest)
+			return
+		}
+		nfe := append([]byte(`<NFe xmlns="`+nsNFe+`">`), envio.NFe.Conteudo...)
+		nfe = append(nfe, "</NFe>"...)
+		retorno, _ := s.Autorizar(nfe, envio.Lote)
+
+		var chave notaRecebida
+		decodificarElemento(nfe, "NFe", &chave)
+		w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope"><soap:Body>`+
+			`<nfeResultMsg xmlns="%s"><retEnviNFe xmlns="%s" versao="%s"><tpAmb>%d</tpAmb><cStat>%d</cStat><xMotivo>Lote processado</xMotivo>`+
+			`<dhRecbto>%s</dhRecbto><protNFe versao="%s"><infProt><chNFe>%s</chNFe><dhRecbto>%s</dhRecbto><nProt>%s</nProt><cStat>%d</cStat><xMotivo>%s</xMotivo></infProt></protNFe>`+
+			`</retEnviNFe></nfeResultMsg></soap:Body></soap:Envelope>`,
+			nsAutorizacao, nsNFe, versaoNFe, AmbienteHomologacao, SefazLoteProcessado,
+			retorno.RecebidoEm.Format(time.RFC3339), versaoNFe, strings.TrimPrefix(chave.Inf.ID, "NFe"),
+			retorno.RecebidoEm.Format(time.RFC3339), retorno.Protocolo, retorno.Status, escaparTextoC14N(retorno.Motivo))
+	})
+}
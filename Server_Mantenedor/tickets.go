@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Prioridades aceitas para os tickets
+const (
+	PrioridadeBaixa   = "baixa"
+	PrioridadeMedia   = "media"
+	PrioridadeAlta    = "alta"
+	PrioridadeUrgente = "urgente"
+)
+
+// Situações possíveis de um ticket
+const (
+	StatusAberto     = "aberto"
+	StatusRespondido = "respondido"
+	StatusResolvido  = "resolvido"
+)
+
+var prioridades = []string{PrioridadeUrgente, PrioridadeAlta, PrioridadeMedia, PrioridadeBaixa}
+
+// Peso usado para desempatar tickets com o mesmo prazo (maior é mais urgente)
+var pesoPrioridade = map[string]int{
+	PrioridadeBaixa:   1,
+	PrioridadeMedia:   2,
+	PrioridadeAlta:    3,
+	PrioridadeUrgente: 4,
+}
+
+type Notificacao struct {
+	Papel    string
+	Mensagem string
+	TicketID string
+	Data     time.Time
+}
+
+type LinhaRelatorioSLA struct {
+	Prioridade          string
+	Total               int
+	RespostasNoPrazo    int
+	ResolucoesNoPrazo   int
+	Violacoes           int
+	PercentualResposta  float64
+	PercentualResolvido float64
+}
+
+type RelatorioSLAPageData struct {
+	PageTitle string
+	Inicio    string
+	Fim       string
+	Linhas    []LinhaRelatorioSLA
+	Total     LinhaRelatorioSLA
+}
+
+func prioridadeValida(prioridade string) bool {
+	_, ok := pesoPrioridade[prioridade]
+	return ok
+}
+
+// Preenche prioridade, status e prazos de tickets gravados antes do controle de SLA
+func (t *Ticket) normalizar() {
+	if !prioridadeValida(t.Prioridade) {
+		t.Prioridade = PrioridadeMedia
+	}
+	if t.Status == "" {
+		t.Status = StatusAberto
+	}
+	if t.PrazoResposta.IsZero() || t.PrazoResolucao.IsZero() {
+		t.calcularPrazos()
+	}
+}
+
+// Calcula os prazos de resposta e resolução a partir da data de abertura e das metas configuradas
+func (t *Ticket) calcularPrazos() {
+	meta, ok := config.SLA[t.Prioridade]
+	if !ok {
+		meta = config.SLA[PrioridadeMedia]
+	}
+	t.PrazoResposta = t.DataAbertura.Add(time.Duration(meta.RespostaMin) * time.Minute)
+	t.PrazoResolucao = t.DataAbertura.Add(time.Duration(meta.ResolucaoMin) * time.Minute)
+}
+
+func (t Ticket) encerrado() bool {
+	return t.Status == StatusResolvido
+}
+
+// Próximo prazo que o ticket precisa cumprir
+func (t Ticket) proximoPrazo() time.Time {
+	if t.DataResposta.IsZero() {
+		return t.PrazoResposta
+	}
+	return t.PrazoResolucao
+}
+
+// Indica se algum prazo do ticket já foi (ou está sendo) descumprido
+func (t Ticket) Atrasado() bool {
+	return t.RespostaViolada || t.ResolucaoViolada || (!t.encerrado() && time.Now().After(t.proximoPrazo()))
+}
+
+// Ordena os tickets por urgência: abertos primeiro, pelo prazo mais próximo e depois pela prioridade
+func ordenarPorUrgencia(tickets []Ticket) {
+	sort.SliceStable(tickets, func(i, j int) bool {
+		a, b := tickets[i], tickets[j]
+		if a.encerrado() != b.encerrado() {
+			return !a.encerrado()
+		}
+		if a.encerrado() {
+			return a.DataResolucao.After(b.DataResolucao)
+		}
+		if !a.proximoPrazo().Equal(b.proximoPrazo()) {
+			return a.proximoPrazo().Before(b.proximoPrazo())
+		}
+		return pesoPrioridade[a.Prioridade] > pesoPrioridade[b.Prioridade]
+	})
+}
+
+// Verifica os tickets abertos, marcando e escalonando os que descumpriram o SLA
+func verificarSLA(repositorio TicketRepository, notificar func(Notificacao) error, agora time.Time) error {
+	tickets, err := repositorio.Todos()
+	if err != nil {
+		return err
+	}
+
+	for _, ticket := range tickets {
+		if ticket.encerrado() {
+			continue
+		}
+
+		// Os dois prazos podem vencer na mesma verificação; a notificação relata ambos
+		var motivos []string
+		if !ticket.RespostaViolada && ticket.DataResposta.IsZero() && agora.After(ticket.PrazoResposta) {
+			ticket.RespostaViolada = true
+			motivos = append(motivos, "prazo de resposta")
+		}
+		if !ticket.ResolucaoViolada && agora.After(ticket.PrazoResolucao) {
+			ticket.ResolucaoViolada = true
+			motivos = append(motivos, "prazo de resolução")
+		}
+		if len(motivos) == 0 {
+			continue
+		}
+
+		// Notifica antes de gravar: se o aviso falhar, o ticket continua sem escalonamento e é tentado de novo
+		notificacao := Notificacao{
+			Papel:    config.PapelEscalonamento,
+			Mensagem: fmt.Sprintf("Ticket \"%s\" (prioridade %s) descumpriu o %s", ticket.Titulo, ticket.Prioridade, strings.Join(motivos, " e o ")),
+			TicketID: ticket.ID,
+			Data:     agora,
+		}
+		if err := notificar(notificacao); err != nil {
+			return err
+		}
+		ticket.Escalado = true
+		if err := repositorio.Salvar(ticket); err != nil {
+			return err
+		}
+		log.Printf("Ticket %s escalonado para %s: %s", ticket.ID, notificacao.Papel, notificacao.Mensagem)
+	}
+	return nil
+}
+
+// Envia a notificação por email, pela fila, aos endereços do papel destinatário
+func enviarNotificacao(notificacao Notificacao) error {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		return err
+	}
+	defer firestoreClient.Client.Close()
+	return enfileirarEmail(firestoreClient, emailEscalonamentoSLA(notificacao))
+}
+
+// Rotina em segundo plano que verifica periodicamente as violações de SLA
+func monitorarSLA() {
+	ticker := time.NewTicker(config.intervaloVerificacaoSLA())
+	defer ticker.Stop()
+
+	for range ticker.C {
+		repositorio, err := novoRepositorioTickets()
+		if err != nil {
+			log.Printf("Failed to open tickets repository: %v", err)
+			continue
+		}
+		if err := verificarSLA(repositorio, enviarNotificacao, time.Now()); err != nil {
+			log.Printf("Failed to check ticket SLA: %v", err)
+		}
+		repositorio.Fechar()
+	}
+}
+
+func ResponderTicketHandler(w http.ResponseWriter, r *http.Request) {
+	resposta := strings.TrimSpace(r.FormValue("resposta"))
+	alterarTicket(w, r, func(t *Ticket) error {
+		if err := t.registrarStatus(StatusRespondido, time.Now()); err != nil {
+			return err
+		}
+		if resposta != "" {
+			t.Resposta = resposta
+		}
+		return nil
+	})
+}
+
+func ResolverTicketHandler(w http.ResponseWriter, r *http.Request) {
+	alterarTicket(w, r, func(t *Ticket) error {
+		return t.registrarStatus(StatusResolvido, time.Now())
+	})
+}
+
+func AtribuirTicketHandler(w http.ResponseWriter, r *http.Request) {
+	responsavel := strings.TrimSpace(r.FormValue("responsavel"))
+	alterarTicket(w, r, func(t *Ticket) error {
+		t.Responsavel = responsavel
+		return nil
+	})
+}
+
+// Registra a mudança de status, marcando a violação dos prazos cumpridos com atraso.
+// Um ticket resolvido fica encerrado: voltar a respondido deixaria a DataResolucao sem sentido
+func (t *Ticket) registrarStatus(status string, agora time.Time) error {
+	if t.Status == StatusResolvido {
+		return ErrTicketResolvido
+	}
+	t.Status = status
+
+	// A primeira ação sobre o ticket também conta como resposta
+	if t.DataResposta.IsZero() {
+		t.DataResposta = agora
+		if agora.After(t.PrazoResposta) {
+			t.RespostaViolada = true
+		}
+	}
+	if status == StatusResolvido {
+		t.DataResolucao = agora
+		if agora.After(t.PrazoResolucao) {
+			t.ResolucaoViolada = true
+		}
+	}
+	return nil
+}
+
+func alterarTicket(w http.ResponseWriter, r *http.Request, alterar func(*Ticket) error) {
+	repositorio, err := novoRepositorioTickets()
+	if err != nil {
+		http.Error(w, "Failed to open tickets repository", http.StatusInternalServerError)
+		return
+	}
+	defer repositorio.Fechar()
+
+	ticket, err := repositorio.Obter(mux.Vars(r)["id"])
+	if err == ErrTicketNaoEncontrado {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch ticket", http.StatusInternalServerError)
+		return
+	}
+
+	respostaAnterior := ticket.Resposta
+	if err := alterar(&ticket); err == ErrTicketResolvido {
+		http.Error(w, "Ticket already resolved", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to update ticket", http.StatusInternalServerError)
+		return
+	}
+
+	if err := repositorio.Salvar(ticket); err != nil {
+		http.Error(w, "Failed to update ticket", http.StatusInternalServerError)
+		return
+	}
+
+	// Uma resposta nova vai por email para quem abriu o ticket; o ticket já está salvo mesmo se o email falhar
+	if ticket.Resposta != respostaAnterior && ticket.EmailContato != "" {
+		if err := enfileirarEmailTicket(ticket); err != nil {
+			log.Printf("Failed to queue reply email for ticket %s: %v", ticket.ID, err)
+		}
+	}
+
+	destino := "/tickets"
+	if r.URL.RawQuery != "" {
+		destino += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, destino, http.StatusSeeOther)
+}
+
+func enfileirarEmailTicket(ticket Ticket) error {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		return err
+	}
+	defer firestoreClient.Client.Close()
+	return enfileirarEmail(firestoreClient, emailRespostaTicket(ticket, time.Now()))
+}
+
+// Consolida o cumprimento do SLA dos tickets abertos no período [inicio, fim)
+func consolidarSLA(tickets []Ticket, inicio, fim time.Time) ([]LinhaRelatorioSLA, LinhaRelatorioSLA) {
+	linhasPorPrioridade := make(map[string]*LinhaRelatorioSLA)
+	for _, p := range prioridades {
+		linhasPorPrioridade[p] = &LinhaRelatorioSLA{Prioridade: p}
+	}
+
+	for _, t := range tickets {
+		if t.DataAbertura.Before(inicio) || !t.DataAbertura.Before(fim) {
+			continue
+		}
+		linha := linhasPorPrioridade[t.Prioridade]
+		linha.Total++
+
+		respostaNoPrazo := !t.DataResposta.IsZero() && !t.DataResposta.After(t.PrazoResposta)
+		resolucaoNoPrazo := !t.DataResolucao.IsZero() && !t.DataResolucao.After(t.PrazoResolucao)
+		if respostaNoPrazo {
+			linha.RespostasNoPrazo++
+		}
+		if resolucaoNoPrazo {
+			linha.ResolucoesNoPrazo++
+		}
+		if t.Atrasado() {
+			linha.Violacoes++
+		}
+	}
+
+	total := LinhaRelatorioSLA{Prioridade: "total"}
+	var linhas []LinhaRelatorioSLA
+	for _, p := range prioridades {
+		linha := linhasPorPrioridade[p]
+		linha.calcularPercentuais()
+		linhas = append(linhas, *linha)
+
+		total.Total += linha.Total
+		total.RespostasNoPrazo += linha.RespostasNoPrazo
+		total.ResolucoesNoPrazo += linha.ResolucoesNoPrazo
+		total.Violacoes += linha.Violacoes
+	}
+	total.calcularPercentuais()
+	return linhas, total
+}
+
+func (l *LinhaRelatorioSLA) calcularPercentuais() {
+	if l.Total == 0 {
+		return
+	}
+	l.PercentualResposta = 100 * float64(l.RespostasNoPrazo) / float64(l.Total)
+	l.PercentualResolvido = 100 * float64(l.ResolucoesNoPrazo) / float64(l.Total)
+}
+
+func RelatorioSLAHandler(w http.ResponseWriter, r *http.Request) {
+	repositorio, err := novoRepositorioTickets()
+	if err != nil {
+		http.Error(w, "Failed to open tickets repository", http.StatusInternalServerError)
+		return
+	}
+	defer repositorio.Fechar()
+
+	// Por padrão, o relatório cobre o mês corrente
+	agora := time.Now().In(fusoLoja())
+	inicio := time.Date(agora.Year(), agora.Month(), 1, 0, 0, 0, 0, fusoLoja())
+	fim := inicio.AddDate(0, 1, 0)
+
+	if v := r.URL.Query().Get("inicio"); v != "" {
+		inicio, err = time.ParseInLocation("2006-01-02", v, fusoLoja())
+		if err != nil {
+			http.Error(w, "Invalid inicio", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("fim"); v != "" {
+		dataFim, err := time.ParseInLocation("2006-01-02", v, fusoLoja())
+		if err != nil {
+			http.Error(w, "Invalid fim", http.StatusBadRequest)
+			return
+		}
+		// A data final é inclusiva no formulário
+		fim = dataFim.AddDate(0, 0, 1)
+	}
+
+	tickets, err := repositorio.Todos()
+	if err != nil {
+		http.Error(w, "Failed to fetch tickets", http.StatusInternalServerError)
+		return
+	}
+
+	linhas, total := consolidarSLA(tickets, inicio, fim)
+
+	tmpl := template.Must(template.ParseFiles("template/relatorio_sla.html"))
+	data := RelatorioSLAPageData{
+		PageTitle: "Coffee Shop - Cumprimento de SLA",
+		Inicio:    inicio.Format("2006-01-02"),
+		Fim:       fim.AddDate(0, 0, -1).Format("2006-01-02"),
+		Linhas:    linhas,
+		Total:     total,
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
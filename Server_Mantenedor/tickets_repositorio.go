@@ -0,0 +1,508 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var ErrTicketNaoEncontrado = errors.New("ticket não encontrado")
+
+var ErrTicketResolvido = errors.New("ticket já resolvido")
+
+// Critérios de busca da listagem de tickets. Campos vazios não filtram.
+type FiltroTickets struct {
+	Status      string
+	Prioridade  string
+	Responsavel string
+	// Intervalo [De, Ate) aplicado sobre a data de abertura
+	De    time.Time
+	Ate   time.Time
+	Busca string
+
+	Pagina    int
+	PorPagina int
+}
+
+type PaginaTickets struct {
+	Tickets      []Ticket
+	Total        int
+	Pagina       int
+	TotalPaginas int
+}
+
+// Camada de acesso aos tickets, implementada para o Firestore e para o SQLite
+type TicketRepository interface {
+	Criar(ticket Ticket) (Ticket, error)
+	Obter(id string) (Ticket, error)
+	Salvar(ticket Ticket) error
+	Listar(filtro FiltroTickets) (PaginaTickets, error)
+	Todos() ([]Ticket, error)
+	Fechar() error
+}
+
+// Abre o repositório de tickets do banco configurado
+func novoRepositorioTickets() (TicketRepository, error) {
+	if config.BancoTickets == "sqlite" {
+		return novoRepositorioTicketsSQLite(config.CaminhoSQLiteTickets)
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		return nil, err
+	}
+	return &repositorioTicketsFirestore{firestoreClient}, nil
+}
+
+// Lê os filtros da query string da listagem de tickets
+func lerFiltroTickets(r *http.Request) (FiltroTickets, error) {
+	query := r.URL.Query()
+	filtro := FiltroTickets{
+		Status:      query.Get("status"),
+		Prioridade:  query.Get("prioridade"),
+		Responsavel: strings.TrimSpace(query.Get("responsavel")),
+		Busca:       query.Get("busca"),
+	}
+
+	if v := query.Get("de"); v != "" {
+		de, err := time.ParseInLocation("2006-01-02", v, fusoLoja())
+		if err != nil {
+			return filtro, errors.New("Invalid de")
+		}
+		filtro.De = de
+	}
+	if v := query.Get("ate"); v != "" {
+		ate, err := time.ParseInLocation("2006-01-02", v, fusoLoja())
+		if err != nil {
+			return filtro, errors.New("Invalid ate")
+		}
+		// A data final é inclusiva no formulário
+		filtro.Ate = ate.AddDate(0, 0, 1)
+	}
+	if v := query.Get("pagina"); v != "" {
+		pagina, err := strconv.Atoi(v)
+		if err != nil {
+			return filtro, errors.New("Invalid pagina")
+		}
+		filtro.Pagina = pagina
+	}
+	if v := query.Get("por_pagina"); v != "" {
+		porPagina, err := strconv.Atoi(v)
+		if err != nil || porPagina > 100 {
+			return filtro, errors.New("Invalid por_pagina")
+		}
+		filtro.PorPagina = porPagina
+	}
+	return filtro, nil
+}
+
+func (f *FiltroTickets) normalizar() {
+	if f.Pagina < 1 {
+		f.Pagina = 1
+	}
+	if f.PorPagina < 1 {
+		f.PorPagina = 20
+	}
+	f.Busca = strings.TrimSpace(f.Busca)
+}
+
+func (f FiltroTickets) aceita(t Ticket) bool {
+	if f.Status != "" && t.Status != f.Status {
+		return false
+	}
+	if f.Prioridade != "" && t.Prioridade != f.Prioridade {
+		return false
+	}
+	if f.Responsavel != "" && t.Responsavel != f.Responsavel {
+		return false
+	}
+	if !f.De.IsZero() && t.DataAbertura.Before(f.De) {
+		return false
+	}
+	if !f.Ate.IsZero() && !t.DataAbertura.Before(f.Ate) {
+		return false
+	}
+	if f.Busca != "" {
+		texto := strings.ToLower(t.Titulo + " " + t.Descricao)
+		for _, termo := range strings.Fields(strings.ToLower(f.Busca)) {
+			if !strings.Contains(texto, termo) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Recorta a página pedida de uma lista já filtrada e ordenada
+func paginar(tickets []Ticket, filtro FiltroTickets) PaginaTickets {
+	pagina := PaginaTickets{
+		Total:        len(tickets),
+		Pagina:       filtro.Pagina,
+		TotalPaginas: (len(tickets) + filtro.PorPagina - 1) / filtro.PorPagina,
+	}
+
+	inicio := (filtro.Pagina - 1) * filtro.PorPagina
+	if inicio >= len(tickets) {
+		return pagina
+	}
+	fim := inicio + filtro.PorPagina
+	if fim > len(tickets) {
+		fim = len(tickets)
+	}
+	pagina.Tickets = tickets[inicio:fim]
+	return pagina
+}
+
+func (p PaginaTickets) TemAnterior() bool {
+	return p.Pagina > 1
+}
+
+func (p PaginaTickets) TemProxima() bool {
+	return p.Pagina < p.TotalPaginas
+}
+
+func (p PaginaTickets) Anterior() int {
+	return p.Pagina - 1
+}
+
+func (p PaginaTickets) Proxima() int {
+	return p.Pagina + 1
+}
+
+type repositorioTicketsFirestore struct {
+	firestoreClient *FirestoreClient
+}
+
+func (r *repositorioTicketsFirestore) Criar(ticket Ticket) (Ticket, error) {
+	ref, _, err := r.firestoreClient.Client.Collection("tickets").Add(r.firestoreClient.Ctx, ticket)
+	if err != nil {
+		return Ticket{}, err
+	}
+	ticket.ID = ref.ID
+	return ticket, nil
+}
+
+func (r *repositorioTicketsFirestore) Obter(id string) (Ticket, error) {
+	snapshot, err := r.firestoreClient.Client.Collection("tickets").Doc(id).Get(r.firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return Ticket{}, ErrTicketNaoEncontrado
+	}
+	if err != nil {
+		return Ticket{}, err
+	}
+
+	var ticket Ticket
+	if err := snapshot.DataTo(&ticket); err != nil {
+		return Ticket{}, err
+	}
+	ticket.ID = snapshot.Ref.ID
+	ticket.normalizar()
+	return ticket, nil
+}
+
+func (r *repositorioTicketsFirestore) Salvar(ticket Ticket) error {
+	_, err := r.firestoreClient.Client.Collection("tickets").Doc(ticket.ID).Set(r.firestoreClient.Ctx, ticket)
+	return err
+}
+
+// O Firestore não oferece busca textual nem ordenação composta, então o intervalo de datas
+// é filtrado na consulta e o restante em memória
+func (r *repositorioTicketsFirestore) Listar(filtro FiltroTickets) (PaginaTickets, error) {
+	filtro.normalizar()
+
+	query := r.firestoreClient.Client.Collection("tickets").Query
+	if !filtro.De.IsZero() {
+		query = query.Where("DataAbertura", ">=", filtro.De)
+	}
+	if !filtro.Ate.IsZero() {
+		query = query.Where("DataAbertura", "<", filtro.Ate)
+	}
+
+	docs, err := query.Documents(r.firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return PaginaTickets{}, err
+	}
+
+	var tickets []Ticket
+	for _, doc := range docs {
+		var ticket Ticket
+		if err := doc.DataTo(&ticket); err != nil {
+			return PaginaTickets{}, err
+		}
+		ticket.ID = doc.Ref.ID
+		ticket.normalizar()
+		if filtro.aceita(ticket) {
+			tickets = append(tickets, ticket)
+		}
+	}
+
+	ordenarPorUrgencia(tickets)
+	return paginar(tickets, filtro), nil
+}
+
+func (r *repositorioTicketsFirestore) Todos() ([]Ticket, error) {
+	pagina, err := r.Listar(FiltroTickets{PorPagina: 1 << 30})
+	return pagina.Tickets, err
+}
+
+func (r *repositorioTicketsFirestore) Fechar() error {
+	return r.firestoreClient.Client.Close()
+}
+
+// Registro da tabela "tickets" do SQLite, compatível com o esquema criado pelo gorm.Model
+type ticketRegistro struct {
+	gorm.Model
+	Titulo           string
+	Descricao        string
+	DataAbertura     time.Time `gorm:"index"`
+	Prioridade       string    `gorm:"index"`
+	Status           string    `gorm:"index"`
+	Responsavel      string    `gorm:"index"`
+	PrazoResposta    time.Time
+	PrazoResolucao   time.Time
+	DataResposta     *time.Time
+	DataResolucao    *time.Time
+	RespostaViolada  bool
+	ResolucaoViolada bool
+	Escalado         bool
+	EmailContato     string
+	Resposta         string
+}
+
+func (ticketRegistro) TableName() string {
+	return "tickets"
+}
+
+func paraRegistro(t Ticket) ticketRegistro {
+	registro := ticketRegistro{
+		Titulo:           t.Titulo,
+		Descricao:        t.Descricao,
+		DataAbertura:     t.DataAbertura,
+		Prioridade:       t.Prioridade,
+		Status:           t.Status,
+		Responsavel:      t.Responsavel,
+		PrazoResposta:    t.PrazoResposta,
+		PrazoResolucao:   t.PrazoResolucao,
+		RespostaViolada:  t.RespostaViolada,
+		ResolucaoViolada: t.ResolucaoViolada,
+		Escalado:         t.Escalado,
+		EmailContato:     t.EmailContato,
+		Resposta:         t.Resposta,
+	}
+	if id, err := strconv.ParseUint(t.ID, 10, 64); err == nil {
+		registro.ID = uint(id)
+	}
+	if !t.DataResposta.IsZero() {
+		registro.DataResposta = &t.DataResposta
+	}
+	if !t.DataResolucao.IsZero() {
+		registro.DataResolucao = &t.DataResolucao
+	}
+	return registro
+}
+
+func (r ticketRegistro) paraTicket() Ticket {
+	ticket := Ticket{
+		ID:               strconv.FormatUint(uint64(r.ID), 10),
+		Titulo:           r.Titulo,
+		Descricao:        r.Descricao,
+		DataAbertura:     r.DataAbertura,
+		Prioridade:       r.Prioridade,
+		Status:           r.Status,
+		Responsavel:      r.Responsavel,
+		PrazoResposta:    r.PrazoResposta,
+		PrazoResolucao:   r.PrazoResolucao,
+		RespostaViolada:  r.RespostaViolada,
+		ResolucaoViolada: r.ResolucaoViolada,
+		Escalado:         r.Escalado,
+		EmailContato:     r.EmailContato,
+		Resposta:         r.Resposta,
+	}
+	if r.DataResposta != nil {
+		ticket.DataResposta = *r.DataResposta
+	}
+	if r.DataResolucao != nil {
+		ticket.DataResolucao = *r.DataResolucao
+	}
+	ticket.normalizar()
+	return ticket
+}
+
+type repositorioTicketsSQLite struct {
+	db *gorm.DB
+}
+
+func novoRepositorioTicketsSQLite(caminho string) (*repositorioTicketsSQLite, error) {
+	db, err := gorm.Open(sqlite.Open(caminho), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&ticketRegistro{}); err != nil {
+		return nil, err
+	}
+
+	repositorio := &repositorioTicketsSQLite{db}
+	if err := repositorio.migrarTicketsLegados(); err != nil {
+		return nil, err
+	}
+	return repositorio, nil
+}
+
+// Preenche prioridade, status e prazos das linhas gravadas antes do controle de SLA,
+// para que os filtros e a ordenação feitos pelo banco as considerem
+func (r *repositorioTicketsSQLite) migrarTicketsLegados() error {
+	var registros []ticketRegistro
+	err := r.db.Where("status IS NULL OR status = '' OR prioridade IS NULL OR prioridade = '' OR prazo_resposta IS NULL OR prazo_resolucao IS NULL").
+		Find(&registros).Error
+	if err != nil {
+		return err
+	}
+
+	for _, registro := range registros {
+		atualizado := paraRegistro(registro.paraTicket())
+		atualizado.CreatedAt = registro.CreatedAt
+		if err := r.db.Save(&atualizado).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *repositorioTicketsSQLite) Criar(ticket Ticket) (Ticket, error) {
+	registro := paraRegistro(ticket)
+	registro.ID = 0
+	if err := r.db.Create(&registro).Error; err != nil {
+		return Ticket{}, err
+	}
+	return registro.paraTicket(), nil
+}
+
+func (r *repositorioTicketsSQLite) Obter(id string) (Ticket, error) {
+	var registro ticketRegistro
+	err := r.db.First(&registro, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Ticket{}, ErrTicketNaoEncontrado
+	}
+	if err != nil {
+		return Ticket{}, err
+	}
+	return registro.paraTicket(), nil
+}
+
+func (r *repositorioTicketsSQLite) Salvar(ticket Ticket) error {
+	var atual ticketRegistro
+	if err := r.db.First(&atual, "id = ?", ticket.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrTicketNaoEncontrado
+		}
+		return err
+	}
+
+	registro := paraRegistro(ticket)
+	registro.CreatedAt = atual.CreatedAt
+	return r.db.Save(&registro).Error
+}
+
+// Ordem de urgência equivalente a ordenarPorUrgencia, calculada pelo próprio banco
+const ordemUrgenciaSQL = `status = 'resolvido',
+	CASE WHEN status = 'resolvido' THEN 0 ELSE julianday(CASE WHEN data_resposta IS NULL THEN prazo_resposta ELSE prazo_resolucao END) END,
+	CASE WHEN status = 'resolvido' THEN julianday(data_resolucao) END DESC,
+	CASE prioridade WHEN 'urgente' THEN 4 WHEN 'alta' THEN 3 WHEN 'media' THEN 2 WHEN 'baixa' THEN 1 ELSE 2 END DESC`
+
+func (r *repositorioTicketsSQLite) Listar(filtro FiltroTickets) (PaginaTickets, error) {
+	filtro.normalizar()
+
+	query := r.db.Model(&ticketRegistro{})
+	if filtro.Status != "" {
+		query = query.Where("status = ?", filtro.Status)
+	}
+	if filtro.Prioridade != "" {
+		query = query.Where("prioridade = ?", filtro.Prioridade)
+	}
+	if filtro.Responsavel != "" {
+		query = query.Where("responsavel = ?", filtro.Responsavel)
+	}
+	if !filtro.De.IsZero() {
+		query = query.Where("data_abertura >= ?", filtro.De)
+	}
+	if !filtro.Ate.IsZero() {
+		query = query.Where("data_abertura < ?", filtro.Ate)
+	}
+	for _, termo := range strings.Fields(strings.ToLower(filtro.Busca)) {
+		padrao := "%" + termo + "%"
+		query = query.Where("(LOWER(titulo) LIKE ? OR LOWER(descricao) LIKE ?)", padrao, padrao)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return PaginaTickets{}, err
+	}
+
+	var registros []ticketRegistro
+	err := query.Order(ordemUrgenciaSQL).
+		Offset((filtro.Pagina - 1) * filtro.PorPagina).
+		Limit(filtro.PorPagina).
+		Find(&registros).Error
+	if err != nil {
+		return PaginaTickets{}, err
+	}
+
+	pagina := PaginaTickets{
+		Total:        int(total),
+		Pagina:       filtro.Pagina,
+		TotalPaginas: (int(total) + filtro.PorPagina - 1) / filtro.PorPagina,
+	}
+	for _, registro := range registros {
+		pagina.Tickets = append(pagina.Tickets, registro.paraTicket())
+	}
+	return pagina, nil
+}
+
+func (r *repositorioTicketsSQLite) Todos() ([]Ticket, error) {
+	var registros []ticketRegistro
+	if err := r.db.Find(&registros).Error; err != nil {
+		return nil, err
+	}
+
+	var tickets []Ticket
+	for _, registro := range registros {
+		tickets = append(tickets, registro.paraTicket())
+	}
+	sort.SliceStable(tickets, func(i, j int) bool {
+		return tickets[i].DataAbertura.Before(tickets[j].DataAbertura)
+	})
+	return tickets, nil
+}
+
+func (r *repositorioTicketsSQLite) Fechar() error {
+	sqlDB, err := r.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// Query string atual da listagem, usada para voltar à mesma página após uma ação
+func (d TicketsPageData) Query() template.URL {
+	return template.URL(d.Filtro.Encode())
+}
+
+// Link para outra página da listagem, mantendo os filtros aplicados
+func (d TicketsPageData) LinkPagina(pagina int) template.URL {
+	query := url.Values{}
+	for chave, valores := range d.Filtro {
+		query[chave] = valores
+	}
+	query.Set("pagina", strconv.Itoa(pagina))
+	return template.URL("/tickets?" + query.Encode())
+}
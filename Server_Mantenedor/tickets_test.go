@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func repositorioTeste(t *testing.T) *repositorioTicketsSQLite {
+	t.Helper()
+	repositorio, err := novoRepositorioTicketsSQLite(filepath.Join(t.TempDir(), "tickets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repositorio.Fechar() })
+	return repositorio
+}
+
+// Ticket aberto às 9h com uma hora para resposta e quatro para resolução
+func ticketAtrasadoTeste(t *testing.T, repositorio TicketRepository) Ticket {
+	t.Helper()
+	abertura := time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC)
+	ticket, err := repositorio.Criar(Ticket{
+		Titulo: "Máquina de espresso parada", Prioridade: PrioridadeUrgente, Status: StatusAberto, DataAbertura: abertura,
+		PrazoResposta: abertura.Add(time.Hour), PrazoResolucao: abertura.Add(4 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ticket
+}
+
+func TestVerificarSLAFalhaNotificacao(t *testing.T) {
+	repositorio := repositorioTeste(t)
+	ticket := ticketAtrasadoTeste(t, repositorio)
+	agora := ticket.DataAbertura.Add(2 * time.Hour)
+
+	falhar := func(Notificacao) error { return errors.New("fila indisponível") }
+	if err := verificarSLA(repositorio, falhar, agora); err == nil {
+		t.Fatal("falha na notificação não foi devolvida")
+	}
+	gravado, err := repositorio.Obter(ticket.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gravado.Escalado || gravado.RespostaViolada {
+		t.Fatalf("ticket gravado como escalonado sem notificação: %+v", gravado)
+	}
+
+	// Na verificação seguinte o escalonamento é tentado de novo
+	var enviadas []Notificacao
+	registrar := func(n Notificacao) error { enviadas = append(enviadas, n); return nil }
+	if err := verificarSLA(repositorio, registrar, agora.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(enviadas) != 1 {
+		t.Fatalf("notificações = %d, esperava 1", len(enviadas))
+	}
+	if gravado, _ = repositorio.Obter(ticket.ID); !gravado.Escalado || !gravado.RespostaViolada {
+		t.Errorf("ticket não ficou escalonado: %+v", gravado)
+	}
+
+	// Já escalonado pelo mesmo prazo, não notifica de novo
+	if err := verificarSLA(repositorio, registrar, agora.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(enviadas) != 1 {
+		t.Errorf("notificações = %d depois de repetir a verificação, esperava 1", len(enviadas))
+	}
+}
+
+func TestVerificarSLADoisPrazos(t *testing.T) {
+	repositorio := repositorioTeste(t)
+	ticket := ticketAtrasadoTeste(t, repositorio)
+
+	var enviadas []Notificacao
+	registrar := func(n Notificacao) error { enviadas = append(enviadas, n); return nil }
+	if err := verificarSLA(repositorio, registrar, ticket.DataAbertura.Add(5*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(enviadas) != 1 {
+		t.Fatalf("notificações = %d, esperava 1", len(enviadas))
+	}
+	for _, motivo := range []string{"prazo de resposta", "prazo de resolução"} {
+		if !strings.Contains(enviadas[0].Mensagem, motivo) {
+			t.Errorf("notificação sem %q: %s", motivo, enviadas[0].Mensagem)
+		}
+	}
+	gravado, _ := repositorio.Obter(ticket.ID)
+	if !gravado.RespostaViolada || !gravado.ResolucaoViolada {
+		t.Errorf("violações não gravadas: %+v", gravado)
+	}
+}
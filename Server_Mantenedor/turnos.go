@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/mux"
+)
+
+// Situação de um turno de caixa
+const (
+	TurnoAberto  = "aberto"
+	TurnoFechado = "fechado"
+)
+
+// Movimentações manuais de dinheiro no caixa
+const (
+	MovimentoSangria    = "sangria"
+	MovimentoSuprimento = "suprimento"
+)
+
+var ErrTurnoJaAberto = errors.New("there is already an open shift")
+
+// Turno do caixa do balcão, guardado na coleção "turnos". As vendas são ligadas ao turno
+// pelo campo TurnoID das transações; os totais do fechamento ficam gravados no próprio turno.
+type Turno struct {
+	ID           string `firestore:"-"`
+	Status       string
+	Operador     string
+	Abertura     time.Time
+	FundoInicial float64
+	Fechamento   time.Time
+	FechadoPor   string
+	ValorContado float64
+	Observacao   string
+	Resumo       ResumoTurno
+}
+
+// Sangria ou suprimento, guardado na coleção "movimentos_caixa"
+type MovimentoCaixa struct {
+	ID      string `firestore:"-"`
+	TurnoID string
+	Tipo    string
+	Valor   float64
+	Motivo  string
+	Usuario string
+	Data    time.Time
+}
+
+// Conferência do dinheiro em caixa de um turno
+type ResumoTurno struct {
+	FundoInicial   float64
+	VendasDinheiro float64
+	Suprimentos    float64
+	Sangrias       float64
+	Esperado       float64
+	Contado        float64
+	Diferenca      float64
+	Pedidos        int
+	Pagamentos     []LinhaPagamentoFluxo
+}
+
+type TurnosPageData struct {
+	PageTitle string
+	Aberto    *Turno
+	Resumo    ResumoTurno
+	Turnos    []Turno
+	Erro      string
+}
+
+type TurnoPageData struct {
+	PageTitle  string
+	Turno      Turno
+	Resumo     ResumoTurno
+	Movimentos []MovimentoCaixa
+	Transacoes []Transacao
+}
+
+// Calcula o dinheiro esperado na gaveta: fundo inicial mais vendas em dinheiro e suprimentos, menos sangrias.
+// Estornos em dinheiro entram nas vendas com valor negativo.
+func calcularResumoTurno(turno Turno, movimentos []MovimentoCaixa, transacoes []Transacao) ResumoTurno {
+	resumo := ResumoTurno{FundoInicial: turno.FundoInicial}
+
+	pedidos := make(map[int]bool)
+	for _, t := range transacoes {
+		if !t.Estorno() {
+			pedidos[t.CodigoTransacao] = true
+		}
+		resumo.VendasDinheiro += t.valorPorMetodo()["cash"]
+	}
+	resumo.Pedidos = len(pedidos)
+	resumo.Pagamentos = calcularFluxoCaixa(transacoes, nil, Periodo{}).Pagamentos
+
+	for _, m := range movimentos {
+		switch m.Tipo {
+		case MovimentoSangria:
+			resumo.Sangrias += m.Valor
+		case MovimentoSuprimento:
+			resumo.Suprimentos += m.Valor
+		}
+	}
+
+	resumo.Esperado = arredondarCentavos(resumo.FundoInicial + resumo.VendasDinheiro + resumo.Suprimentos - resumo.Sangrias)
+	if turno.Status == TurnoFechado {
+		resumo.Contado = turno.ValorContado
+		resumo.Diferenca = arredondarCentavos(resumo.Contado - resumo.Esperado)
+	}
+	return resumo
+}
+
+func arredondarCentavos(valor float64) float64 {
+	return math.Round(valor*100) / 100
+}
+
+// Situação da conferência, para exibição
+func (r ResumoTurno) Conferencia() string {
+	switch {
+	case r.Diferenca > 0:
+		return "Sobra"
+	case r.Diferenca < 0:
+		return "Falta"
+	}
+	return "Conferido"
+}
+
+// Turno aberto no momento, ou nil se o caixa estiver fechado
+func buscarTurnoAberto(firestoreClient *FirestoreClient) (*Turno, error) {
+	docs, err := firestoreClient.Client.Collection("turnos").Where("Status", "==", TurnoAberto).Limit(1).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	var turno Turno
+	if err := docs[0].DataTo(&turno); err != nil {
+		return nil, err
+	}
+	turno.ID = docs[0].Ref.ID
+	return &turno, nil
+}
+
+func buscarTurno(firestoreClient *FirestoreClient, id string) (Turno, error) {
+	var turno Turno
+	snapshot, err := firestoreClient.Client.Collection("turnos").Doc(id).Get(firestoreClient.Ctx)
+	if err != nil {
+		return turno, err
+	}
+	if err := snapshot.DataTo(&turno); err != nil {
+		return turno, err
+	}
+	turno.ID = snapshot.Ref.ID
+	return turno, nil
+}
+
+// Sangrias, suprimentos e vendas registrados no turno
+func buscarMovimentosTurno(firestoreClient *FirestoreClient, turnoID string) ([]MovimentoCaixa, []Transacao, error) {
+	docs, err := firestoreClient.Client.Collection("movimentos_caixa").Where("TurnoID", "==", turnoID).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	var movimentos []MovimentoCaixa
+	for _, doc := range docs {
+		var movimento MovimentoCaixa
+		if err := doc.DataTo(&movimento); err != nil {
+			return nil, nil, err
+		}
+		movimento.ID = doc.Ref.ID
+		movimentos = append(movimentos, movimento)
+	}
+	sort.Slice(movimentos, func(i, j int) bool { return movimentos[i].Data.Before(movimentos[j].Data) })
+
+	docs, err = firestoreClient.Client.Collection("transacoes").Where("TurnoID", "==", turnoID).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	var transacoes []Transacao
+	for _, doc := range docs {
+		var transacao Transacao
+		if err := doc.DataTo(&transacao); err != nil {
+			return nil, nil, err
+		}
+		transacoes = append(transacoes, transacao)
+	}
+	sort.Slice(transacoes, func(i, j int) bool { return transacoes[i].DataTransacao.Before(transacoes[j].DataTransacao) })
+	return movimentos, transacoes, nil
+}
+
+// Abre um novo turno, desde que não exista outro aberto
+func abrirTurno(firestoreClient *FirestoreClient, turno Turno) (Turno, error) {
+	turnos := firestoreClient.Client.Collection("turnos")
+	ref := turnos.NewDoc()
+	err := firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		abertos, err := tx.Documents(turnos.Where("Status", "==", TurnoAberto).Limit(1)).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(abertos) > 0 {
+			return ErrTurnoJaAberto
+		}
+		return tx.Create(ref, turno)
+	})
+	turno.ID = ref.ID
+	return turno, err
+}
+
+func lerValorMonetario(r *http.Request, campo string) (float64, error) {
+	valor, err := strconv.ParseFloat(r.FormValue(campo), 64)
+	if err != nil || valor < 0 || math.IsInf(valor, 0) || math.IsNaN(valor) {
+		return 0, fmt.Errorf("Invalid %s", campo)
+	}
+	return arredondarCentavos(valor), nil
+}
+
+func TurnosHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	docs, err := firestoreClient.Client.Collection("turnos").OrderBy("Abertura", firestore.Desc).Limit(30).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		log.Printf("Failed to list shifts: %v", err)
+		http.Error(w, "Failed to fetch shifts", http.StatusInternalServerError)
+		return
+	}
+
+	data := TurnosPageData{PageTitle: "Coffee Shop - Caixa", Erro: r.URL.Query().Get("erro")}
+	for _, doc := range docs {
+		var turno Turno
+		if err := doc.DataTo(&turno); err != nil {
+			http.Error(w, "Failed to parse shift data", http.StatusInternalServerError)
+			return
+		}
+		turno.ID = doc.Ref.ID
+		data.Turnos = append(data.Turnos, turno)
+	}
+
+	data.Aberto, err = buscarTurnoAberto(firestoreClient)
+	if err != nil {
+		log.Printf("Failed to fetch open shift: %v", err)
+		http.Error(w, "Failed to fetch shifts", http.StatusInternalServerError)
+		return
+	}
+	if data.Aberto != nil {
+		movimentos, transacoes, err := buscarMovimentosTurno(firestoreClient, data.Aberto.ID)
+		if err != nil {
+			log.Printf("Failed to fetch shift movements: %v", err)
+			http.Error(w, "Failed to fetch shift movements", http.StatusInternalServerError)
+			return
+		}
+		data.Resumo = calcularResumoTurno(*data.Aberto, movimentos, transacoes)
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/turnos.html"))
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+func AbrirTurnoHandler(w http.ResponseWriter, r *http.Request) {
+	fundoInicial, err := lerValorMonetario(r, "fundoInicial")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	_, err = abrirTurno(firestoreClient, Turno{
+		Status:       TurnoAberto,
+		Operador:     usuarioRequisicao(r),
+		Abertura:     time.Now(),
+		FundoInicial: fundoInicial,
+	})
+	if err == ErrTurnoJaAberto {
+		http.Redirect(w, r, "/turnos?erro="+url.QueryEscape("Já existe um turno aberto"), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to open shift: %v", err)
+		http.Error(w, "Failed to open shift", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/turnos", http.StatusSeeOther)
+}
+
+// Registra uma sangria ou um suprimento no turno aberto
+func MovimentoTurnoHandler(w http.ResponseWriter, r *http.Request) {
+	tipo := r.FormValue("tipo")
+	if tipo != MovimentoSangria && tipo != MovimentoSuprimento {
+		http.Error(w, "Invalid movement type", http.StatusBadRequest)
+		return
+	}
+	valor, err := lerValorMonetario(r, "valor")
+	if err != nil || valor == 0 {
+		http.Error(w, "Invalid valor", http.StatusBadRequest)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	turno, err := buscarTurno(firestoreClient, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Shift not found", http.StatusNotFound)
+		return
+	}
+	if turno.Status != TurnoAberto {
+		http.Error(w, "Shift is already closed", http.StatusConflict)
+		return
+	}
+
+	// A sangria não pode retirar mais dinheiro do que deveria haver na gaveta
+	if tipo == MovimentoSangria {
+		movimentos, transacoes, err := buscarMovimentosTurno(firestoreClient, turno.ID)
+		if err != nil {
+			http.Error(w, "Failed to fetch shift movements", http.StatusInternalServerError)
+			return
+		}
+		if valor > calcularResumoTurno(turno, movimentos, transacoes).Esperado {
+			http.Redirect(w, r, "/turnos?erro="+url.QueryEscape("Sangria maior que o dinheiro em caixa"), http.StatusSeeOther)
+			return
+		}
+	}
+
+	_, _, err = firestoreClient.Client.Collection("movimentos_caixa").Add(firestoreClient.Ctx, MovimentoCaixa{
+		TurnoID: turno.ID,
+		Tipo:    tipo,
+		Valor:   valor,
+		Motivo:  r.FormValue("motivo"),
+		Usuario: usuarioRequisicao(r),
+		Data:    time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to record cash movement: %v", err)
+		http.Error(w, "Failed to record cash movement", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/turnos", http.StatusSeeOther)
+}
+
+// Fecha o turno com o valor contado na gaveta e grava a conferência
+func FecharTurnoHandler(w http.ResponseWriter, r *http.Request) {
+	contado, err := lerValorMonetario(r, "valorContado")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	turno, err := buscarTurno(firestoreClient, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Shift not found", http.StatusNotFound)
+		return
+	}
+	if turno.Status != TurnoAberto {
+		http.Error(w, "Shift is already closed", http.StatusConflict)
+		return
+	}
+
+	movimentos, transacoes, err := buscarMovimentosTurno(firestoreClient, turno.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch shift movements", http.StatusInternalServerError)
+		return
+	}
+
+	turno.Status = TurnoFechado
+	turno.Fechamento = time.Now()
+	turno.FechadoPor = usuarioRequisicao(r)
+	turno.ValorContado = contado
+	turno.Observacao = r.FormValue("observacao")
+	turno.Resumo = calcularResumoTurno(turno, movimentos, transacoes)
+
+	if _, err := firestoreClient.Client.Collection("turnos").Doc(turno.ID).Set(firestoreClient.Ctx, turno); err != nil {
+		log.Printf("Failed to close shift: %v", err)
+		http.Error(w, "Failed to close shift", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/turnos/"+turno.ID, http.StatusSeeOther)
+}
+
+// Relatório de fechamento do turno, pronto para impressão
+func TurnoHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	turno, err := buscarTurno(firestoreClient, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Shift not found", http.StatusNotFound)
+		return
+	}
+
+	movimentos, transacoes, err := buscarMovimentosTurno(firestoreClient, turno.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch shift movements", http.StatusInternalServerError)
+		return
+	}
+
+	// Turnos fechados mostram a conferência gravada no fechamento
+	resumo := turno.Resumo
+	if turno.Status == TurnoAberto {
+		resumo = calcularResumoTurno(turno, movimentos, transacoes)
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/turno.html"))
+	data := TurnoPageData{
+		PageTitle:  fmt.Sprintf("Fechamento de Caixa - %s", turno.Abertura.In(fusoLoja()).Format("02/01/2006 15:04")),
+		Turno:      turno,
+		Resumo:     resumo,
+		Movimentos: movimentos,
+		Transacoes: transacoes,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalcularResumoTurno(t *testing.T) {
+	abertura := time.Date(2026, 3, 10, 8, 0, 0, 0, time.UTC)
+	turno := Turno{ID: "t1", Status: TurnoAberto, FundoInicial: 100, Abertura: abertura}
+	transacoes := []Transacao{
+		{CodigoTransacao: 1, CodigoProd: 1, QuantidadeProd: 2, ValorUnitario: 6, ValorTransacao: 12, MetodoPagamento: "cash", DataTransacao: abertura, TurnoID: "t1"},
+		{CodigoTransacao: 1, CodigoProd: 2, QuantidadeProd: 1, ValorUnitario: 5, ValorTransacao: 5, MetodoPagamento: "cash", DataTransacao: abertura, TurnoID: "t1"},
+		{CodigoTransacao: 2, CodigoProd: 1, QuantidadeProd: 1, ValorUnitario: 30, ValorTransacao: 30, MetodoPagamento: "card", DataTransacao: abertura, TurnoID: "t1"},
+		// Pago em parte com vale: só a parte em dinheiro vai para a gaveta
+		{CodigoTransacao: 3, CodigoProd: 1, QuantidadeProd: 1, ValorUnitario: 30, ValorTransacao: 30, MetodoPagamento: "cash", DataTransacao: abertura, TurnoID: "t1",
+			Pagamentos: []PagamentoParcial{{Metodo: "vale", Valor: 20, Referencia: "VALE-1"}, {Metodo: "cash", Valor: 10}}},
+		// Estorno em dinheiro de um dos itens do pedido 1
+		{CodigoTransacao: 1, CodigoProd: 2, QuantidadeProd: -1, ValorUnitario: 5, ValorTransacao: -5, MetodoPagamento: "cash", DataTransacao: abertura, TurnoID: "t1", Tipo: TransacaoEstorno},
+	}
+	movimentos := []MovimentoCaixa{
+		{TurnoID: "t1", Tipo: MovimentoSuprimento, Valor: 50},
+		{TurnoID: "t1", Tipo: MovimentoSangria, Valor: 80},
+		{TurnoID: "t1", Tipo: MovimentoSangria, Valor: 20},
+	}
+
+	resumo := calcularResumoTurno(turno, movimentos, transacoes)
+	// 100 de fundo + 12 + 5 + 10 - 5 em dinheiro + 50 - 100
+	if math.Abs(resumo.VendasDinheiro-22) > 0.001 || math.Abs(resumo.Esperado-72) > 0.001 {
+		t.Errorf("vendas em dinheiro = %.2f, esperado = %.2f; esperava 22.00 e 72.00", resumo.VendasDinheiro, resumo.Esperado)
+	}
+	if resumo.Suprimentos != 50 || resumo.Sangrias != 100 {
+		t.Errorf("suprimentos = %.2f, sangrias = %.2f", resumo.Suprimentos, resumo.Sangrias)
+	}
+	if resumo.Pedidos != 3 {
+		t.Errorf("pedidos = %d, esperava 3", resumo.Pedidos)
+	}
+	if resumo.Contado != 0 || resumo.Diferenca != 0 || resumo.Conferencia() != "Conferido" {
+		t.Errorf("turno aberto com conferência: contado %.2f, diferença %.2f", resumo.Contado, resumo.Diferenca)
+	}
+
+	casos := []struct {
+		contado     float64
+		diferenca   float64
+		conferencia string
+	}{
+		{72, 0, "Conferido"},
+		{70.5, -1.5, "Falta"},
+		{75, 3, "Sobra"},
+	}
+	for _, caso := range casos {
+		turno.Status = TurnoFechado
+		turno.ValorContado = caso.contado
+		resumo := calcularResumoTurno(turno, movimentos, transacoes)
+		if math.Abs(resumo.Diferenca-caso.diferenca) > 0.001 || resumo.Conferencia() != caso.conferencia {
+			t.Errorf("contado %.2f: diferença %.2f (%s), esperava %.2f (%s)", caso.contado, resumo.Diferenca, resumo.Conferencia(), caso.diferenca, caso.conferencia)
+		}
+	}
+}
+
+func TestLerValorMonetario(t *testing.T) {
+	casos := []struct {
+		valor    string
+		esperado float64
+		invalido bool
+	}{
+		{valor: "150", esperado: 150},
+		{valor: "10.456", esperado: 10.46},
+		{valor: "0", esperado: 0},
+		{valor: "-5", invalido: true},
+		{valor: "abc", invalido: true},
+		{valor: "", invalido: true},
+		{valor: "NaN", invalido: true},
+		{valor: "Inf", invalido: true},
+	}
+	for _, caso := range casos {
+		r := httptest.NewRequest("POST", "/turnos/abrir", strings.NewReader(url.Values{"fundo": {caso.valor}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		valor, err := lerValorMonetario(r, "fundo")
+		if caso.invalido {
+			if err == nil {
+				t.Errorf("%q aceito como %.2f", caso.valor, valor)
+			}
+			continue
+		}
+		if err != nil || valor != caso.esperado {
+			t.Errorf("%q = %.2f (%v), esperava %.2f", caso.valor, valor, err, caso.esperado)
+		}
+	}
+}
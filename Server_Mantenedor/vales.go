@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Tipos de movimento de um vale-presente
+const (
+	ValeEmissao     = "emissao"
+	ValeResgate     = "resgate"
+	ValeEstorno     = "estorno"
+	ValeBloqueio    = "bloqueio"
+	ValeDesbloqueio = "desbloqueio"
+	// Vale vendido num pedido estornado
+	ValeCancelamento = "cancelamento"
+)
+
+// Letras e números sem os caracteres que se confundem na leitura (0/O, 1/I)
+const alfabetoVale = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var ErrValeNaoEncontrado = errors.New("gift card not found")
+
+// Vale-presente guardado na coleção "vales_presente", com o código como ID do documento
+type ValePresente struct {
+	Codigo       string `firestore:"-"`
+	ValorInicial float64
+	Saldo        float64
+	Ativo        bool
+	CriadoEm     time.Time
+	CriadoPor    string
+	// Pedido da loja que vendeu o vale; zero nos vales gerados no back office
+	CodigoTransacao int
+}
+
+// Movimento do vale na coleção "movimentos_vale", gravado na mesma transação que altera o saldo
+type MovimentoVale struct {
+	Codigo          string
+	Tipo            string
+	Valor           float64
+	SaldoApos       float64
+	CodigoTransacao int
+	Usuario         string
+	Data            time.Time
+}
+
+// Parte do valor de uma linha paga por um método
+type PagamentoParcial struct {
+	Metodo string
+	Valor  float64
+	// Código do vale-presente usado
+	Referencia string
+}
+
+type ValesPageData struct {
+	PageTitle string
+	Vales     []ValePresente
+	Gerados   []string
+	Erro      string
+}
+
+type ValePageData struct {
+	PageTitle  string
+	Vale       ValePresente
+	Movimentos []MovimentoVale
+}
+
+// Valor da linha por método de pagamento; linhas sem divisão foram pagas inteiras por MetodoPagamento
+func (t Transacao) valorPorMetodo() map[string]float64 {
+	if len(t.Pagamentos) == 0 {
+		return map[string]float64{t.MetodoPagamento: t.ValorTransacao}
+	}
+	valores := make(map[string]float64)
+	for _, p := range t.Pagamentos {
+		valores[p.Metodo] += p.Valor
+	}
+	return valores
+}
+
+func gerarCodigoVale() (string, error) {
+	var codigo strings.Builder
+	for i := 0; i < 16; i++ {
+		if i > 0 && i%4 == 0 {
+			codigo.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alfabetoVale))))
+		if err != nil {
+			return "", err
+		}
+		codigo.WriteByte(alfabetoVale[n.Int64()])
+	}
+	return codigo.String(), nil
+}
+
+func normalizarCodigoVale(codigo string) string {
+	return strings.ToUpper(strings.TrimSpace(codigo))
+}
+
+// Cria um vale com código inédito e registra o movimento de emissão
+func emitirVale(firestoreClient *FirestoreClient, valor float64, usuario string, codigoTransacao int) (string, error) {
+	vales := firestoreClient.Client.Collection("vales_presente")
+	for tentativa := 0; tentativa < 5; tentativa++ {
+		codigo, err := gerarCodigoVale()
+		if err != nil {
+			return "", err
+		}
+		agora := time.Now()
+		vale := ValePresente{ValorInicial: valor, Saldo: valor, Ativo: true, CriadoEm: agora, CriadoPor: usuario, CodigoTransacao: codigoTransacao}
+		err = firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			// Create falha se o código já existir
+			if err := tx.Create(vales.Doc(codigo), vale); err != nil {
+				return err
+			}
+			return tx.Create(firestoreClient.Client.Collection("movimentos_vale").NewDoc(), MovimentoVale{
+				Codigo: codigo, Tipo: ValeEmissao, Valor: valor, SaldoApos: valor,
+				CodigoTransacao: codigoTransacao, Usuario: usuario, Data: agora,
+			})
+		})
+		if err == nil {
+			return codigo, nil
+		}
+		log.Printf("Failed to issue gift card %s (attempt %d): %v", codigo, tentativa+1, err)
+	}
+	return "", errors.New("failed to generate a unique gift card code")
+}
+
+func buscarVale(firestoreClient *FirestoreClient, codigo string) (ValePresente, error) {
+	var vale ValePresente
+	snapshot, err := firestoreClient.Client.Collection("vales_presente").Doc(codigo).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return vale, ErrValeNaoEncontrado
+	}
+	if err != nil {
+		return vale, err
+	}
+	if err := snapshot.DataTo(&vale); err != nil {
+		return vale, err
+	}
+	vale.Codigo = codigo
+	return vale, nil
+}
+
+func ValesHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	docs, err := firestoreClient.Client.Collection("vales_presente").OrderBy("CriadoEm", firestore.Desc).Limit(200).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		log.Printf("Failed to list gift cards: %v", err)
+		http.Error(w, "Failed to fetch gift cards", http.StatusInternalServerError)
+		return
+	}
+	var vales []ValePresente
+	for _, doc := range docs {
+		var vale ValePresente
+		if err := doc.DataTo(&vale); err != nil {
+			http.Error(w, "Failed to parse gift card data", http.StatusInternalServerError)
+			return
+		}
+		vale.Codigo = doc.Ref.ID
+		vales = append(vales, vale)
+	}
+
+	var gerados []string
+	if lista := r.URL.Query().Get("gerados"); lista != "" {
+		gerados = strings.Split(lista, ",")
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/vales.html"))
+	data := ValesPageData{
+		PageTitle: "Coffee Shop - Vales-presente",
+		Vales:     vales,
+		Gerados:   gerados,
+		Erro:      r.URL.Query().Get("erro"),
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+// Gera um lote de vales com o mesmo valor
+func GerarValesHandler(w http.ResponseWriter, r *http.Request) {
+	quantidade, err := strconv.Atoi(r.FormValue("quantidade"))
+	if err != nil || quantidade < 1 || quantidade > 100 {
+		http.Error(w, "Invalid quantity", http.StatusBadRequest)
+		return
+	}
+	valor, err := lerValorMonetario(r, "valor")
+	if err != nil || valor <= 0 {
+		http.Error(w, "Invalid valor", http.StatusBadRequest)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	var gerados []string
+	for i := 0; i < quantidade; i++ {
+		codigo, err := emitirVale(firestoreClient, valor, usuarioRequisicao(r), 0)
+		if err != nil {
+			log.Printf("Failed to issue gift card: %v", err)
+			http.Redirect(w, r, "/vales?gerados="+url.QueryEscape(strings.Join(gerados, ","))+
+				"&erro="+url.QueryEscape(fmt.Sprintf("Só %d de %d vales foram gerados", len(gerados), quantidade)), http.StatusSeeOther)
+			return
+		}
+		gerados = append(gerados, codigo)
+	}
+	http.Redirect(w, r, "/vales?gerados="+url.QueryEscape(strings.Join(gerados, ",")), http.StatusSeeOther)
+}
+
+func ValeHandler(w http.ResponseWriter, r *http.Request) {
+	codigo := normalizarCodigoVale(mux.Vars(r)["codigo"])
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	vale, err := buscarVale(firestoreClient, codigo)
+	if err == ErrValeNaoEncontrado {
+		http.Error(w, "Gift card not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch gift card", http.StatusInternalServerError)
+		return
+	}
+
+	docs, err := firestoreClient.Client.Collection("movimentos_vale").Where("Codigo", "==", codigo).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		http.Error(w, "Failed to fetch gift card history", http.StatusInternalServerError)
+		return
+	}
+	var movimentos []MovimentoVale
+	for _, doc := range docs {
+		var m MovimentoVale
+		if err := doc.DataTo(&m); err != nil {
+			http.Error(w, "Failed to parse gift card history", http.StatusInternalServerError)
+			return
+		}
+		movimentos = append(movimentos, m)
+	}
+	sort.Slice(movimentos, func(i, j int) bool { return movimentos[i].Data.Before(movimentos[j].Data) })
+
+	tmpl := template.Must(template.ParseFiles("template/vale.html"))
+	data := ValePageData{
+		PageTitle:  "Coffee Shop - Vale " + codigo,
+		Vale:       vale,
+		Movimentos: movimentos,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+// Bloqueia ou libera o vale, registrando quem alterou
+func BloquearValeHandler(w http.ResponseWriter, r *http.Request) {
+	codigo := normalizarCodigoVale(mux.Vars(r)["codigo"])
+	ativo := r.FormValue("ativo") == "1"
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	ref := firestoreClient.Client.Collection("vales_presente").Doc(codigo)
+	err = firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var vale ValePresente
+		if err := snapshot.DataTo(&vale); err != nil {
+			return err
+		}
+		if vale.Ativo == ativo {
+			return nil
+		}
+		tipo := ValeBloqueio
+		if ativo {
+			tipo = ValeDesbloqueio
+		}
+		if err := tx.Update(ref, []firestore.Update{{Path: "Ativo", Value: ativo}}); err != nil {
+			return err
+		}
+		return tx.Create(firestoreClient.Client.Collection("movimentos_vale").NewDoc(), MovimentoVale{
+			Codigo: codigo, Tipo: tipo, SaldoApos: vale.Saldo, Usuario: usuarioRequisicao(r), Data: time.Now(),
+		})
+	})
+	if err != nil {
+		log.Printf("Failed to update gift card %s: %v", codigo, err)
+		http.Error(w, "Failed to update gift card", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/vales/"+codigo, http.StatusSeeOther)
+}
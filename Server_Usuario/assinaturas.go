@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Situações de uma assinatura, as mesmas do Server_Mantenedor
+const (
+	AssinaturaAtiva     = "ativa"
+	AssinaturaPausada   = "pausada"
+	AssinaturaCancelada = "cancelada"
+)
+
+// Intervalos de entrega oferecidos, em dias
+var intervalosAssinatura = []int{7, 14, 30}
+
+// Métodos que o Server_Mantenedor consegue cobrar sem o cliente na loja
+var metodosAssinatura = map[string]bool{
+	"card": true,
+	"pix":  true,
+}
+
+// Assinatura de um produto com entregas periódicas, na coleção "assinaturas".
+// Os pedidos de cada entrega são gerados pelo agendador do Server_Mantenedor.
+type Assinatura struct {
+	ID            string `firestore:"-"`
+	ClienteEmail  string
+	CodigoProd    int
+	NomeProd      string
+	Quantidade    int
+	IntervaloDias int
+	// Meia-noite, no fuso da loja, do dia da próxima entrega
+	ProximaEntrega  time.Time
+	Status          string
+	MetodoPagamento string
+	CriadaEm        time.Time
+	UltimoPedido    int
+	Falhas          int
+	UltimoErro      string
+}
+
+// Erro de uma ação do cliente na assinatura, mostrado na página
+type AssinaturaInvalidaError struct {
+	Mensagem string
+}
+
+type AssinaturasPageData struct {
+	PageTitle   string
+	Cliente     Cliente
+	Assinaturas []Assinatura
+	Produtos    []Produto
+	Intervalos  []int
+	// Primeira data aceita para a entrega inicial, no formato do campo de data
+	PrimeiraData string
+	Erro         string
+	Mensagem     string
+}
+
+func (e *AssinaturaInvalidaError) Error() string {
+	return e.Mensagem
+}
+
+func assinaturaInvalida(mensagem string) error {
+	return &AssinaturaInvalidaError{Mensagem: mensagem}
+}
+
+// Primeira data de entrega depois de agora, seguindo o intervalo
+func (a Assinatura) proximaDepois(agora time.Time) time.Time {
+	proxima := a.ProximaEntrega
+	for !proxima.After(agora) {
+		proxima = proxima.AddDate(0, 0, a.IntervaloDias)
+	}
+	return proxima
+}
+
+func intervaloValido(dias int) bool {
+	for _, intervalo := range intervalosAssinatura {
+		if intervalo == dias {
+			return true
+		}
+	}
+	return false
+}
+
+func amanha(agora time.Time) time.Time {
+	return time.Date(agora.Year(), agora.Month(), agora.Day()+1, 0, 0, 0, 0, agora.Location())
+}
+
+// Aplica ao documento a ação escolhida pelo cliente; só o dono altera a assinatura
+func alterarAssinatura(firestoreClient *FirestoreClient, id, email, acao string, agora time.Time) error {
+	ref := firestoreClient.Client.Collection("assinaturas").Doc(id)
+	return firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return assinaturaInvalida("Assinatura não encontrada")
+		}
+		if err != nil {
+			return err
+		}
+		var a Assinatura
+		if err := snapshot.DataTo(&a); err != nil {
+			return err
+		}
+		if a.ClienteEmail != email {
+			return assinaturaInvalida("Assinatura não encontrada")
+		}
+		if a.Status == AssinaturaCancelada {
+			return assinaturaInvalida("Esta assinatura foi cancelada")
+		}
+
+		var atualizacoes []firestore.Update
+		switch acao {
+		case "pausar":
+			if a.Status != AssinaturaAtiva {
+				return assinaturaInvalida("A assinatura já está pausada")
+			}
+			atualizacoes = []firestore.Update{{Path: "Status", Value: AssinaturaPausada}}
+		case "retomar":
+			if a.Status != AssinaturaPausada {
+				return assinaturaInvalida("A assinatura já está ativa")
+			}
+			// Entregas que venceram durante a pausa não são geradas
+			atualizacoes = []firestore.Update{
+				{Path: "Status", Value: AssinaturaAtiva},
+				{Path: "ProximaEntrega", Value: a.proximaDepois(agora)},
+				{Path: "Falhas", Value: 0},
+				{Path: "UltimoErro", Value: ""},
+			}
+		case "pular":
+			if a.Status != AssinaturaAtiva {
+				return assinaturaInvalida("Retome a assinatura para pular uma entrega")
+			}
+			atualizacoes = []firestore.Update{{Path: "ProximaEntrega", Value: a.ProximaEntrega.AddDate(0, 0, a.IntervaloDias)}}
+		case "cancelar":
+			atualizacoes = []firestore.Update{{Path: "Status", Value: AssinaturaCancelada}}
+		default:
+			return assinaturaInvalida("Ação inválida")
+		}
+		return tx.Update(ref, atualizacoes)
+	})
+}
+
+// Assinaturas do cliente logado e o formulário para criar uma nova
+func assinaturasHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch session from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if cliente == nil {
+		http.Redirect(w, r, "/entrar", http.StatusSeeOther)
+		return
+	}
+
+	docs, err := firestoreClient.Client.Collection("assinaturas").Where("ClienteEmail", "==", cliente.Email).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch subscriptions from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	var assinaturas []Assinatura
+	for _, doc := range docs {
+		var a Assinatura
+		if err := doc.DataTo(&a); err != nil {
+			http.Error(w, "Failed to parse subscription data", http.StatusInternalServerError)
+			return
+		}
+		a.ID = doc.Ref.ID
+		assinaturas = append(assinaturas, a)
+	}
+	// Canceladas por último; as demais pela próxima entrega
+	sort.Slice(assinaturas, func(i, j int) bool {
+		ci, cj := assinaturas[i].Status == AssinaturaCancelada, assinaturas[j].Status == AssinaturaCancelada
+		if ci != cj {
+			return cj
+		}
+		return assinaturas[i].ProximaEntrega.Before(assinaturas[j].ProximaEntrega)
+	})
+
+	produtosDocs, err := firestoreClient.Client.Collection("produtos").Where("Assinavel", "==", true).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch products from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	var produtos []Produto
+	for _, doc := range produtosDocs {
+		var p Produto
+		if err := doc.DataTo(&p); err != nil {
+			http.Error(w, "Failed to parse product data", http.StatusInternalServerError)
+			return
+		}
+		produtos = append(produtos, p)
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/assinaturas.html"))
+	data := AssinaturasPageData{
+		PageTitle:    "Coffee Shop - Minhas assinaturas",
+		Cliente:      *cliente,
+		Assinaturas:  assinaturas,
+		Produtos:     produtos,
+		Intervalos:   intervalosAssinatura,
+		PrimeiraData: amanha(time.Now().In(fusoLoja())).Format("2006-01-02"),
+		Erro:         r.URL.Query().Get("erro"),
+		Mensagem:     r.URL.Query().Get("mensagem"),
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to execute template: %s", err.Error()), http.StatusInternalServerError)
+	}
+}
+
+func criarAssinaturaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil || cliente == nil {
+		http.Redirect(w, r, "/entrar", http.StatusSeeOther)
+		return
+	}
+
+	const destino = "/minha_conta/assinaturas"
+	codigoProd, _ := strconv.Atoi(r.FormValue("produto"))
+	quantidade, err := strconv.Atoi(r.FormValue("quantidade"))
+	if err != nil || quantidade < 1 || quantidade > 20 {
+		redirecionarComErro(w, r, destino, "Escolha de 1 a 20 unidades por entrega")
+		return
+	}
+	intervalo, _ := strconv.Atoi(r.FormValue("intervalo"))
+	if !intervaloValido(intervalo) {
+		redirecionarComErro(w, r, destino, "Intervalo de entrega inválido")
+		return
+	}
+	metodo := r.FormValue("payment")
+	if !metodosAssinatura[metodo] {
+		redirecionarComErro(w, r, destino, "Escolha cartão ou pix para as assinaturas")
+		return
+	}
+	agora := time.Now().In(fusoLoja())
+	primeira, err := time.ParseInLocation("2006-01-02", r.FormValue("primeiraEntrega"), fusoLoja())
+	if err != nil || primeira.Before(amanha(agora)) {
+		redirecionarComErro(w, r, destino, "A primeira entrega deve ser a partir de amanhã")
+		return
+	}
+
+	produto, err := buscarProduto(firestoreClient, codigoProd)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch product from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !produto.Assinavel {
+		redirecionarComErro(w, r, destino, "Este produto não está disponível por assinatura")
+		return
+	}
+
+	_, _, err = firestoreClient.Client.Collection("assinaturas").Add(firestoreClient.Ctx, Assinatura{
+		ClienteEmail:    cliente.Email,
+		CodigoProd:      produto.ID,
+		NomeProd:        produto.NomeProduto,
+		Quantidade:      quantidade,
+		IntervaloDias:   intervalo,
+		ProximaEntrega:  primeira,
+		Status:          AssinaturaAtiva,
+		MetodoPagamento: metodo,
+		CriadaEm:        time.Now(),
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save subscription in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, destino+"?mensagem="+url.QueryEscape("Assinatura criada"), http.StatusSeeOther)
+}
+
+// Pausa, retoma, pula a próxima entrega ou cancela uma assinatura
+func alterarAssinaturaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil || cliente == nil {
+		http.Redirect(w, r, "/entrar", http.StatusSeeOther)
+		return
+	}
+
+	const destino = "/minha_conta/assinaturas"
+	id := r.FormValue("id")
+	if id == "" {
+		redirecionarComErro(w, r, destino, "Assinatura não encontrada")
+		return
+	}
+	err = alterarAssinatura(firestoreClient, id, cliente.Email, r.FormValue("acao"), time.Now().In(fusoLoja()))
+	var invalida *AssinaturaInvalidaError
+	if errors.As(err, &invalida) {
+		redirecionarComErro(w, r, destino, err.Error())
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update subscription in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, destino+"?mensagem="+url.QueryEscape("Assinatura atualizada"), http.StatusSeeOther)
+}
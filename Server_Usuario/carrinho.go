@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	cookieCarrinho  = "carrinho"
+	duracaoCarrinho = 7 * 24 * time.Hour
+)
+
+// Carrinho de um visitante, guardado na coleção "carrinhos" com o token do cookie como ID do documento.
+// Cada navegador tem o seu, logado ou não.
+type Carrinho struct {
+	Token string `firestore:"-"`
+	Itens []CarrinhoItem
+	Cupom string
+	// Pontos escolhidos pelo cliente logado, conferidos de novo ao finalizar a compra
+	Resgate ResgatePontos
+	// Vale-presente informado e quanto dele usar; zero usa o máximo possível
+	Vale      string
+	ValorVale float64
+	// Endereço de entrega; nil quando o cliente vai retirar na loja
+	Entrega *EnderecoEntrega
+	// Conta logada ao informar o endereço, para que a exclusão dos dados pessoais alcance o carrinho
+	ClienteEmail string
+	// Mesa lida do QR code ao abrir o catálogo; zero fora do salão
+	Mesa         int
+	AtualizadoEm time.Time
+}
+
+// Carrinho do cookie da requisição. Sem cookie, ou com um carrinho expirado, começa um vazio com
+// token novo; o cookie é enviado já aqui, então a chamada vem antes de escrever a resposta.
+func carrinhoDaRequisicao(firestoreClient *FirestoreClient, w http.ResponseWriter, r *http.Request) (*Carrinho, error) {
+	if cookie, err := r.Cookie(cookieCarrinho); err == nil && cookie.Value != "" {
+		snapshot, err := firestoreClient.Client.Collection("carrinhos").Doc(cookie.Value).Get(firestoreClient.Ctx)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return nil, err
+		}
+		if err == nil {
+			var carrinho Carrinho
+			if err := snapshot.DataTo(&carrinho); err != nil {
+				return nil, err
+			}
+			if time.Since(carrinho.AtualizadoEm) < duracaoCarrinho {
+				carrinho.Token = cookie.Value
+				return &carrinho, nil
+			}
+		}
+	}
+
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return nil, err
+	}
+	carrinho := &Carrinho{Token: hex.EncodeToString(bytes)}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieCarrinho,
+		Value:    carrinho.Token,
+		Path:     "/",
+		Expires:  time.Now().Add(duracaoCarrinho),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return carrinho, nil
+}
+
+func salvarCarrinho(firestoreClient *FirestoreClient, carrinho *Carrinho) error {
+	carrinho.AtualizadoEm = time.Now()
+	_, err := firestoreClient.Client.Collection("carrinhos").Doc(carrinho.Token).Set(firestoreClient.Ctx, carrinho)
+	return err
+}
+
+// Resgate de pontos que vale para o cliente logado. Quem sai da conta, ou entra com outra no mesmo
+// navegador, não usa os pontos escolhidos pela conta anterior.
+func (c *Carrinho) resgateDe(cliente *Cliente) ResgatePontos {
+	if cliente == nil || c.Resgate.ClienteEmail != cliente.Email {
+		return ResgatePontos{}
+	}
+	return c.Resgate
+}
+
+// Esvazia o carrinho, mantendo o token do visitante
+func (c *Carrinho) limpar() {
+	*c = Carrinho{Token: c.Token}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	cookieSessao  = "sessao"
+	duracaoSessao = 30 * 24 * time.Hour
+	tamanhoSenha  = 8
+)
+
+// Cliente cadastrado na loja, guardado na coleção "clientes" com o e-mail como ID do documento
+type Cliente struct {
+	Email     string
+	Nome      string
+	Telefone  string
+	SenhaHash string
+	CriadoEm  time.Time
+	// Cópia do saldo do extrato de pontos, atualizada junto com cada lançamento
+	SaldoPontos int
+	// Confirmado pelo link enviado no cadastro ou pela redefinição de senha
+	EmailVerificado bool
+}
+
+// Sessão de login, guardada na coleção "sessoes" com o token do cookie como ID do documento
+type Sessao struct {
+	Email  string
+	Expira time.Time
+}
+
+// Pedido da loja visto pelo cliente: as linhas de venda e os estornos do mesmo código
+type PedidoCliente struct {
+	Codigo          int
+	Data            time.Time
+	MetodoPagamento string
+	Itens           []Transacao
+	Total           float64
+	TotalEstornado  float64
+}
+
+type ContaPageData struct {
+	PageTitle string
+	Cliente   Cliente
+	Pedidos   []PedidoCliente
+	// Pedidos feitos como convidado com o e-mail da conta, ainda não reivindicados
+	PedidosConvidado int
+	Erro             string
+	Mensagem         string
+}
+
+func (p PedidoCliente) Status() string {
+	switch {
+	case p.TotalEstornado == 0:
+		return "Concluído"
+	case p.TotalEstornado >= p.Total-0.005:
+		return "Cancelado"
+	}
+	return "Estornado parcialmente"
+}
+
+// E-mail em minúsculas, ou erro se não for um endereço simples
+func normalizarEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	endereco, err := mail.ParseAddress(email)
+	if err != nil || endereco.Address != email {
+		return "", errors.New("E-mail inválido")
+	}
+	return email, nil
+}
+
+func buscarCliente(firestoreClient *FirestoreClient, email string) (*Cliente, error) {
+	snapshot, err := firestoreClient.Client.Collection("clientes").Doc(email).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cliente Cliente
+	if err := snapshot.DataTo(&cliente); err != nil {
+		return nil, err
+	}
+	return &cliente, nil
+}
+
+// Cliente da sessão do cookie, ou nil se ninguém estiver logado
+func clienteLogado(firestoreClient *FirestoreClient, r *http.Request) (*Cliente, error) {
+	cookie, err := r.Cookie(cookieSessao)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+	snapshot, err := firestoreClient.Client.Collection("sessoes").Doc(cookie.Value).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sessao Sessao
+	if err := snapshot.DataTo(&sessao); err != nil {
+		return nil, err
+	}
+	if time.Now().After(sessao.Expira) {
+		return nil, nil
+	}
+	return buscarCliente(firestoreClient, sessao.Email)
+}
+
+func criarSessao(w http.ResponseWriter, firestoreClient *FirestoreClient, email string) error {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(bytes)
+	sessao := Sessao{Email: email, Expira: time.Now().Add(duracaoSessao)}
+	if _, err := firestoreClient.Client.Collection("sessoes").Doc(token).Set(firestoreClient.Ctx, sessao); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieSessao,
+		Value:    token,
+		Path:     "/",
+		Expires:  sessao.Expira,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func redirecionarComErro(w http.ResponseWriter, r *http.Request, destino, mensagem string) {
+	http.Redirect(w, r, destino+"?erro="+url.QueryEscape(mensagem), http.StatusSeeOther)
+}
+
+func renderizarConta(w http.ResponseWriter, arquivo string, data ContaPageData) {
+	tmpl := template.Must(template.ParseFiles("template/" + arquivo))
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to execute template: %s", err.Error()), http.StatusInternalServerError)
+	}
+}
+
+// Página de login e cadastro
+func entrarHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		renderizarConta(w, "entrar.html", ContaPageData{PageTitle: "Coffee Shop - Entrar", Erro: r.URL.Query().Get("erro")})
+		return
+	}
+
+	email, err := normalizarEmail(r.FormValue("email"))
+	if err != nil {
+		redirecionarComErro(w, r, "/entrar", err.Error())
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente, err := buscarCliente(firestoreClient, email)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch customer from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if cliente == nil || bcrypt.CompareHashAndPassword([]byte(cliente.SenhaHash), []byte(r.FormValue("senha"))) != nil {
+		redirecionarComErro(w, r, "/entrar", "E-mail ou senha incorretos")
+		return
+	}
+
+	if err := criarSessao(w, firestoreClient, email); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create session: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/minha_conta", http.StatusSeeOther)
+}
+
+func cadastrarHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	email, err := normalizarEmail(r.FormValue("email"))
+	if err != nil {
+		redirecionarComErro(w, r, "/entrar", err.Error())
+		return
+	}
+	senha := r.FormValue("senha")
+	if len(senha) < tamanhoSenha {
+		redirecionarComErro(w, r, "/entrar", fmt.Sprintf("A senha deve ter pelo menos %d caracteres", tamanhoSenha))
+		return
+	}
+	nome := strings.TrimSpace(r.FormValue("nome"))
+	if nome == "" {
+		redirecionarComErro(w, r, "/entrar", "Informe seu nome")
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(senha), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente := Cliente{
+		Email:     email,
+		Nome:      nome,
+		Telefone:  strings.TrimSpace(r.FormValue("telefone")),
+		SenhaHash: string(hash),
+		CriadoEm:  time.Now(),
+	}
+	// Create falha se o e-mail já tiver conta
+	if _, err := firestoreClient.Client.Collection("clientes").Doc(email).Create(firestoreClient.Ctx, cliente); err != nil {
+		log.Printf("Failed to create customer %s: %v", email, err)
+		redirecionarComErro(w, r, "/entrar", "Já existe uma conta com este e-mail")
+		return
+	}
+	// A conta já existe; sem o email, o cliente pede outro link em Minha conta
+	if err := enviarVerificacaoEmail(firestoreClient, r, email); err != nil {
+		log.Printf("Failed to queue verification email for %s: %v", email, err)
+	}
+
+	if err := criarSessao(w, firestoreClient, email); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create session: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/minha_conta", http.StatusSeeOther)
+}
+
+func sairHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(cookieSessao); err == nil && cookie.Value != "" {
+		firestoreClient, err := InitializeFirestore()
+		if err != nil {
+			http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+			return
+		}
+		defer firestoreClient.Client.Close()
+		if _, err := firestoreClient.Client.Collection("sessoes").Doc(cookie.Value).Delete(firestoreClient.Ctx); err != nil {
+			log.Printf("Failed to delete session: %v", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: cookieSessao, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/pagina_inicial", http.StatusSeeOther)
+}
+
+// Agrupa as transações do cliente em pedidos, do mais recente para o mais antigo
+func montarPedidosCliente(transacoes []Transacao) []PedidoCliente {
+	porCodigo := make(map[int]*PedidoCliente)
+	for _, t := range transacoes {
+		pedido, ok := porCodigo[t.CodigoTransacao]
+		if !ok {
+			pedido = &PedidoCliente{Codigo: t.CodigoTransacao}
+			porCodigo[t.CodigoTransacao] = pedido
+		}
+		if t.Tipo == "estorno" {
+			pedido.TotalEstornado -= t.ValorTransacao
+			continue
+		}
+		pedido.Itens = append(pedido.Itens, t)
+		pedido.Total += t.ValorTransacao
+		if pedido.Data.IsZero() || t.DataTransacao.Before(pedido.Data) {
+			pedido.Data = t.DataTransacao
+			pedido.MetodoPagamento = t.MetodoPagamento
+		}
+	}
+
+	pedidos := make([]PedidoCliente, 0, len(porCodigo))
+	for _, pedido := range porCodigo {
+		pedido.Total = arredondarCentavos(pedido.Total)
+		pedido.TotalEstornado = arredondarCentavos(pedido.TotalEstornado)
+		pedidos = append(pedidos, *pedido)
+	}
+	sort.Slice(pedidos, func(i, j int) bool { return pedidos[i].Data.After(pedidos[j].Data) })
+	return pedidos
+}
+
+func buscarTransacoes(query firestore.Query, firestoreClient *FirestoreClient) ([]Transacao, error) {
+	docs, err := query.Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	transacoes := make([]Transacao, 0, len(docs))
+	for _, doc := range docs {
+		var t Transacao
+		if err := doc.DataTo(&t); err != nil {
+			return nil, err
+		}
+		transacoes = append(transacoes, t)
+	}
+	return transacoes, nil
+}
+
+// Perfil do cliente e seus pedidos
+func minhaContaHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch session from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if cliente == nil {
+		http.Redirect(w, r, "/entrar", http.StatusSeeOther)
+		return
+	}
+
+	transacoes := firestoreClient.Client.Collection("transacoes")
+	minhas, err := buscarTransacoes(transacoes.Where("ClienteEmail", "==", cliente.Email), firestoreClient)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch orders from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	convidado, err := buscarTransacoes(transacoes.Where("EmailContato", "==", cliente.Email).Where("ClienteEmail", "==", ""), firestoreClient)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch guest orders from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	renderizarConta(w, "minha_conta.html", ContaPageData{
+		PageTitle:        "Coffee Shop - Minha conta",
+		Cliente:          *cliente,
+		Pedidos:          montarPedidosCliente(minhas),
+		PedidosConvidado: len(montarPedidosCliente(convidado)),
+		Erro:             r.URL.Query().Get("erro"),
+		Mensagem:         r.URL.Query().Get("mensagem"),
+	})
+}
+
+func atualizarPerfilHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil || cliente == nil {
+		http.Redirect(w, r, "/entrar", http.StatusSeeOther)
+		return
+	}
+
+	nome := strings.TrimSpace(r.FormValue("nome"))
+	if nome == "" {
+		redirecionarComErro(w, r, "/minha_conta", "Informe seu nome")
+		return
+	}
+	_, err = firestoreClient.Client.Collection("clientes").Doc(cliente.Email).Update(firestoreClient.Ctx, []firestore.Update{
+		{Path: "Nome", Value: nome},
+		{Path: "Telefone", Value: strings.TrimSpace(r.FormValue("telefone"))},
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update customer in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/minha_conta?mensagem="+url.QueryEscape("Perfil atualizado"), http.StatusSeeOther)
+}
+
+// Liga à conta um pedido feito como convidado. Só contas com o e-mail confirmado reivindicam, já que
+// qualquer um pode se cadastrar com o e-mail usado numa compra; o número do pedido escolhe qual ligar.
+func reivindicarPedidoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	codigo, err := strconv.Atoi(strings.TrimSpace(r.FormValue("pedido")))
+	if err != nil {
+		redirecionarComErro(w, r, "/minha_conta", "Número do pedido inválido")
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil || cliente == nil {
+		http.Redirect(w, r, "/entrar", http.StatusSeeOther)
+		return
+	}
+	if !cliente.EmailVerificado {
+		redirecionarComErro(w, r, "/minha_conta", "Confirme seu e-mail pelo link que enviamos para reivindicar pedidos")
+		return
+	}
+
+	docs, err := firestoreClient.Client.Collection("transacoes").Where("CodigoTransacao", "==", codigo).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch order from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	var linhas []*firestore.DocumentRef
+	for _, doc := range docs {
+		var t Transacao
+		if err := doc.DataTo(&t); err != nil {
+			http.Error(w, "Failed to parse transaction data", http.StatusInternalServerError)
+			return
+		}
+		if t.ClienteEmail != "" || t.EmailContato != cliente.Email {
+			continue
+		}
+		linhas = append(linhas, doc.Ref)
+	}
+	if len(linhas) == 0 {
+		redirecionarComErro(w, r, "/minha_conta", "Nenhum pedido de convidado com este número e o e-mail da conta")
+		return
+	}
+
+	batch := firestoreClient.Client.Batch()
+	for _, ref := range linhas {
+		batch.Update(ref, []firestore.Update{{Path: "ClienteEmail", Value: cliente.Email}})
+	}
+	if _, err := batch.Commit(firestoreClient.Ctx); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to claim order in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/minha_conta?mensagem="+url.QueryEscape(fmt.Sprintf("Pedido %d adicionado à sua conta", codigo)), http.StatusSeeOther)
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+var ErrPedidoNaoEncontrado = errors.New("order not found")
+
+// Colunas de uma impressora térmica de 80mm na fonte A
+const colunasComprovante = 48
+
+// Nomes dos métodos de pagamento, os mesmos do Server_Mantenedor
+var nomesMetodoPagamento = map[string]string{
+	"card": "Cartão",
+	"cash": "Dinheiro",
+	"pix":  "PIX",
+	"vale": "Vale-presente",
+}
+
+// Produto do pedido, somando as linhas vendidas dele
+type ItemComprovante struct {
+	NomeProd      string
+	Quantidade    int
+	ValorUnitario float64
+	Desconto      float64
+	Valor         float64
+}
+
+type DescontoComprovante struct {
+	Descricao string
+	Valor     float64
+}
+
+type PagamentoComprovante struct {
+	Metodo string
+	Valor  float64
+}
+
+// Comprovante de um pedido, montado das transações que compartilham o código
+type Comprovante struct {
+	Codigo         int
+	Data           time.Time
+	Itens          []ItemComprovante
+	Subtotal       float64
+	Descontos      []DescontoComprovante
+	TotalDescontos float64
+	TaxaEntrega    float64
+	Total          float64
+	Pagamentos     []PagamentoComprovante
+	// Valor já devolvido em estornos feitos pela loja
+	Estornado  float64
+	RetiradaEm time.Time
+	Mesa       int
+	// Dono do pedido e hash do token de acesso, conferidos antes de mostrá-lo
+	ClienteEmail string
+	HashAcesso   string
+}
+
+type ComprovantePageData struct {
+	PageTitle   string
+	Comprovante Comprovante
+	// Token de acesso repassado ao link do arquivo para a impressora
+	Token string
+}
+
+type ConfirmacaoPedidoPageData struct {
+	PageTitle   string
+	Comprovante Comprovante
+	// Token de acesso repassado ao link do comprovante
+	Token string
+	// Vales emitidos no pedido
+	Vales []string
+	// Endereço de entrega e se há preparo a acompanhar, vindos da finalização da compra
+	Entrega    string
+	Acompanhar bool
+}
+
+func nomeMetodoPagamento(metodo string) string {
+	if nome, ok := nomesMetodoPagamento[metodo]; ok {
+		return nome
+	}
+	if metodo == "" {
+		return "Não informado"
+	}
+	return metodo
+}
+
+// Agrupa as vendas do pedido por produto, com os descontos pelo nome e os pagamentos pelo método
+func montarComprovante(codigo int, transacoes []Transacao) (Comprovante, error) {
+	comprovante := Comprovante{Codigo: codigo}
+	sort.SliceStable(transacoes, func(i, j int) bool {
+		return transacoes[i].DataTransacao.Before(transacoes[j].DataTransacao)
+	})
+
+	itens := make(map[int]*ItemComprovante)
+	var ordem []int
+	descontos := make(map[string]float64)
+	var ordemDescontos []string
+	pagamentos := make(map[string]float64)
+	var ordemPagamentos []string
+	pagar := func(metodo string, valor float64) {
+		if _, ok := pagamentos[metodo]; !ok {
+			ordemPagamentos = append(ordemPagamentos, metodo)
+		}
+		pagamentos[metodo] += valor
+	}
+
+	for _, t := range transacoes {
+		if t.Tipo == "estorno" {
+			comprovante.Estornado -= t.ValorTransacao
+			continue
+		}
+		if comprovante.Data.IsZero() {
+			comprovante.Data = t.DataTransacao.In(fusoLoja())
+		}
+		if !t.RetiradaEm.IsZero() {
+			comprovante.RetiradaEm = t.RetiradaEm.In(fusoLoja())
+		}
+		if t.Mesa != 0 {
+			comprovante.Mesa = t.Mesa
+		}
+		if t.ClienteEmail != "" {
+			comprovante.ClienteEmail = t.ClienteEmail
+		}
+		if t.HashAcesso != "" {
+			comprovante.HashAcesso = t.HashAcesso
+		}
+		comprovante.Total += t.ValorTransacao
+		if len(t.Pagamentos) > 0 {
+			for _, p := range t.Pagamentos {
+				pagar(p.Metodo, p.Valor)
+			}
+		} else {
+			pagar(t.MetodoPagamento, t.ValorTransacao)
+		}
+
+		if t.CodigoProd == CodigoTaxaEntrega {
+			comprovante.TaxaEntrega += t.ValorTransacao
+			continue
+		}
+		item, ok := itens[t.CodigoProd]
+		if !ok {
+			item = &ItemComprovante{NomeProd: t.NomeProd, ValorUnitario: t.ValorUnitario}
+			itens[t.CodigoProd] = item
+			ordem = append(ordem, t.CodigoProd)
+		}
+		item.Quantidade += t.QuantidadeProd
+		item.Desconto += t.Desconto
+		item.Valor += t.ValorTransacao
+		comprovante.Subtotal += float64(t.QuantidadeProd) * t.ValorUnitario
+		comprovante.TotalDescontos += t.Desconto
+
+		// Linhas antigas só têm o valor do desconto, sem a origem
+		restante := t.Desconto
+		for _, d := range t.Descontos {
+			if _, ok := descontos[d.Descricao]; !ok {
+				ordemDescontos = append(ordemDescontos, d.Descricao)
+			}
+			descontos[d.Descricao] += d.Valor
+			restante -= d.Valor
+		}
+		if restante > 0.005 {
+			if _, ok := descontos["Desconto"]; !ok {
+				ordemDescontos = append(ordemDescontos, "Desconto")
+			}
+			descontos["Desconto"] += restante
+		}
+	}
+	if comprovante.Data.IsZero() {
+		return comprovante, ErrPedidoNaoEncontrado
+	}
+
+	for _, codigoProd := range ordem {
+		item := itens[codigoProd]
+		item.Desconto = arredondarCentavos(item.Desconto)
+		item.Valor = arredondarCentavos(item.Valor)
+		comprovante.Itens = append(comprovante.Itens, *item)
+	}
+	for _, descricao := range ordemDescontos {
+		comprovante.Descontos = append(comprovante.Descontos, DescontoComprovante{Descricao: descricao, Valor: arredondarCentavos(descontos[descricao])})
+	}
+	for _, metodo := range ordemPagamentos {
+		if valor := arredondarCentavos(pagamentos[metodo]); valor > 0 {
+			comprovante.Pagamentos = append(comprovante.Pagamentos, PagamentoComprovante{Metodo: nomeMetodoPagamento(metodo), Valor: valor})
+		}
+	}
+	comprovante.Subtotal = arredondarCentavos(comprovante.Subtotal)
+	comprovante.TotalDescontos = arredondarCentavos(comprovante.TotalDescontos)
+	comprovante.TaxaEntrega = arredondarCentavos(comprovante.TaxaEntrega)
+	comprovante.Total = arredondarCentavos(comprovante.Total)
+	comprovante.Estornado = arredondarCentavos(comprovante.Estornado)
+	return comprovante, nil
+}
+
+func moedaComprovante(valor float64) string {
+	return strings.Replace(fmt.Sprintf("%.2f", valor), ".", ",", 1)
+}
+
+// Texto à esquerda e valor alinhado à direita na mesma linha, cortando o texto se não couber
+func linhaComprovante(texto, valor string) string {
+	espaco := colunasComprovante - utf8.RuneCountInString(valor) - 1
+	if utf8.RuneCountInString(texto) > espaco {
+		texto = string([]rune(texto)[:espaco])
+	}
+	return texto + strings.Repeat(" ", colunasComprovante-utf8.RuneCountInString(texto)-utf8.RuneCountInString(valor)) + valor + "\n"
+}
+
+// Comandos ESC/POS usados no comprovante
+const (
+	escInicializar   = "\x1b@"
+	escPaginaCP850   = "\x1bt\x02"
+	escCentralizar   = "\x1ba\x01"
+	escAlinharEsq    = "\x1ba\x00"
+	escNegritoLiga   = "\x1bE\x01"
+	escNegritoDesl   = "\x1bE\x00"
+	escAvancarLinhas = "\x1bd\x04"
+	escCortarPapel   = "\x1dV\x42\x00"
+)
+
+// Comprovante para impressoras térmicas ESC/POS, em 48 colunas e na página de código 850,
+// que cobre os acentos do português
+func (c Comprovante) escPos(loja string) ([]byte, error) {
+	var texto strings.Builder
+	separador := strings.Repeat("-", colunasComprovante) + "\n"
+
+	texto.WriteString(escInicializar + escPaginaCP850 + escCentralizar)
+	texto.WriteString(escNegritoLiga + loja + "\n" + escNegritoDesl)
+	fmt.Fprintf(&texto, "Pedido nº %d\n%s\n", c.Codigo, c.Data.Format("02/01/2006 15:04"))
+	if c.Mesa != 0 {
+		fmt.Fprintf(&texto, "Mesa %d\n", c.Mesa)
+	}
+	if !c.RetiradaEm.IsZero() {
+		fmt.Fprintf(&texto, "Retirada: %s\n", c.RetiradaEm.Format("02/01 15:04"))
+	}
+	texto.WriteString(escAlinharEsq + separador)
+
+	for _, item := range c.Itens {
+		texto.WriteString(linhaComprovante(item.NomeProd, moedaComprovante(item.Valor)))
+		detalhe := fmt.Sprintf("  %d x %s", item.Quantidade, moedaComprovante(item.ValorUnitario))
+		if item.Desconto > 0 {
+			detalhe += " (-" + moedaComprovante(item.Desconto) + ")"
+		}
+		texto.WriteString(detalhe + "\n")
+	}
+	texto.WriteString(separador)
+
+	texto.WriteString(linhaComprovante("Subtotal", moedaComprovante(c.Subtotal)))
+	for _, d := range c.Descontos {
+		texto.WriteString(linhaComprovante(d.Descricao, "-"+moedaComprovante(d.Valor)))
+	}
+	if c.TaxaEntrega > 0 {
+		texto.WriteString(linhaComprovante("Taxa de entrega", moedaComprovante(c.TaxaEntrega)))
+	}
+	texto.WriteString(escNegritoLiga + linhaComprovante("TOTAL R$", moedaComprovante(c.Total)) + escNegritoDesl)
+	for _, p := range c.Pagamentos {
+		texto.WriteString(linhaComprovante(p.Metodo, moedaComprovante(p.Valor)))
+	}
+	if c.Estornado > 0 {
+		texto.WriteString(linhaComprovante("Estornado", "-"+moedaComprovante(c.Estornado)))
+	}
+	texto.WriteString(separador)
+
+	texto.WriteString(escCentralizar + "Obrigado pela preferência!\n" + "Este comprovante não é documento fiscal.\n")
+	texto.WriteString(escAvancarLinhas + escCortarPapel)
+
+	var saida bytes.Buffer
+	escritor := encoding.ReplaceUnsupported(charmap.CodePage850.NewEncoder()).Writer(&saida)
+	if _, err := escritor.Write([]byte(texto.String())); err != nil {
+		return nil, err
+	}
+	return saida.Bytes(), nil
+}
+
+func buscarComprovante(firestoreClient *FirestoreClient, codigo int) (Comprovante, error) {
+	transacoes, err := buscarTransacoes(firestoreClient.Client.Collection("transacoes").Where("CodigoTransacao", "==", codigo), firestoreClient)
+	if err != nil {
+		return Comprovante{}, err
+	}
+	return montarComprovante(codigo, transacoes)
+}
+
+// Só o token do pedido ou a sessão da conta que fez a compra liberam o comprovante
+func (c Comprovante) liberado(token string, cliente *Cliente) bool {
+	if token != "" && c.HashAcesso != "" && subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(c.HashAcesso)) == 1 {
+		return true
+	}
+	return cliente != nil && c.ClienteEmail != "" && cliente.Email == c.ClienteEmail
+}
+
+// Códigos dos vales-presente vendidos no pedido
+func buscarValesEmitidos(firestoreClient *FirestoreClient, codigo int) ([]string, error) {
+	docs, err := firestoreClient.Client.Collection("vales_presente").Where("CodigoTransacao", "==", codigo).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var vales []string
+	for _, doc := range docs {
+		vales = append(vales, doc.Ref.ID)
+	}
+	sort.Strings(vales)
+	return vales, nil
+}
+
+// Lê o código do pedido e busca o comprovante, respondendo com o erro quando não encontra ou quando
+// a requisição não tem acesso a ele
+func comprovanteRequisicao(firestoreClient *FirestoreClient, w http.ResponseWriter, r *http.Request) (Comprovante, bool) {
+	codigo, err := strconv.Atoi(r.URL.Query().Get("codigo"))
+	if err != nil {
+		http.Error(w, "Pedido inválido", http.StatusBadRequest)
+		return Comprovante{}, false
+	}
+
+	comprovante, err := buscarComprovante(firestoreClient, codigo)
+	if err == ErrPedidoNaoEncontrado {
+		http.Error(w, "Pedido não encontrado", http.StatusNotFound)
+		return Comprovante{}, false
+	}
+	if err != nil {
+		log.Printf("Failed to fetch order %d: %v", codigo, err)
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return Comprovante{}, false
+	}
+
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch session from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return Comprovante{}, false
+	}
+	// Sem acesso, o pedido é tratado como inexistente, para não revelar quais códigos existem
+	if !comprovante.liberado(r.URL.Query().Get("token"), cliente) {
+		http.Error(w, "Pedido não encontrado", http.StatusNotFound)
+		return Comprovante{}, false
+	}
+	return comprovante, true
+}
+
+// Página mostrada ao fim da compra, com o resumo do pedido e os links para o comprovante
+func confirmacaoPedidoHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	comprovante, ok := comprovanteRequisicao(firestoreClient, w, r)
+	if !ok {
+		return
+	}
+
+	data := ConfirmacaoPedidoPageData{
+		PageTitle:   fmt.Sprintf("Coffee Shop - Pedido %d confirmado", comprovante.Codigo),
+		Comprovante: comprovante,
+		Token:       r.URL.Query().Get("token"),
+		Entrega:     r.URL.Query().Get("entrega"),
+		Acompanhar:  r.URL.Query().Get("acompanhar") != "",
+	}
+	vales, err := buscarValesEmitidos(firestoreClient, comprovante.Codigo)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch gift cards from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	data.Vales = vales
+	tmpl := template.Must(template.ParseFiles("template/confirmacao_pedido.html"))
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to execute template: %s", err.Error()), http.StatusInternalServerError)
+	}
+}
+
+// Comprovante para impressão: HTML no tamanho da bobina ou, com formato=escpos, os bytes para a impressora térmica
+func comprovanteHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	comprovante, ok := comprovanteRequisicao(firestoreClient, w, r)
+	if !ok {
+		return
+	}
+
+	if r.URL.Query().Get("formato") == "escpos" {
+		conteudo, err := comprovante.escPos("Coffee Shop")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to encode receipt: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="comprovante-%d.bin"`, comprovante.Codigo))
+		w.Write(conteudo)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/comprovante.html"))
+	data := ComprovantePageData{
+		PageTitle:   fmt.Sprintf("Coffee Shop - Comprovante do pedido %d", comprovante.Codigo),
+		Comprovante: comprovante,
+		Token:       r.URL.Query().Get("token"),
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to execute template: %s", err.Error()), http.StatusInternalServerError)
+	}
+}
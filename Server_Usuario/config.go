@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// Caminho padrão do arquivo de configuração da loja.
+// Pode ser sobrescrito pela variável de ambiente USUARIO_CONFIG.
+const configPadrao = "config.json"
+
+type Config struct {
+	// Endereço público da loja, usado nos links dos emails. Não vem do cabeçalho Host da requisição,
+	// que o cliente controla.
+	URLLoja string
+}
+
+var config = configPadraoUsuario()
+
+func configPadraoUsuario() Config {
+	return Config{
+		URLLoja: "http://localhost:8081",
+	}
+}
+
+// Carrega o arquivo de configuração, mantendo os valores padrão para os campos ausentes
+func carregarConfig() {
+	caminho := os.Getenv("USUARIO_CONFIG")
+	if caminho == "" {
+		caminho = configPadrao
+	}
+
+	conteudo, err := os.ReadFile(caminho)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read config file %s: %v", caminho, err)
+		}
+		return
+	}
+
+	if err := json.Unmarshal(conteudo, &config); err != nil {
+		log.Printf("Failed to parse config file %s: %v", caminho, err)
+		config = configPadraoUsuario()
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Fuso horário da loja, usado nas janelas de validade e no happy hour
+const fusoHorarioLoja = "America/Sao_Paulo"
+
+// Tipos de cupom cadastrados no Server_Mantenedor
+const (
+	CupomPercentual = "percentual"
+	CupomValor      = "valor"
+	CupomItemGratis = "item_gratis"
+)
+
+// Tipos de promoção automática
+const (
+	PromocaoQuantidade = "quantidade"
+	PromocaoHappyHour  = "happy_hour"
+)
+
+// Motivo pelo qual o cupom não pode ser usado, exibido ao cliente
+type CupomInvalidoError struct {
+	Mensagem string
+}
+
+func (e *CupomInvalidoError) Error() string {
+	return e.Mensagem
+}
+
+func cupomInvalido(formato string, args ...interface{}) error {
+	return &CupomInvalidoError{Mensagem: fmt.Sprintf(formato, args...)}
+}
+
+var ErrCupomNaoEncontrado = cupomInvalido("Cupom não encontrado")
+
+// Cupom guardado na coleção "cupons", com o código como ID do documento
+type Cupom struct {
+	Codigo string `firestore:"-"`
+	Tipo   string
+	// Percentual de desconto ou valor em reais, conforme o tipo
+	Valor float64
+	// Produto dado de graça nos cupons do tipo item_gratis
+	CodigoProdGratis int
+	ValidoDe         time.Time
+	ValidoAte        time.Time
+	// Zero significa uso ilimitado
+	LimiteUsos   int
+	Usos         int
+	PedidoMinimo float64
+	Ativo        bool
+}
+
+// Promoção aplicada sem cupom, guardada na coleção "promocoes"
+type Promocao struct {
+	ID   string `firestore:"-"`
+	Nome string
+	Tipo string
+	// Produtos participantes; vazio vale para todo o catálogo
+	Produtos   []int
+	Percentual float64
+	// Quantidade mínima dos produtos participantes, nas promoções por quantidade
+	QuantidadeMinima int
+	// Janela do happy hour, no formato HH:MM, e dias da semana (0 = domingo; vazio = todos)
+	HoraInicio string
+	HoraFim    string
+	DiasSemana []int
+	Ativa      bool
+}
+
+// Desconto aplicado a uma linha do pedido
+type DescontoAplicado struct {
+	Origem    string
+	Codigo    string
+	Descricao string
+	Valor     float64
+}
+
+// Linha do carrinho com os descontos que recebeu
+type ItemComDesconto struct {
+	CarrinhoItem
+	Descontos []DescontoAplicado
+	Desconto  float64
+}
+
+type ResultadoDescontos struct {
+	Itens    []ItemComDesconto
+	Subtotal float64
+	Desconto float64
+	Total    float64
+}
+
+func arredondarCentavos(valor float64) float64 {
+	return math.Round(valor*100) / 100
+}
+
+func fusoLoja() *time.Location {
+	loc, err := time.LoadLocation(fusoHorarioLoja)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+func (i ItemComDesconto) ValorLiquido() float64 {
+	return arredondarCentavos(i.ValorTransacao - i.Desconto)
+}
+
+func (i *ItemComDesconto) aplicar(desconto DescontoAplicado) {
+	desconto.Valor = arredondarCentavos(math.Min(desconto.Valor, i.ValorLiquido()))
+	if desconto.Valor <= 0 {
+		return
+	}
+	i.Descontos = append(i.Descontos, desconto)
+	i.Desconto = arredondarCentavos(i.Desconto + desconto.Valor)
+}
+
+func (p Promocao) participa(codigoProduto int) bool {
+	if len(p.Produtos) == 0 {
+		return true
+	}
+	for _, codigo := range p.Produtos {
+		if codigo == codigoProduto {
+			return true
+		}
+	}
+	return false
+}
+
+// Indica se o happy hour está valendo no horário informado
+func (p Promocao) noHorario(agora time.Time) bool {
+	if len(p.DiasSemana) > 0 {
+		dia := false
+		for _, d := range p.DiasSemana {
+			dia = dia || d == int(agora.Weekday())
+		}
+		if !dia {
+			return false
+		}
+	}
+	hora := agora.Format("15:04")
+	return p.HoraInicio <= hora && hora < p.HoraFim
+}
+
+func (c Cupom) Descricao() string {
+	switch c.Tipo {
+	case CupomPercentual:
+		return fmt.Sprintf("Cupom %s (%.0f%%)", c.Codigo, c.Valor)
+	case CupomValor:
+		return fmt.Sprintf("Cupom %s (R$ %.2f)", c.Codigo, c.Valor)
+	}
+	return fmt.Sprintf("Cupom %s (item grátis)", c.Codigo)
+}
+
+// Confere validade, limite de usos e pedido mínimo do cupom
+func (c Cupom) validar(subtotal float64, agora time.Time) error {
+	switch {
+	case !c.Ativo:
+		return cupomInvalido("O cupom %s não está ativo", c.Codigo)
+	case !c.ValidoDe.IsZero() && agora.Before(c.ValidoDe):
+		return cupomInvalido("O cupom %s ainda não é válido", c.Codigo)
+	case !c.ValidoAte.IsZero() && !agora.Before(c.ValidoAte):
+		return cupomInvalido("O cupom %s expirou", c.Codigo)
+	case c.LimiteUsos > 0 && c.Usos >= c.LimiteUsos:
+		return cupomInvalido("O cupom %s atingiu o limite de usos", c.Codigo)
+	case subtotal < c.PedidoMinimo:
+		return cupomInvalido("O cupom %s exige pedido mínimo de R$ %.2f", c.Codigo, c.PedidoMinimo)
+	}
+	return nil
+}
+
+// Calcula os descontos do carrinho. Cada linha recebe a melhor promoção automática que se aplica a ela
+// (promoções não se acumulam entre si) e o cupom, se houver, incide sobre o valor que restou.
+// As linhas de vale-presente não recebem desconto, para o vale emitido valer o que foi pago.
+func calcularDescontos(carrinho []CarrinhoItem, cupom *Cupom, promocoes []Promocao, agora time.Time) (ResultadoDescontos, error) {
+	var resultado ResultadoDescontos
+	for _, item := range carrinho {
+		resultado.Itens = append(resultado.Itens, ItemComDesconto{CarrinhoItem: item})
+		resultado.Subtotal += item.ValorTransacao
+	}
+	resultado.Subtotal = arredondarCentavos(resultado.Subtotal)
+
+	for i := range resultado.Itens {
+		item := &resultado.Itens[i]
+		if item.ValePresente {
+			continue
+		}
+		var melhor DescontoAplicado
+		for _, promocao := range promocoes {
+			if !promocao.Ativa || !promocao.participa(item.CodigoProduto) {
+				continue
+			}
+			switch promocao.Tipo {
+			case PromocaoQuantidade:
+				quantidade := 0
+				for _, outro := range carrinho {
+					if !outro.ValePresente && promocao.participa(outro.CodigoProduto) {
+						quantidade += outro.QuantidadeProd
+					}
+				}
+				if quantidade < promocao.QuantidadeMinima {
+					continue
+				}
+			case PromocaoHappyHour:
+				if !promocao.noHorario(agora) {
+					continue
+				}
+			default:
+				continue
+			}
+			valor := arredondarCentavos(item.ValorTransacao * promocao.Percentual / 100)
+			if valor > melhor.Valor {
+				melhor = DescontoAplicado{Origem: "promocao", Codigo: promocao.ID, Descricao: promocao.Nome, Valor: valor}
+			}
+		}
+		item.aplicar(melhor)
+	}
+
+	if cupom != nil {
+		if err := aplicarCupom(&resultado, *cupom, agora); err != nil {
+			return resultado, err
+		}
+	}
+
+	resultado.totalizar()
+	return resultado, nil
+}
+
+// Recalcula o desconto e o total do pedido a partir das linhas
+func (r *ResultadoDescontos) totalizar() {
+	r.Desconto = 0
+	for _, item := range r.Itens {
+		r.Desconto += item.Desconto
+	}
+	r.Desconto = arredondarCentavos(r.Desconto)
+	r.Total = arredondarCentavos(r.Subtotal - r.Desconto)
+}
+
+// Valor das linhas depois dos descontos já aplicados
+func (r ResultadoDescontos) liquido() float64 {
+	liquido := 0.0
+	for _, item := range r.Itens {
+		liquido += item.ValorLiquido()
+	}
+	return liquido
+}
+
+// Valor líquido das linhas que aceitam desconto, base dos cupons e dos pontos
+func (r ResultadoDescontos) descontavel() float64 {
+	descontavel := 0.0
+	for _, item := range r.Itens {
+		if !item.ValePresente {
+			descontavel += item.ValorLiquido()
+		}
+	}
+	return descontavel
+}
+
+// Subtotal das linhas que aceitam desconto, sem os vales-presente; é ele que precisa atingir o pedido mínimo
+func (r ResultadoDescontos) subtotalDescontavel() float64 {
+	subtotal := 0.0
+	for _, item := range r.Itens {
+		if !item.ValePresente {
+			subtotal += item.ValorTransacao
+		}
+	}
+	return arredondarCentavos(subtotal)
+}
+
+// Desconta uma unidade do produto, se ele estiver no carrinho
+func (r *ResultadoDescontos) descontarUnidade(desconto DescontoAplicado, codigoProduto int) bool {
+	for i := range r.Itens {
+		item := &r.Itens[i]
+		if item.CodigoProduto == codigoProduto && item.QuantidadeProd > 0 && !item.ValePresente {
+			desconto.Valor = item.ValorLiquido() / float64(item.QuantidadeProd)
+			item.aplicar(desconto)
+			return true
+		}
+	}
+	return false
+}
+
+// Rateia um desconto do pedido inteiro entre as linhas que aceitam desconto, proporcionalmente ao valor
+// líquido de cada uma, para que os estornos devolvam o valor efetivamente pago. A última delas fica com a
+// sobra do arredondamento.
+func (r *ResultadoDescontos) ratear(desconto DescontoAplicado, total float64) {
+	liquido := r.descontavel()
+	if liquido <= 0 {
+		return
+	}
+	ultima := -1
+	for i, item := range r.Itens {
+		if !item.ValePresente {
+			ultima = i
+		}
+	}
+	restante := total
+	for i := range r.Itens {
+		item := &r.Itens[i]
+		if item.ValePresente {
+			continue
+		}
+		desconto.Valor = arredondarCentavos(total * item.ValorLiquido() / liquido)
+		if i == ultima {
+			desconto.Valor = arredondarCentavos(restante)
+		}
+		antes := item.Desconto
+		item.aplicar(desconto)
+		restante -= item.Desconto - antes
+	}
+}
+
+// Aplica o cupom sobre o valor líquido das linhas
+func aplicarCupom(resultado *ResultadoDescontos, cupom Cupom, agora time.Time) error {
+	if err := cupom.validar(resultado.subtotalDescontavel(), agora); err != nil {
+		return err
+	}
+	desconto := DescontoAplicado{Origem: "cupom", Codigo: cupom.Codigo, Descricao: cupom.Descricao()}
+
+	if cupom.Tipo == CupomItemGratis {
+		if !resultado.descontarUnidade(desconto, cupom.CodigoProdGratis) {
+			return cupomInvalido("Adicione o produto do cupom %s ao carrinho para ganhá-lo", cupom.Codigo)
+		}
+		return nil
+	}
+
+	liquido := resultado.descontavel()
+	total := arredondarCentavos(liquido * cupom.Valor / 100)
+	if cupom.Tipo == CupomValor {
+		total = math.Min(cupom.Valor, liquido)
+	}
+	resultado.ratear(desconto, total)
+	return nil
+}
+
+func buscarCupom(firestoreClient *FirestoreClient, codigo string) (*Cupom, error) {
+	codigo = strings.ToUpper(strings.TrimSpace(codigo))
+	if codigo == "" {
+		return nil, ErrCupomNaoEncontrado
+	}
+	snapshot, err := firestoreClient.Client.Collection("cupons").Doc(codigo).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrCupomNaoEncontrado
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cupom Cupom
+	if err := snapshot.DataTo(&cupom); err != nil {
+		return nil, err
+	}
+	cupom.Codigo = codigo
+	return &cupom, nil
+}
+
+func buscarPromocoesAtivas(firestoreClient *FirestoreClient) ([]Promocao, error) {
+	docs, err := firestoreClient.Client.Collection("promocoes").Where("Ativa", "==", true).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var promocoes []Promocao
+	for _, doc := range docs {
+		var promocao Promocao
+		if err := doc.DataTo(&promocao); err != nil {
+			return nil, err
+		}
+		promocao.ID = doc.Ref.ID
+		promocoes = append(promocoes, promocao)
+	}
+	return promocoes, nil
+}
+
+// Calcula os descontos dos itens do carrinho com o cupom informado e as promoções ativas
+func descontosCarrinho(firestoreClient *FirestoreClient, carrinho []CarrinhoItem, codigoCupom string, agora time.Time) (ResultadoDescontos, *Cupom, error) {
+	promocoes, err := buscarPromocoesAtivas(firestoreClient)
+	if err != nil {
+		return ResultadoDescontos{}, nil, err
+	}
+
+	var cupom *Cupom
+	if codigoCupom != "" {
+		cupom, err = buscarCupom(firestoreClient, codigoCupom)
+		if err != nil {
+			resultado, _ := calcularDescontos(carrinho, nil, promocoes, agora)
+			return resultado, nil, err
+		}
+	}
+
+	resultado, err := calcularDescontos(carrinho, cupom, promocoes, agora)
+	if err != nil {
+		// O carrinho continua valendo com as promoções automáticas, sem o cupom
+		resultado, _ = calcularDescontos(carrinho, nil, promocoes, agora)
+		return resultado, nil, err
+	}
+	return resultado, cupom, nil
+}
+
+// Resumo dos descontos do pedido, para exibição no carrinho
+func (r ResultadoDescontos) DescontosAgrupados() []DescontoAplicado {
+	var agrupados []DescontoAplicado
+	indice := make(map[string]int)
+	for _, item := range r.Itens {
+		for _, desconto := range item.Descontos {
+			chave := desconto.Origem + ":" + desconto.Codigo
+			if i, ok := indice[chave]; ok {
+				agrupados[i].Valor = arredondarCentavos(agrupados[i].Valor + desconto.Valor)
+				continue
+			}
+			indice[chave] = len(agrupados)
+			agrupados = append(agrupados, desconto)
+		}
+	}
+	return agrupados
+}
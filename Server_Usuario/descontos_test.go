@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+var (
+	cafeTeste = CarrinhoItem{CodigoProduto: 1, NomeProduto: "Café expresso", QuantidadeProd: 2, ValorVenda: 6, ValorTransacao: 12}
+	paoTeste  = CarrinhoItem{CodigoProduto: 2, NomeProduto: "Pão de queijo", QuantidadeProd: 1, ValorVenda: 5, ValorTransacao: 5}
+	valeTeste = CarrinhoItem{CodigoProduto: 9, NomeProduto: "Vale-presente R$ 50", QuantidadeProd: 1, ValorVenda: 50, ValorTransacao: 50, ValePresente: true}
+)
+
+func TestCalcularDescontos(t *testing.T) {
+	// Terça-feira, 10 de março de 2026, às 17h30 no horário da loja
+	agora := time.Date(2026, 3, 10, 17, 30, 0, 0, fusoLoja())
+	cupom := func(tipo string, valor float64) *Cupom {
+		return &Cupom{Codigo: "TESTE", Tipo: tipo, Valor: valor, Ativo: true}
+	}
+	happyHour := Promocao{ID: "hh", Nome: "Happy hour", Tipo: PromocaoHappyHour, Percentual: 10, HoraInicio: "17:00", HoraFim: "19:00", Ativa: true}
+
+	casos := []struct {
+		nome      string
+		itens     []CarrinhoItem
+		cupom     *Cupom
+		promocoes []Promocao
+		agora     time.Time
+		desconto  float64
+		invalido  bool
+	}{
+		{nome: "sem descontos", itens: []CarrinhoItem{cafeTeste, paoTeste}},
+		{nome: "cupom percentual", itens: []CarrinhoItem{cafeTeste, paoTeste}, cupom: cupom(CupomPercentual, 10), desconto: 1.70},
+		{nome: "cupom de valor limitado ao pedido", itens: []CarrinhoItem{paoTeste}, cupom: cupom(CupomValor, 8), desconto: 5},
+		{nome: "cupom de valor", itens: []CarrinhoItem{cafeTeste, paoTeste}, cupom: cupom(CupomValor, 3), desconto: 3},
+		{nome: "cupom não desconta o vale-presente", itens: []CarrinhoItem{cafeTeste, valeTeste}, cupom: cupom(CupomPercentual, 10), desconto: 1.20},
+		{nome: "pedido mínimo atingido", itens: []CarrinhoItem{cafeTeste, paoTeste},
+			cupom: &Cupom{Codigo: "MIN15", Tipo: CupomPercentual, Valor: 10, PedidoMinimo: 15, Ativo: true}, desconto: 1.70},
+		{nome: "pedido mínimo não atingido", itens: []CarrinhoItem{cafeTeste},
+			cupom: &Cupom{Codigo: "MIN15", Tipo: CupomPercentual, Valor: 10, PedidoMinimo: 15, Ativo: true}, invalido: true},
+		{nome: "vale-presente não conta para o pedido mínimo", itens: []CarrinhoItem{cafeTeste, valeTeste},
+			cupom: &Cupom{Codigo: "MIN15", Tipo: CupomPercentual, Valor: 10, PedidoMinimo: 15, Ativo: true}, invalido: true},
+		{nome: "limite de usos atingido", itens: []CarrinhoItem{cafeTeste},
+			cupom: &Cupom{Codigo: "LIMITE", Tipo: CupomValor, Valor: 2, LimiteUsos: 3, Usos: 3, Ativo: true}, invalido: true},
+		{nome: "abaixo do limite de usos", itens: []CarrinhoItem{cafeTeste},
+			cupom: &Cupom{Codigo: "LIMITE", Tipo: CupomValor, Valor: 2, LimiteUsos: 3, Usos: 2, Ativo: true}, desconto: 2},
+		{nome: "cupom inativo", itens: []CarrinhoItem{cafeTeste}, cupom: &Cupom{Codigo: "OFF", Tipo: CupomValor, Valor: 2}, invalido: true},
+		{nome: "cupom expirado", itens: []CarrinhoItem{cafeTeste},
+			cupom: &Cupom{Codigo: "VELHO", Tipo: CupomValor, Valor: 2, ValidoAte: agora.Add(-time.Hour), Ativo: true}, invalido: true},
+		{nome: "cupom ainda não válido", itens: []CarrinhoItem{cafeTeste},
+			cupom: &Cupom{Codigo: "NOVO", Tipo: CupomValor, Valor: 2, ValidoDe: agora.Add(time.Hour), Ativo: true}, invalido: true},
+		{nome: "item grátis", itens: []CarrinhoItem{cafeTeste, paoTeste},
+			cupom: &Cupom{Codigo: "PAO", Tipo: CupomItemGratis, CodigoProdGratis: 2, Ativo: true}, desconto: 5},
+		{nome: "item grátis fora do carrinho", itens: []CarrinhoItem{cafeTeste},
+			cupom: &Cupom{Codigo: "PAO", Tipo: CupomItemGratis, CodigoProdGratis: 2, Ativo: true}, invalido: true},
+		{nome: "promoção por quantidade", itens: []CarrinhoItem{cafeTeste, paoTeste},
+			promocoes: []Promocao{{ID: "q", Nome: "Dois cafés", Tipo: PromocaoQuantidade, Produtos: []int{1}, Percentual: 20, QuantidadeMinima: 2, Ativa: true}},
+			desconto:  2.40},
+		{nome: "quantidade abaixo do mínimo", itens: []CarrinhoItem{cafeTeste, paoTeste},
+			promocoes: []Promocao{{ID: "q", Nome: "Três cafés", Tipo: PromocaoQuantidade, Produtos: []int{1}, Percentual: 20, QuantidadeMinima: 3, Ativa: true}}},
+		{nome: "vale-presente não conta na quantidade", itens: []CarrinhoItem{cafeTeste, valeTeste},
+			promocoes: []Promocao{{ID: "q", Nome: "Três itens", Tipo: PromocaoQuantidade, Percentual: 20, QuantidadeMinima: 3, Ativa: true}}},
+		{nome: "promoção inativa", itens: []CarrinhoItem{cafeTeste},
+			promocoes: []Promocao{{ID: "q", Nome: "Café", Tipo: PromocaoQuantidade, Percentual: 50, QuantidadeMinima: 1}}},
+		{nome: "happy hour no horário", itens: []CarrinhoItem{cafeTeste, paoTeste}, promocoes: []Promocao{happyHour}, desconto: 1.70},
+		{nome: "happy hour fora do horário", itens: []CarrinhoItem{cafeTeste, paoTeste}, promocoes: []Promocao{happyHour},
+			agora: time.Date(2026, 3, 10, 20, 0, 0, 0, fusoLoja())},
+		{nome: "cada linha fica com a melhor promoção", itens: []CarrinhoItem{cafeTeste, paoTeste},
+			promocoes: []Promocao{happyHour, {ID: "c", Nome: "Café", Tipo: PromocaoQuantidade, Produtos: []int{1}, Percentual: 30, QuantidadeMinima: 1, Ativa: true}},
+			desconto:  4.10},
+		{nome: "cupom incide sobre o que sobrou da promoção", itens: []CarrinhoItem{cafeTeste, paoTeste},
+			promocoes: []Promocao{{ID: "q", Nome: "Dois cafés", Tipo: PromocaoQuantidade, Produtos: []int{1}, Percentual: 20, QuantidadeMinima: 2, Ativa: true}},
+			cupom:     cupom(CupomPercentual, 50), desconto: 9.70},
+	}
+
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			quando := caso.agora
+			if quando.IsZero() {
+				quando = agora
+			}
+			resultado, err := calcularDescontos(caso.itens, caso.cupom, caso.promocoes, quando)
+			var invalido *CupomInvalidoError
+			if caso.invalido {
+				if !errors.As(err, &invalido) {
+					t.Fatalf("erro = %v, esperava cupom inválido", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(resultado.Desconto-caso.desconto) > 0.001 {
+				t.Errorf("desconto = %.2f, esperava %.2f", resultado.Desconto, caso.desconto)
+			}
+
+			// O total é a soma das linhas, e os vales-presente saem sem desconto
+			liquido := 0.0
+			for _, item := range resultado.Itens {
+				liquido += item.ValorLiquido()
+				if item.ValePresente && item.Desconto != 0 {
+					t.Errorf("vale-presente recebeu desconto de %.2f", item.Desconto)
+				}
+			}
+			if math.Abs(liquido-resultado.Total) > 0.001 || math.Abs(resultado.Subtotal-resultado.Desconto-resultado.Total) > 0.001 {
+				t.Errorf("linhas somam %.2f, total %.2f, subtotal %.2f, desconto %.2f", liquido, resultado.Total, resultado.Subtotal, resultado.Desconto)
+			}
+		})
+	}
+}
+
+// O cupom é rateado entre as linhas, para que o estorno de uma delas devolva o que foi pago por ela
+func TestCupomRateado(t *testing.T) {
+	resultado, err := calcularDescontos([]CarrinhoItem{cafeTeste, paoTeste}, &Cupom{Codigo: "DEZ", Tipo: CupomValor, Valor: 10, Ativo: true}, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	esperados := []float64{7.06, 2.94}
+	for i, item := range resultado.Itens {
+		if math.Abs(item.Desconto-esperados[i]) > 0.001 {
+			t.Errorf("%s: desconto %.2f, esperava %.2f", item.NomeProduto, item.Desconto, esperados[i])
+		}
+	}
+}
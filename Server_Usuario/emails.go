@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Modelos de email do Server_Mantenedor, que monta as mensagens e as envia
+const (
+	ModeloPedidoConfirmado = "pedido_confirmado"
+	ModeloRedefinirSenha   = "redefinir_senha"
+	ModeloVerificarEmail   = "verificar_email"
+	ModeloEstoqueBaixo     = "estoque_baixo"
+)
+
+const (
+	duracaoRedefinicao = time.Hour
+	duracaoVerificacao = 48 * time.Hour
+)
+
+var (
+	ErrRedefinicaoInvalida = errors.New("Link de redefinição inválido ou expirado. Peça um novo link.")
+	ErrVerificacaoInvalida = errors.New("Link de confirmação inválido ou expirado. Peça um novo link em Minha conta.")
+)
+
+// Email na coleção "emails", a fila que o Server_Mantenedor esvazia com novas tentativas em caso de falha
+type EmailFila struct {
+	Modelo string
+	// Destinatários; vazio manda para a equipe da loja
+	Para             []string
+	Dados            map[string]interface{}
+	Status           string
+	Tentativas       int
+	ProximaTentativa time.Time
+	UltimoErro       string
+	CriadoEm         time.Time
+	EnviadoEm        time.Time
+}
+
+// Pedido de redefinição de senha, guardado na coleção "redefinicoes_senha" com o hash do token como ID
+type RedefinicaoSenha struct {
+	Email    string
+	ExpiraEm time.Time
+	Usada    bool
+}
+
+// Confirmação do e-mail de uma conta, guardada na coleção "verificacoes_email" com o hash do token como ID
+type VerificacaoEmail struct {
+	Email    string
+	ExpiraEm time.Time
+	Usada    bool
+}
+
+type RedefinirSenhaPageData struct {
+	PageTitle string
+	Token     string
+	Erro      string
+	Mensagem  string
+}
+
+func enfileirarEmail(firestoreClient *FirestoreClient, modelo string, para []string, dados map[string]interface{}) error {
+	agora := time.Now()
+	_, _, err := firestoreClient.Client.Collection("emails").Add(firestoreClient.Ctx, EmailFila{
+		Modelo:           modelo,
+		Para:             para,
+		Dados:            dados,
+		Status:           "pendente",
+		ProximaTentativa: agora,
+		CriadoEm:         agora,
+	})
+	return err
+}
+
+// Endereço configurado da loja, para os links dos emails
+func urlLoja() string {
+	return strings.TrimRight(config.URLLoja, "/")
+}
+
+// Resumo do pedido para o email de confirmação, com as linhas já com desconto
+func emailPedidoConfirmado(codigo int, token string, itens []ItemComDesconto, base string) map[string]interface{} {
+	linhas := make([]map[string]interface{}, 0, len(itens))
+	total := 0.0
+	for _, item := range itens {
+		linhas = append(linhas, map[string]interface{}{
+			"NomeProd":   item.NomeProduto,
+			"Quantidade": item.QuantidadeProd,
+			"Valor":      item.ValorLiquido(),
+		})
+		total += item.ValorLiquido()
+	}
+	return map[string]interface{}{
+		"Codigo":         codigo,
+		"Itens":          linhas,
+		"Total":          arredondarCentavos(total),
+		"URLConfirmacao": fmt.Sprintf("%s/pedido/confirmacao?codigo=%d&token=%s", base, codigo, token),
+	}
+}
+
+// Indica se a venda da quantidade leva o estoque ao mínimo; só a venda que cruza o limite avisa a equipe
+func (p Produto) atingeEstoqueMinimo(quantidade int) bool {
+	return p.ControlaEstoque && p.EstoqueMinimo > 0 && p.Estoque > p.EstoqueMinimo && p.Estoque-quantidade <= p.EstoqueMinimo
+}
+
+func emailEstoqueBaixo(produto Produto, restante int) map[string]interface{} {
+	return map[string]interface{}{
+		"CodigoProd":    produto.ID,
+		"Produto":       produto.NomeProduto,
+		"Estoque":       restante,
+		"EstoqueMinimo": produto.EstoqueMinimo,
+	}
+}
+
+// Token aleatório dos links enviados por email
+func gerarToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// Só o hash do token fica no Firestore; o token em si vai apenas no link do email
+func hashToken(token string) string {
+	soma := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(soma[:])
+}
+
+func renderizarRedefinicao(w http.ResponseWriter, arquivo string, data RedefinirSenhaPageData) {
+	tmpl := template.Must(template.ParseFiles("template/" + arquivo))
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to execute template: %s", err.Error()), http.StatusInternalServerError)
+	}
+}
+
+// Pede o link de redefinição de senha. A resposta é a mesma exista ou não a conta, para não revelar
+// quais e-mails estão cadastrados.
+func esqueciSenhaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		renderizarRedefinicao(w, "esqueci_senha.html", RedefinirSenhaPageData{PageTitle: "Coffee Shop - Esqueci minha senha", Erro: r.URL.Query().Get("erro")})
+		return
+	}
+
+	email, err := normalizarEmail(r.FormValue("email"))
+	if err != nil {
+		redirecionarComErro(w, r, "/esqueci_senha", err.Error())
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente, err := buscarCliente(firestoreClient, email)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch customer from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if cliente != nil {
+		token, err := gerarToken()
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+		redefinicao := RedefinicaoSenha{Email: email, ExpiraEm: time.Now().Add(duracaoRedefinicao)}
+		if _, err := firestoreClient.Client.Collection("redefinicoes_senha").Doc(hashToken(token)).Set(firestoreClient.Ctx, redefinicao); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to save password reset in Firestore: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		err = enfileirarEmail(firestoreClient, ModeloRedefinirSenha, []string{email}, map[string]interface{}{
+			"URL":      fmt.Sprintf("%s/redefinir_senha?token=%s", urlLoja(), token),
+			"ExpiraEm": redefinicao.ExpiraEm.In(fusoLoja()).Format("02/01/2006 15:04"),
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to queue email in Firestore: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	renderizarRedefinicao(w, "esqueci_senha.html", RedefinirSenhaPageData{
+		PageTitle: "Coffee Shop - Esqueci minha senha",
+		Mensagem:  "Se houver uma conta com este e-mail, enviaremos um link para redefinir a senha.",
+	})
+}
+
+// Troca a senha com o token do link. O token vale uma vez e, na troca, as sessões abertas da conta são encerradas.
+func redefinirSenhaHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if r.Method != http.MethodPost {
+		renderizarRedefinicao(w, "redefinir_senha.html", RedefinirSenhaPageData{PageTitle: "Coffee Shop - Redefinir senha", Token: token})
+		return
+	}
+
+	senha := r.FormValue("senha")
+	if len(senha) < tamanhoSenha {
+		renderizarRedefinicao(w, "redefinir_senha.html", RedefinirSenhaPageData{
+			PageTitle: "Coffee Shop - Redefinir senha",
+			Token:     token,
+			Erro:      fmt.Sprintf("A senha deve ter pelo menos %d caracteres", tamanhoSenha),
+		})
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(senha), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	// Marca o token como usado e troca a senha na mesma transação, para o link não valer duas vezes
+	var email string
+	redefinicaoRef := firestoreClient.Client.Collection("redefinicoes_senha").Doc(hashToken(token))
+	err = firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(redefinicaoRef)
+		if status.Code(err) == codes.NotFound {
+			return ErrRedefinicaoInvalida
+		}
+		if err != nil {
+			return err
+		}
+		var redefinicao RedefinicaoSenha
+		if err := snapshot.DataTo(&redefinicao); err != nil {
+			return err
+		}
+		if redefinicao.Usada || time.Now().After(redefinicao.ExpiraEm) {
+			return ErrRedefinicaoInvalida
+		}
+		email = redefinicao.Email
+		clienteRef := firestoreClient.Client.Collection("clientes").Doc(email)
+		if err := tx.Update(redefinicaoRef, []firestore.Update{{Path: "Usada", Value: true}}); err != nil {
+			return err
+		}
+		// O link chegou à caixa do e-mail, o que também confirma o endereço
+		return tx.Update(clienteRef, []firestore.Update{
+			{Path: "SenhaHash", Value: string(hash)},
+			{Path: "EmailVerificado", Value: true},
+		})
+	})
+	if err == ErrRedefinicaoInvalida {
+		renderizarRedefinicao(w, "redefinir_senha.html", RedefinirSenhaPageData{
+			PageTitle: "Coffee Shop - Redefinir senha",
+			Erro:      err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to reset password in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	// Quem pediu a troca pode não ser quem está logado em outro aparelho
+	sessoes, err := firestoreClient.Client.Collection("sessoes").Where("Email", "==", email).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		log.Printf("Failed to fetch sessions of %s: %v", email, err)
+	}
+	for _, doc := range sessoes {
+		if _, err := doc.Ref.Delete(firestoreClient.Ctx); err != nil {
+			log.Printf("Failed to delete session: %v", err)
+		}
+	}
+
+	if err := criarSessao(w, firestoreClient, email); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create session: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/minha_conta", http.StatusSeeOther)
+}
+
+// Grava o token de confirmação e enfileira o email com o link
+func enviarVerificacaoEmail(firestoreClient *FirestoreClient, r *http.Request, email string) error {
+	token, err := gerarToken()
+	if err != nil {
+		return err
+	}
+	verificacao := VerificacaoEmail{Email: email, ExpiraEm: time.Now().Add(duracaoVerificacao)}
+	if _, err := firestoreClient.Client.Collection("verificacoes_email").Doc(hashToken(token)).Set(firestoreClient.Ctx, verificacao); err != nil {
+		return err
+	}
+	return enfileirarEmail(firestoreClient, ModeloVerificarEmail, []string{email}, map[string]interface{}{
+		"URL":      fmt.Sprintf("%s/verificar_email?token=%s", urlLoja(), token),
+		"ExpiraEm": verificacao.ExpiraEm.In(fusoLoja()).Format("02/01/2006 15:04"),
+	})
+}
+
+// Confirma o e-mail da conta pelo link enviado no cadastro. O token vale uma vez.
+func verificarEmailHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	verificacaoRef := firestoreClient.Client.Collection("verificacoes_email").Doc(hashToken(r.FormValue("token")))
+	err = firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(verificacaoRef)
+		if err != nil {
+			if status.Code(err) == codes.NotFound {
+				return ErrVerificacaoInvalida
+			}
+			return err
+		}
+		var verificacao VerificacaoEmail
+		if err := snapshot.DataTo(&verificacao); err != nil {
+			return err
+		}
+		if verificacao.Usada || time.Now().After(verificacao.ExpiraEm) {
+			return ErrVerificacaoInvalida
+		}
+		if err := tx.Update(verificacaoRef, []firestore.Update{{Path: "Usada", Value: true}}); err != nil {
+			return err
+		}
+		clienteRef := firestoreClient.Client.Collection("clientes").Doc(verificacao.Email)
+		return tx.Update(clienteRef, []firestore.Update{{Path: "EmailVerificado", Value: true}})
+	})
+	if err == ErrVerificacaoInvalida {
+		redirecionarComErro(w, r, "/minha_conta", err.Error())
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to verify email in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/minha_conta?mensagem="+url.QueryEscape("E-mail confirmado"), http.StatusSeeOther)
+}
+
+// Envia de novo o link de confirmação para o cliente logado
+func reenviarVerificacaoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil || cliente == nil {
+		http.Redirect(w, r, "/entrar", http.StatusSeeOther)
+		return
+	}
+	if cliente.EmailVerificado {
+		http.Redirect(w, r, "/minha_conta", http.StatusSeeOther)
+		return
+	}
+	if err := enviarVerificacaoEmail(firestoreClient, r, cliente.Email); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to queue email in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/minha_conta?mensagem="+url.QueryEscape("Enviamos um novo link de confirmação para "+cliente.Email), http.StatusSeeOther)
+}
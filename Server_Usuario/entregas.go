@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Documento em "configuracoes" com as zonas de entrega, editadas no Server_Mantenedor
+const documentoRegrasEntrega = "entrega"
+
+// Código de produto da linha da taxa de entrega nas transações; não existe no catálogo
+const CodigoTaxaEntrega = -1
+
+// Situações de uma entrega, as mesmas do Server_Mantenedor
+const (
+	EntregaPendente   = "pendente"
+	EntregaDespachada = "despachada"
+	EntregaEntregue   = "entregue"
+	EntregaCancelada  = "cancelada"
+)
+
+// Faixa de CEPs atendida, com os dois extremos em 8 dígitos
+type ZonaEntrega struct {
+	Nome         string
+	CEPInicial   string
+	CEPFinal     string
+	Taxa         float64
+	PedidoMinimo float64
+}
+
+type RegrasEntrega struct {
+	Ativo bool
+	Zonas []ZonaEntrega
+}
+
+// Endereço informado no carrinho
+type EnderecoEntrega struct {
+	Destinatario string
+	Telefone     string
+	CEP          string
+	Logradouro   string
+	Numero       string
+	Complemento  string
+	Bairro       string
+	Cidade       string
+}
+
+// Entrega de um pedido, na coleção "entregas" com o código do pedido como ID do documento
+type Entrega struct {
+	Codigo       int
+	ClienteEmail string
+	Endereco     EnderecoEntrega
+	Zona         string
+	Taxa         float64
+	Status       string
+	CriadaEm     time.Time
+	DespachadaEm time.Time
+	EntregueEm   time.Time
+}
+
+// Erro de entrega mostrado ao cliente, como um CEP fora das zonas atendidas
+type EntregaInvalidaError struct {
+	Mensagem string
+}
+
+func (e *EntregaInvalidaError) Error() string {
+	return e.Mensagem
+}
+
+func entregaInvalida(formato string, args ...interface{}) error {
+	return &EntregaInvalidaError{Mensagem: fmt.Sprintf(formato, args...)}
+}
+
+// Só os dígitos do CEP, que precisa ter 8
+func normalizarCEP(cep string) (string, error) {
+	var digitos strings.Builder
+	for _, c := range cep {
+		if c >= '0' && c <= '9' {
+			digitos.WriteRune(c)
+		} else if c != '-' && c != '.' && c != ' ' {
+			return "", entregaInvalida("CEP inválido")
+		}
+	}
+	if digitos.Len() != 8 {
+		return "", entregaInvalida("CEP inválido")
+	}
+	return digitos.String(), nil
+}
+
+func (e EnderecoEntrega) CEPFormatado() string {
+	if len(e.CEP) != 8 {
+		return e.CEP
+	}
+	return e.CEP[:5] + "-" + e.CEP[5:]
+}
+
+func (e EnderecoEntrega) validar() error {
+	if _, err := normalizarCEP(e.CEP); err != nil {
+		return err
+	}
+	if e.Destinatario == "" || e.Logradouro == "" || e.Numero == "" || e.Bairro == "" || e.Cidade == "" {
+		return entregaInvalida("Preencha destinatário, rua, número, bairro e cidade para a entrega")
+	}
+	return nil
+}
+
+// Sem documento a entrega fica desligada e a loja só trabalha com retirada
+func buscarRegrasEntrega(firestoreClient *FirestoreClient) (RegrasEntrega, error) {
+	var regras RegrasEntrega
+	snapshot, err := firestoreClient.Client.Collection("configuracoes").Doc(documentoRegrasEntrega).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return regras, nil
+	}
+	if err != nil {
+		return regras, err
+	}
+	err = snapshot.DataTo(&regras)
+	return regras, err
+}
+
+// Zona que atende o CEP, procurada só na tabela configurada, sem consulta externa.
+// Como todos os CEPs têm 8 dígitos, a comparação de texto segue a ordem numérica.
+func (r RegrasEntrega) zona(cep string) (ZonaEntrega, bool) {
+	for _, zona := range r.Zonas {
+		if cep >= zona.CEPInicial && cep <= zona.CEPFinal {
+			return zona, true
+		}
+	}
+	return ZonaEntrega{}, false
+}
+
+// Zona do endereço, conferindo o pedido mínimo contra o valor dos produtos já com descontos
+func (r RegrasEntrega) calcular(endereco EnderecoEntrega, valorProdutos float64) (ZonaEntrega, error) {
+	if !r.Ativo {
+		return ZonaEntrega{}, entregaInvalida("A entrega não está disponível no momento")
+	}
+	if err := endereco.validar(); err != nil {
+		return ZonaEntrega{}, err
+	}
+	zona, ok := r.zona(endereco.CEP)
+	if !ok {
+		return ZonaEntrega{}, entregaInvalida("Ainda não entregamos no CEP %s", endereco.CEPFormatado())
+	}
+	if valorProdutos < zona.PedidoMinimo {
+		return zona, entregaInvalida("O pedido mínimo para entrega em %s é R$%.2f", zona.Nome, zona.PedidoMinimo)
+	}
+	return zona, nil
+}
+
+// Inclui a taxa da zona como uma linha do pedido, sem descontos, para que entre no total,
+// no rateio do vale-presente e nos estornos como as demais linhas
+func adicionarTaxaEntrega(resultado *ResultadoDescontos, zona ZonaEntrega) {
+	if zona.Taxa <= 0 {
+		return
+	}
+	resultado.Itens = append(resultado.Itens, ItemComDesconto{CarrinhoItem: CarrinhoItem{
+		CodigoProduto:  CodigoTaxaEntrega,
+		NomeProduto:    "Taxa de entrega",
+		QuantidadeProd: 1,
+		ValorVenda:     zona.Taxa,
+		ValorTransacao: zona.Taxa,
+	}})
+	resultado.Subtotal = arredondarCentavos(resultado.Subtotal + zona.Taxa)
+	resultado.totalizar()
+}
+
+// Guarda o endereço de entrega do carrinho; modo "retirada" volta para a retirada na loja
+func definirEntregaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	carrinho, err := carrinhoDaRequisicao(firestoreClient, w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch cart from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("modo") == "retirada" {
+		carrinho.Entrega = nil
+		if err := salvarCarrinho(firestoreClient, carrinho); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to save cart in Firestore: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/carrinho", http.StatusSeeOther)
+		return
+	}
+	endereco := EnderecoEntrega{
+		Destinatario: strings.TrimSpace(r.FormValue("destinatario")),
+		Telefone:     strings.TrimSpace(r.FormValue("telefone")),
+		CEP:          strings.TrimSpace(r.FormValue("cep")),
+		Logradouro:   strings.TrimSpace(r.FormValue("logradouro")),
+		Numero:       strings.TrimSpace(r.FormValue("numero")),
+		Complemento:  strings.TrimSpace(r.FormValue("complemento")),
+		Bairro:       strings.TrimSpace(r.FormValue("bairro")),
+		Cidade:       strings.TrimSpace(r.FormValue("cidade")),
+	}
+	// Um CEP inválido fica como digitado, e o carrinho mostra o erro
+	if cep, err := normalizarCEP(endereco.CEP); err == nil {
+		endereco.CEP = cep
+	}
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch session from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	carrinho.Entrega = &endereco
+	carrinho.ClienteEmail = ""
+	if cliente != nil {
+		carrinho.ClienteEmail = cliente.Email
+	}
+	carrinho.Mesa = 0
+	if err := salvarCarrinho(firestoreClient, carrinho); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save cart in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/carrinho", http.StatusSeeOther)
+}
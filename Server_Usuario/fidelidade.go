@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Tipos de lançamento no extrato de pontos, os mesmos do Server_Mantenedor
+const (
+	PontosGanho          = "ganho"
+	PontosResgate        = "resgate"
+	PontosEstornoGanho   = "estorno_ganho"
+	PontosEstornoResgate = "estorno_resgate"
+)
+
+// Documento em "configuracoes" com as regras do programa, editadas no Server_Mantenedor
+const documentoRegrasFidelidade = "fidelidade"
+
+type RegrasFidelidade struct {
+	Ativo         bool
+	PontosPorReal float64
+	ValorPonto    float64
+	ResgateMinimo int
+	Recompensas   []RecompensaFidelidade
+}
+
+type RecompensaFidelidade struct {
+	CodigoProd int
+	NomeProd   string
+	Pontos     int
+}
+
+// Lançamento do extrato de pontos, na coleção "pontos"
+type LancamentoPontos struct {
+	ClienteEmail    string
+	Tipo            string
+	Pontos          int
+	CodigoTransacao int
+	Descricao       string
+	Data            time.Time
+}
+
+// Pontos que o cliente escolheu usar no carrinho: como desconto e/ou trocados por um produto
+type ResgatePontos struct {
+	Pontos     int
+	Recompensa int
+	// Conta que escolheu o resgate; só ela pode usá-lo
+	ClienteEmail string
+}
+
+// Erro de resgate mostrado ao cliente; o carrinho continua valendo sem os pontos
+type ResgateInvalidoError struct {
+	Mensagem string
+}
+
+type PontosPageData struct {
+	PageTitle   string
+	Cliente     Cliente
+	Regras      RegrasFidelidade
+	Lancamentos []LancamentoPontos
+}
+
+// Valor do saldo em descontos, pelas regras atuais
+func (d PontosPageData) ValorSaldo() float64 {
+	return arredondarCentavos(float64(d.Cliente.SaldoPontos) * d.Regras.ValorPonto)
+}
+
+func (e *ResgateInvalidoError) Error() string {
+	return e.Mensagem
+}
+
+func resgateInvalido(formato string, args ...interface{}) error {
+	return &ResgateInvalidoError{Mensagem: fmt.Sprintf(formato, args...)}
+}
+
+func (r RegrasFidelidade) recompensa(codigoProd int) (RecompensaFidelidade, bool) {
+	for _, recompensa := range r.Recompensas {
+		if recompensa.CodigoProd == codigoProd {
+			return recompensa, true
+		}
+	}
+	return RecompensaFidelidade{}, false
+}
+
+// Pontos ganhos com um pedido pago
+func (r RegrasFidelidade) pontosGanhos(valorPago float64) int {
+	if !r.Ativo || valorPago <= 0 {
+		return 0
+	}
+	return int(math.Floor(valorPago*r.PontosPorReal + 1e-9))
+}
+
+func buscarRegrasFidelidade(firestoreClient *FirestoreClient) (RegrasFidelidade, error) {
+	var regras RegrasFidelidade
+	snapshot, err := firestoreClient.Client.Collection("configuracoes").Doc(documentoRegrasFidelidade).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return regras, nil
+	}
+	if err != nil {
+		return regras, err
+	}
+	err = snapshot.DataTo(&regras)
+	return regras, err
+}
+
+// Aplica o resgate depois dos demais descontos e devolve quantos pontos ele consome.
+// Tudo é conferido antes de mexer no resultado, para que um resgate inválido não o altere.
+func aplicarResgate(resultado *ResultadoDescontos, regras RegrasFidelidade, saldo int, resgate ResgatePontos) (int, error) {
+	if resgate.Pontos == 0 && resgate.Recompensa == 0 {
+		return 0, nil
+	}
+	if !regras.Ativo {
+		return 0, resgateInvalido("O programa de fidelidade não está ativo")
+	}
+
+	usados := 0
+	var recompensa RecompensaFidelidade
+	if resgate.Recompensa != 0 {
+		var ok bool
+		if recompensa, ok = regras.recompensa(resgate.Recompensa); !ok {
+			return 0, resgateInvalido("Esta recompensa não está mais disponível")
+		}
+		presente := false
+		for _, item := range resultado.Itens {
+			presente = presente || (item.CodigoProduto == recompensa.CodigoProd && item.QuantidadeProd > 0 && !item.ValePresente)
+		}
+		if !presente {
+			return 0, resgateInvalido("Adicione %s ao carrinho para trocá-lo por pontos", recompensa.NomeProd)
+		}
+		usados += recompensa.Pontos
+	}
+	if resgate.Pontos < 0 || (resgate.Pontos > 0 && resgate.Pontos < regras.ResgateMinimo) {
+		return 0, resgateInvalido("O resgate mínimo é de %d pontos", regras.ResgateMinimo)
+	}
+	if usados+resgate.Pontos > saldo {
+		return 0, resgateInvalido("Saldo insuficiente: você tem %d pontos", saldo)
+	}
+
+	if resgate.Recompensa != 0 {
+		desconto := DescontoAplicado{Origem: "pontos", Codigo: strconv.Itoa(recompensa.CodigoProd), Descricao: fmt.Sprintf("%s por %d pontos", recompensa.NomeProd, recompensa.Pontos)}
+		resultado.descontarUnidade(desconto, recompensa.CodigoProd)
+	}
+	if resgate.Pontos > 0 && regras.ValorPonto > 0 {
+		// Os pontos não passam do valor que resta a pagar; o excedente fica no saldo
+		valor := math.Min(float64(resgate.Pontos)*regras.ValorPonto, resultado.descontavel())
+		pontos := int(math.Ceil(valor/regras.ValorPonto - 1e-9))
+		valor = arredondarCentavos(math.Min(float64(pontos)*regras.ValorPonto, valor))
+		if pontos > 0 {
+			resultado.ratear(DescontoAplicado{Origem: "pontos", Codigo: "desconto", Descricao: fmt.Sprintf("%d pontos", pontos)}, valor)
+			usados += pontos
+		}
+	}
+	resultado.totalizar()
+	return usados, nil
+}
+
+// Guarda os pontos que o cliente quer usar no carrinho; zero nos dois campos desfaz o resgate
+func usarPontosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	pontos, _ := strconv.Atoi(r.FormValue("pontos"))
+	recompensa, _ := strconv.Atoi(r.FormValue("recompensa"))
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil || cliente == nil {
+		http.Redirect(w, r, "/entrar", http.StatusSeeOther)
+		return
+	}
+	carrinho, err := carrinhoDaRequisicao(firestoreClient, w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch cart from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	carrinho.Resgate = ResgatePontos{Pontos: pontos, Recompensa: recompensa, ClienteEmail: cliente.Email}
+	if err := salvarCarrinho(firestoreClient, carrinho); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save cart in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/carrinho", http.StatusSeeOther)
+}
+
+// Saldo e extrato de pontos do cliente logado
+func pontosHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch session from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if cliente == nil {
+		http.Redirect(w, r, "/entrar", http.StatusSeeOther)
+		return
+	}
+
+	regras, err := buscarRegrasFidelidade(firestoreClient)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch loyalty rules from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	docs, err := firestoreClient.Client.Collection("pontos").Where("ClienteEmail", "==", cliente.Email).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch points from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	var lancamentos []LancamentoPontos
+	for _, doc := range docs {
+		var l LancamentoPontos
+		if err := doc.DataTo(&l); err != nil {
+			http.Error(w, "Failed to parse points data", http.StatusInternalServerError)
+			return
+		}
+		lancamentos = append(lancamentos, l)
+	}
+	sort.Slice(lancamentos, func(i, j int) bool { return lancamentos[i].Data.After(lancamentos[j].Data) })
+
+	tmpl := template.Must(template.ParseFiles("template/pontos.html"))
+	data := PontosPageData{
+		PageTitle:   "Coffee Shop - Meus pontos",
+		Cliente:     *cliente,
+		Regras:      regras,
+		Lancamentos: lancamentos,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to execute template: %s", err.Error()), http.StatusInternalServerError)
+	}
+}
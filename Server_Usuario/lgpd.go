@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Tipos e situações das solicitações do titular dos dados (LGPD), atendidas pelo Server_Mantenedor
+const (
+	SolicitacaoExportacao = "exportacao"
+	SolicitacaoExclusao   = "exclusao"
+
+	SolicitacaoPendente  = "pendente"
+	SolicitacaoConcluida = "concluida"
+	SolicitacaoRecusada  = "recusada"
+)
+
+// Solicitação registrada na coleção "solicitacoes_lgpd". A exportação pelo site é atendida na hora;
+// a exclusão fica pendente até a equipe anonimizar os dados.
+type SolicitacaoLGPD struct {
+	Email  string
+	Tipo   string
+	Status string
+	// "site" quando feita pelo cliente, "equipe" quando registrada no Server_Mantenedor
+	Origem      string
+	Observacao  string
+	CriadaEm    time.Time
+	ConcluidaEm time.Time
+}
+
+type DadosPessoaisPageData struct {
+	PageTitle    string
+	Cliente      Cliente
+	Solicitacoes []SolicitacaoLGPD
+	Erro         string
+	Mensagem     string
+}
+
+// Coleção com dados do titular e o campo que guarda o e-mail dele. A lista, os campos ocultos e o percurso
+// dos documentos são iguais no Server_Usuario e no Server_Mantenedor; TestLGPDIgualNosServidores confere.
+type colecaoTitular struct {
+	Colecao string
+	Campo   string
+}
+
+// Coleções que usam o próprio e-mail do titular como ID do documento
+var documentosPorEmail = []string{"clientes", "newsletter"}
+
+// As transações vêm antes das entregas, que dependem delas para saber quais pedidos são da conta
+var colecoesTitular = []colecaoTitular{
+	{"transacoes", "ClienteEmail"},
+	{"transacoes", "EmailContato"},
+	{"entregas", "ClienteEmail"},
+	{"assinaturas", "ClienteEmail"},
+	{"pontos", "ClienteEmail"},
+	{"carrinhos", "ClienteEmail"},
+	{"consentimentos", "Email"},
+	{"tickets", "EmailContato"},
+	{"solicitacoes_lgpd", "Email"},
+}
+
+// Campos que são credenciais, e não dados do titular, deixados de fora da exportação
+var camposOcultosTitular = map[string][]string{
+	"clientes":   {"SenhaHash"},
+	"newsletter": {"Token"},
+}
+
+// Percorre os documentos do titular no Firestore, sem os campos ocultos. O mesmo documento pode aparecer por
+// mais de um campo, como o pedido com ClienteEmail e EmailContato, e é visitado uma vez só.
+func documentosTitular(firestoreClient *FirestoreClient, email string, visitar func(colecao string, dados map[string]interface{})) error {
+	dadosDocumento := func(colecao string, snapshot *firestore.DocumentSnapshot) map[string]interface{} {
+		dados := snapshot.Data()
+		for _, campo := range camposOcultosTitular[colecao] {
+			delete(dados, campo)
+		}
+		return dados
+	}
+
+	for _, colecao := range documentosPorEmail {
+		snapshot, err := firestoreClient.Client.Collection(colecao).Doc(email).Get(firestoreClient.Ctx)
+		if status.Code(err) == codes.NotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		visitar(colecao, dadosDocumento(colecao, snapshot))
+	}
+
+	vistos := make(map[string]bool)
+	for _, c := range colecoesTitular {
+		docs, err := firestoreClient.Client.Collection(c.Colecao).Where(c.Campo, "==", email).Documents(firestoreClient.Ctx).GetAll()
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if !vistos[doc.Ref.Path] {
+				vistos[doc.Ref.Path] = true
+				visitar(c.Colecao, dadosDocumento(c.Colecao, doc))
+			}
+		}
+	}
+	return nil
+}
+
+// Indica se o pedido, a entrega ou o ticket foi feito pela própria conta, e não por quem só informou o e-mail.
+// Os códigos dos pedidos da conta são guardados ao passar pelas transações, lidas antes das entregas.
+func registroDaConta(colecao string, dados map[string]interface{}, email string, pedidos map[int64]bool) bool {
+	switch colecao {
+	case "transacoes":
+		if dados["ClienteEmail"] != email {
+			return false
+		}
+		if codigo, ok := dados["CodigoTransacao"].(int64); ok {
+			pedidos[codigo] = true
+		}
+	case "entregas":
+		codigo, _ := dados["Codigo"].(int64)
+		return pedidos[codigo]
+	case "tickets":
+		// Abertos pela equipe com o e-mail informado no contato, sem ligação com a conta
+		return false
+	}
+	return true
+}
+
+// Reúne todos os documentos do titular, agrupados por coleção. Sem o e-mail verificado, a conta ainda não
+// provou ser dona dele, então os pedidos e entregas de convidado e os tickets com o mesmo e-mail ficam de fora.
+// Os tickets só aparecem quando o Server_Mantenedor os guarda no Firestore, e não no SQLite.
+func exportarDadosTitular(firestoreClient *FirestoreClient, email string, verificado bool) (map[string][]map[string]interface{}, error) {
+	dados := make(map[string][]map[string]interface{})
+	pedidosConta := make(map[int64]bool)
+	err := documentosTitular(firestoreClient, email, func(colecao string, documento map[string]interface{}) {
+		if verificado || registroDaConta(colecao, documento, email, pedidosConta) {
+			dados[colecao] = append(dados[colecao], documento)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dados, nil
+}
+
+func buscarSolicitacoesLGPD(firestoreClient *FirestoreClient, email string) ([]SolicitacaoLGPD, error) {
+	docs, err := firestoreClient.Client.Collection("solicitacoes_lgpd").Where("Email", "==", email).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	solicitacoes := make([]SolicitacaoLGPD, 0, len(docs))
+	for _, doc := range docs {
+		var s SolicitacaoLGPD
+		if err := doc.DataTo(&s); err != nil {
+			return nil, err
+		}
+		s.CriadaEm = s.CriadaEm.In(fusoLoja())
+		s.ConcluidaEm = s.ConcluidaEm.In(fusoLoja())
+		solicitacoes = append(solicitacoes, s)
+	}
+	sort.Slice(solicitacoes, func(i, j int) bool { return solicitacoes[i].CriadaEm.After(solicitacoes[j].CriadaEm) })
+	return solicitacoes, nil
+}
+
+// Página "Meus dados", com a exportação, o pedido de exclusão e o andamento das solicitações
+func meusDadosHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch session from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if cliente == nil {
+		http.Redirect(w, r, "/entrar", http.StatusSeeOther)
+		return
+	}
+
+	solicitacoes, err := buscarSolicitacoesLGPD(firestoreClient, cliente.Email)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch data requests from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	tmpl := template.Must(template.ParseFiles("template/meus_dados.html"))
+	err = tmpl.Execute(w, DadosPessoaisPageData{
+		PageTitle:    "Coffee Shop - Meus dados",
+		Cliente:      *cliente,
+		Solicitacoes: solicitacoes,
+		Erro:         r.URL.Query().Get("erro"),
+		Mensagem:     r.URL.Query().Get("mensagem"),
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to execute template: %s", err.Error()), http.StatusInternalServerError)
+	}
+}
+
+// Baixa em JSON todos os dados guardados sobre o cliente logado
+func exportarMeusDadosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch session from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if cliente == nil {
+		http.Redirect(w, r, "/entrar", http.StatusSeeOther)
+		return
+	}
+
+	dados, err := exportarDadosTitular(firestoreClient, cliente.Email, cliente.EmailVerificado)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch personal data from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	agora := time.Now()
+	conteudo, err := json.MarshalIndent(map[string]interface{}{
+		"Email":    cliente.Email,
+		"GeradoEm": agora,
+		"Dados":    dados,
+	}, "", "  ")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode personal data: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	_, _, err = firestoreClient.Client.Collection("solicitacoes_lgpd").Add(firestoreClient.Ctx, SolicitacaoLGPD{
+		Email:       cliente.Email,
+		Tipo:        SolicitacaoExportacao,
+		Status:      SolicitacaoConcluida,
+		Origem:      "site",
+		CriadaEm:    agora,
+		ConcluidaEm: agora,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save data request in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="meus_dados_%s.json"`, agora.In(fusoLoja()).Format("20060102")))
+	w.Write(conteudo)
+}
+
+// Pede a exclusão da conta, confirmada com a senha. Os pedidos continuam guardados por exigência fiscal,
+// sem os dados pessoais; a equipe conclui a anonimização no Server_Mantenedor.
+func excluirMeusDadosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch session from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if cliente == nil {
+		http.Redirect(w, r, "/entrar", http.StatusSeeOther)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(cliente.SenhaHash), []byte(r.FormValue("senha"))) != nil {
+		redirecionarComErro(w, r, "/minha_conta/dados", "Senha incorreta")
+		return
+	}
+
+	solicitacoes, err := buscarSolicitacoesLGPD(firestoreClient, cliente.Email)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch data requests from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	for _, s := range solicitacoes {
+		if s.Tipo == SolicitacaoExclusao && s.Status == SolicitacaoPendente {
+			redirecionarComErro(w, r, "/minha_conta/dados", "Já existe um pedido de exclusão em andamento")
+			return
+		}
+	}
+
+	_, _, err = firestoreClient.Client.Collection("solicitacoes_lgpd").Add(firestoreClient.Ctx, SolicitacaoLGPD{
+		Email:      cliente.Email,
+		Tipo:       SolicitacaoExclusao,
+		Status:     SolicitacaoPendente,
+		Origem:     "site",
+		Observacao: r.FormValue("motivo"),
+		CriadaEm:   time.Now(),
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save data request in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/minha_conta/dados?mensagem="+url.QueryEscape("Pedido de exclusão registrado. A equipe conclui a exclusão em até 15 dias; depois disso, a conta deixa de existir."), http.StatusSeeOther)
+}
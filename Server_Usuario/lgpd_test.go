@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+// Sem o e-mail verificado, a exportação leva só o que a conta fez
+func TestRegistroDaConta(t *testing.T) {
+	const email = "ana@example.com"
+	pedidos := make(map[int64]bool)
+	casos := []struct {
+		nome     string
+		colecao  string
+		dados    map[string]interface{}
+		esperado bool
+	}{
+		{"pedido da conta", "transacoes", map[string]interface{}{"ClienteEmail": email, "CodigoTransacao": int64(7)}, true},
+		{"pedido de convidado com o mesmo e-mail", "transacoes", map[string]interface{}{"EmailContato": email, "CodigoTransacao": int64(8)}, false},
+		{"entrega do pedido da conta", "entregas", map[string]interface{}{"ClienteEmail": email, "Codigo": int64(7)}, true},
+		{"entrega do pedido de convidado", "entregas", map[string]interface{}{"ClienteEmail": email, "Codigo": int64(8)}, false},
+		{"ticket aberto com o e-mail", "tickets", map[string]interface{}{"EmailContato": email}, false},
+		{"carrinho da conta", "carrinhos", map[string]interface{}{"ClienteEmail": email}, true},
+		{"pontos", "pontos", map[string]interface{}{"ClienteEmail": email}, true},
+	}
+	// Em ordem: as transações passam antes das entregas, como no percurso de documentosTitular
+	for _, caso := range casos {
+		if obtido := registroDaConta(caso.colecao, caso.dados, email, pedidos); obtido != caso.esperado {
+			t.Errorf("%s: %v, esperava %v", caso.nome, obtido, caso.esperado)
+		}
+	}
+}
+
+// As entregas dependem das transações já percorridas
+func TestColecoesTitularOrdem(t *testing.T) {
+	posicao := make(map[string]int)
+	for i, c := range colecoesTitular {
+		if _, ok := posicao[c.Colecao]; !ok {
+			posicao[c.Colecao] = i
+		}
+	}
+	for _, colecao := range []string{"transacoes", "entregas", "carrinhos", "tickets"} {
+		if _, ok := posicao[colecao]; !ok {
+			t.Errorf("coleção %s fora da lista do titular", colecao)
+		}
+	}
+	if posicao["transacoes"] > posicao["entregas"] {
+		t.Error("entregas percorridas antes das transações")
+	}
+}
@@ -2,16 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/firestore"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type FirestoreClient struct {
@@ -20,10 +25,24 @@ type FirestoreClient struct {
 }
 
 type Produto struct {
-	ID          int
-	NomeProduto string
-	ValorCompra float64
-	ValorVenda  float64
+	ID              int
+	NomeProduto     string
+	ValorCompra     float64
+	ValorVenda      float64
+	ControlaEstoque bool
+	Estoque         int
+	// Abaixo ou igual a este estoque a equipe recebe um aviso por email; zero desativa o aviso
+	EstoqueMinimo int
+	ValePresente  bool
+	Assinavel     bool
+	// Dados fiscais mantidos pelo Server_Mantenedor
+	NCM            string
+	CFOP           string
+	CSOSN          string
+	CST            string
+	AliquotaICMS   float64
+	AliquotaPIS    float64
+	AliquotaCOFINS float64
 }
 
 type ProdutoPageData struct {
@@ -32,26 +51,89 @@ type ProdutoPageData struct {
 	Produto            Produto
 	ValorTotalCarrinho float64
 	Carrinho           []CarrinhoItem
+	Descontos          ResultadoDescontos
+	Cupom              string
+	ErroCupom          string
+	// Cliente logado, ou nil na compra como convidado
+	Cliente *Cliente
+	// Programa de fidelidade: resgate escolhido, pontos que ele consome e pontos que o pedido rende
+	Fidelidade   RegrasFidelidade
+	Resgate      ResgatePontos
+	PontosUsados int
+	PontosGanhos int
+	ErroPontos   string
+	// Vale-presente usado no pagamento e o que resta pagar pelos outros métodos
+	Vale           *ValePresente
+	ValorVale      float64
+	RestanteAPagar float64
+	ErroVale       string
+	// Retirada agendada: ligada pelo back office, com os horários que ainda têm vaga
+	RetiradaAtiva    bool
+	HorariosRetirada []HorarioRetirada
+	// Entrega: ligada pelo back office, com o endereço informado e a zona que o atende
+	EntregaAtiva bool
+	Entrega      *EnderecoEntrega
+	ZonaEntrega  *ZonaEntrega
+	ErroEntrega  string
+	// Mesa do salão, quando o cliente chegou pelo QR code
+	Mesa int
 }
 
 // Estrutura para os itens do carrinho
 type CarrinhoItem struct {
+	CodigoProduto  int
+	NomeProduto    string
+	QuantidadeProd int
+	ValorVenda     float64
+	ValorTransacao float64
+	// Vales-presente são vendidos pelo valor que carregam e ficam fora de promoções, cupons e pontos
+	ValePresente bool
+}
+
+// Registro de venda gravado na coleção "transacoes", com os campos lidos pelo Server_Mantenedor
+type Transacao struct {
 	CodigoTransacao int
-	CodigoProduto   int
-	NomeProduto     string
+	CodigoProd      int
+	NomeProd        string
 	QuantidadeProd  int
-	ValorVenda      float64
+	ValorUnitario   float64
+	CustoUnitario   float64
 	ValorTransacao  float64
+	MetodoPagamento string
+	DataTransacao   time.Time
+	// Turno de caixa aberto no momento da venda, se houver
+	TurnoID string
+	Tipo    string
+	// Descontos da linha; ValorTransacao já vem com eles abatidos
+	Desconto  float64
+	Descontos []DescontoAplicado
+	// Conta do cliente e e-mail informado na compra; um pedido de convidado só tem o e-mail
+	ClienteEmail string
+	EmailContato string
+	// Divisão do valor da linha entre métodos, quando parte foi paga com vale-presente
+	Pagamentos []PagamentoParcial
+	// Assinatura que gerou o pedido, nos pedidos criados pelo Server_Mantenedor
+	AssinaturaID string
+	// Início do horário de retirada escolhido no carrinho
+	RetiradaEm time.Time
+	// Mesa do salão, nos pedidos feitos pelo QR code
+	Mesa int
+	// Classificação e alíquotas do produto no momento da venda
+	DadosFiscais *DadosFiscais
+	// Hash do token que libera a confirmação e o comprovante a quem não está logado na conta do pedido
+	HashAcesso string
 }
 
-var carrinho []CarrinhoItem // Estrutura de dados para o carrinho
-
-func init() {
-	// Inicializa a variável carrinho, se necessário
-	carrinho = make([]CarrinhoItem, 0)
+// Métodos de pagamento oferecidos no carrinho
+var metodosPagamento = map[string]bool{
+	"card": true,
+	"cash": true,
+	"pix":  true,
 }
 
 func main() {
+	carregarConfig()
+
 	// Configuração do servidor de arquivos estáticos
 	fs := http.FileServer(http.Dir("template"))
 	http.Handle("/", fs)
@@ -63,8 +145,37 @@ func main() {
 	http.HandleFunc("/fale_conosco", faleConoscoHandler)
 	http.HandleFunc("/carrinho", carrinhoHandler)
 	http.HandleFunc("/adicionar-ao-carrinho", adicionarAoCarrinhoHandler)
+	http.HandleFunc("/aplicar_cupom", aplicarCupomHandler)
+	http.HandleFunc("/usar_pontos", usarPontosHandler)
+	http.HandleFunc("/aplicar_vale", aplicarValeHandler)
+	http.HandleFunc("/definir_entrega", definirEntregaHandler)
+	http.HandleFunc("/vale_presente", valePresenteHandler)
 	http.HandleFunc("/zerar_carrinho", zerarCarrinhoHandler)
 	http.HandleFunc("/finalizar_compra", finalizarCompraHandler)
+	http.HandleFunc("/pedido", acompanharPedidoHandler)
+	http.HandleFunc("/pedido/eventos", pedidoEventosHandler)
+	http.HandleFunc("/pedido/confirmacao", confirmacaoPedidoHandler)
+	http.HandleFunc("/pedido/comprovante", comprovanteHandler)
+	http.HandleFunc("/entrar", entrarHandler)
+	http.HandleFunc("/cadastrar", cadastrarHandler)
+	http.HandleFunc("/sair", sairHandler)
+	http.HandleFunc("/esqueci_senha", esqueciSenhaHandler)
+	http.HandleFunc("/redefinir_senha", redefinirSenhaHandler)
+	http.HandleFunc("/verificar_email", verificarEmailHandler)
+	http.HandleFunc("/newsletter/inscrever", inscreverNewsletterHandler)
+	http.HandleFunc("/newsletter/confirmar", confirmarNewsletterHandler)
+	http.HandleFunc("/newsletter/cancelar", cancelarNewsletterHandler)
+	http.HandleFunc("/minha_conta", minhaContaHandler)
+	http.HandleFunc("/minha_conta/perfil", atualizarPerfilHandler)
+	http.HandleFunc("/minha_conta/reivindicar", reivindicarPedidoHandler)
+	http.HandleFunc("/minha_conta/verificar_email", reenviarVerificacaoHandler)
+	http.HandleFunc("/minha_conta/pontos", pontosHandler)
+	http.HandleFunc("/minha_conta/assinaturas", assinaturasHandler)
+	http.HandleFunc("/minha_conta/assinaturas/nova", criarAssinaturaHandler)
+	http.HandleFunc("/minha_conta/assinaturas/alterar", alterarAssinaturaHandler)
+	http.HandleFunc("/minha_conta/dados", meusDadosHandler)
+	http.HandleFunc("/minha_conta/dados/exportar", exportarMeusDadosHandler)
+	http.HandleFunc("/minha_conta/dados/excluir", excluirMeusDadosHandler)
 
 	// Definindo o endereço e porta do servidor
 	port := ":8081"
@@ -106,6 +217,30 @@ func catalogoHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
 		return
 	}
+	defer firestoreClient.Client.Close()
+
+	carrinho, err := carrinhoDaRequisicao(firestoreClient, w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch cart from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	// O QR code da mesa abre o catálogo com ?mesa=N; o pedido é servido no salão, sem entrega
+	if valor := r.URL.Query().Get("mesa"); valor != "" {
+		mesas, err := buscarConfigMesas(firestoreClient)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to fetch tables from Firestore: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		if numero, ok := mesas.mesa(valor); ok {
+			carrinho.Mesa = numero
+			carrinho.Entrega = nil
+			if err := salvarCarrinho(firestoreClient, carrinho); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to save cart in Firestore: %s", err.Error()), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
 
 	// Realiza uma busca por todos os produtos na tabela
 	var produtos []Produto
@@ -133,6 +268,7 @@ func catalogoHandler(w http.ResponseWriter, r *http.Request) {
 	data := ProdutoPageData{
 		PageTitle: "Coffee Shop - Catalogo",
 		Produtos:  produtos,
+		Mesa:      carrinho.Mesa,
 	}
 
 	if err := tmpl.Execute(w, data); err != nil {
@@ -150,14 +286,123 @@ func faleConoscoHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func carrinhoHandler(w http.ResponseWriter, r *http.Request) {
-	// Calcula o valor total do carrinho
-	valorTotalCarrinho := calcularValorTotalCarrinho()
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	carrinho, err := carrinhoDaRequisicao(firestoreClient, w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch cart from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	// Aplica as promoções automáticas e o cupom informado
+	descontos, _, err := descontosCarrinho(firestoreClient, carrinho.Itens, carrinho.Cupom, time.Now().In(fusoLoja()))
+	var invalido *CupomInvalidoError
+	if err != nil && !errors.As(err, &invalido) {
+		http.Error(w, fmt.Sprintf("Failed to fetch promotions from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	erroCupom := ""
+	if invalido != nil {
+		erroCupom = invalido.Error()
+	}
+
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch session from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	// Pontos de fidelidade, só para clientes logados
+	var regras RegrasFidelidade
+	pontosUsados, erroPontos := 0, ""
+	if cliente != nil {
+		if regras, err = buscarRegrasFidelidade(firestoreClient); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to fetch loyalty rules from Firestore: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		if pontosUsados, err = aplicarResgate(&descontos, regras, cliente.SaldoPontos, carrinho.resgateDe(cliente)); err != nil {
+			erroPontos = err.Error()
+		}
+	}
+
+	// Taxa de entrega da zona do CEP, somada depois dos descontos e dos pontos
+	regrasEntrega, err := buscarRegrasEntrega(firestoreClient)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch delivery zones from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	var zonaEntrega *ZonaEntrega
+	erroEntrega := ""
+	valorProdutos := descontos.Total
+	if carrinho.Entrega != nil {
+		zona, err := regrasEntrega.calcular(*carrinho.Entrega, valorProdutos)
+		if err != nil {
+			erroEntrega = err.Error()
+		} else {
+			zonaEntrega = &zona
+			adicionarTaxaEntrega(&descontos, zona)
+		}
+	}
+
+	// Vale-presente, abatido do total depois de todos os descontos
+	var vale *ValePresente
+	valorVale, erroVale := 0.0, ""
+	if carrinho.Vale != "" {
+		vale, err = buscarVale(firestoreClient, carrinho.Vale)
+		if err == nil {
+			valorVale, err = vale.valorUsado(descontos.Total, carrinho.ValorVale)
+		}
+		var valeErro *ValeInvalidoError
+		if errors.As(err, &valeErro) {
+			erroVale = valeErro.Error()
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to fetch gift card from Firestore: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Horários de retirada com vaga
+	regrasRetirada, err := buscarRegrasRetirada(firestoreClient)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch pickup rules from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	horarios, err := horariosDisponiveis(firestoreClient, regrasRetirada, time.Now().In(fusoLoja()))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch pickup slots from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
 
 	// Crie a estrutura de dados para enviar à página
 	data := ProdutoPageData{
 		PageTitle:          "Coffee Shop - Carrinho",
-		ValorTotalCarrinho: valorTotalCarrinho, // Define o valor total do carrinho
-		Carrinho:           carrinho,           // Passa os itens do carrinho para o template
+		ValorTotalCarrinho: descontos.Total, // Define o valor total do carrinho
+		Carrinho:           carrinho.Itens,  // Passa os itens do carrinho para o template
+		Descontos:          descontos,
+		Cupom:              carrinho.Cupom,
+		ErroCupom:          erroCupom,
+		Cliente:            cliente,
+		Fidelidade:         regras,
+		Resgate:            carrinho.resgateDe(cliente),
+		PontosUsados:       pontosUsados,
+		PontosGanhos:       regras.pontosGanhos(valorProdutos),
+		ErroPontos:         erroPontos,
+		Vale:               vale,
+		ValorVale:          valorVale,
+		RestanteAPagar:     arredondarCentavos(descontos.Total - valorVale),
+		ErroVale:           erroVale,
+		RetiradaAtiva:      regrasRetirada.Ativo,
+		HorariosRetirada:   horarios,
+		EntregaAtiva:       regrasEntrega.Ativo,
+		Entrega:            carrinho.Entrega,
+		ZonaEntrega:        zonaEntrega,
+		ErroEntrega:        erroEntrega,
+		Mesa:               carrinho.Mesa,
 	}
 
 	// Carrega os dados na página HTML
@@ -168,6 +413,33 @@ func carrinhoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Guarda o cupom digitado no carrinho; um código vazio remove o cupom
+func aplicarCupomHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	carrinho, err := carrinhoDaRequisicao(firestoreClient, w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch cart from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	carrinho.Cupom = strings.ToUpper(strings.TrimSpace(r.FormValue("cupom")))
+	if err := salvarCarrinho(firestoreClient, carrinho); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save cart in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/carrinho", http.StatusSeeOther)
+}
+
 func adicionarAoCarrinhoHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
@@ -180,6 +452,13 @@ func adicionarAoCarrinhoHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
 		return
 	}
+	defer firestoreClient.Client.Close()
+
+	carrinho, err := carrinhoDaRequisicao(firestoreClient, w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch cart from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
 
 	// Obtenção dos dados do produto e quantidade do formulário enviado pelo front-end
 	codigoProdutoStr := r.FormValue("codigoProduto")
@@ -188,144 +467,653 @@ func adicionarAoCarrinhoHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Erro na conversão do código do produto", http.StatusBadRequest)
 		return
 	}
-	nomeProduto := r.FormValue("nomeProduto")
-	valorVenda, _ := strconv.ParseFloat(r.FormValue("valorVenda"), 64)
 	quantidadeProd, _ := strconv.Atoi(r.FormValue("quantidadeProd"))
+	if quantidadeProd < 1 {
+		http.Error(w, "Quantidade inválida", http.StatusBadRequest)
+		return
+	}
 
-	// Obtém o próximo código de transação baseado no próximo ID do documento na coleção "transacoes"
-	proxCodigoTransacao, err := proximoCodigoTransacao(firestoreClient)
+	// Nome, preço e tipo vêm do catálogo: é deles que depende o valor dos vales-presente emitidos
+	produto, err := buscarProduto(firestoreClient, int(codigoProduto))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get next transaction ID: %s", err.Error()), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to fetch product from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if produto.ID == 0 {
+		http.Error(w, "Produto não encontrado", http.StatusNotFound)
 		return
 	}
 
 	// Criando um novo item do carrinho
 	itemCarrinho := CarrinhoItem{
-		CodigoTransacao: proxCodigoTransacao,
-		CodigoProduto:   int(codigoProduto),
-		NomeProduto:     nomeProduto,
-		QuantidadeProd:  int(quantidadeProd),
-		ValorVenda:      valorVenda,
-		ValorTransacao:  valorVenda * float64(quantidadeProd),
+		CodigoProduto:  produto.ID,
+		NomeProduto:    produto.NomeProduto,
+		QuantidadeProd: quantidadeProd,
+		ValorVenda:     produto.ValorVenda,
+		ValorTransacao: produto.ValorVenda * float64(quantidadeProd),
+		ValePresente:   produto.ValePresente,
 	}
 
-	// Salva o item do carrinho na coleção "carrinho" no Firestore
-	_, _, err = firestoreClient.Client.Collection("carrinho").Add(firestoreClient.Ctx, itemCarrinho)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to save item in Firestore: %s", err.Error()), http.StatusInternalServerError)
+	// Salva o item no carrinho do visitante
+	carrinho.Itens = append(carrinho.Itens, itemCarrinho)
+	if err := salvarCarrinho(firestoreClient, carrinho); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save cart in Firestore: %s", err.Error()), http.StatusInternalServerError)
 		return
 	}
 
-	// Adiciona o item ao slice carrinho local
-	carrinho = append(carrinho, itemCarrinho)
-
 	// Responde ao front-end indicando sucesso
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Produto adicionado ao carrinho com sucesso!"))
 }
 
-func proximoCodigoTransacao(firestoreClient *FirestoreClient) (int, error) {
-	// Obtém o próximo código de transação baseado no próximo ID do documento na coleção "transacoes"
-	iter := firestoreClient.Client.Collection("transacoes").Documents(firestoreClient.Ctx)
-	numDocs := int(0)
-	for {
-		_, err := iter.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return 0, err
-		}
-		numDocs++
+func zerarCarrinhoHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
 	}
-	return numDocs + 1, nil
-}
+	defer firestoreClient.Client.Close()
 
-func zerarCarrinhoHandler(w http.ResponseWriter, r *http.Request) {
-	carrinho = make([]CarrinhoItem, 0) // Zera o carrinho
+	carrinho, err := carrinhoDaRequisicao(firestoreClient, w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch cart from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	carrinho.limpar() // Zera o carrinho
+	if err := salvarCarrinho(firestoreClient, carrinho); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save cart in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
 	fmt.Fprintln(w, "Carrinho zerado com sucesso!")
 }
 
 func finalizarCompraHandler(w http.ResponseWriter, r *http.Request) {
+	// A compra baixa estoque, cupom, pontos e vale; um GET de link ou de robô não pode fazê-la
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	metodoPagamento := r.FormValue("payment")
+
 	// Inicializa o cliente Firestore
 	firestoreClient, err := InitializeFirestore()
 	if err != nil {
 		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
 		return
 	}
+	defer firestoreClient.Client.Close()
 
-	// Salva os itens do carrinho na coleção "carrinho" no Firestore
-	for _, item := range carrinho {
-		itemData := map[string]interface{}{
-			"codigo_transacao": item.CodigoTransacao,
-			"codigo_produto":   item.CodigoProduto,
-			"nome_produto":     item.NomeProduto,
-			"quantidade_prod":  item.QuantidadeProd,
-			"valor_venda":      item.ValorVenda,
-			"valor_transacao":  item.ValorTransacao,
-			"data_transacao":   time.Now(),
-		}
+	carrinho, err := carrinhoDaRequisicao(firestoreClient, w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch cart from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
 
-		_, _, err := firestoreClient.Client.Collection("carrinho").Add(context.Background(), itemData)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to save item in Firestore: %s", err.Error()), http.StatusInternalServerError)
+	// Compras de clientes logados ficam na conta; convidados podem deixar o e-mail para reivindicar o pedido depois
+	cliente, err := clienteLogado(firestoreClient, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch session from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	var clienteEmail, emailContato string
+	if cliente != nil {
+		clienteEmail, emailContato = cliente.Email, cliente.Email
+	} else if email := r.FormValue("email"); email != "" {
+		if emailContato, err = normalizarEmail(email); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 	}
 
-	// Salva os itens do carrinho na coleção "transacoes" no Firestore
-	for _, item := range carrinho {
-		itemData := map[string]interface{}{
-			"codigo_transacao": item.CodigoTransacao,
-			"codigo_produto":   item.CodigoProduto,
-			"nome_produto":     item.NomeProduto,
-			"quantidade_prod":  item.QuantidadeProd,
-			"valor_venda":      item.ValorVenda,
-			"valor_transacao":  item.ValorTransacao,
-			"data_transacao":   time.Now(),
+	// Recalcula os descontos: o cupom pode ter expirado ou esgotado desde que foi aplicado
+	descontos, cupom, err := descontosCarrinho(firestoreClient, carrinho.Itens, carrinho.Cupom, time.Now().In(fusoLoja()))
+	var invalido *CupomInvalidoError
+	if errors.As(err, &invalido) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch promotions from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	// Os pontos são resgatados por último, sobre o valor que restou após promoções e cupom
+	var regras RegrasFidelidade
+	pontosUsados := 0
+	if cliente != nil {
+		if regras, err = buscarRegrasFidelidade(firestoreClient); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to fetch loyalty rules from Firestore: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		if pontosUsados, err = aplicarResgate(&descontos, regras, cliente.SaldoPontos, carrinho.resgateDe(cliente)); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
 		}
+	}
+	if len(descontos.Itens) == 0 {
+		http.Error(w, "O carrinho está vazio", http.StatusBadRequest)
+		return
+	}
 
-		_, _, err := firestoreClient.Client.Collection("transacoes").Add(context.Background(), itemData)
+	// Na entrega, a taxa da zona entra como uma linha do pedido; os pontos ganhos ficam só sobre os produtos
+	valorProdutos := descontos.Total
+	var entrega *Entrega
+	if carrinho.Entrega != nil {
+		regrasEntrega, err := buscarRegrasEntrega(firestoreClient)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to fetch delivery zones from Firestore: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		zona, err := regrasEntrega.calcular(*carrinho.Entrega, valorProdutos)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to save transaction in Firestore: %s", err.Error()), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusConflict)
 			return
 		}
+		adicionarTaxaEntrega(&descontos, zona)
+		entrega = &Entrega{
+			ClienteEmail: emailContato,
+			Endereco:     *carrinho.Entrega,
+			Zona:         zona.Nome,
+			Taxa:         zona.Taxa,
+			Status:       EntregaPendente,
+			CriadaEm:     time.Now(),
+		}
 	}
 
-	// Exclui todos os documentos da coleção "carrinho" no Firestore, exceto o documento com ID "1"
-	iter := firestoreClient.Client.Collection("carrinho").Documents(firestoreClient.Ctx)
-	for {
-		doc, err := iter.Next()
-		if err == iterator.Done {
-			break
+	// O vale-presente paga o que puder; o restante vai para o método escolhido
+	valorVale := 0.0
+	if carrinho.Vale != "" {
+		vale, err := buscarVale(firestoreClient, carrinho.Vale)
+		if err == nil {
+			valorVale, err = vale.valorUsado(descontos.Total, carrinho.ValorVale)
+		}
+		var valeErro *ValeInvalidoError
+		if errors.As(err, &valeErro) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
 		}
 		if err != nil {
-			http.Error(w, "Failed to fetch documents from Firestore", http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to fetch gift card from Firestore: %s", err.Error()), http.StatusInternalServerError)
 			return
 		}
+	}
+	if valorVale > 0 && arredondarCentavos(descontos.Total-valorVale) == 0 {
+		metodoPagamento = "vale"
+	} else if !metodosPagamento[metodoPagamento] {
+		http.Error(w, "Método de pagamento inválido", http.StatusBadRequest)
+		return
+	}
+	pagamentos := ratearPagamentos(descontos, valorVale, carrinho.Vale, metodoPagamento)
+
+	// A venda é ligada ao turno de caixa aberto; sem turno não há onde receber dinheiro
+	turnoID, err := buscarTurnoAberto(firestoreClient)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch open shift from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if turnoID == "" && metodoPagamento == "cash" {
+		http.Error(w, "Pagamento em dinheiro indisponível: o caixa está fechado", http.StatusConflict)
+		return
+	}
+
+	// Com a retirada agendada ligada, o pedido precisa de um horário válido, a não ser que vá por entrega
+	// ou seja servido numa mesa
+	regrasRetirada, err := buscarRegrasRetirada(firestoreClient)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch pickup rules from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	var retiradaEm time.Time
+	if regrasRetirada.Ativo && entrega == nil && carrinho.Mesa == 0 {
+		if retiradaEm, err = regrasRetirada.validarHorario(r.FormValue("retirada"), time.Now().In(fusoLoja())); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
 
-		docID := doc.Ref.ID
-		if docID != "1" {
-			_, err := firestoreClient.Client.Collection("carrinho").Doc(docID).Delete(firestoreClient.Ctx)
+	// Custo, dados fiscais e tipo de cada produto no momento da venda
+	produtos := make(map[int]Produto)
+	quantidades := make(map[int]int)
+	for _, item := range carrinho.Itens {
+		if _, ok := produtos[item.CodigoProduto]; !ok {
+			produto, err := buscarProduto(firestoreClient, item.CodigoProduto)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Failed to delete document in Firestore: %s", err.Error()), http.StatusInternalServerError)
+				http.Error(w, fmt.Sprintf("Failed to fetch product from Firestore: %s", err.Error()), http.StatusInternalServerError)
 				return
 			}
+			produtos[item.CodigoProduto] = produto
+		}
+		quantidades[item.CodigoProduto] += item.QuantidadeProd
+	}
+
+	venda := Venda{
+		Produtos:    produtos,
+		Quantidades: quantidades,
+		Vale:        carrinho.Vale,
+		ValorVale:   valorVale,
+		Retirada:    regrasRetirada,
+		RetiradaEm:  retiradaEm,
+		Entrega:     entrega,
+		Mesa:        carrinho.Mesa,
+	}
+	if cupom != nil {
+		venda.Cupom = cupom.Codigo
+	}
+	if cliente != nil {
+		venda.ClienteEmail = cliente.Email
+		venda.PontosUsados = pontosUsados
+		venda.PontosGanhos = regras.pontosGanhos(valorProdutos) // Pontos ganhos sobre o valor efetivamente pago
+	}
+
+	// O token vai apenas no link da confirmação; no pedido fica só o hash
+	tokenAcesso, err := gerarToken()
+	if err != nil {
+		http.Error(w, "Failed to generate order token", http.StatusInternalServerError)
+		return
+	}
+
+	dataTransacao := time.Now()
+	for i, item := range descontos.Itens {
+		fiscais := produtos[item.CodigoProduto].dadosFiscais()
+		venda.Transacoes = append(venda.Transacoes, Transacao{
+			CodigoProd:      item.CodigoProduto,
+			NomeProd:        item.NomeProduto,
+			QuantidadeProd:  item.QuantidadeProd,
+			ValorUnitario:   item.ValorVenda,
+			CustoUnitario:   produtos[item.CodigoProduto].ValorCompra,
+			ValorTransacao:  item.ValorLiquido(),
+			MetodoPagamento: metodoPagamento,
+			DataTransacao:   dataTransacao,
+			TurnoID:         turnoID,
+			Tipo:            "venda",
+			Desconto:        item.Desconto,
+			Descontos:       item.Descontos,
+			ClienteEmail:    clienteEmail,
+			EmailContato:    emailContato,
+			Pagamentos:      pagamentos[i],
+			RetiradaEm:      retiradaEm,
+			Mesa:            carrinho.Mesa,
+			DadosFiscais:    &fiscais,
+			HashAcesso:      hashToken(tokenAcesso),
+		})
+	}
+
+	// Cada unidade de um produto vale-presente emite um vale com o valor de venda do catálogo;
+	// o balcão prepara todo o resto
+	var itensPreparo []ItemPreparo
+	for _, item := range carrinho.Itens {
+		produto := produtos[item.CodigoProduto]
+		if !produto.ValePresente {
+			itensPreparo = append(itensPreparo, ItemPreparo{NomeProd: item.NomeProduto, Quantidade: item.QuantidadeProd})
+			continue
+		}
+		for i := 0; i < item.QuantidadeProd; i++ {
+			venda.ValesVendidos = append(venda.ValesVendidos, produto.ValorVenda)
+		}
+	}
+	venda.Preparo = itensPreparo
+
+	// Cupom, pontos, vale, estoque, horário e as linhas do pedido são gravados juntos, ou nada é
+	estoqueAnterior, err := registrarVenda(firestoreClient, &venda)
+	var (
+		cupomErro    *CupomInvalidoError
+		resgateErro  *ResgateInvalidoError
+		valeErro     *ValeInvalidoError
+		semEstoque   *EstoqueInsuficienteError
+		indisponivel *HorarioIndisponivelError
+	)
+	if errors.As(err, &cupomErro) || errors.As(err, &resgateErro) || errors.As(err, &valeErro) ||
+		errors.As(err, &semEstoque) || errors.As(err, &indisponivel) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save order in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	codigoPedido := venda.Codigo
+
+	// O aviso de estoque baixo não impede a venda, que já foi gravada
+	for codigo, produto := range estoqueAnterior {
+		if quantidade := quantidades[codigo]; produto.atingeEstoqueMinimo(quantidade) {
+			if err := enfileirarEmail(firestoreClient, ModeloEstoqueBaixo, nil, emailEstoqueBaixo(produto, produto.Estoque-quantidade)); err != nil {
+				log.Printf("Failed to queue low stock email for product %d: %v", codigo, err)
+			}
+		}
+	}
+
+	// Confirmação por email para o cliente logado ou o convidado que informou o e-mail
+	if emailContato != "" {
+		dados := emailPedidoConfirmado(codigoPedido, tokenAcesso, descontos.Itens, urlLoja())
+		if err := enfileirarEmail(firestoreClient, ModeloPedidoConfirmado, []string{emailContato}, dados); err != nil {
+			log.Printf("Failed to queue confirmation email for order %d: %v", codigoPedido, err)
 		}
 	}
 
-	// Limpa o carrinho após salvar os itens no Firestore e excluir os itens do carrinho
-	carrinho = make([]CarrinhoItem, 0)
+	// Esvazia o carrinho do visitante; o pedido já está gravado, então uma falha aqui só é registrada
+	carrinho.limpar()
+	if err := salvarCarrinho(firestoreClient, carrinho); err != nil {
+		log.Printf("Failed to clear cart after order %d: %v", codigoPedido, err)
+	}
+
+	// Redireciona o usuário para a confirmação do pedido, com o token de acesso, o endereço de entrega
+	// e se há preparo a acompanhar; os vales comprados são buscados pela própria confirmação
+	destino := fmt.Sprintf("/pedido/confirmacao?codigo=%d&token=%s", codigoPedido, tokenAcesso)
+	if entrega != nil {
+		destino += "&entrega=" + url.QueryEscape(entrega.Endereco.Logradouro+", "+entrega.Endereco.Numero)
+	}
+	if len(itensPreparo) > 0 {
+		destino += "&acompanhar=1"
+	}
+	http.Redirect(w, r, destino, http.StatusSeeOther)
+}
+
+// ID do turno de caixa aberto no Server_Mantenedor, ou vazio se o caixa estiver fechado
+func buscarTurnoAberto(firestoreClient *FirestoreClient) (string, error) {
+	docs, err := firestoreClient.Client.Collection("turnos").Where("Status", "==", "aberto").Limit(1).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil || len(docs) == 0 {
+		return "", err
+	}
+	return docs[0].Ref.ID, nil
+}
+
+type EstoqueInsuficienteError struct {
+	Mensagem string
+}
+
+func (e *EstoqueInsuficienteError) Error() string {
+	return e.Mensagem
+}
+
+// Pedido fechado no carrinho, com tudo o que registrarVenda grava
+type Venda struct {
+	// Código do pedido, reservado por registrarVenda
+	Codigo      int
+	Transacoes  []Transacao
+	Produtos    map[int]Produto
+	Quantidades map[int]int
+	Cupom       string
+	// Cliente logado, os pontos resgatados no pedido e os que ele rende
+	ClienteEmail string
+	PontosUsados int
+	PontosGanhos int
+	Vale         string
+	ValorVale    float64
+	Retirada     RegrasRetirada
+	RetiradaEm   time.Time
+	Entrega      *Entrega
+	Mesa         int
+	Preparo      []ItemPreparo
+	// Valor de cada vale-presente vendido no pedido
+	ValesVendidos []float64
+}
+
+// Grava a venda numa única transação: código do pedido, uso do cupom, pontos, débito do vale, baixa de estoque,
+// vaga do horário de retirada, linhas do pedido, entrega, preparo, NFC-e e vales emitidos.
+// Limite do cupom, saldos e estoque são relidos e conferidos na transação, para que dois pedidos
+// simultâneos não gastem o mesmo recurso, e uma falha no meio não deixa o pedido pela metade.
+// Devolve os produtos controlados como estavam antes da baixa, usados no aviso de estoque baixo.
+func registrarVenda(firestoreClient *FirestoreClient, venda *Venda) (map[int]Produto, error) {
+	client := firestoreClient.Client
+	cupomRef := client.Collection("cupons").Doc(venda.Cupom)
+	clienteRef := client.Collection("clientes").Doc(venda.ClienteEmail)
+	valeRef := client.Collection("vales_presente").Doc(venda.Vale)
+	horarioRef := client.Collection("horarios_retirada").Doc(venda.RetiradaEm.Format(formatoHorarioRetirada))
+
+	var anteriores map[int]Produto
+	var valesEmitidos []string
+	err := client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// Todas as leituras precisam acontecer antes das escritas
+		codigo, err := proximoCodigoPedido(tx, client)
+		if err != nil {
+			return err
+		}
+		venda.Codigo = codigo
+		for i := range venda.Transacoes {
+			venda.Transacoes[i].CodigoTransacao = codigo
+		}
+		if venda.Entrega != nil {
+			venda.Entrega.Codigo = codigo
+		}
+		codigoPedido := strconv.Itoa(codigo)
+
+		if venda.Cupom != "" {
+			snapshot, err := tx.Get(cupomRef)
+			if err != nil {
+				return err
+			}
+			var cupom Cupom
+			if err := snapshot.DataTo(&cupom); err != nil {
+				return err
+			}
+			if cupom.LimiteUsos > 0 && cupom.Usos >= cupom.LimiteUsos {
+				return cupomInvalido("O cupom %s atingiu o limite de usos", venda.Cupom)
+			}
+		}
+
+		if venda.PontosUsados > 0 {
+			snapshot, err := tx.Get(clienteRef)
+			if err != nil {
+				return err
+			}
+			var cliente Cliente
+			if err := snapshot.DataTo(&cliente); err != nil {
+				return err
+			}
+			if cliente.SaldoPontos < venda.PontosUsados {
+				return resgateInvalido("Saldo insuficiente: você tem %d pontos", cliente.SaldoPontos)
+			}
+		}
+
+		var saldoVale float64
+		if venda.ValorVale > 0 {
+			snapshot, err := tx.Get(valeRef)
+			if status.Code(err) == codes.NotFound {
+				return valeInvalido("Vale-presente %s não encontrado", venda.Vale)
+			}
+			if err != nil {
+				return err
+			}
+			var vale ValePresente
+			if err := snapshot.DataTo(&vale); err != nil {
+				return err
+			}
+			if !vale.Ativo {
+				return valeInvalido("O vale-presente %s está bloqueado", venda.Vale)
+			}
+			if vale.Saldo < venda.ValorVale-0.005 {
+				return valeInvalido("Saldo insuficiente no vale-presente %s: R$ %.2f", venda.Vale, vale.Saldo)
+			}
+			saldoVale = arredondarCentavos(vale.Saldo - venda.ValorVale)
+		}
+
+		anteriores = make(map[int]Produto)
+		for codigo, quantidade := range venda.Quantidades {
+			if !venda.Produtos[codigo].ControlaEstoque {
+				continue
+			}
+			snapshot, err := tx.Get(client.Collection("produtos").Doc(strconv.Itoa(codigo)))
+			if err != nil {
+				return err
+			}
+			var produto Produto
+			if err := snapshot.DataTo(&produto); err != nil {
+				return err
+			}
+			if produto.ControlaEstoque && produto.Estoque < quantidade {
+				return &EstoqueInsuficienteError{Mensagem: fmt.Sprintf("Estoque insuficiente de %s: restam %d", produto.NomeProduto, produto.Estoque)}
+			}
+			anteriores[codigo] = produto
+		}
+
+		reserva := ReservaHorario{Inicio: venda.RetiradaEm}
+		if !venda.RetiradaEm.IsZero() {
+			snapshot, err := tx.Get(horarioRef)
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+			if err == nil {
+				if err := snapshot.DataTo(&reserva); err != nil {
+					return err
+				}
+			}
+			if reserva.Pedidos >= venda.Retirada.Capacidade {
+				return horarioIndisponivel("O horário das %s lotou; escolha outro", venda.RetiradaEm.Format("15:04"))
+			}
+		}
+
+		// Códigos inéditos para os vales vendidos
+		valesEmitidos = nil
+		for range venda.ValesVendidos {
+			codigo, err := codigoValeLivre(tx, client.Collection("vales_presente"))
+			if err != nil {
+				return err
+			}
+			valesEmitidos = append(valesEmitidos, codigo)
+		}
+
+		agora := time.Now()
+		if err := tx.Set(client.Collection("contadores").Doc("pedidos"), ContadorPedidos{Ultimo: codigo}); err != nil {
+			return err
+		}
+		if venda.Cupom != "" {
+			if err := tx.Update(cupomRef, []firestore.Update{{Path: "Usos", Value: firestore.Increment(1)}}); err != nil {
+				return err
+			}
+		}
+
+		if venda.ClienteEmail != "" && (venda.PontosUsados > 0 || venda.PontosGanhos > 0) {
+			lancamentos := []LancamentoPontos{
+				{Tipo: PontosResgate, Pontos: -venda.PontosUsados, Descricao: fmt.Sprintf("Resgate no pedido %d", venda.Codigo)},
+				{Tipo: PontosGanho, Pontos: venda.PontosGanhos, Descricao: fmt.Sprintf("Pedido %d", venda.Codigo)},
+			}
+			for _, lancamento := range lancamentos {
+				if lancamento.Pontos == 0 {
+					continue
+				}
+				lancamento.ClienteEmail, lancamento.CodigoTransacao, lancamento.Data = venda.ClienteEmail, venda.Codigo, agora
+				if err := tx.Create(client.Collection("pontos").NewDoc(), lancamento); err != nil {
+					return err
+				}
+			}
+			saldo := firestore.Increment(venda.PontosGanhos - venda.PontosUsados)
+			if err := tx.Update(clienteRef, []firestore.Update{{Path: "SaldoPontos", Value: saldo}}); err != nil {
+				return err
+			}
+		}
+
+		if venda.ValorVale > 0 {
+			if err := tx.Update(valeRef, []firestore.Update{{Path: "Saldo", Value: saldoVale}}); err != nil {
+				return err
+			}
+			if err := tx.Create(client.Collection("movimentos_vale").NewDoc(), MovimentoVale{
+				Codigo: venda.Vale, Tipo: ValeResgate, Valor: -venda.ValorVale, SaldoApos: saldoVale,
+				CodigoTransacao: venda.Codigo, Usuario: "loja", Data: agora,
+			}); err != nil {
+				return err
+			}
+		}
+
+		for codigo, produto := range anteriores {
+			ref := client.Collection("produtos").Doc(strconv.Itoa(codigo))
+			if err := tx.Update(ref, []firestore.Update{{Path: "Estoque", Value: produto.Estoque - venda.Quantidades[codigo]}}); err != nil {
+				return err
+			}
+		}
+
+		if !venda.RetiradaEm.IsZero() {
+			reserva.Pedidos++
+			reserva.Codigos = append(reserva.Codigos, venda.Codigo)
+			if err := tx.Set(horarioRef, reserva); err != nil {
+				return err
+			}
+		}
+
+		for _, transacao := range venda.Transacoes {
+			if err := tx.Create(client.Collection("transacoes").NewDoc(), transacao); err != nil {
+				return err
+			}
+		}
+
+		if venda.Entrega != nil {
+			if err := tx.Set(client.Collection("entregas").Doc(codigoPedido), *venda.Entrega); err != nil {
+				return err
+			}
+		}
+
+		if len(venda.Preparo) > 0 {
+			preparo := novoPreparo(venda.Codigo, venda.Preparo, venda.RetiradaEm, venda.Entrega != nil, venda.Mesa, agora)
+			if err := tx.Set(client.Collection("preparos").Doc(codigoPedido), preparo); err != nil {
+				return err
+			}
+		}
+
+		nota := DocumentoFiscal{Codigo: venda.Codigo, Status: NFCePendente, SolicitadaEm: agora}
+		if err := tx.Set(client.Collection("nfce").Doc(codigoPedido), nota); err != nil {
+			return err
+		}
 
-	// Redireciona o usuário para a página desejada após a compra
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+		for i, valor := range venda.ValesVendidos {
+			vale := ValePresente{ValorInicial: valor, Saldo: valor, Ativo: true, CriadoEm: agora, CriadoPor: "loja", CodigoTransacao: venda.Codigo}
+			if err := tx.Create(client.Collection("vales_presente").Doc(valesEmitidos[i]), vale); err != nil {
+				return err
+			}
+			if err := tx.Create(client.Collection("movimentos_vale").NewDoc(), MovimentoVale{
+				Codigo: valesEmitidos[i], Tipo: ValeEmissao, Valor: valor, SaldoApos: valor,
+				CodigoTransacao: venda.Codigo, Usuario: "loja", Data: agora,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return anteriores, err
+}
+
+// Último código de pedido usado, no documento "contadores/pedidos". O Server_Mantenedor usa o mesmo
+// contador nos pedidos das assinaturas, então os dois servidores nunca repetem um código.
+type ContadorPedidos struct {
+	Ultimo int
+}
+
+// Lê o contador na transação que grava o pedido e devolve o próximo código; a transação grava o
+// contador de volta com ele. Sem contador, a numeração continua depois do maior código já gravado.
+func proximoCodigoPedido(tx *firestore.Transaction, client *firestore.Client) (int, error) {
+	snapshot, err := tx.Get(client.Collection("contadores").Doc("pedidos"))
+	if err == nil {
+		var contador ContadorPedidos
+		if err := snapshot.DataTo(&contador); err != nil {
+			return 0, err
+		}
+		return contador.Ultimo + 1, nil
+	}
+	if status.Code(err) != codes.NotFound {
+		return 0, err
+	}
+	docs, err := tx.Documents(client.Collection("transacoes").OrderBy("CodigoTransacao", firestore.Desc).Limit(1)).GetAll()
+	if err != nil || len(docs) == 0 {
+		return 1, err
+	}
+	var ultima Transacao
+	if err := docs[0].DataTo(&ultima); err != nil {
+		return 0, err
+	}
+	return ultima.CodigoTransacao + 1, nil
 }
 
-// Função para calcular o valor total do carrinho considerando a quantidade de cada item
-func calcularValorTotalCarrinho() float64 {
-	var valorTotal float64
-	for _, item := range carrinho {
-		valorTotal += float64(item.QuantidadeProd) * item.ValorVenda
+// Busca o produto atual no catálogo; produtos removidos voltam vazios, com custo zero e sem controle de estoque
+func buscarProduto(firestoreClient *FirestoreClient, codigoProduto int) (Produto, error) {
+	var produto Produto
+	snapshot, err := firestoreClient.Client.Collection("produtos").Doc(strconv.Itoa(codigoProduto)).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return produto, nil
+	}
+	if err != nil {
+		return produto, err
+	}
+
+	if err := snapshot.DataTo(&produto); err != nil {
+		return produto, err
 	}
-	return valorTotal
+	return produto, nil
 }
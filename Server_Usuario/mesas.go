@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Documento em "configuracoes" com as mesas do salão, cadastradas no Server_Mantenedor
+const documentoMesas = "mesas"
+
+// Mesas numeradas de 1 até a quantidade
+type ConfigMesas struct {
+	Quantidade int
+}
+
+func buscarConfigMesas(firestoreClient *FirestoreClient) (ConfigMesas, error) {
+	var mesas ConfigMesas
+	snapshot, err := firestoreClient.Client.Collection("configuracoes").Doc(documentoMesas).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return mesas, nil
+	}
+	if err != nil {
+		return mesas, err
+	}
+	err = snapshot.DataTo(&mesas)
+	return mesas, err
+}
+
+// Número da mesa do QR code, se ela estiver cadastrada
+func (c ConfigMesas) mesa(valor string) (int, bool) {
+	numero, err := strconv.Atoi(valor)
+	if err != nil || numero < 1 || numero > c.Quantidade {
+		return 0, false
+	}
+	return numero, true
+}
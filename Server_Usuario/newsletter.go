@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Situações de uma inscrição na newsletter
+const (
+	InscricaoPendente   = "pendente"
+	InscricaoConfirmada = "confirmada"
+	InscricaoCancelada  = "cancelada"
+)
+
+const ModeloNewsletterConfirmacao = "newsletter_confirmacao"
+
+// Finalidade e texto do consentimento da newsletter, iguais ao da caixa marcada no rodapé das páginas.
+// Ao mudar o texto, mude também a versão, para os registros antigos continuarem identificáveis.
+const (
+	FinalidadeNewsletter          = "newsletter"
+	TextoConsentimentoNewsletter  = "Aceito receber novidades e promoções da Coffee Shop por e-mail."
+	VersaoConsentimentoNewsletter = "2026-10"
+)
+
+// Ações registradas no histórico de consentimentos
+const (
+	ConsentimentoConcedido  = "concedido"
+	ConsentimentoConfirmado = "confirmado"
+	ConsentimentoRevogado   = "revogado"
+)
+
+var ErrInscricaoNaoEncontrada = errors.New("Link inválido ou já utilizado")
+
+// Inscrição na newsletter, guardada na coleção "newsletter" com o e-mail como ID do documento.
+// O token vai nos links de confirmação e de cancelamento.
+type InscricaoNewsletter struct {
+	Email        string
+	Status       string
+	Token        string
+	CriadaEm     time.Time
+	ConfirmadaEm time.Time
+	CanceladaEm  time.Time
+}
+
+// Registro de consentimento da LGPD na coleção "consentimentos". Os registros nunca são alterados:
+// cada concessão, confirmação ou revogação é um novo documento.
+type Consentimento struct {
+	Email      string
+	Finalidade string
+	Acao       string
+	Texto      string
+	Versao     string
+	IP         string
+	UserAgent  string
+	Data       time.Time
+}
+
+type NewsletterPageData struct {
+	PageTitle string
+	Mensagem  string
+	Erro      string
+}
+
+func renderizarNewsletter(w http.ResponseWriter, data NewsletterPageData) {
+	data.PageTitle = "Coffee Shop - Newsletter"
+	tmpl := template.Must(template.ParseFiles("template/newsletter.html"))
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to execute template: %s", err.Error()), http.StatusInternalServerError)
+	}
+}
+
+func consentimentoNewsletter(r *http.Request, email, acao string) Consentimento {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return Consentimento{
+		Email:      email,
+		Finalidade: FinalidadeNewsletter,
+		Acao:       acao,
+		Texto:      TextoConsentimentoNewsletter,
+		Versao:     VersaoConsentimentoNewsletter,
+		IP:         ip,
+		UserAgent:  r.UserAgent(),
+		Data:       time.Now(),
+	}
+}
+
+// Inscreve o e-mail com a confirmação pendente e envia o link de confirmação (double opt-in).
+// Quem já está confirmado não recebe outro email.
+func inscreverNewsletterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	email, err := normalizarEmail(r.FormValue("email"))
+	if err != nil {
+		renderizarNewsletter(w, NewsletterPageData{Erro: err.Error()})
+		return
+	}
+	if r.FormValue("consentimento") == "" {
+		renderizarNewsletter(w, NewsletterPageData{Erro: "Marque a caixa de consentimento para receber a newsletter"})
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(bytes)
+
+	inscricaoRef := firestoreClient.Client.Collection("newsletter").Doc(email)
+	var enviar bool
+	err = firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		enviar = false
+		snapshot, err := tx.Get(inscricaoRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			var atual InscricaoNewsletter
+			if err := snapshot.DataTo(&atual); err != nil {
+				return err
+			}
+			if atual.Status == InscricaoConfirmada {
+				return nil
+			}
+		}
+		enviar = true
+		if err := tx.Set(inscricaoRef, InscricaoNewsletter{Email: email, Status: InscricaoPendente, Token: token, CriadaEm: time.Now()}); err != nil {
+			return err
+		}
+		return tx.Create(firestoreClient.Client.Collection("consentimentos").NewDoc(), consentimentoNewsletter(r, email, ConsentimentoConcedido))
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save subscription in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	if enviar {
+		err := enfileirarEmail(firestoreClient, ModeloNewsletterConfirmacao, []string{email}, map[string]interface{}{
+			"URLConfirmar": fmt.Sprintf("%s/newsletter/confirmar?token=%s", urlLoja(), token),
+			"URLCancelar":  fmt.Sprintf("%s/newsletter/cancelar?token=%s", urlLoja(), token),
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to queue email in Firestore: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
+	renderizarNewsletter(w, NewsletterPageData{Mensagem: "Se " + email + " ainda não estiver inscrito, enviaremos um link de confirmação. Confirme a inscrição pelo e-mail para começar a receber a newsletter."})
+}
+
+// Muda a situação da inscrição do token e registra a ação no histórico de consentimentos
+func alterarInscricao(firestoreClient *FirestoreClient, r *http.Request, token, status, acao string) error {
+	if token == "" {
+		return ErrInscricaoNaoEncontrada
+	}
+	docs, err := firestoreClient.Client.Collection("newsletter").Where("Token", "==", token).Limit(1).Documents(firestoreClient.Ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return ErrInscricaoNaoEncontrada
+	}
+
+	return firestoreClient.Client.RunTransaction(firestoreClient.Ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(docs[0].Ref)
+		if err != nil {
+			return err
+		}
+		var inscricao InscricaoNewsletter
+		if err := snapshot.DataTo(&inscricao); err != nil {
+			return err
+		}
+		// Um novo pedido de inscrição troca o token; links antigos deixam de valer
+		if inscricao.Token != token {
+			return ErrInscricaoNaoEncontrada
+		}
+		if inscricao.Status == status {
+			return nil
+		}
+		if status == InscricaoConfirmada && inscricao.Status != InscricaoPendente {
+			return ErrInscricaoNaoEncontrada
+		}
+
+		atualizacao := []firestore.Update{{Path: "Status", Value: status}}
+		if status == InscricaoConfirmada {
+			atualizacao = append(atualizacao, firestore.Update{Path: "ConfirmadaEm", Value: time.Now()})
+		} else {
+			atualizacao = append(atualizacao, firestore.Update{Path: "CanceladaEm", Value: time.Now()})
+		}
+		if err := tx.Update(docs[0].Ref, atualizacao); err != nil {
+			return err
+		}
+		return tx.Create(firestoreClient.Client.Collection("consentimentos").NewDoc(), consentimentoNewsletter(r, inscricao.Email, acao))
+	})
+}
+
+func respostaInscricao(w http.ResponseWriter, r *http.Request, status, acao, mensagem string) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	err = alterarInscricao(firestoreClient, r, r.URL.Query().Get("token"), status, acao)
+	if err == ErrInscricaoNaoEncontrada {
+		renderizarNewsletter(w, NewsletterPageData{Erro: err.Error()})
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update subscription in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	renderizarNewsletter(w, NewsletterPageData{Mensagem: mensagem})
+}
+
+// Link do email de confirmação
+func confirmarNewsletterHandler(w http.ResponseWriter, r *http.Request) {
+	respostaInscricao(w, r, InscricaoConfirmada, ConsentimentoConfirmado, "Inscrição confirmada! Você passará a receber a newsletter da Coffee Shop.")
+}
+
+// Link de cancelamento presente em todos os emails da newsletter
+func cancelarNewsletterHandler(w http.ResponseWriter, r *http.Request) {
+	respostaInscricao(w, r, InscricaoCancelada, ConsentimentoRevogado, "Inscrição cancelada. Você não receberá mais a newsletter da Coffee Shop.")
+}
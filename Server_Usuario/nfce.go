@@ -0,0 +1,32 @@
+package main
+
+import "time"
+
+// Situação inicial da nota, a mesma do Server_Mantenedor
+const NFCePendente = "pendente"
+
+// Nota fiscal do pedido na coleção "nfce", emitida pelo Server_Mantenedor
+type DocumentoFiscal struct {
+	Codigo       int
+	Status       string
+	SolicitadaEm time.Time
+}
+
+// Classificação e alíquotas do produto, copiadas para cada linha vendida. Os tributos são calculados
+// pelo Server_Mantenedor, que conhece o regime tributário da loja.
+type DadosFiscais struct {
+	NCM            string
+	CFOP           string
+	CSOSN          string
+	CST            string
+	AliquotaICMS   float64
+	AliquotaPIS    float64
+	AliquotaCOFINS float64
+}
+
+func (p Produto) dadosFiscais() DadosFiscais {
+	return DadosFiscais{
+		NCM: p.NCM, CFOP: p.CFOP, CSOSN: p.CSOSN, CST: p.CST,
+		AliquotaICMS: p.AliquotaICMS, AliquotaPIS: p.AliquotaPIS, AliquotaCOFINS: p.AliquotaCOFINS,
+	}
+}
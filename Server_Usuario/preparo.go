@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Situações de um pedido na fila de preparo, as mesmas do Server_Mantenedor
+const (
+	PreparoRecebido   = "recebido"
+	PreparoPreparando = "preparando"
+	PreparoPronto     = "pronto"
+	PreparoRetirado   = "retirado"
+	PreparoCancelado  = "cancelado"
+)
+
+// Texto mostrado ao cliente para cada situação
+var descricaoPreparo = map[string]string{
+	PreparoRecebido:   "Pedido recebido",
+	PreparoPreparando: "Em preparo",
+	PreparoPronto:     "Pronto para retirada",
+	PreparoRetirado:   "Retirado",
+	PreparoCancelado:  "Cancelado",
+}
+
+// Pedido na fila de preparo, na coleção "preparos" com o código do pedido como ID do documento.
+// O balcão do Server_Mantenedor avança a situação; a página do pedido acompanha em tempo real.
+type Preparo struct {
+	Codigo     int
+	Status     string
+	Itens      []ItemPreparo
+	RetiradaEm time.Time
+	// Pedido que sai para entrega em vez de ser retirado no balcão
+	Entrega bool
+	// Mesa do salão para onde o pedido é levado
+	Mesa         int
+	CriadoEm     time.Time
+	AtualizadoEm time.Time
+	Historico    []MudancaPreparo
+}
+
+type ItemPreparo struct {
+	NomeProd   string
+	Quantidade int
+}
+
+type MudancaPreparo struct {
+	Status  string
+	Data    time.Time
+	Usuario string
+}
+
+type AcompanharPedidoPageData struct {
+	PageTitle string
+	Preparo   Preparo
+	Descricao string
+	// Token de acesso do pedido, repassado ao fluxo de eventos
+	Token string
+}
+
+// Texto da situação, lembrando que o pedido pronto de uma entrega espera o entregador
+func (p Preparo) descricao() string {
+	if p.Entrega && p.Status == PreparoPronto {
+		return "Pronto, aguardando o entregador"
+	}
+	if p.Entrega && p.Status == PreparoRetirado {
+		return "Saiu para entrega"
+	}
+	if p.Mesa != 0 && p.Status == PreparoPronto {
+		return fmt.Sprintf("Pronto, a caminho da mesa %d", p.Mesa)
+	}
+	if p.Mesa != 0 && p.Status == PreparoRetirado {
+		return "Servido"
+	}
+	return descricaoPreparo[p.Status]
+}
+
+// Situação enviada à página do pedido
+type EventoPreparo struct {
+	Status    string
+	Descricao string
+}
+
+// Pedido recém-chegado à fila do balcão
+func novoPreparo(codigoPedido int, itens []ItemPreparo, retiradaEm time.Time, entrega bool, mesa int, agora time.Time) Preparo {
+	return Preparo{
+		Codigo:       codigoPedido,
+		Status:       PreparoRecebido,
+		Itens:        itens,
+		RetiradaEm:   retiradaEm,
+		Entrega:      entrega,
+		Mesa:         mesa,
+		CriadoEm:     agora,
+		AtualizadoEm: agora,
+		Historico:    []MudancaPreparo{{Status: PreparoRecebido, Data: agora, Usuario: "loja"}},
+	}
+}
+
+// Página do pedido com a situação atual, atualizada por /pedido/eventos
+func acompanharPedidoHandler(w http.ResponseWriter, r *http.Request) {
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	// Como no comprovante, só o token do pedido ou a sessão de quem comprou mostram a situação
+	comprovante, ok := comprovanteRequisicao(firestoreClient, w, r)
+	if !ok {
+		return
+	}
+	codigo := comprovante.Codigo
+
+	snapshot, err := firestoreClient.Client.Collection("preparos").Doc(strconv.Itoa(codigo)).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		http.Error(w, "Pedido não encontrado", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch order from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	var preparo Preparo
+	if err := snapshot.DataTo(&preparo); err != nil {
+		http.Error(w, "Failed to parse order data", http.StatusInternalServerError)
+		return
+	}
+	preparo.RetiradaEm = preparo.RetiradaEm.In(fusoLoja())
+
+	tmpl := template.Must(template.ParseFiles("template/acompanhar_pedido.html"))
+	data := AcompanharPedidoPageData{
+		PageTitle: fmt.Sprintf("Coffee Shop - Pedido %d", codigo),
+		Preparo:   preparo,
+		Descricao: preparo.descricao(),
+		Token:     r.URL.Query().Get("token"),
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to execute template: %s", err.Error()), http.StatusInternalServerError)
+	}
+}
+
+// Envia a situação do pedido por Server-Sent Events a cada mudança no Firestore, até o pedido
+// sair do balcão ou o navegador desconectar
+func pedidoEventosHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	comprovante, ok := comprovanteRequisicao(firestoreClient, w, r)
+	if !ok {
+		return
+	}
+	codigo := comprovante.Codigo
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	snapshots := firestoreClient.Client.Collection("preparos").Doc(strconv.Itoa(codigo)).Snapshots(r.Context())
+	defer snapshots.Stop()
+	for {
+		snapshot, err := snapshots.Next()
+		if err != nil {
+			if r.Context().Err() == nil {
+				log.Printf("Failed to watch order %d: %v", codigo, err)
+			}
+			return
+		}
+		if !snapshot.Exists() {
+			continue
+		}
+		var preparo Preparo
+		if err := snapshot.DataTo(&preparo); err != nil {
+			log.Printf("Failed to parse order %d: %v", codigo, err)
+			return
+		}
+		conteudo, err := json.Marshal(EventoPreparo{Status: preparo.Status, Descricao: preparo.descricao()})
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: status\ndata: %s\n\n", conteudo); err != nil {
+			return
+		}
+		flusher.Flush()
+		if preparo.Status == PreparoRetirado || preparo.Status == PreparoCancelado {
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Documento em "configuracoes" com as regras de retirada, editadas no Server_Mantenedor
+const documentoRegrasRetirada = "retirada"
+
+// Formato do ID dos documentos de "horarios_retirada" e do valor escolhido no carrinho
+const formatoHorarioRetirada = "2006-01-02T15:04"
+
+type HorarioFuncionamento struct {
+	Abre  string
+	Fecha string
+}
+
+type RegrasRetirada struct {
+	Ativo           bool
+	DuracaoMin      int
+	Capacidade      int
+	AntecedenciaMin int
+	DiasAgendamento int
+	Horarios        []HorarioFuncionamento
+}
+
+// Ocupação de um horário de retirada, na coleção "horarios_retirada"
+type ReservaHorario struct {
+	Inicio  time.Time
+	Pedidos int
+	Codigos []int
+}
+
+// Horário oferecido no carrinho e quantos pedidos ele ainda aceita
+type HorarioRetirada struct {
+	Inicio time.Time
+	Vagas  int
+}
+
+// Erro de horário mostrado ao cliente, como um horário que lotou enquanto ele comprava
+type HorarioIndisponivelError struct {
+	Mensagem string
+}
+
+func (e *HorarioIndisponivelError) Error() string {
+	return e.Mensagem
+}
+
+func horarioIndisponivel(formato string, args ...interface{}) error {
+	return &HorarioIndisponivelError{Mensagem: fmt.Sprintf(formato, args...)}
+}
+
+func (h HorarioRetirada) ID() string {
+	return h.Inicio.Format(formatoHorarioRetirada)
+}
+
+// Sem documento a retirada fica desligada e os pedidos seguem sem horário
+func buscarRegrasRetirada(firestoreClient *FirestoreClient) (RegrasRetirada, error) {
+	var regras RegrasRetirada
+	snapshot, err := firestoreClient.Client.Collection("configuracoes").Doc(documentoRegrasRetirada).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return regras, nil
+	}
+	if err != nil {
+		return regras, err
+	}
+	err = snapshot.DataTo(&regras)
+	return regras, err
+}
+
+// Inícios dos horários de retirada dos próximos dias, a partir da antecedência mínima
+func (r RegrasRetirada) horarios(agora time.Time) []time.Time {
+	if !r.Ativo || r.DuracaoMin <= 0 {
+		return nil
+	}
+	duracao := time.Duration(r.DuracaoMin) * time.Minute
+	primeiro := agora.Add(time.Duration(r.AntecedenciaMin) * time.Minute)
+
+	var inicios []time.Time
+	for d := 0; d < r.DiasAgendamento; d++ {
+		dia := time.Date(agora.Year(), agora.Month(), agora.Day()+d, 0, 0, 0, 0, agora.Location())
+		if int(dia.Weekday()) >= len(r.Horarios) {
+			continue
+		}
+		funcionamento := r.Horarios[dia.Weekday()]
+		abre, err := time.Parse("15:04", funcionamento.Abre)
+		if err != nil {
+			continue
+		}
+		fecha, err := time.Parse("15:04", funcionamento.Fecha)
+		if err != nil {
+			continue
+		}
+		fim := time.Date(dia.Year(), dia.Month(), dia.Day(), fecha.Hour(), fecha.Minute(), 0, 0, dia.Location())
+		for inicio := time.Date(dia.Year(), dia.Month(), dia.Day(), abre.Hour(), abre.Minute(), 0, 0, dia.Location()); !inicio.Add(duracao).After(fim); inicio = inicio.Add(duracao) {
+			if !inicio.Before(primeiro) {
+				inicios = append(inicios, inicio)
+			}
+		}
+	}
+	return inicios
+}
+
+// Horários com vaga; os que lotaram deixam de ser oferecidos
+func horariosDisponiveis(firestoreClient *FirestoreClient, regras RegrasRetirada, agora time.Time) ([]HorarioRetirada, error) {
+	inicios := regras.horarios(agora)
+	if len(inicios) == 0 {
+		return nil, nil
+	}
+	colecao := firestoreClient.Client.Collection("horarios_retirada")
+	refs := make([]*firestore.DocumentRef, len(inicios))
+	for i, inicio := range inicios {
+		refs[i] = colecao.Doc(inicio.Format(formatoHorarioRetirada))
+	}
+	snapshots, err := firestoreClient.Client.GetAll(firestoreClient.Ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	var disponiveis []HorarioRetirada
+	for i, snapshot := range snapshots {
+		var reserva ReservaHorario
+		if snapshot.Exists() {
+			if err := snapshot.DataTo(&reserva); err != nil {
+				return nil, err
+			}
+		}
+		if vagas := regras.Capacidade - reserva.Pedidos; vagas > 0 {
+			disponiveis = append(disponiveis, HorarioRetirada{Inicio: inicios[i], Vagas: vagas})
+		}
+	}
+	return disponiveis, nil
+}
+
+// Confere o horário escolhido contra as regras atuais e devolve seu início
+func (r RegrasRetirada) validarHorario(id string, agora time.Time) (time.Time, error) {
+	if id == "" {
+		return time.Time{}, horarioIndisponivel("Escolha um horário de retirada")
+	}
+	for _, inicio := range r.horarios(agora) {
+		if inicio.Format(formatoHorarioRetirada) == id {
+			return inicio, nil
+		}
+	}
+	return time.Time{}, horarioIndisponivel("O horário de retirada escolhido não está mais disponível")
+}
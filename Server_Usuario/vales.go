@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Tipos de movimento de um vale-presente, os mesmos do Server_Mantenedor
+const (
+	ValeEmissao = "emissao"
+	ValeResgate = "resgate"
+)
+
+// Letras e números sem os caracteres que se confundem na leitura (0/O, 1/I)
+const alfabetoVale = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// Vale-presente guardado na coleção "vales_presente", com o código como ID do documento
+type ValePresente struct {
+	Codigo          string `firestore:"-"`
+	ValorInicial    float64
+	Saldo           float64
+	Ativo           bool
+	CriadoEm        time.Time
+	CriadoPor       string
+	CodigoTransacao int
+}
+
+// Movimento do vale na coleção "movimentos_vale", gravado na mesma transação que altera o saldo
+type MovimentoVale struct {
+	Codigo          string
+	Tipo            string
+	Valor           float64
+	SaldoApos       float64
+	CodigoTransacao int
+	Usuario         string
+	Data            time.Time
+}
+
+// Parte do valor de uma linha paga por um método
+type PagamentoParcial struct {
+	Metodo     string
+	Valor      float64
+	Referencia string
+}
+
+// Erro de vale mostrado ao cliente; o carrinho continua valendo sem o vale
+type ValeInvalidoError struct {
+	Mensagem string
+}
+
+type ValePageData struct {
+	PageTitle string
+	Codigo    string
+	Vale      *ValePresente
+	Erro      string
+}
+
+func (e *ValeInvalidoError) Error() string {
+	return e.Mensagem
+}
+
+func valeInvalido(formato string, args ...interface{}) error {
+	return &ValeInvalidoError{Mensagem: fmt.Sprintf(formato, args...)}
+}
+
+func gerarCodigoVale() (string, error) {
+	var codigo strings.Builder
+	for i := 0; i < 16; i++ {
+		if i > 0 && i%4 == 0 {
+			codigo.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alfabetoVale))))
+		if err != nil {
+			return "", err
+		}
+		codigo.WriteByte(alfabetoVale[n.Int64()])
+	}
+	return codigo.String(), nil
+}
+
+func normalizarCodigoVale(codigo string) string {
+	return strings.ToUpper(strings.TrimSpace(codigo))
+}
+
+// Busca o vale; vales inexistentes, bloqueados ou sem saldo voltam como ValeInvalidoError
+func buscarVale(firestoreClient *FirestoreClient, codigo string) (*ValePresente, error) {
+	snapshot, err := firestoreClient.Client.Collection("vales_presente").Doc(codigo).Get(firestoreClient.Ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, valeInvalido("Vale-presente %s não encontrado", codigo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var vale ValePresente
+	if err := snapshot.DataTo(&vale); err != nil {
+		return nil, err
+	}
+	vale.Codigo = codigo
+	return &vale, nil
+}
+
+// Valor do vale usado no pedido: o pedido no valor solicitado, limitado ao saldo e ao total
+func (v ValePresente) valorUsado(total, solicitado float64) (float64, error) {
+	if !v.Ativo {
+		return 0, valeInvalido("O vale-presente %s está bloqueado", v.Codigo)
+	}
+	if v.Saldo <= 0 {
+		return 0, valeInvalido("O vale-presente %s não tem saldo", v.Codigo)
+	}
+	valor := math.Min(v.Saldo, total)
+	if solicitado > 0 {
+		valor = math.Min(valor, solicitado)
+	}
+	return arredondarCentavos(valor), nil
+}
+
+// Divide o pagamento de cada linha entre o vale e o método escolhido para o restante,
+// rateando o vale proporcionalmente ao valor líquido das linhas
+func ratearPagamentos(resultado ResultadoDescontos, valorVale float64, codigoVale, metodo string) [][]PagamentoParcial {
+	pagamentos := make([][]PagamentoParcial, len(resultado.Itens))
+	if valorVale <= 0 {
+		return pagamentos
+	}
+	liquido := resultado.liquido()
+	restante := valorVale
+	for i, item := range resultado.Itens {
+		parte := 0.0
+		if liquido > 0 {
+			parte = arredondarCentavos(valorVale * item.ValorLiquido() / liquido)
+		}
+		if i == len(resultado.Itens)-1 {
+			parte = arredondarCentavos(restante)
+		}
+		parte = math.Min(parte, item.ValorLiquido())
+		restante -= parte
+		pagamentos[i] = append(pagamentos[i], PagamentoParcial{Metodo: "vale", Valor: parte, Referencia: codigoVale})
+		if resto := arredondarCentavos(item.ValorLiquido() - parte); resto > 0 {
+			pagamentos[i] = append(pagamentos[i], PagamentoParcial{Metodo: metodo, Valor: resto})
+		}
+	}
+	return pagamentos
+}
+
+// Gera um código que ainda não existe, lido na transação da venda que vai criar o vale
+func codigoValeLivre(tx *firestore.Transaction, vales *firestore.CollectionRef) (string, error) {
+	for tentativa := 0; tentativa < 5; tentativa++ {
+		codigo, err := gerarCodigoVale()
+		if err != nil {
+			return "", err
+		}
+		_, err = tx.Get(vales.Doc(codigo))
+		if status.Code(err) == codes.NotFound {
+			return codigo, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", errors.New("failed to generate a unique gift card code")
+}
+
+// Guarda o vale digitado no carrinho; um código vazio remove o vale
+func aplicarValeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	firestoreClient, err := InitializeFirestore()
+	if err != nil {
+		http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+		return
+	}
+	defer firestoreClient.Client.Close()
+
+	carrinho, err := carrinhoDaRequisicao(firestoreClient, w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch cart from Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	carrinho.Vale = normalizarCodigoVale(r.FormValue("vale"))
+	carrinho.ValorVale, _ = strconv.ParseFloat(r.FormValue("valor"), 64)
+	if carrinho.ValorVale < 0 || math.IsNaN(carrinho.ValorVale) {
+		carrinho.ValorVale = 0
+	}
+	if err := salvarCarrinho(firestoreClient, carrinho); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save cart in Firestore: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/carrinho", http.StatusSeeOther)
+}
+
+// Consulta de saldo do vale-presente
+func valePresenteHandler(w http.ResponseWriter, r *http.Request) {
+	data := ValePageData{PageTitle: "Coffee Shop - Vale-presente", Codigo: normalizarCodigoVale(r.FormValue("codigo"))}
+
+	if data.Codigo != "" {
+		firestoreClient, err := InitializeFirestore()
+		if err != nil {
+			http.Error(w, "Failed to connect to Firestore", http.StatusInternalServerError)
+			return
+		}
+		defer firestoreClient.Client.Close()
+
+		data.Vale, err = buscarVale(firestoreClient, data.Codigo)
+		var invalido *ValeInvalidoError
+		if errors.As(err, &invalido) {
+			data.Erro = invalido.Error()
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to fetch gift card from Firestore: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/vale_presente.html"))
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to execute template: %s", err.Error()), http.StatusInternalServerError)
+	}
+}